@@ -22,29 +22,201 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "preflight" {
+		os.Exit(preflight(os.Args[2:]))
+	}
+
 	var (
-		endpoint = flag.String("endpoint", "unix:///var/lib/kubelet/plugins/"+driver.DriverName+"/csi.sock", "CSI endpoint")
-		token    = flag.String("token", "", "cloudscale.ch access token")
-		url      = flag.String("url", "https://api.cloudscale.ch/", "cloudscale.ch API URL")
-		version  = flag.Bool("version", false, "Print the version and exit.")
+		endpoint  = flag.String("endpoint", driver.DefaultEndpoint, "CSI endpoint")
+		token     = flag.String("token", "", "cloudscale.ch access token")
+		tokenFile = flag.String("cloudscale-token-file", "", "File containing the cloudscale.ch access token, which is re-read on every request; takes precedence over --token")
+		url       = flag.String("url", driver.DefaultAPIURL, "cloudscale.ch API URL")
+		proxyURL  = flag.String("proxy-url", "", "Proxy used to reach the cloudscale.ch API (defaults to $HTTPS_PROXY)")
+		caBundle  = flag.String("ca-bundle", "", "PEM file with CA certificates trusted in addition to the system roots when reaching the cloudscale.ch API")
+		version   = flag.Bool("version", false, "Print the version and exit.")
+		logFormat = flag.String("log-format", "text", "Log format, either text or json")
+		logLevel  = flag.String("log-level", "info", "Log level, e.g. debug, info or warning")
+		config    = flag.String("config", "", "YAML config file with driver options, which take precedence over the flags; reloaded on changes")
+		serverId  = flag.String("server-id", "", "UUID of the cloudscale.ch server the plugin runs on (defaults to the UUID from the metadata service)")
+		fake      = flag.Bool("fake-cloudscale", false, "Use an in-memory fake of the cloudscale.ch API for development and demos; volumes are not real")
+		zone      = flag.String("zone", "", "Zone of the volumes (defaults to the zone of the server); a controller with a zone and without a server ID runs outside of a cloudscale.ch server")
+
+		fallbackTokens     = flag.String("fallback-tokens", "", "Comma-separated cloudscale.ch access tokens used in order if the API rejects the token in use (defaults to $CLOUDSCALE_FALLBACK_ACCESS_TOKENS)")
+		fallbackTokenFiles = flag.String("fallback-token-files", "", "Comma-separated files containing cloudscale.ch access tokens used in order after --fallback-tokens")
+
+		vaultAddr      = flag.String("vault-addr", "", "Vault address used to resolve luks key references (defaults to $VAULT_ADDR)")
+		vaultTokenFile = flag.String("vault-token-file", "", "File containing the Vault token; $VAULT_TOKEN is used if not set")
+
+		fstrimInterval       = flag.Duration("fstrim-interval", 0, "Interval in which fstrim is run on all staged volumes; disabled if 0")
+		deviceWaitTimeout    = flag.Duration("device-wait-timeout", driver.DefaultDeviceWaitTimeout, "How long to wait for the device of an attached volume to appear")
+		publishMountOptions  = flag.String("publish-mount-options", "", "Comma-separated mount options applied to all published filesystem volumes (e.g. noexec,nosuid,nodev,rslave)")
+		cleanupOnStart       = flag.Bool("cleanup-on-start", true, "Tear down stale staging mounts and luks mappings of detached volumes on start")
+		debugAddr            = flag.String("debug-addr", "", "Address of the debug endpoint serving the disk info of the node (e.g. :9810); disabled if empty")
+		luksHeaderAddr       = flag.String("luks-header-addr", "", "Loopback address of the endpoint serving the backup of luks headers on /luks/header (e.g. 127.0.0.1:9811); disabled if empty")
+		healthAddr           = flag.String("health-addr", "", "Address of the /healthz and /readyz endpoints (e.g. :9808); disabled if empty")
+		mode                 = flag.String("mode", driver.ModeAll, "Whether the plugin runs as controller, node or all; selects the readiness checks")
+		apiCheckInterval     = flag.Duration("api-check-interval", driver.DefaultAPICheckInterval, "How often the controller checks the cloudscale.ch API for the readiness endpoint")
+		apiCheckThreshold    = flag.Int("api-check-failure-threshold", driver.DefaultAPICheckFailureThreshold, "Number of failed API checks in a row after which the controller is not ready")
+		metricsAddr          = flag.String("metrics-addr", "", "Address of the Prometheus metrics endpoint (e.g. :9809); disabled if empty")
+		slowThreshold        = flag.Duration("slow-operation-threshold", driver.DefaultSlowOperationThreshold, "Duration after which a CSI call is logged as slow; disabled if 0")
+		grpcMaxStreams       = flag.Uint("grpc-max-concurrent-streams", 0, "Maximum number of concurrent gRPC calls per connection; unlimited if 0")
+		grpcMaxRecvMsgSize   = flag.Int("grpc-max-recv-msg-size", 0, "Maximum size of a gRPC request in bytes (defaults to 4 MiB)")
+		grpcKeepaliveTime    = flag.Duration("grpc-keepalive-time", 0, "Idle time after which the gRPC server pings a client (defaults to 2h)")
+		grpcKeepaliveTimeout = flag.Duration("grpc-keepalive-timeout", 0, "How long the gRPC server waits for the response to a ping (defaults to 20s)")
+		grpcReflection       = flag.Bool("grpc-reflection", false, "Enable the gRPC reflection service on the CSI endpoint for debugging with grpcurl")
+		maxVolumesPerNode    = flag.Int64("max-volumes-per-node", 0, "Maximum number of volumes attached to a node by the driver (defaults to $CLOUDSCALE_MAX_CSI_VOLUMES_PER_NODE or 125)")
+		maxEphemeralSize     = flag.String("max-ephemeral-volume-size", "100Gi", "Maximum size of an ephemeral inline volume, larger ones are rejected; unlimited if 0")
+
+		orchestrator = flag.String("container-orchestrator", driver.OrchestratorKubernetes, "Container orchestrator the plugin is used with, kubernetes, nomad or swarm")
+
+		tlsAddr         = flag.String("tls-addr", "", "Address of a TCP endpoint serving the controller with mutual TLS (e.g. :9443); disabled if empty")
+		tlsCertFile     = flag.String("tls-cert-file", "", "PEM file with the server certificate of the TLS endpoint")
+		tlsKeyFile      = flag.String("tls-key-file", "", "PEM file with the server key of the TLS endpoint")
+		tlsClientCAFile = flag.String("tls-client-ca-file", "", "PEM file with the CA certificates the client certificates of the TLS endpoint are verified with")
+
+		kubeconfig = flag.String("kubeconfig", "", "Kubeconfig used to access Kubernetes outside of the cluster (defaults to $KUBECONFIG, then the service account of the pod)")
+
+		nodeFencing         = flag.Bool("node-fencing", false, "Detach the volumes from the servers of nodes tainted with "+driver.FenceTaint+" or node.kubernetes.io/out-of-service")
+		nodeFencingInterval = flag.Duration("node-fencing-interval", driver.DefaultFencingInterval, "How often the nodes are checked for the fence taints")
+		nodeLabeler         = flag.Bool("node-labeler", false, "Label the nodes with "+driver.DriverName+"/zone, topology.kubernetes.io/zone and topology.kubernetes.io/region of their servers")
+		nodeLabelerInterval = flag.Duration("node-labeler-interval", driver.DefaultNodeLabelInterval, "How often the labels of the nodes are checked")
+		claimEvents         = flag.Bool("claim-events", false, "Report events on the persistent volume claims, e.g. when an expansion does not resize the volume")
+
+		orphanCleanup         = flag.Bool("orphan-cleanup", false, "Unmount and remove the publish target paths of pods which do not exist anymore on the node")
+		orphanCleanupInterval = flag.Duration("orphan-cleanup-interval", driver.DefaultOrphanCleanupInterval, "How often the publish target paths are checked for deleted pods")
+		nodeName              = flag.String("node-name", "", "Name of the Kubernetes node the plugin runs on (defaults to $KUBE_NODE_NAME)")
 	)
 	flag.Parse()
 
+	if *version {
+		fmt.Printf("%s - %s (%s)\n", driver.GetVersion(), driver.GetCommit(), driver.GetTreeState())
+		os.Exit(0)
+	}
+
 	if *token == "" {
 		*token = os.Getenv("CLOUDSCALE_ACCESS_TOKEN")
 	}
 
-	if *version {
-		fmt.Printf("%s - %s (%s)\n", driver.GetVersion(), driver.GetCommit(), driver.GetTreeState())
-		os.Exit(0)
+	if *fallbackTokens == "" {
+		*fallbackTokens = os.Getenv("CLOUDSCALE_FALLBACK_ACCESS_TOKENS")
+	}
+
+	if *kubeconfig == "" {
+		*kubeconfig = os.Getenv("KUBECONFIG")
+	}
+
+	if *nodeName == "" {
+		*nodeName = os.Getenv("KUBE_NODE_NAME")
+	}
+
+	if *vaultAddr == "" {
+		*vaultAddr = os.Getenv("VAULT_ADDR")
+	}
+
+	if *maxVolumesPerNode < 0 {
+		log.Fatalln("max-volumes-per-node must not be negative")
+	}
+
+	maxEphemeralVolumeSize, err := resource.ParseQuantity(*maxEphemeralSize)
+	if err != nil || maxEphemeralVolumeSize.Sign() < 0 {
+		log.Fatalf("invalid max-ephemeral-volume-size %q", *maxEphemeralSize)
+	}
+
+	var luksKeyProvider driver.LuksKeyProvider
+	if *vaultAddr != "" {
+		luksKeyProvider = driver.NewVaultKeyProvider(*vaultAddr, *vaultTokenFile)
+	}
+
+	var fallbackTokenList, fallbackTokenFileList []string
+	if *fallbackTokens != "" {
+		fallbackTokenList = strings.Split(*fallbackTokens, ",")
+	}
+	if *fallbackTokenFiles != "" {
+		fallbackTokenFileList = strings.Split(*fallbackTokenFiles, ",")
+	}
+
+	var mountOptions []string
+	if *publishMountOptions != "" {
+		mountOptions = strings.Split(*publishMountOptions, ",")
+	}
+
+	logger, err := driver.NewLogger(*logFormat, *logLevel)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	opts := []driver.Option{
+		driver.WithLogger(logger),
+		driver.WithEndpoint(*endpoint),
+		driver.WithToken(*token),
+		driver.WithTokenFile(*tokenFile),
+		driver.WithFallbackTokens(fallbackTokenList...),
+		driver.WithFallbackTokenFiles(fallbackTokenFileList...),
+		driver.WithFakeCloudscale(*fake),
+		driver.WithAPIURL(*url),
+		driver.WithProxyURL(*proxyURL),
+		driver.WithCABundle(*caBundle),
+		driver.WithServerID(*serverId),
+		driver.WithZone(*zone),
+		driver.WithKubeconfig(*kubeconfig),
+		driver.WithLuksKeyProvider(luksKeyProvider),
+		driver.WithFstrimInterval(*fstrimInterval),
+		driver.WithDeviceWaitTimeout(*deviceWaitTimeout),
+		driver.WithMaxVolumesPerNode(*maxVolumesPerNode),
+		driver.WithMaxEphemeralVolumeSize(maxEphemeralVolumeSize.Value()),
+		driver.WithPublishMountOptions(mountOptions),
+		driver.WithCleanupOnStart(*cleanupOnStart),
+		driver.WithDebugAddr(*debugAddr),
+		driver.WithLuksHeaderAddr(*luksHeaderAddr),
+		driver.WithMetricsAddr(*metricsAddr),
+		driver.WithHealthAddr(*healthAddr),
+		driver.WithMode(*mode),
+		driver.WithContainerOrchestrator(*orchestrator),
+		driver.WithAPICheck(*apiCheckInterval, *apiCheckThreshold),
+		driver.WithSlowOperationThreshold(*slowThreshold),
+		driver.WithGRPCServerConfig(driver.GRPCServerConfig{
+			MaxConcurrentStreams: uint32(*grpcMaxStreams),
+			MaxRecvMsgSize:       *grpcMaxRecvMsgSize,
+			KeepaliveTime:        *grpcKeepaliveTime,
+			KeepaliveTimeout:     *grpcKeepaliveTimeout,
+			Reflection:           *grpcReflection,
+		}),
+		driver.WithTLSEndpoint(driver.TLSEndpointConfig{
+			Addr:         *tlsAddr,
+			CertFile:     *tlsCertFile,
+			KeyFile:      *tlsKeyFile,
+			ClientCAFile: *tlsClientCAFile,
+		}),
+	}
+
+	if *nodeFencing {
+		opts = append(opts, driver.WithNodeFencing(*nodeFencingInterval))
+	}
+
+	if *nodeLabeler {
+		opts = append(opts, driver.WithNodeLabeler(*nodeLabelerInterval))
+	}
+
+	if *claimEvents {
+		opts = append(opts, driver.WithClaimEvents())
+	}
+
+	if *orphanCleanup {
+		opts = append(opts, driver.WithOrphanCleanup(*nodeName, *orphanCleanupInterval))
+	}
+
+	if *config != "" {
+		opts = append(opts, driver.WithConfigFile(*config))
 	}
 
-	drv, err := driver.NewDriver(*endpoint, *token, *url)
+	drv, err := driver.NewDriver(opts...)
 	if err != nil {
 		log.Fatalln(err)
 	}
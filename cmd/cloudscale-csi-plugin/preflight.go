@@ -0,0 +1,64 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/cloudscale-ch/csi-cloudscale/driver"
+)
+
+// preflight runs the preflight checks and returns the exit code, which is
+// non-zero if a check failed. It is meant to run as an init container.
+func preflight(args []string) int {
+	fs := flag.NewFlagSet("preflight", flag.ExitOnError)
+	var (
+		token      = fs.String("token", "", "cloudscale.ch access token (defaults to $CLOUDSCALE_ACCESS_TOKEN)")
+		tokenFile  = fs.String("cloudscale-token-file", "", "File containing the cloudscale.ch access token; takes precedence over --token")
+		url        = fs.String("url", driver.DefaultAPIURL, "cloudscale.ch API URL")
+		proxyURL   = fs.String("proxy-url", "", "Proxy used to reach the cloudscale.ch API (defaults to $HTTPS_PROXY)")
+		caBundle   = fs.String("ca-bundle", "", "PEM file with CA certificates trusted in addition to the system roots when reaching the cloudscale.ch API")
+		mode       = fs.String("mode", driver.ModeAll, "Whether the plugin runs as controller, node or all; the node checks are skipped for the controller")
+		kubeletDir = fs.String("kubelet-dir", driver.DefaultKubeletDir, "Kubelet directory whose plugins and pods directories must be writable; skipped if empty")
+		timeout    = fs.Duration("timeout", 30*time.Second, "Timeout of the API checks")
+	)
+	_ = fs.Parse(args)
+
+	if *token == "" {
+		*token = os.Getenv("CLOUDSCALE_ACCESS_TOKEN")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	checks := driver.Preflight(ctx, driver.PreflightConfig{
+		Mode:       *mode,
+		Token:      *token,
+		TokenFile:  *tokenFile,
+		APIURL:     *url,
+		ProxyURL:   *proxyURL,
+		CABundle:   *caBundle,
+		KubeletDir: *kubeletDir,
+	})
+	if !driver.PrintPreflight(os.Stdout, checks) {
+		return 1
+	}
+	return 0
+}
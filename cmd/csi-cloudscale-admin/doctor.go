@@ -0,0 +1,105 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// finding is a volume which exists only in the cloudscale.ch account or only
+// in the cluster
+type finding struct {
+	// Missing is "pv" for volumes without persistent volume and "volume"
+	// for persistent volumes whose volume is missing
+	Missing   string    `json:"missing"`
+	UUID      string    `json:"uuid"`
+	Name      string    `json:"name,omitempty"`
+	PV        string    `json:"pv,omitempty"`
+	PVC       string    `json:"pvc,omitempty"`
+	SizeGB    int       `json:"sizeGB"`
+	Zone      string    `json:"zone,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Age       string    `json:"age"`
+}
+
+func findings(rows []volumeRow, now time.Time) []finding {
+	result := []finding{}
+	for _, row := range rows {
+		var missing string
+		switch row.Status {
+		case statusOrphaned:
+			missing = "pv"
+		case statusMissingVolume:
+			missing = "volume"
+		default:
+			continue
+		}
+		result = append(result, finding{
+			Missing:   missing,
+			UUID:      row.UUID,
+			Name:      row.Name,
+			PV:        row.PV,
+			PVC:       row.PVC,
+			SizeGB:    row.SizeGB,
+			Zone:      row.Zone,
+			CreatedAt: row.CreatedAt,
+			Age:       formatAge(now.Sub(row.CreatedAt)),
+		})
+	}
+	return result
+}
+
+func printDoctor(w io.Writer, rows []volumeRow, now time.Time, jsonOutput bool) error {
+	found := findings(rows, now)
+	if jsonOutput {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(found)
+	}
+
+	if len(found) == 0 {
+		fmt.Fprintln(w, "all volumes and persistent volumes match")
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "MISSING\tUUID\tNAME\tPV\tPVC\tSIZE\tZONE\tAGE")
+	for _, f := range found {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%dGi\t%s\t%s\n",
+			f.Missing, f.UUID, orDash(f.Name), orDash(f.PV), orDash(f.PVC), f.SizeGB, orDash(f.Zone), f.Age)
+	}
+	return tw.Flush()
+}
+
+// formatAge formats a duration like kubectl does for the age of objects
+func formatAge(d time.Duration) string {
+	switch {
+	case d < 0:
+		return "0s"
+	case d < 2*time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < 2*time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintDoctor(t *testing.T) {
+	now := time.Date(2023, 6, 10, 12, 0, 0, 0, time.UTC)
+	rows := []volumeRow{
+		{UUID: "missing-uuid", PV: "pvc-missing", PVC: "default/gone", SizeGB: 5, Status: statusMissingVolume, CreatedAt: now.Add(-3 * time.Hour)},
+		{UUID: "bound-uuid", Name: "pvc-bound", PV: "pvc-bound", Status: "bound", CreatedAt: now},
+		{UUID: "orphan-uuid", Name: "pvc-orphan", SizeGB: 2, Zone: "lpg1", Status: statusOrphaned, CreatedAt: now.Add(-72 * time.Hour)},
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, printDoctor(&out, rows, now, true))
+	var found []finding
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &found))
+	assert.Equal(t, []finding{
+		{Missing: "volume", UUID: "missing-uuid", PV: "pvc-missing", PVC: "default/gone", SizeGB: 5, CreatedAt: now.Add(-3 * time.Hour), Age: "3h"},
+		{Missing: "pv", UUID: "orphan-uuid", Name: "pvc-orphan", SizeGB: 2, Zone: "lpg1", CreatedAt: now.Add(-72 * time.Hour), Age: "3d"},
+	}, found)
+
+	out.Reset()
+	assert.NoError(t, printDoctor(&out, rows, now, false))
+	assert.Contains(t, out.String(), "orphan-uuid")
+	assert.NotContains(t, out.String(), "bound-uuid")
+
+	out.Reset()
+	assert.NoError(t, printDoctor(&out, rows[1:2], now, true))
+	assert.Equal(t, "[]\n", out.String())
+}
+
+func TestFormatAge(t *testing.T) {
+	assert.Equal(t, "45s", formatAge(45*time.Second))
+	assert.Equal(t, "90m", formatAge(90*time.Minute))
+	assert.Equal(t, "30h", formatAge(30*time.Hour))
+	assert.Equal(t, "10d", formatAge(240*time.Hour))
+}
@@ -0,0 +1,149 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cmdutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	luksUsage = "usage: csi-cloudscale-admin [flags] luks backup-header --node <node> <volume-uuid> <file>"
+
+	// nodePluginContainer is the container of the node plugin pod which
+	// serves the luks header endpoint
+	nodePluginContainer = "csi-cloudscale-plugin"
+)
+
+// runLuks backs up the luks header of a volume through the luks header
+// endpoint of the node plugin on the node the volume is attached to. The
+// endpoint only listens on the loopback interface of the node and is
+// reached by an exec into the node plugin, which requires the pods/exec
+// permission in the namespace of the node plugin.
+func runLuks(ctx context.Context, kubeconfig string, args []string) error {
+	if len(args) == 0 || args[0] != "backup-header" {
+		return errors.New(luksUsage)
+	}
+
+	fs := flag.NewFlagSet("luks backup-header", flag.ExitOnError)
+	node := fs.String("node", "", "Node the volume is attached to")
+	namespace := fs.String("namespace", "kube-system", "Namespace of the node plugin")
+	addr := fs.String("luks-header-addr", "127.0.0.1:9811", "Address of the luks header endpoint of the node plugin")
+	_ = fs.Parse(args[1:])
+	if *node == "" || fs.NArg() != 2 {
+		return errors.New(luksUsage)
+	}
+	volumeID, file := fs.Arg(0), fs.Arg(1)
+
+	config, err := cmdutil.KubernetesConfig(kubeconfig)
+	if err != nil {
+		return err
+	}
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("couldn't create the Kubernetes client: %v", err)
+	}
+	pod, err := nodePluginPod(ctx, kubeClient, *namespace, *node)
+	if err != nil {
+		return err
+	}
+
+	var header bytes.Buffer
+	err = execInPod(config, kubeClient, *namespace, pod, luksHeaderCommand(*addr, volumeID), &header)
+	if err != nil {
+		return fmt.Errorf("couldn't back up the luks header of volume %s: %v", volumeID, err)
+	}
+	// the header contains the encrypted volume key, which is as sensitive as
+	// the data on the volume
+	if err := ioutil.WriteFile(file, header.Bytes(), 0600); err != nil {
+		return err
+	}
+	fmt.Printf("backed up the luks header of volume %s to %s\n", volumeID, file)
+	return nil
+}
+
+// luksHeaderCommand returns the command which fetches the luks header of the
+// volume from the endpoint with the wget of the node plugin image
+func luksHeaderCommand(addr, volumeID string) []string {
+	query := url.Values{"volume": []string{volumeID}}
+	return []string{"wget", "-q", "-O", "-", fmt.Sprintf("http://%s/luks/header?%s", addr, query.Encode())}
+}
+
+// execInPod runs the command in the node plugin container of the pod and
+// writes its output to stdout
+func execInPod(config *rest.Config, client kubernetes.Interface, namespace, pod string, command []string, stdout *bytes.Buffer) error {
+	req := client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pod).
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: nodePluginContainer,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+	if err != nil {
+		return fmt.Errorf("failed to init executor: %v", err)
+	}
+	var stderr bytes.Buffer
+	err = exec.Stream(remotecommand.StreamOptions{
+		Stdout: stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// nodePluginPod returns the name of the running node plugin pod on the node
+func nodePluginPod(ctx context.Context, client kubernetes.Interface, namespace, node string) (string, error) {
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "app=csi-cloudscale-node",
+		FieldSelector: "spec.nodeName=" + node,
+	})
+	if err != nil {
+		return "", fmt.Errorf("couldn't list the node plugin pods: %v", err)
+	}
+	return runningPod(pods.Items, node)
+}
+
+func runningPod(pods []v1.Pod, node string) (string, error) {
+	for _, pod := range pods {
+		if pod.Status.Phase == v1.PodRunning && pod.DeletionTimestamp == nil {
+			return pod.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no running node plugin pod on node %s", node)
+}
@@ -0,0 +1,299 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command csi-cloudscale-admin inspects and repairs the cloudscale.ch volumes
+// managed by the driver:
+//
+//	csi-cloudscale-admin [flags] volumes [--orphans]
+//	csi-cloudscale-admin [flags] doctor [--json]
+//	csi-cloudscale-admin [flags] detach <volume-uuid>
+//	csi-cloudscale-admin [flags] luks backup-header --node <node> <volume-uuid> <file>
+//	csi-cloudscale-admin [flags] migrate-zone [--dry-run] --zone <zone> <pv-name>
+//
+// The volumes command lists the managed volumes with the servers they are
+// attached to and their persistent volumes and claims. Volumes without a
+// persistent volume and persistent volumes of missing volumes are orphaned,
+// which the doctor command reports with their age and size.
+// The detach command detaches a volume which is stuck on a server. The luks
+// command backs up the luks header of a volume through an exec into the node
+// plugin, which must be started with --luks-header-addr. The migrate-zone
+// command moves the data of a persistent volume to a new volume in another
+// zone.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cmdutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	statusOrphaned      = "orphaned"
+	statusMissingVolume = "missing volume"
+)
+
+// volumeRow is a managed volume or a persistent volume of the driver
+type volumeRow struct {
+	UUID       string
+	Name       string
+	SizeGB     int
+	Zone       string
+	AttachedTo []string
+	PV         string
+	PVC        string
+	Status     string
+	CreatedAt  time.Time
+}
+
+func (r volumeRow) orphaned() bool {
+	return r.Status == statusOrphaned || r.Status == statusMissingVolume
+}
+
+func main() {
+	var (
+		token      = flag.String("token", "", "cloudscale.ch access token (defaults to $CLOUDSCALE_ACCESS_TOKEN)")
+		apiURL     = flag.String("url", driver.DefaultAPIURL, "cloudscale.ch API URL")
+		kubeconfig = flag.String("kubeconfig", "", "Kubeconfig of the cluster (defaults to $KUBECONFIG, then ~/.kube/config)")
+	)
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "usage: %s [flags] <command> [args]\n\n", os.Args[0])
+		fmt.Fprintln(out, "commands:")
+		fmt.Fprintln(out, "  volumes [--orphans]    list the managed volumes with their attachments and persistent volumes")
+		fmt.Fprintln(out, "  doctor [--json]        report volumes without persistent volume and persistent volumes without volume")
+		fmt.Fprintln(out, "  detach <volume-uuid>   detach a volume from its servers")
+		fmt.Fprintln(out, "  luks backup-header --node <node> <volume-uuid> <file>")
+		fmt.Fprintln(out, "                         back up the luks header of a volume")
+		fmt.Fprintln(out, "  migrate-zone [--dry-run] --zone <zone> <pv-name>")
+		fmt.Fprintln(out, "                         move a persistent volume to a new volume in another zone")
+		fmt.Fprintln(out, "\nflags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	newCloudscaleClient := func() *cloudscale.Client {
+		client, err := cmdutil.NewCloudscaleClient(ctx, *token, *apiURL)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return client
+	}
+
+	switch command, args := flag.Arg(0), flag.Args()[1:]; command {
+	case "volumes":
+		fs := flag.NewFlagSet(command, flag.ExitOnError)
+		orphans := fs.Bool("orphans", false, "List only orphaned volumes and persistent volumes")
+		_ = fs.Parse(args)
+
+		rows, err := clusterVolumes(ctx, newCloudscaleClient(), *kubeconfig)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		printVolumes(os.Stdout, rows, *orphans)
+	case "doctor":
+		fs := flag.NewFlagSet(command, flag.ExitOnError)
+		jsonOutput := fs.Bool("json", false, "Print the findings as JSON")
+		_ = fs.Parse(args)
+
+		rows, err := clusterVolumes(ctx, newCloudscaleClient(), *kubeconfig)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := printDoctor(os.Stdout, rows, time.Now(), *jsonOutput); err != nil {
+			log.Fatalln(err)
+		}
+	case "detach":
+		if len(args) != 1 {
+			log.Fatalf("usage: %s [flags] detach <volume-uuid>", os.Args[0])
+		}
+		if err := detachVolume(ctx, newCloudscaleClient(), args[0], os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+	case "luks":
+		if err := runLuks(ctx, *kubeconfig, args); err != nil {
+			log.Fatalln(err)
+		}
+	case "migrate-zone":
+		if err := runMigrateZone(ctx, newCloudscaleClient, *kubeconfig, os.Stdout, args); err != nil {
+			log.Fatalln(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// clusterVolumes returns the managed volumes and the persistent volumes of the
+// cluster; see listVolumes
+func clusterVolumes(ctx context.Context, client *cloudscale.Client, kubeconfig string) ([]volumeRow, error) {
+	kubeClient, err := cmdutil.NewKubernetesClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	pvs, err := kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list the persistent volumes: %v", err)
+	}
+	return listVolumes(ctx, client, pvs.Items)
+}
+
+// listVolumes returns the managed volumes and the persistent volumes of the
+// driver, matched by the volume handle
+func listVolumes(ctx context.Context, client *cloudscale.Client, pvs []v1.PersistentVolume) ([]volumeRow, error) {
+	volumes, err := client.Volumes.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list the volumes: %v", err)
+	}
+	servers, err := client.Servers.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list the servers: %v", err)
+	}
+	serverNames := map[string]string{}
+	for _, server := range servers {
+		serverNames[server.UUID] = server.Name
+	}
+
+	pvsByHandle := map[string]v1.PersistentVolume{}
+	for _, pv := range pvs {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driver.DriverName {
+			pvsByHandle[pv.Spec.CSI.VolumeHandle] = pv
+		}
+	}
+
+	var rows []volumeRow
+	for _, vol := range volumes {
+		pv, ok := pvsByHandle[vol.UUID]
+		if !driver.IsManagedVolume(vol) && !ok {
+			continue
+		}
+		delete(pvsByHandle, vol.UUID)
+
+		row := volumeRow{
+			UUID:      vol.UUID,
+			Name:      vol.Name,
+			SizeGB:    vol.SizeGB,
+			Zone:      vol.Zone.Slug,
+			Status:    statusOrphaned,
+			CreatedAt: vol.CreatedAt,
+		}
+		if vol.ServerUUIDs != nil {
+			for _, serverID := range *vol.ServerUUIDs {
+				if name, ok := serverNames[serverID]; ok {
+					row.AttachedTo = append(row.AttachedTo, name)
+				} else {
+					row.AttachedTo = append(row.AttachedTo, serverID)
+				}
+			}
+		}
+		if ok {
+			row.PV, row.PVC, row.Status = pvInfo(pv)
+		}
+		rows = append(rows, row)
+	}
+
+	for handle, pv := range pvsByHandle {
+		row := volumeRow{UUID: handle, CreatedAt: pv.CreationTimestamp.Time}
+		row.PV, row.PVC, _ = pvInfo(pv)
+		row.Status = statusMissingVolume
+		if size, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+			row.SizeGB = int(size.Value() / driver.GB)
+		}
+		rows = append(rows, row)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Name != rows[j].Name {
+			return rows[i].Name < rows[j].Name
+		}
+		return rows[i].UUID < rows[j].UUID
+	})
+	return rows, nil
+}
+
+// pvInfo returns the name, claim and lowercase phase of a persistent volume
+func pvInfo(pv v1.PersistentVolume) (name, claim, status string) {
+	if pv.Spec.ClaimRef != nil {
+		claim = pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name
+	}
+	return pv.Name, claim, strings.ToLower(string(pv.Status.Phase))
+}
+
+func printVolumes(w io.Writer, rows []volumeRow, orphansOnly bool) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "UUID\tNAME\tSIZE\tZONE\tATTACHED TO\tPV\tPVC\tSTATUS")
+	for _, row := range rows {
+		if orphansOnly && !row.orphaned() {
+			continue
+		}
+		status := row.Status
+		if row.orphaned() {
+			status = strings.ToUpper(status)
+		}
+		size := "-"
+		if row.SizeGB > 0 {
+			size = fmt.Sprintf("%dGi", row.SizeGB)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			row.UUID, orDash(row.Name), size, orDash(row.Zone),
+			orDash(strings.Join(row.AttachedTo, ",")), orDash(row.PV), orDash(row.PVC), status)
+	}
+	_ = tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// detachVolume detaches a volume from all servers it is attached to
+func detachVolume(ctx context.Context, client *cloudscale.Client, volumeID string, out io.Writer) error {
+	vol, err := client.Volumes.Get(ctx, volumeID)
+	if err != nil {
+		return fmt.Errorf("couldn't get volume %s: %v", volumeID, err)
+	}
+	if vol.ServerUUIDs == nil || len(*vol.ServerUUIDs) == 0 {
+		fmt.Fprintf(out, "volume %s (%s) is not attached\n", vol.UUID, vol.Name)
+		return nil
+	}
+
+	servers := *vol.ServerUUIDs
+	if err := client.Volumes.Update(ctx, vol.UUID, &cloudscale.VolumeRequest{ServerUUIDs: &[]string{}}); err != nil {
+		return fmt.Errorf("couldn't detach volume %s: %v", vol.UUID, err)
+	}
+	fmt.Fprintf(out, "detached volume %s (%s) from %s\n", vol.UUID, vol.Name, strings.Join(servers, ","))
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testPV(name, handle, claim string, phase v1.PersistentVolumePhase) v1.PersistentVolume {
+	pv := v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driver.DriverName, VolumeHandle: handle},
+			},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: phase},
+	}
+	if claim != "" {
+		pv.Spec.ClaimRef = &v1.ObjectReference{Namespace: "default", Name: claim}
+	}
+	return pv
+}
+
+func TestListVolumes(t *testing.T) {
+	ctx := context.Background()
+	server := &cloudscale.Server{UUID: "server-1", Name: "node-1"}
+	client := cloudscalefake.NewClient(map[string]*cloudscale.Server{server.UUID: server})
+
+	bound, err := client.Volumes.Create(ctx, &cloudscale.VolumeRequest{
+		Name: "pvc-bound", SizeGB: 1, ServerUUIDs: &[]string{server.UUID},
+	})
+	assert.NoError(t, err)
+	orphan, err := client.Volumes.Create(ctx, &cloudscale.VolumeRequest{Name: "pvc-orphan", SizeGB: 2})
+	assert.NoError(t, err)
+	_, err = client.Volumes.Create(ctx, &cloudscale.VolumeRequest{Name: "unmanaged", SizeGB: 3})
+	assert.NoError(t, err)
+
+	pvs := []v1.PersistentVolume{
+		testPV("pvc-bound", bound.UUID, "data", v1.VolumeBound),
+		testPV("pvc-missing", "missing-uuid", "gone", v1.VolumeReleased),
+	}
+
+	rows, err := listVolumes(ctx, client, pvs)
+	assert.NoError(t, err)
+	assert.Equal(t, []volumeRow{
+		{UUID: "missing-uuid", PV: "pvc-missing", PVC: "default/gone", Status: statusMissingVolume},
+		{UUID: bound.UUID, Name: "pvc-bound", SizeGB: 1, Zone: cloudscalefake.Zone, AttachedTo: []string{"node-1"}, PV: "pvc-bound", PVC: "default/data", Status: "bound"},
+		{UUID: orphan.UUID, Name: "pvc-orphan", SizeGB: 2, Zone: cloudscalefake.Zone, Status: statusOrphaned},
+	}, rows)
+
+	var out bytes.Buffer
+	printVolumes(&out, rows, true)
+	assert.Contains(t, out.String(), "MISSING VOLUME")
+	assert.Contains(t, out.String(), "ORPHANED")
+	assert.NotContains(t, out.String(), "pvc-bound")
+}
+
+func TestDetachVolume(t *testing.T) {
+	ctx := context.Background()
+	server := &cloudscale.Server{UUID: "server-1", Name: "node-1"}
+	client := cloudscalefake.NewClient(map[string]*cloudscale.Server{server.UUID: server})
+
+	vol, err := client.Volumes.Create(ctx, &cloudscale.VolumeRequest{
+		Name: "pvc-stuck", SizeGB: 1, ServerUUIDs: &[]string{server.UUID},
+	})
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.NoError(t, detachVolume(ctx, client, vol.UUID, &out))
+	assert.Contains(t, out.String(), "detached volume")
+
+	vol, err = client.Volumes.Get(ctx, vol.UUID)
+	assert.NoError(t, err)
+	assert.Empty(t, *vol.ServerUUIDs)
+
+	out.Reset()
+	assert.NoError(t, detachVolume(ctx, client, vol.UUID, &out))
+	assert.Contains(t, out.String(), "is not attached")
+
+	assert.Error(t, detachVolume(ctx, client, "unknown", &out))
+}
+
+func TestRunningPod(t *testing.T) {
+	pods := []v1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "pending"}, Status: v1.PodStatus{Phase: v1.PodPending}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "running"}, Status: v1.PodStatus{Phase: v1.PodRunning}},
+	}
+	pod, err := runningPod(pods, "node-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "running", pod)
+
+	_, err = runningPod(pods[:1], "node-1")
+	assert.EqualError(t, err, "no running node plugin pod on node node-1")
+}
+
+func TestLuksHeaderCommand(t *testing.T) {
+	assert.Equal(t,
+		[]string{"wget", "-q", "-O", "-", "http://127.0.0.1:9811/luks/header?volume=4f4b4a5c"},
+		luksHeaderCommand("127.0.0.1:9811", "4f4b4a5c"))
+}
@@ -0,0 +1,527 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cmdutil"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	migrateZoneUsage = "usage: csi-cloudscale-admin [flags] migrate-zone [--dry-run] --zone <zone> <pv-name>"
+
+	// migrationMountPath is where the helper pods mount filesystem volumes
+	// and migrationDevicePath where they get block volumes
+	migrationMountPath  = "/data"
+	migrationDevicePath = "/dev/migration"
+
+	// migrationProgressInterval defines how often the copy progress is
+	// reported
+	migrationProgressInterval = 10 * time.Second
+)
+
+// zoneMigration moves the data of a persistent volume to a new volume in
+// another zone and swaps the volume of the persistent volume. Volumes can
+// only be attached to servers in their zone, so the data is streamed from a
+// helper pod using the source volume to a helper pod using the target
+// volume, with tar for filesystem volumes and dd for block volumes.
+type zoneMigration struct {
+	cloudscale *cloudscale.Client
+	kube       kubernetes.Interface
+	config     *rest.Config
+	out        io.Writer
+
+	image   string
+	timeout time.Duration
+	zone    string
+
+	pv     *v1.PersistentVolume
+	pvc    *v1.PersistentVolumeClaim
+	source *cloudscale.Volume
+	target *cloudscale.Volume
+}
+
+func runMigrateZone(ctx context.Context, cloudscaleClient func() *cloudscale.Client, kubeconfig string, out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("migrate-zone", flag.ExitOnError)
+	zone := fs.String("zone", "", "Zone of the new volume (e.g. lpg1)")
+	dryRun := fs.Bool("dry-run", false, "Print the migration steps without running them")
+	image := fs.String("image", "docker.io/library/busybox:1.36", "Image of the helper pods, which needs tar, dd and du")
+	timeout := fs.Duration("timeout", 10*time.Minute, "How long to wait for the helper pods and the deletion of objects")
+	_ = fs.Parse(args)
+	if *zone == "" || fs.NArg() != 1 {
+		return errors.New(migrateZoneUsage)
+	}
+
+	config, err := cmdutil.KubernetesConfig(kubeconfig)
+	if err != nil {
+		return err
+	}
+	kube, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("couldn't create the Kubernetes client: %v", err)
+	}
+
+	m := &zoneMigration{
+		cloudscale: cloudscaleClient(),
+		kube:       kube,
+		config:     config,
+		out:        out,
+		image:      *image,
+		timeout:    *timeout,
+		zone:       *zone,
+	}
+	if err := m.prepare(ctx, fs.Arg(0)); err != nil {
+		return err
+	}
+	m.printPlan()
+	if *dryRun {
+		return nil
+	}
+	return m.run(ctx)
+}
+
+// prepare loads the persistent volume, its claim and its volume and checks
+// that the volume can be migrated
+func (m *zoneMigration) prepare(ctx context.Context, pvName string) error {
+	pv, err := m.kube.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("couldn't get persistent volume %s: %v", pvName, err)
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driver.DriverName {
+		return fmt.Errorf("persistent volume %s is not a volume of %s", pvName, driver.DriverName)
+	}
+	if pv.Spec.ClaimRef == nil {
+		return fmt.Errorf("persistent volume %s is not bound to a claim", pvName)
+	}
+	pvc, err := m.kube.CoreV1().PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).Get(ctx, pv.Spec.ClaimRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("couldn't get the claim of persistent volume %s: %v", pvName, err)
+	}
+
+	source, err := m.cloudscale.Volumes.Get(ctx, pv.Spec.CSI.VolumeHandle)
+	if err != nil {
+		return fmt.Errorf("couldn't get volume %s: %v", pv.Spec.CSI.VolumeHandle, err)
+	}
+	if source.Zone.Slug == m.zone {
+		return fmt.Errorf("volume %s is in zone %s already", source.UUID, m.zone)
+	}
+	if source.ServerUUIDs != nil && len(*source.ServerUUIDs) > 0 {
+		return fmt.Errorf("volume %s is attached to %s, stop the workloads using claim %s/%s first",
+			source.UUID, strings.Join(*source.ServerUUIDs, ","), pvc.Namespace, pvc.Name)
+	}
+
+	m.pv, m.pvc, m.source = pv, pvc, source
+	return nil
+}
+
+func (m *zoneMigration) printPlan() {
+	tmp := migrationName(m.pv.Name)
+	fmt.Fprintf(m.out, "migrating persistent volume %s (claim %s/%s) from zone %s to %s:\n",
+		m.pv.Name, m.pvc.Namespace, m.pvc.Name, m.source.Zone.Slug, m.zone)
+	fmt.Fprintf(m.out, " 1. create a %dGiB %s volume %q in zone %s\n", m.source.SizeGB, m.source.Type, m.source.Name, m.zone)
+	fmt.Fprintf(m.out, " 2. create persistent volume and claim %s/%s for the new volume\n", m.pvc.Namespace, tmp)
+	fmt.Fprintf(m.out, " 3. copy the data from claim %s to claim %s with helper pods (%s)\n", m.pvc.Name, tmp, m.image)
+	fmt.Fprintf(m.out, " 4. delete the helper pods and persistent volume and claim %s\n", tmp)
+	fmt.Fprintf(m.out, " 5. recreate persistent volume %s and claim %s/%s with the new volume\n", m.pv.Name, m.pvc.Namespace, m.pvc.Name)
+	fmt.Fprintf(m.out, "the volume %s in zone %s is kept\n", m.source.UUID, m.source.Zone.Slug)
+}
+
+func (m *zoneMigration) run(ctx context.Context) error {
+	req := &cloudscale.VolumeRequest{
+		Name:   m.source.Name,
+		SizeGB: m.source.SizeGB,
+		Type:   m.source.Type,
+	}
+	req.Zone = m.zone
+	req.Tags = m.source.Tags
+	target, err := m.cloudscale.Volumes.Create(ctx, req)
+	if err != nil {
+		return fmt.Errorf("couldn't create the volume in zone %s: %v", m.zone, err)
+	}
+	m.target = target
+	fmt.Fprintf(m.out, "created volume %s in zone %s\n", target.UUID, m.zone)
+
+	if err := m.copyData(ctx); err != nil {
+		return fmt.Errorf("%v; the new volume %s is kept, delete it before retrying", err, target.UUID)
+	}
+	if err := m.swap(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintf(m.out, "migrated persistent volume %s to volume %s, delete volume %s once the data is verified\n",
+		m.pv.Name, target.UUID, m.source.UUID)
+	return nil
+}
+
+// copyData copies the data of the source volume to the target volume
+// through a temporary persistent volume and claim for the target volume
+func (m *zoneMigration) copyData(ctx context.Context) error {
+	core := m.kube.CoreV1()
+	ns := m.pvc.Namespace
+	tmp := migrationName(m.pv.Name)
+
+	tmpPV := targetPersistentVolume(tmp, m.pv, m.target, m.source.Zone.Slug)
+	tmpPV.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimRetain
+	tmpPV.Spec.ClaimRef = &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: ns, Name: tmp}
+	if _, err := core.PersistentVolumes().Create(ctx, tmpPV, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("couldn't create persistent volume %s: %v", tmp, err)
+	}
+	defer m.delete(ctx, "persistent volume "+tmp, func(opts metav1.DeleteOptions) error {
+		return core.PersistentVolumes().Delete(ctx, tmp, opts)
+	}, func() error {
+		_, err := core.PersistentVolumes().Get(ctx, tmp, metav1.GetOptions{})
+		return err
+	})
+
+	tmpPVC := restoredClaim(m.pvc, tmp)
+	tmpPVC.Name = tmp
+	tmpPVC.Labels, tmpPVC.Annotations = nil, nil
+	if _, err := core.PersistentVolumeClaims(ns).Create(ctx, tmpPVC, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("couldn't create claim %s/%s: %v", ns, tmp, err)
+	}
+	defer m.delete(ctx, "claim "+tmp, func(opts metav1.DeleteOptions) error {
+		return core.PersistentVolumeClaims(ns).Delete(ctx, tmp, opts)
+	}, func() error {
+		_, err := core.PersistentVolumeClaims(ns).Get(ctx, tmp, metav1.GetOptions{})
+		return err
+	})
+
+	block := m.pv.Spec.VolumeMode != nil && *m.pv.Spec.VolumeMode == v1.PersistentVolumeBlock
+	for _, pod := range []*v1.Pod{
+		helperPod(tmp+"-source", ns, m.pvc.Name, m.image, block),
+		helperPod(tmp+"-target", ns, tmp, m.image, block),
+	} {
+		name := pod.Name
+		if _, err := core.Pods(ns).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("couldn't create helper pod %s: %v", name, err)
+		}
+		// pods are deleted before the claims, which are only removed once
+		// no pod uses them
+		defer m.delete(ctx, "helper pod "+name, func(opts metav1.DeleteOptions) error {
+			return core.Pods(ns).Delete(ctx, name, opts)
+		}, func() error {
+			_, err := core.Pods(ns).Get(ctx, name, metav1.GetOptions{})
+			return err
+		})
+	}
+	for _, name := range []string{tmp + "-source", tmp + "-target"} {
+		if err := m.waitForPod(ctx, ns, name); err != nil {
+			return err
+		}
+	}
+
+	readCmd := []string{"dd", "if=" + migrationDevicePath, "bs=4M"}
+	writeCmd := []string{"dd", "of=" + migrationDevicePath, "bs=4M"}
+	total := int64(m.source.SizeGB) * driver.GB
+	if !block {
+		readCmd = []string{"tar", "-C", migrationMountPath, "-cf", "-", "."}
+		writeCmd = []string{"tar", "-C", migrationMountPath, "-xpf", "-"}
+		var du bytes.Buffer
+		if err := m.exec(ns, tmp+"-source", []string{"du", "-sk", migrationMountPath}, nil, &du); err != nil {
+			return err
+		}
+		total = 0
+		if fields := strings.Fields(du.String()); len(fields) > 0 {
+			kb, _ := strconv.ParseInt(fields[0], 10, 64)
+			total = kb * 1024
+		}
+	}
+
+	fmt.Fprintf(m.out, "copying %s from claim %s to claim %s\n", formatBytes(total), m.pvc.Name, tmp)
+	progress := newProgressWriter(m.out, total, migrationProgressInterval)
+	r, w := io.Pipe()
+	readErr := make(chan error, 1)
+	go func() {
+		err := m.exec(ns, tmp+"-source", readCmd, nil, io.MultiWriter(w, progress))
+		w.CloseWithError(err)
+		readErr <- err
+	}()
+	writeErr := m.exec(ns, tmp+"-target", writeCmd, r, io.Discard)
+	r.CloseWithError(writeErr)
+	if err := <-readErr; err != nil {
+		return fmt.Errorf("reading the data failed: %v", err)
+	}
+	if writeErr != nil {
+		return fmt.Errorf("writing the data failed: %v", writeErr)
+	}
+	progress.done()
+	return nil
+}
+
+// swap recreates the persistent volume and its claim with the target volume,
+// as the volume handle of a persistent volume cannot be changed
+func (m *zoneMigration) swap(ctx context.Context) error {
+	core := m.kube.CoreV1()
+	ns, name := m.pvc.Namespace, m.pvc.Name
+
+	pv, err := core.PersistentVolumes().Get(ctx, m.pv.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	pv.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimRetain
+	if _, err := core.PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("couldn't retain the volume of persistent volume %s: %v", pv.Name, err)
+	}
+
+	if err := m.delete(ctx, "claim "+name, func(opts metav1.DeleteOptions) error {
+		return core.PersistentVolumeClaims(ns).Delete(ctx, name, opts)
+	}, func() error {
+		_, err := core.PersistentVolumeClaims(ns).Get(ctx, name, metav1.GetOptions{})
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := m.delete(ctx, "persistent volume "+pv.Name, func(opts metav1.DeleteOptions) error {
+		return core.PersistentVolumes().Delete(ctx, pv.Name, opts)
+	}, func() error {
+		_, err := core.PersistentVolumes().Get(ctx, pv.Name, metav1.GetOptions{})
+		return err
+	}); err != nil {
+		return err
+	}
+
+	newPV := targetPersistentVolume(m.pv.Name, m.pv, m.target, m.source.Zone.Slug)
+	newPV.Spec.ClaimRef = &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: ns, Name: name}
+	if _, err := core.PersistentVolumes().Create(ctx, newPV, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("couldn't recreate persistent volume %s: %v", newPV.Name, err)
+	}
+	if _, err := core.PersistentVolumeClaims(ns).Create(ctx, restoredClaim(m.pvc, newPV.Name), metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("couldn't recreate claim %s/%s: %v", ns, name, err)
+	}
+	fmt.Fprintf(m.out, "recreated persistent volume %s and claim %s/%s\n", newPV.Name, ns, name)
+	return nil
+}
+
+// delete deletes an object and waits until it is gone
+func (m *zoneMigration) delete(ctx context.Context, desc string, del func(metav1.DeleteOptions) error, get func() error) error {
+	if err := del(metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		fmt.Fprintf(m.out, "couldn't delete %s: %v\n", desc, err)
+		return err
+	}
+	err := wait.PollImmediate(2*time.Second, m.timeout, func() (bool, error) {
+		err := get()
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		fmt.Fprintf(m.out, "waiting for the deletion of %s failed: %v\n", desc, err)
+		return err
+	}
+	return nil
+}
+
+func (m *zoneMigration) waitForPod(ctx context.Context, ns, name string) error {
+	err := wait.PollImmediate(2*time.Second, m.timeout, func() (bool, error) {
+		pod, err := m.kube.CoreV1().Pods(ns).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if pod.Status.Phase == v1.PodFailed || pod.Status.Phase == v1.PodSucceeded {
+			return false, fmt.Errorf("pod is %s", pod.Status.Phase)
+		}
+		return pod.Status.Phase == v1.PodRunning, nil
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for helper pod %s failed: %v", name, err)
+	}
+	return nil
+}
+
+// exec runs the command in the helper pod with the given stdin and stdout
+func (m *zoneMigration) exec(ns, pod string, command []string, stdin io.Reader, stdout io.Writer) error {
+	req := m.kube.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pod).
+		Namespace(ns).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Command: command,
+			Stdin:   stdin != nil,
+			Stdout:  true,
+			Stderr:  true,
+		}, scheme.ParameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(m.config, "POST", req.URL())
+	if err != nil {
+		return fmt.Errorf("failed to init executor: %v", err)
+	}
+	var stderr bytes.Buffer
+	err = exec.Stream(remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return fmt.Errorf("%s in pod %s failed: %v: %s", command[0], pod, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func migrationName(pvName string) string {
+	return pvName + "-migration"
+}
+
+// targetPersistentVolume returns a copy of the persistent volume with the
+// target volume, whose node affinity to the source zone is replaced by the
+// target zone
+func targetPersistentVolume(name string, pv *v1.PersistentVolume, target *cloudscale.Volume, sourceZone string) *v1.PersistentVolume {
+	newPV := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      pv.Labels,
+			Annotations: map[string]string{"pv.kubernetes.io/provisioned-by": driver.DriverName},
+		},
+		Spec: *pv.Spec.DeepCopy(),
+	}
+	newPV.Spec.ClaimRef = nil
+	newPV.Spec.CSI.VolumeHandle = target.UUID
+
+	if newPV.Spec.NodeAffinity != nil && newPV.Spec.NodeAffinity.Required != nil {
+		for _, term := range newPV.Spec.NodeAffinity.Required.NodeSelectorTerms {
+			for _, expr := range term.MatchExpressions {
+				for i, value := range expr.Values {
+					if value == sourceZone {
+						expr.Values[i] = target.Zone.Slug
+					}
+				}
+			}
+		}
+	}
+	return newPV
+}
+
+// restoredClaim returns a copy of the claim which is bound to the given
+// persistent volume, without the annotations of the previous binding
+func restoredClaim(pvc *v1.PersistentVolumeClaim, pvName string) *v1.PersistentVolumeClaim {
+	annotations := map[string]string{}
+	for key, value := range pvc.Annotations {
+		if !strings.HasPrefix(key, "pv.kubernetes.io/") {
+			annotations[key] = value
+		}
+	}
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pvc.Name,
+			Namespace:   pvc.Namespace,
+			Labels:      pvc.Labels,
+			Annotations: annotations,
+		},
+		Spec: *pvc.Spec.DeepCopy(),
+	}
+	claim.Spec.VolumeName = pvName
+	return claim
+}
+
+// helperPod returns a pod which uses the claim and sleeps, so that commands
+// can be run in it
+func helperPod(name, namespace, claim, image string, block bool) *v1.Pod {
+	container := v1.Container{
+		Name:    "migration",
+		Image:   image,
+		Command: []string{"sleep", "infinity"},
+	}
+	if block {
+		container.VolumeDevices = []v1.VolumeDevice{{Name: "data", DevicePath: migrationDevicePath}}
+	} else {
+		container.VolumeMounts = []v1.VolumeMount{{Name: "data", MountPath: migrationMountPath}}
+	}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{"app": "csi-cloudscale-migration"},
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy: v1.RestartPolicyNever,
+			Containers:    []v1.Container{container},
+			Volumes: []v1.Volume{{
+				Name: "data",
+				VolumeSource: v1.VolumeSource{
+					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+				},
+			}},
+		},
+	}
+}
+
+// progressWriter counts the bytes written to it and reports the progress in
+// the given interval
+type progressWriter struct {
+	out      io.Writer
+	total    int64
+	written  int64
+	interval time.Duration
+	last     time.Time
+}
+
+func newProgressWriter(out io.Writer, total int64, interval time.Duration) *progressWriter {
+	return &progressWriter{out: out, total: total, interval: interval, last: time.Now()}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if time.Since(p.last) >= p.interval {
+		p.last = time.Now()
+		p.report()
+	}
+	return len(b), nil
+}
+
+func (p *progressWriter) done() {
+	p.report()
+}
+
+func (p *progressWriter) report() {
+	if p.total > 0 {
+		fmt.Fprintf(p.out, "copied %s of %s (%d%%)\n", formatBytes(p.written), formatBytes(p.total), p.written*100/p.total)
+		return
+	}
+	fmt.Fprintf(p.out, "copied %s\n", formatBytes(p.written))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
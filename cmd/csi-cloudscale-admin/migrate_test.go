@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTargetPersistentVolume(t *testing.T) {
+	pv := testPV("pvc-1234", "source-uuid", "data", v1.VolumeBound)
+	pv.Labels = map[string]string{"app": "db"}
+	pv.Annotations = map[string]string{"pv.kubernetes.io/bound-by-controller": "yes"}
+	pv.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimDelete
+	pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+		Required: &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{{
+				MatchExpressions: []v1.NodeSelectorRequirement{{
+					Key:      driver.DriverName + "/zone",
+					Operator: v1.NodeSelectorOpIn,
+					Values:   []string{"rma1"},
+				}},
+			}},
+		},
+	}
+	target := &cloudscale.Volume{UUID: "target-uuid"}
+	target.Zone.Slug = "lpg1"
+
+	newPV := targetPersistentVolume("pvc-1234", &pv, target, "rma1")
+	assert.Equal(t, "target-uuid", newPV.Spec.CSI.VolumeHandle)
+	assert.Equal(t, []string{"lpg1"}, newPV.Spec.NodeAffinity.Required.NodeSelectorTerms[0].MatchExpressions[0].Values)
+	assert.Equal(t, v1.PersistentVolumeReclaimDelete, newPV.Spec.PersistentVolumeReclaimPolicy)
+	assert.Equal(t, map[string]string{"app": "db"}, newPV.Labels)
+	assert.Equal(t, map[string]string{"pv.kubernetes.io/provisioned-by": driver.DriverName}, newPV.Annotations)
+	assert.Nil(t, newPV.Spec.ClaimRef)
+
+	// the source persistent volume is unchanged
+	assert.Equal(t, "source-uuid", pv.Spec.CSI.VolumeHandle)
+	assert.Equal(t, []string{"rma1"}, pv.Spec.NodeAffinity.Required.NodeSelectorTerms[0].MatchExpressions[0].Values)
+}
+
+func TestRestoredClaim(t *testing.T) {
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "data",
+			Namespace:       "default",
+			UID:             "1234",
+			ResourceVersion: "42",
+			Annotations: map[string]string{
+				"pv.kubernetes.io/bind-completed": "yes",
+				"example.com/owner":               "team-a",
+			},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{VolumeName: "pvc-1234"},
+	}
+
+	claim := restoredClaim(pvc, "pvc-5678")
+	assert.Equal(t, "data", claim.Name)
+	assert.Equal(t, "default", claim.Namespace)
+	assert.Empty(t, claim.UID)
+	assert.Empty(t, claim.ResourceVersion)
+	assert.Equal(t, map[string]string{"example.com/owner": "team-a"}, claim.Annotations)
+	assert.Equal(t, "pvc-5678", claim.Spec.VolumeName)
+}
+
+func TestHelperPod(t *testing.T) {
+	pod := helperPod("pvc-1234-migration-source", "default", "data", "busybox", false)
+	assert.Equal(t, migrationMountPath, pod.Spec.Containers[0].VolumeMounts[0].MountPath)
+	assert.Equal(t, "data", pod.Spec.Volumes[0].PersistentVolumeClaim.ClaimName)
+
+	pod = helperPod("pvc-1234-migration-source", "default", "data", "busybox", true)
+	assert.Empty(t, pod.Spec.Containers[0].VolumeMounts)
+	assert.Equal(t, migrationDevicePath, pod.Spec.Containers[0].VolumeDevices[0].DevicePath)
+}
+
+func TestProgressWriter(t *testing.T) {
+	var out bytes.Buffer
+	p := newProgressWriter(&out, 4096, time.Hour)
+	_, _ = p.Write(make([]byte, 1024))
+	assert.Empty(t, out.String())
+	p.done()
+	assert.Equal(t, "copied 1.0KiB of 4.0KiB (25%)\n", out.String())
+
+	out.Reset()
+	p = newProgressWriter(&out, 0, time.Hour)
+	_, _ = p.Write(make([]byte, 100))
+	p.done()
+	assert.Equal(t, "copied 100B\n", out.String())
+}
@@ -0,0 +1,237 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command csi-cloudscale-migrate creates the CSI persistent volumes of
+// existing cloudscale.ch volumes, e.g. of hand-crafted persistent volumes
+// from before the CSI driver. It prints the persistent volumes as YAML or
+// creates them with --apply:
+//
+//	csi-cloudscale-migrate [flags] <volume-uuid>[=<pv-name>] ...
+//
+// If a persistent volume with the given name exists, its claim, storage
+// class, access modes, mount options and labels are kept.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cmdutil"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// migrateOptions are the settings of the created persistent volumes which
+// cannot be derived from the cloudscale.ch volume
+type migrateOptions struct {
+	storageClass  string
+	fsType        string
+	reclaimPolicy v1.PersistentVolumeReclaimPolicy
+
+	luksCipher       string
+	luksKeySize      string
+	luksSecret       string
+	luksSecretNs     string
+	luksEncrypted    bool
+	zoneNodeAffinity bool
+}
+
+func main() {
+	var (
+		token            = flag.String("token", "", "cloudscale.ch access token (defaults to $CLOUDSCALE_ACCESS_TOKEN)")
+		apiURL           = flag.String("url", driver.DefaultAPIURL, "cloudscale.ch API URL")
+		kubeconfig       = flag.String("kubeconfig", "", "Kubeconfig of the cluster (defaults to $KUBECONFIG, then ~/.kube/config)")
+		apply            = flag.Bool("apply", false, "Create the persistent volumes instead of printing them")
+		storageClass     = flag.String("storage-class", "", "Storage class of persistent volumes which do not exist yet")
+		fsType           = flag.String("fs-type", "ext4", "Filesystem type of the volumes")
+		reclaimPolicy    = flag.String("reclaim-policy", string(v1.PersistentVolumeReclaimRetain), "Reclaim policy of persistent volumes which do not exist yet, Retain or Delete")
+		zoneNodeAffinity = flag.Bool("zone-node-affinity", true, "Restrict the persistent volumes to the nodes in the zone of the volume")
+		luks             = flag.Bool("luks", false, "The volumes are luks encrypted by the driver")
+		luksCipher       = flag.String("luks-cipher", "aes-xts-plain64", "Cipher of the luks encrypted volumes")
+		luksKeySize      = flag.String("luks-key-size", "512", "Key size of the luks encrypted volumes")
+		luksSecret       = flag.String("luks-secret", "", "<namespace>/<name> of the node stage secret with the luks key")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <volume-uuid>[=<pv-name>] ...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts := migrateOptions{
+		storageClass:     *storageClass,
+		fsType:           *fsType,
+		reclaimPolicy:    v1.PersistentVolumeReclaimPolicy(*reclaimPolicy),
+		zoneNodeAffinity: *zoneNodeAffinity,
+		luksEncrypted:    *luks,
+		luksCipher:       *luksCipher,
+		luksKeySize:      *luksKeySize,
+	}
+	if opts.reclaimPolicy != v1.PersistentVolumeReclaimRetain && opts.reclaimPolicy != v1.PersistentVolumeReclaimDelete {
+		log.Fatalf("invalid reclaim policy %q, must be Retain or Delete", *reclaimPolicy)
+	}
+	if *luksSecret != "" {
+		parts := strings.SplitN(*luksSecret, "/", 2)
+		if len(parts) != 2 {
+			log.Fatalf("invalid luks secret %q, must be <namespace>/<name>", *luksSecret)
+		}
+		opts.luksSecretNs, opts.luksSecret = parts[0], parts[1]
+	}
+
+	ctx := context.Background()
+	cloudscaleClient, err := cmdutil.NewCloudscaleClient(ctx, *token, *apiURL)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	kubeClient, err := cmdutil.NewKubernetesClient(*kubeconfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	pvs := kubeClient.CoreV1().PersistentVolumes()
+
+	for i, arg := range flag.Args() {
+		volumeID, name := arg, arg
+		if parts := strings.SplitN(arg, "=", 2); len(parts) == 2 {
+			volumeID, name = parts[0], parts[1]
+		}
+
+		vol, err := cloudscaleClient.Volumes.Get(ctx, volumeID)
+		if err != nil {
+			log.Fatalf("couldn't get volume %s: %v", volumeID, err)
+		}
+		old, err := pvs.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			old = nil
+		} else if err != nil {
+			log.Fatalf("couldn't get persistent volume %s: %v", name, err)
+		}
+		if old != nil && old.Spec.CSI != nil && old.Spec.CSI.Driver == driver.DriverName {
+			log.Printf("persistent volume %s already uses %s, skipping it", name, driver.DriverName)
+			continue
+		}
+
+		pv := buildPersistentVolume(name, vol, old, opts)
+		if *apply {
+			if old != nil {
+				log.Fatalf("persistent volume %s exists, delete it before creating its CSI persistent volume", name)
+			}
+			if _, err := pvs.Create(ctx, pv, metav1.CreateOptions{}); err != nil {
+				log.Fatalf("couldn't create persistent volume %s: %v", name, err)
+			}
+			log.Printf("created persistent volume %s of volume %s", name, vol.UUID)
+			continue
+		}
+
+		out, err := yaml.Marshal(pv)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if i > 0 {
+			fmt.Println("---")
+		}
+		fmt.Print(string(out))
+	}
+}
+
+// buildPersistentVolume returns the CSI persistent volume of the given
+// cloudscale.ch volume. The claim and the settings of an existing persistent
+// volume are kept, so that its claim binds to the new one.
+func buildPersistentVolume(name string, vol *cloudscale.Volume, old *v1.PersistentVolume, opts migrateOptions) *v1.PersistentVolume {
+	attributes := map[string]string{
+		driver.PublishInfoVolumeName:  vol.Name,
+		driver.LuksEncryptedAttribute: "false",
+		driver.StorageTypeAttribute:   vol.Type,
+	}
+	if opts.luksEncrypted {
+		attributes[driver.LuksEncryptedAttribute] = "true"
+		attributes[driver.LuksCipherAttribute] = opts.luksCipher
+		attributes[driver.LuksKeySizeAttribute] = opts.luksKeySize
+	}
+
+	pv := &v1.PersistentVolume{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				"pv.kubernetes.io/provisioned-by": driver.DriverName,
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: *resource.NewQuantity(int64(vol.SizeGB)*driver.GB, resource.BinarySI),
+			},
+			AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			PersistentVolumeReclaimPolicy: opts.reclaimPolicy,
+			StorageClassName:              opts.storageClass,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:           driver.DriverName,
+					VolumeHandle:     vol.UUID,
+					FSType:           opts.fsType,
+					VolumeAttributes: attributes,
+				},
+			},
+		},
+	}
+	if opts.luksSecret != "" {
+		pv.Spec.CSI.NodeStageSecretRef = &v1.SecretReference{Name: opts.luksSecret, Namespace: opts.luksSecretNs}
+	}
+	if opts.zoneNodeAffinity && vol.Zone.Slug != "" {
+		pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+			Required: &v1.NodeSelector{
+				NodeSelectorTerms: []v1.NodeSelectorTerm{{
+					MatchExpressions: []v1.NodeSelectorRequirement{{
+						Key:      driver.DriverName + "/zone",
+						Operator: v1.NodeSelectorOpIn,
+						Values:   []string{vol.Zone.Slug},
+					}},
+				}},
+			},
+		}
+	}
+
+	if old != nil {
+		pv.Labels = old.Labels
+		pv.Spec.AccessModes = old.Spec.AccessModes
+		pv.Spec.PersistentVolumeReclaimPolicy = old.Spec.PersistentVolumeReclaimPolicy
+		pv.Spec.StorageClassName = old.Spec.StorageClassName
+		pv.Spec.MountOptions = old.Spec.MountOptions
+		pv.Spec.VolumeMode = old.Spec.VolumeMode
+		if old.Spec.ClaimRef != nil {
+			// the claim is bound again by name, as the old persistent
+			// volume is deleted before
+			pv.Spec.ClaimRef = &v1.ObjectReference{
+				Kind:      "PersistentVolumeClaim",
+				Namespace: old.Spec.ClaimRef.Namespace,
+				Name:      old.Spec.ClaimRef.Name,
+			}
+		}
+	}
+	return pv
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestBuildPersistentVolume(t *testing.T) {
+	vol := &cloudscale.Volume{
+		UUID:   "4f4b4a5c-5c33-4a9f-9a59-2fbd7e2e8a01",
+		Name:   "data",
+		SizeGB: 5,
+		Type:   "ssd",
+	}
+	vol.Zone.Slug = "lpg1"
+	opts := migrateOptions{
+		storageClass:     "cloudscale-volume-ssd",
+		fsType:           "ext4",
+		reclaimPolicy:    v1.PersistentVolumeReclaimRetain,
+		zoneNodeAffinity: true,
+	}
+
+	pv := buildPersistentVolume(vol.UUID, vol, nil, opts)
+	assert.Equal(t, vol.UUID, pv.Name)
+	assert.Equal(t, driver.DriverName, pv.Spec.CSI.Driver)
+	assert.Equal(t, vol.UUID, pv.Spec.CSI.VolumeHandle)
+	assert.Equal(t, "ext4", pv.Spec.CSI.FSType)
+	assert.Equal(t, "data", pv.Spec.CSI.VolumeAttributes[driver.PublishInfoVolumeName])
+	assert.Equal(t, "false", pv.Spec.CSI.VolumeAttributes[driver.LuksEncryptedAttribute])
+	assert.Equal(t, "5Gi", pv.Spec.Capacity.Storage().String())
+	assert.Equal(t, "cloudscale-volume-ssd", pv.Spec.StorageClassName)
+	assert.Equal(t, v1.PersistentVolumeReclaimRetain, pv.Spec.PersistentVolumeReclaimPolicy)
+	assert.Equal(t, []string{"lpg1"}, pv.Spec.NodeAffinity.Required.NodeSelectorTerms[0].MatchExpressions[0].Values)
+
+	old := &v1.PersistentVolume{
+		Spec: v1.PersistentVolumeSpec{
+			AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			StorageClassName:              "manual",
+			MountOptions:                  []string{"noatime"},
+			ClaimRef: &v1.ObjectReference{
+				Kind:            "PersistentVolumeClaim",
+				Namespace:       "default",
+				Name:            "data",
+				UID:             "1234",
+				ResourceVersion: "42",
+			},
+		},
+	}
+	opts.luksEncrypted = true
+	opts.luksCipher = "aes-xts-plain64"
+	opts.luksKeySize = "512"
+	opts.luksSecret, opts.luksSecretNs = "data-luks-key", "default"
+	opts.zoneNodeAffinity = false
+
+	pv = buildPersistentVolume("data", vol, old, opts)
+	assert.Equal(t, "manual", pv.Spec.StorageClassName)
+	assert.Equal(t, v1.PersistentVolumeReclaimDelete, pv.Spec.PersistentVolumeReclaimPolicy)
+	assert.Equal(t, []string{"noatime"}, pv.Spec.MountOptions)
+	assert.Equal(t, &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "default", Name: "data"}, pv.Spec.ClaimRef)
+	assert.Equal(t, "true", pv.Spec.CSI.VolumeAttributes[driver.LuksEncryptedAttribute])
+	assert.Equal(t, "512", pv.Spec.CSI.VolumeAttributes[driver.LuksKeySizeAttribute])
+	assert.Equal(t, &v1.SecretReference{Name: "data-luks-key", Namespace: "default"}, pv.Spec.CSI.NodeStageSecretRef)
+	assert.Nil(t, pv.Spec.NodeAffinity)
+}
@@ -0,0 +1,42 @@
+# Runs csi-cloudscale as monolith CSI plugin (controller and node) on every
+# client of the datacenter. The API token is read from the Nomad variable
+# nomad/jobs/csi-cloudscale.
+job "csi-cloudscale" {
+  datacenters = ["dc1"]
+  type        = "system"
+
+  group "plugin" {
+    task "plugin" {
+      driver = "docker"
+
+      config {
+        image      = "quay.io/cloudscalech/cloudscale-csi-plugin:v3.5.3"
+        privileged = true
+
+        args = [
+          "--endpoint=unix:///csi/csi.sock",
+          "--container-orchestrator=nomad",
+        ]
+      }
+
+      template {
+        destination = "secrets/token.env"
+        env         = true
+        data        = <<-EOT
+          {{ with nomadVar "nomad/jobs/csi-cloudscale" }}CLOUDSCALE_ACCESS_TOKEN={{ .token }}{{ end }}
+        EOT
+      }
+
+      csi_plugin {
+        id        = "csi.cloudscale.ch"
+        type      = "monolith"
+        mount_dir = "/csi"
+      }
+
+      resources {
+        cpu    = 100
+        memory = 128
+      }
+    }
+  }
+}
@@ -0,0 +1,29 @@
+# Creates a 5 GiB luks encrypted SSD volume with `nomad volume create volume.hcl`.
+id        = "data"
+name      = "data"
+type      = "csi"
+plugin_id = "csi.cloudscale.ch"
+
+capacity_min = "5GiB"
+
+capability {
+  access_mode     = "single-node-writer"
+  attachment_mode = "file-system"
+}
+
+mount_options {
+  fs_type = "ext4"
+}
+
+parameters {
+  "csi.cloudscale.ch/volume-type"    = "ssd"
+  "csi.cloudscale.ch/luks-encrypted" = "true"
+  "csi.cloudscale.ch/luks-cipher"    = "aes-xts-plain64"
+  "csi.cloudscale.ch/luks-key-size"  = "512"
+}
+
+# Nomad has no templating of secrets, the luks key is passed with every
+# request of the volume
+secrets {
+  luksKey = "change-me"
+}
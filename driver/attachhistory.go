@@ -0,0 +1,127 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+)
+
+const (
+	// attachHistoryTagPrefix is the prefix of the tags of the cloudscale.ch
+	// volume which record its last attachments and detachments, the tags
+	// are numbered from the oldest to the newest entry
+	attachHistoryTagPrefix = "csi-cloudscale-attach-history-"
+
+	// attachHistoryLength is the number of entries kept in the history
+	attachHistoryLength = 10
+
+	// attachHistoryTimeFormat is the time format of the entries
+	attachHistoryTimeFormat = "2006-01-02T15:04:05.000Z"
+
+	attachOperation = "attach"
+	detachOperation = "detach"
+)
+
+// attachHistoryEntry formats an entry of the attach history, e.g.
+// "2021-06-01T12:00:00.000Z attach <server-uuid>"
+func attachHistoryEntry(now time.Time, operation string, nodeID string) string {
+	return fmt.Sprintf("%s %s %s", now.UTC().Format(attachHistoryTimeFormat), operation, nodeID)
+}
+
+// attachHistory returns the entries of the history in the tags, oldest first.
+// The entries are ordered by the number of their tag rather than by their
+// time, which is the same for entries written within a millisecond.
+func attachHistory(tags cloudscale.TagMap) []string {
+	type numberedEntry struct {
+		number int
+		value  string
+	}
+	var numbered []numberedEntry
+	for key, value := range tags {
+		if !strings.HasPrefix(key, attachHistoryTagPrefix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(key, attachHistoryTagPrefix))
+		if err != nil {
+			continue
+		}
+		numbered = append(numbered, numberedEntry{number: n, value: value})
+	}
+	sort.Slice(numbered, func(i, j int) bool { return numbered[i].number < numbered[j].number })
+
+	var entries []string
+	for _, e := range numbered {
+		entries = append(entries, e.value)
+	}
+	return entries
+}
+
+// withAttachHistoryEntry returns a copy of the tags with the entry appended
+// to the history, dropping the oldest entries beyond attachHistoryLength.
+// The tags are returned unchanged if the newest entry is for the same
+// operation and node, as publish and unpublish are retried.
+func withAttachHistoryEntry(tags cloudscale.TagMap, entry string) (cloudscale.TagMap, bool) {
+	entries := attachHistory(tags)
+	if len(entries) > 0 {
+		last := strings.SplitN(entries[len(entries)-1], " ", 2)
+		current := strings.SplitN(entry, " ", 2)
+		if len(last) == 2 && len(current) == 2 && last[1] == current[1] {
+			return tags, false
+		}
+	}
+
+	entries = append(entries, entry)
+	if len(entries) > attachHistoryLength {
+		entries = entries[len(entries)-attachHistoryLength:]
+	}
+
+	// volumes created before the managedByTag was introduced get it once
+	// they are attached, so that the node plugin does not count them as
+	// attached outside of CSI
+	updated := cloudscale.TagMap{managedByTag: managedByTagValue}
+	for key, value := range tags {
+		if !strings.HasPrefix(key, attachHistoryTagPrefix) {
+			updated[key] = value
+		}
+	}
+	for i, e := range entries {
+		updated[fmt.Sprintf("%s%d", attachHistoryTagPrefix, i)] = e
+	}
+	return updated, true
+}
+
+// addAttachHistory sets the tags of the attach or detach request to the tags
+// of the volume with the operation appended to the history for each node, so
+// that the history is written together with the attachment. Concurrent
+// requests for the same volume replace each other's tags, but the newest
+// entry always matches the request which was applied last. The tags are sent
+// even if the entry is a retry, otherwise an older request would leave the
+// entry of a newer one behind.
+func addAttachHistory(req *cloudscale.VolumeRequest, vol *cloudscale.Volume, operation string, nodeIDs []string) {
+	now := time.Now()
+	tags := vol.Tags
+	for _, nodeID := range nodeIDs {
+		tags, _ = withAttachHistoryEntry(tags, attachHistoryEntry(now, operation, nodeID))
+	}
+	req.Tags = tags
+}
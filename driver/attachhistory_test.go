@@ -0,0 +1,142 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithAttachHistoryEntry(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tags := cloudscale.TagMap{managedByTag: managedByTagValue}
+
+	for i := 0; i < attachHistoryLength+2; i++ {
+		entry := attachHistoryEntry(start.Add(time.Duration(i)*time.Minute), attachOperation, fmt.Sprintf("server-%d", i))
+		var changed bool
+		tags, changed = withAttachHistoryEntry(tags, entry)
+		assert.True(t, changed)
+	}
+
+	history := attachHistory(tags)
+	assert.Len(t, history, attachHistoryLength)
+	assert.Equal(t, "2021-06-01T12:02:00.000Z attach server-2", history[0])
+	assert.Equal(t, "2021-06-01T12:11:00.000Z attach server-11", history[attachHistoryLength-1])
+	assert.Equal(t, history[attachHistoryLength-1], tags[attachHistoryTagPrefix+"9"])
+	assert.Equal(t, managedByTagValue, tags[managedByTag])
+
+	// retries of the same operation are not recorded again
+	_, changed := withAttachHistoryEntry(tags, attachHistoryEntry(start.Add(time.Hour), attachOperation, "server-11"))
+	assert.False(t, changed)
+	_, changed = withAttachHistoryEntry(tags, attachHistoryEntry(start.Add(time.Hour), detachOperation, "server-11"))
+	assert.True(t, changed)
+}
+
+func TestControllerRecordsAttachHistory(t *testing.T) {
+	serverId := "987654"
+	driver := &Driver{
+		serverId: serverId,
+		cloudscaleClient: cloudscalefake.NewClient(map[string]*cloudscale.Server{
+			serverId: {UUID: serverId},
+		}),
+		mounter: mounter.NewFake(),
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	created, err := driver.CreateVolume(ctx, makeCreateVolumeRequest(randString(32), 1, "ssd", false))
+	assert.NoError(t, err)
+	volumeID := created.Volume.VolumeId
+
+	publishReq := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           serverId,
+		VolumeCapability: makeVolumeCapabilityObject(false)[0],
+	}
+	_, err = driver.ControllerPublishVolume(ctx, publishReq)
+	assert.NoError(t, err)
+	_, err = driver.ControllerPublishVolume(ctx, publishReq)
+	assert.NoError(t, err)
+
+	unpublishReq := &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: serverId}
+	_, err = driver.ControllerUnpublishVolume(ctx, unpublishReq)
+	assert.NoError(t, err)
+	// the volume is not attached anymore, nothing is detached
+	_, err = driver.ControllerUnpublishVolume(ctx, unpublishReq)
+	assert.NoError(t, err)
+
+	vol, err := driver.cloudscaleClient.Volumes.Get(ctx, volumeID)
+	assert.NoError(t, err)
+	assert.Equal(t, managedByTagValue, vol.Tags[managedByTag])
+
+	history := attachHistory(vol.Tags)
+	if assert.Len(t, history, 2) {
+		assert.Regexp(t, "^\\S+ attach "+serverId+"$", history[0])
+		assert.Regexp(t, "^\\S+ detach "+serverId+"$", history[1])
+	}
+}
+
+func TestControllerAttachHistoryConcurrentPublish(t *testing.T) {
+	servers := map[string]*cloudscale.Server{
+		"server-a": {UUID: "server-a"},
+		"server-b": {UUID: "server-b"},
+	}
+	var mu sync.Mutex
+	var updates int
+	driver := &Driver{
+		cloudscaleClient: cloudscalefake.NewClient(servers,
+			cloudscalefake.WithErrorInjection(func(call cloudscalefake.Call) error {
+				if call.Method == "Update" {
+					mu.Lock()
+					updates++
+					mu.Unlock()
+				}
+				return nil
+			})),
+		mounter: mounter.NewFake(),
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	created, err := driver.CreateVolume(ctx, makeCreateVolumeRequest(randString(32), 1, "ssd", false))
+	assert.NoError(t, err)
+	volumeID := created.Volume.VolumeId
+
+	// the volume moves between the servers, the history is written with the
+	// attachment in a single request
+	const publishes = 20
+	var wg sync.WaitGroup
+	for i := 0; i < publishes; i++ {
+		nodeID := "server-a"
+		if i%2 == 1 {
+			nodeID = "server-b"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := driver.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+				VolumeId:         volumeID,
+				NodeId:           nodeID,
+				VolumeCapability: makeVolumeCapabilityObject(false)[0],
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, publishes, updates)
+
+	vol, err := driver.cloudscaleClient.Volumes.Get(ctx, volumeID)
+	assert.NoError(t, err)
+	history := attachHistory(vol.Tags)
+	if assert.NotEmpty(t, history) && assert.Len(t, *vol.ServerUUIDs, 1) {
+		assert.Regexp(t, "^\\S+ attach "+(*vol.ServerUUIDs)[0]+"$", history[len(history)-1])
+	}
+}
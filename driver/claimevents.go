@@ -0,0 +1,120 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coreclient "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// expandSkippedReason is the reason of the event reported on a claim whose
+// expansion did not resize the volume
+const expandSkippedReason = "VolumeResizeSkipped"
+
+// claimEventClient is the part of the Kubernetes client used to report events
+// on the claims of the volumes
+type claimEventClient interface {
+	GetPersistentVolume(ctx context.Context, name string) (*corev1.PersistentVolume, error)
+	CreateEvent(ctx context.Context, event *corev1.Event) error
+}
+
+// coreClaimEventClient implements claimEventClient with the core client
+type coreClaimEventClient struct {
+	client coreclient.CoreV1Interface
+}
+
+func (c coreClaimEventClient) GetPersistentVolume(ctx context.Context, name string) (*corev1.PersistentVolume, error) {
+	return c.client.PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c coreClaimEventClient) CreateEvent(ctx context.Context, event *corev1.Event) error {
+	_, err := c.client.Events(event.Namespace).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
+
+// newClaimEventClient returns a client for the claim events using the given
+// kubeconfig, or the service account of the pod if it is empty
+func newClaimEventClient(kubeconfig string) (claimEventClient, error) {
+	config, err := kubernetesConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := coreclient.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create the Kubernetes client: %v", err)
+	}
+	return coreClaimEventClient{client: client}, nil
+}
+
+// recordClaimEvent reports a normal event on the claim bound to the
+// persistent volume of the given volume, if the claim events are enabled.
+// The persistent volume is named like the volume, as both are named after
+// the name passed to CreateVolume. The events are informational only, so a
+// failure is logged and does not fail the operation.
+func (d *Driver) recordClaimEvent(ctx context.Context, vol *cloudscale.Volume, reason, message string, ll *logrus.Entry) {
+	if d.claimEvents == nil {
+		return
+	}
+	ll = ll.WithField("reason", reason)
+
+	pv, err := d.claimEvents.GetPersistentVolume(ctx, vol.Name)
+	if err != nil {
+		ll.WithError(err).Warn("couldn't get the persistent volume to report the event on its claim")
+		return
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != DriverName || pv.Spec.CSI.VolumeHandle != vol.UUID {
+		ll.WithField("persistent_volume", pv.Name).Warn("persistent volume does not belong to the volume, not reporting the event")
+		return
+	}
+	claim := pv.Spec.ClaimRef
+	if claim == nil {
+		return
+	}
+
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: claim.Name + ".",
+			Namespace:    claim.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      "v1",
+			Kind:            "PersistentVolumeClaim",
+			Namespace:       claim.Namespace,
+			Name:            claim.Name,
+			UID:             claim.UID,
+			ResourceVersion: claim.ResourceVersion,
+		},
+		Reason:              reason,
+		Message:             message,
+		Type:                corev1.EventTypeNormal,
+		Source:              corev1.EventSource{Component: DriverName},
+		ReportingController: DriverName,
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+	}
+	if err := d.claimEvents.CreateEvent(ctx, event); err != nil {
+		ll.WithError(err).Warn("couldn't report the event on the claim")
+	}
+}
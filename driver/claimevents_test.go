@@ -0,0 +1,134 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeClaimEvents stores persistent volumes and records the created events
+type fakeClaimEvents struct {
+	pvs    []corev1.PersistentVolume
+	events []corev1.Event
+}
+
+func (f *fakeClaimEvents) GetPersistentVolume(ctx context.Context, name string) (*corev1.PersistentVolume, error) {
+	for _, pv := range f.pvs {
+		if pv.Name == name {
+			return pv.DeepCopy(), nil
+		}
+	}
+	return nil, apierrors.NewNotFound(corev1.Resource("persistentvolumes"), name)
+}
+
+func (f *fakeClaimEvents) CreateEvent(ctx context.Context, event *corev1.Event) error {
+	f.events = append(f.events, *event.DeepCopy())
+	return nil
+}
+
+func TestControllerExpandVolumeSkipped(t *testing.T) {
+	driver := createDriverForTest(t)
+	driver.metrics = newMetrics()
+	events := &fakeClaimEvents{}
+	driver.claimEvents = events
+	ctx := context.Background()
+
+	name := randString(32)
+	created, err := driver.CreateVolume(ctx, makeCreateVolumeRequest(name, 10, "ssd", false))
+	assert.NoError(t, err)
+	volumeID := created.Volume.VolumeId
+	events.pvs = []corev1.PersistentVolume{{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: DriverName, VolumeHandle: volumeID},
+			},
+			ClaimRef: &corev1.ObjectReference{Namespace: "app", Name: "data", UID: "1234"},
+		},
+	}}
+
+	resp, err := driver.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 * GB},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10*GB), resp.CapacityBytes)
+
+	if assert.Len(t, events.events, 1) {
+		event := events.events[0]
+		assert.Equal(t, "app", event.Namespace)
+		assert.Equal(t, corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "PersistentVolumeClaim",
+			Namespace:  "app",
+			Name:       "data",
+			UID:        "1234",
+		}, event.InvolvedObject)
+		assert.Equal(t, expandSkippedReason, event.Reason)
+		assert.Equal(t, corev1.EventTypeNormal, event.Type)
+		assert.Contains(t, event.Message, "has 10Gi already")
+		assert.Contains(t, event.Message, "requested 5Gi")
+	}
+
+	assert.Contains(t, scrapeMetrics(t, driver), `csi_plugin_expand_skipped_total{driver_name="csi.cloudscale.ch"} 1`)
+
+	// an actual resize is neither counted nor reported
+	_, err = driver.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * GB},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, events.events, 1)
+	assert.Contains(t, scrapeMetrics(t, driver), `csi_plugin_expand_skipped_total{driver_name="csi.cloudscale.ch"} 1`)
+}
+
+func TestRecordClaimEventOtherVolume(t *testing.T) {
+	driver := createDriverForTest(t)
+	events := &fakeClaimEvents{pvs: []corev1.PersistentVolume{{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: DriverName, VolumeHandle: "other"},
+			},
+			ClaimRef: &corev1.ObjectReference{Namespace: "app", Name: "data"},
+		},
+	}}}
+	driver.claimEvents = events
+	ctx := context.Background()
+
+	created, err := driver.CreateVolume(ctx, makeCreateVolumeRequest("pvc-1", 1, "ssd", false))
+	assert.NoError(t, err)
+	vol, err := driver.cloudscaleClient.Volumes.Get(ctx, created.Volume.VolumeId)
+	assert.NoError(t, err)
+
+	driver.recordClaimEvent(ctx, vol, expandSkippedReason, "skipped", driver.log)
+	assert.Empty(t, events.events)
+
+	// a missing persistent volume is not an error either
+	vol.Name = "pvc-2"
+	driver.recordClaimEvent(ctx, vol, expandSkippedReason, "skipped", driver.log)
+	assert.Empty(t, events.events)
+}
+
+func TestNewDriverClaimEvents(t *testing.T) {
+	d, err := NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()), WithClaimEvents(),
+		func(o *options) { o.claimEventClient = &fakeClaimEvents{} })
+	assert.NoError(t, err)
+	assert.NotNil(t, d.claimEvents)
+
+	_, err = NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()), WithClaimEvents(), WithMode(ModeNode),
+		func(o *options) { o.claimEventClient = &fakeClaimEvents{} })
+	assert.Error(t, err)
+
+	_, err = NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()), WithClaimEvents(), WithContainerOrchestrator(OrchestratorNomad),
+		func(o *options) { o.claimEventClient = &fakeClaimEvents{} })
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Kubernetes")
+	}
+}
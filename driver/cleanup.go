@@ -0,0 +1,155 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/sirupsen/logrus"
+	"k8s.io/mount-utils"
+)
+
+// isStale returns true if one of the given devices is gone or belongs to a
+// cloudscale.ch volume that is not attached to this server anymore. Devices
+// which cannot be identified as cloudscale.ch volumes are never stale, unless
+// they are gone. If attached is nil, only missing devices are detected.
+func isStale(devices []string, serials map[string]string, attached map[string]bool) bool {
+	for _, device := range devices {
+		if _, err := os.Stat(device); os.IsNotExist(err) {
+			return true
+		}
+		serial, ok := serials[device]
+		if ok && attached != nil && !attached[serial] {
+			return true
+		}
+	}
+	return false
+}
+
+// staleLuksMappings returns the names of the luks mappings which are not in
+// use and whose device is stale. The mounted devices are given as the names
+// of their device nodes (e.g. dm-0).
+func staleLuksMappings(sysBlockPath string, mountedDevices map[string]bool, serials map[string]string, attached map[string]bool) []string {
+	entries, err := ioutil.ReadDir(sysBlockPath)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, entry := range entries {
+		dmDir := filepath.Join(sysBlockPath, entry.Name(), "dm")
+		uuid, err := ioutil.ReadFile(filepath.Join(dmDir, "uuid"))
+		if err != nil || !strings.HasPrefix(string(uuid), "CRYPT-LUKS") {
+			continue
+		}
+
+		// mappings which are mounted or held by another device are in use
+		if mountedDevices[entry.Name()] {
+			continue
+		}
+		holders, _ := ioutil.ReadDir(filepath.Join(sysBlockPath, entry.Name(), "holders"))
+		if len(holders) > 0 {
+			continue
+		}
+
+		name, err := ioutil.ReadFile(filepath.Join(dmDir, "name"))
+		if err != nil {
+			continue
+		}
+
+		if isStale(mounter.BackingDevices(sysBlockPath, "/dev/"+entry.Name()), serials, attached) {
+			names = append(names, strings.TrimSpace(string(name)))
+		}
+	}
+	return names
+}
+
+// cleanupStaleVolumes tears down staging mounts and luks mappings that were
+// left behind, e.g. after the node plugin crashed while kubelet unstaged and
+// detached a volume. It is run once when the driver starts.
+func (d *Driver) cleanupStaleVolumes(ctx context.Context) {
+	ll := d.log.WithField("method", "cleanup_stale_volumes")
+
+	// without the API, only volumes whose device is gone are detected
+	var attached map[string]bool
+	server, err := d.cloudscaleClient.Servers.Get(ctx, d.serverId)
+	if err != nil {
+		ll.WithError(err).Warn("could not get the volumes attached to the server")
+	} else {
+		attached = map[string]bool{}
+		for _, vol := range server.Volumes {
+			if len(vol.UUID) >= 20 {
+				attached[vol.UUID[:20]] = true
+			}
+		}
+	}
+
+	serials := mounter.VolumeSerials(mounter.DiskIDPath)
+
+	mountPoints, err := mount.New("").List()
+	if err != nil {
+		ll.WithError(err).Error("failed to list mounts")
+		return
+	}
+
+	mounted := map[string]bool{}
+	for _, mp := range mountPoints {
+		if !strings.HasPrefix(mp.Device, "/dev/") || !isStagingTargetPath(d.orchestrator, mp.Path) || mounted[mp.Path] {
+			continue
+		}
+		mounted[mp.Path] = true
+
+		if !isStale(mounter.BackingDevices(mounter.SysClassBlockPath, mp.Device), serials, attached) {
+			continue
+		}
+
+		ll := ll.WithFields(logrus.Fields{
+			"staging_target_path": mp.Path,
+			"source":              mp.Device,
+		})
+		ll.Warn("unmounting stale staging mount")
+		// closes the luks mapping of the mount as well
+		err := d.mounter.Unmount(ctx, mp.Path, mounter.LuksContext{VolumeLifecycle: mounter.VolumeLifecycleNodeUnstageVolume})
+		if err != nil {
+			ll.WithError(err).Error("failed to unmount stale staging mount")
+		}
+	}
+
+	mountPoints, err = mount.New("").List()
+	if err != nil {
+		ll.WithError(err).Error("failed to list mounts")
+		return
+	}
+	mountedDevices := map[string]bool{}
+	for _, mp := range mountPoints {
+		if device, err := filepath.EvalSymlinks(mp.Device); err == nil {
+			mountedDevices[filepath.Base(device)] = true
+		}
+	}
+
+	for _, name := range staleLuksMappings(mounter.SysClassBlockPath, mountedDevices, serials, attached) {
+		ll.WithField("luks_mapping", name).Warn("closing stale luks mapping")
+		if err := mounter.LuksClose(ctx, name, ll); err != nil {
+			ll.WithError(err).WithField("luks_mapping", name).Error("failed to close stale luks mapping")
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsStale(t *testing.T) {
+	devices := t.TempDir()
+	sdb := filepath.Join(devices, "sdb")
+	sdc := filepath.Join(devices, "sdc")
+	assert.NoError(t, ioutil.WriteFile(sdb, nil, 0644))
+	assert.NoError(t, ioutil.WriteFile(sdc, nil, 0644))
+
+	serials := map[string]string{sdb: "2f2e7b8a-4b5f-4d9c-9"}
+
+	assert.False(t, isStale([]string{sdb}, serials, map[string]bool{"2f2e7b8a-4b5f-4d9c-9": true}))
+	assert.True(t, isStale([]string{sdb}, serials, map[string]bool{}))
+	assert.False(t, isStale([]string{sdb}, serials, nil), "attached volumes are unknown")
+	assert.False(t, isStale([]string{sdc}, serials, map[string]bool{}), "unknown devices are never stale")
+	assert.True(t, isStale([]string{filepath.Join(devices, "sdd")}, serials, nil), "missing devices are stale")
+}
+
+func TestStaleLuksMappings(t *testing.T) {
+	sysBlock := t.TempDir()
+
+	mkdev := func(name, uuid, dmName string, holders ...string) {
+		dmDir := filepath.Join(sysBlock, name, "dm")
+		assert.NoError(t, os.MkdirAll(dmDir, 0755))
+		assert.NoError(t, os.MkdirAll(filepath.Join(sysBlock, name, "holders"), 0755))
+		assert.NoError(t, os.MkdirAll(filepath.Join(sysBlock, name, "slaves", "sd-detached"), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dmDir, "uuid"), []byte(uuid+"\n"), 0644))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dmDir, "name"), []byte(dmName+"\n"), 0644))
+		for _, holder := range holders {
+			assert.NoError(t, os.MkdirAll(filepath.Join(sysBlock, name, "holders", holder), 0755))
+		}
+	}
+
+	// the backing devices of the test mappings do not exist, so all mappings
+	// are stale unless they are in use
+	mkdev("dm-0", "CRYPT-LUKS2-abc-pvc-1", "pvc-1")
+	mkdev("dm-1", "CRYPT-LUKS2-abc-pvc-2", "pvc-2")
+	mkdev("dm-2", "CRYPT-LUKS2-abc-pvc-3", "pvc-3", "dm-4")
+	mkdev("dm-3", "mpath-3600", "mpatha")
+
+	names := staleLuksMappings(sysBlock, map[string]bool{"dm-1": true}, nil, nil)
+	assert.Equal(t, []string{"pvc-1"}, names)
+}
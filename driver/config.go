@@ -0,0 +1,243 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+// configPollInterval defines how often the config file is checked for changes.
+// The file is polled instead of watched, as ConfigMaps are updated by
+// replacing a symlink, which is easy to miss with inotify.
+const configPollInterval = 10 * time.Second
+
+// Config contains the driver options that can be set in the config file,
+// which are a subset of the options of the driver; the others can only be set
+// with flags. Unset fields leave the corresponding option unchanged.
+type Config struct {
+	// Endpoint is the CSI endpoint; see WithEndpoint
+	Endpoint string `json:"endpoint,omitempty"`
+	// APIURL is the URL of the cloudscale.ch API; see WithAPIURL
+	APIURL string `json:"apiURL,omitempty"`
+	// ServerID is the UUID of the server; see WithServerID
+	ServerID string `json:"serverID,omitempty"`
+	// Zone is the zone of the server; see WithZone
+	Zone string `json:"zone,omitempty"`
+
+	// MaxVolumesPerNode is reloadable; see WithMaxVolumesPerNode
+	MaxVolumesPerNode *int64 `json:"maxVolumesPerNode,omitempty"`
+	// PublishMountOptions is reloadable; see WithPublishMountOptions
+	PublishMountOptions []string `json:"publishMountOptions,omitempty"`
+
+	// FstrimInterval enables periodic fstrim; see WithFstrimInterval
+	FstrimInterval *Duration `json:"fstrimInterval,omitempty"`
+	// DeviceWaitTimeout see WithDeviceWaitTimeout
+	DeviceWaitTimeout *Duration `json:"deviceWaitTimeout,omitempty"`
+	// DebugAddr is the address of the debug endpoint; see WithDebugAddr
+	DebugAddr string `json:"debugAddr,omitempty"`
+	// LuksHeaderAddr is the address of the luks header endpoint; see
+	// WithLuksHeaderAddr
+	LuksHeaderAddr string `json:"luksHeaderAddr,omitempty"`
+
+	// Features enables or disables optional behavior of the driver
+	Features Features `json:"features,omitempty"`
+}
+
+// Features are the feature gates of the driver.
+type Features struct {
+	// CleanupOnStart see WithCleanupOnStart
+	CleanupOnStart *bool `json:"cleanupOnStart,omitempty"`
+}
+
+// Duration is a time.Duration that is given as a string like "1h30m" in the
+// config file.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses the duration from a string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s, must be a string like \"1h30m\"", b)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// MarshalJSON formats the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+// LoadConfig reads the YAML config file at the given path. Unknown fields are
+// rejected to catch typos.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file failed: %v", err)
+	}
+	return parseConfig(data)
+}
+
+func parseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config file failed: %v", err)
+	}
+	if cfg.MaxVolumesPerNode != nil && *cfg.MaxVolumesPerNode < 0 {
+		return nil, fmt.Errorf("maxVolumesPerNode must not be negative")
+	}
+	if err := validatePublishMountOptions(cfg.PublishMountOptions); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Options returns the driver options for the fields set in the config.
+func (c *Config) Options() []Option {
+	var opts []Option
+	if c.Endpoint != "" {
+		opts = append(opts, WithEndpoint(c.Endpoint))
+	}
+	if c.APIURL != "" {
+		opts = append(opts, WithAPIURL(c.APIURL))
+	}
+	if c.ServerID != "" {
+		opts = append(opts, WithServerID(c.ServerID))
+	}
+	if c.Zone != "" {
+		opts = append(opts, WithZone(c.Zone))
+	}
+	if c.MaxVolumesPerNode != nil {
+		opts = append(opts, WithMaxVolumesPerNode(*c.MaxVolumesPerNode))
+	}
+	if c.PublishMountOptions != nil {
+		opts = append(opts, WithPublishMountOptions(c.PublishMountOptions))
+	}
+	if c.FstrimInterval != nil {
+		opts = append(opts, WithFstrimInterval(c.FstrimInterval.Duration))
+	}
+	if c.DeviceWaitTimeout != nil {
+		opts = append(opts, WithDeviceWaitTimeout(c.DeviceWaitTimeout.Duration))
+	}
+	if c.DebugAddr != "" {
+		opts = append(opts, WithDebugAddr(c.DebugAddr))
+	}
+	if c.LuksHeaderAddr != "" {
+		opts = append(opts, WithLuksHeaderAddr(c.LuksHeaderAddr))
+	}
+	if c.Features.CleanupOnStart != nil {
+		opts = append(opts, WithCleanupOnStart(*c.Features.CleanupOnStart))
+	}
+	return opts
+}
+
+// staticFieldsChanged returns the names of the fields that differ between the
+// configs and cannot be applied without restarting the driver.
+func staticFieldsChanged(old, cfg *Config) []string {
+	var changed []string
+	oldValue := reflect.ValueOf(*old)
+	newValue := reflect.ValueOf(*cfg)
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		switch field.Name {
+		case "MaxVolumesPerNode", "PublishMountOptions":
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, field.Name)
+		}
+	}
+	return changed
+}
+
+// applyConfig applies the reloadable settings of the config to the driver.
+// Settings which are not set in the config revert to their defaults.
+func (d *Driver) applyConfig(cfg *Config) {
+	d.settingsMu.Lock()
+	defer d.settingsMu.Unlock()
+
+	d.maxVolumesPerNode = d.defaultMaxVolumesPerNode
+	if cfg.MaxVolumesPerNode != nil {
+		d.maxVolumesPerNode = *cfg.MaxVolumesPerNode
+	}
+	d.publishMountOptions = d.defaultPublishMountOptions
+	if cfg.PublishMountOptions != nil {
+		d.publishMountOptions = cfg.PublishMountOptions
+	}
+}
+
+// watchConfig reloads the config file whenever its content changes until the
+// stop channel is closed. Invalid configs are logged and ignored.
+func (d *Driver) watchConfig(path string, cfg *Config, interval time.Duration, stop <-chan struct{}) {
+	ll := d.log.WithFields(logrus.Fields{
+		"method":      "watch_config",
+		"config_file": path,
+	})
+
+	last, err := ioutil.ReadFile(path)
+	if err != nil {
+		ll.WithError(err).Warn("failed to read config file")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			ll.WithError(err).Warn("failed to read config file")
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+
+		newCfg, err := parseConfig(data)
+		if err != nil {
+			ll.WithError(err).Error("ignoring invalid config file")
+			continue
+		}
+
+		if changed := staticFieldsChanged(cfg, newCfg); len(changed) > 0 {
+			ll.WithField("fields", changed).Warn("config changes require a restart of the driver")
+		}
+		d.applyConfig(newCfg)
+		cfg = newCfg
+		ll.Info("config file reloaded")
+	}
+}
@@ -0,0 +1,114 @@
+package driver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+zone: lpg1
+maxVolumesPerNode: 20
+publishMountOptions: [nodev, nosuid]
+fstrimInterval: 24h
+features:
+  cleanupOnStart: false
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "lpg1", cfg.Zone)
+	assert.Equal(t, int64(20), *cfg.MaxVolumesPerNode)
+	assert.Equal(t, []string{"nodev", "nosuid"}, cfg.PublishMountOptions)
+	assert.Equal(t, 24*time.Hour, cfg.FstrimInterval.Duration)
+	assert.Nil(t, cfg.DeviceWaitTimeout)
+	assert.False(t, *cfg.Features.CleanupOnStart)
+
+	o := &options{cleanupOnStart: true}
+	for _, opt := range cfg.Options() {
+		opt(o)
+	}
+	assert.Equal(t, "lpg1", o.zone)
+	assert.Equal(t, int64(20), o.maxVolumesPerNode)
+	assert.Equal(t, 24*time.Hour, o.fstrimInterval)
+	assert.False(t, o.cleanupOnStart)
+	assert.Equal(t, "", o.endpoint)
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"unknown field":         "maxVolumes: 20",
+		"invalid duration":      "fstrimInterval: 24",
+		"negative max volumes":  "maxVolumesPerNode: -1",
+		"invalid mount options": "publishMountOptions: [rw]",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseConfig([]byte(data))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestStaticFieldsChanged(t *testing.T) {
+	old, err := parseConfig([]byte("zone: lpg1\nmaxVolumesPerNode: 20"))
+	assert.NoError(t, err)
+	cfg, err := parseConfig([]byte("zone: rma1\nmaxVolumesPerNode: 10\nfeatures: {cleanupOnStart: true}"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"Zone", "Features"}, staticFieldsChanged(old, cfg))
+	assert.Empty(t, staticFieldsChanged(old, old))
+}
+
+func TestWatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("maxVolumesPerNode: 20"), 0644))
+	cfg, err := LoadConfig(path)
+	assert.NoError(t, err)
+
+	d := &Driver{log: logrus.NewEntry(logrus.New())}
+	d.applyConfig(cfg)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go d.watchConfig(path, cfg, 10*time.Millisecond, stop)
+
+	maxVolumes := func() int64 {
+		d.settingsMu.RLock()
+		defer d.settingsMu.RUnlock()
+		return d.maxVolumesPerNode
+	}
+	assert.Equal(t, int64(20), maxVolumes())
+
+	// invalid configs are ignored
+	assert.NoError(t, ioutil.WriteFile(path, []byte("maxVolumesPerNode: -1"), 0644))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(20), maxVolumes())
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("maxVolumesPerNode: 10\npublishMountOptions: [noexec]"), 0644))
+	assert.Eventually(t, func() bool { return maxVolumes() == 10 }, time.Second, 10*time.Millisecond)
+
+	d.settingsMu.RLock()
+	assert.Equal(t, []string{"noexec"}, d.publishMountOptions)
+	d.settingsMu.RUnlock()
+}
+
+func TestConfigRemovedSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("maxVolumesPerNode: 20\npublishMountOptions: [noexec]"), 0644))
+
+	// the config file takes precedence over the other options
+	d, err := NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()),
+		WithMaxVolumesPerNode(10), WithPublishMountOptions([]string{"nodev"}), WithConfigFile(path))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), d.maxVolumesPerNode)
+	assert.Equal(t, []string{"noexec"}, d.publishMountOptions)
+
+	// settings removed from the file revert to the other options
+	d.applyConfig(&Config{})
+	assert.Equal(t, int64(10), d.maxVolumesPerNode)
+	assert.Equal(t, []string{"nodev"}, d.publishMountOptions)
+}
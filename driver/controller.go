@@ -19,6 +19,7 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
@@ -53,8 +54,22 @@ const (
 	// `ControllerPublishVolume` to `NodeStageVolume or `NodePublishVolume`
 	PublishInfoVolumeName = DriverName + "/volume-name"
 
+	// PublishInfoVolumeSize passes the size of the volume in bytes to
+	// `NodeStageVolume`, which verifies the device before formatting it
+	PublishInfoVolumeSize = DriverName + "/volume-size"
+
 	// Storage type of the volume, must be either "ssd" or "bulk"
 	StorageTypeAttribute = DriverName + "/volume-type"
+
+	// RoundingPolicyAttribute defines how a requested size that is not a
+	// multiple of the size increment of the volume type is handled; either
+	// "round-up" (the default) or "error". "roundUp" is accepted as well, as
+	// the values of Kubernetes API fields are camel case.
+	RoundingPolicyAttribute = DriverName + "/rounding-policy"
+
+	roundingPolicyRoundUp      = "round-up"
+	roundingPolicyRoundUpCamel = "roundUp"
+	roundingPolicyError        = "error"
 )
 
 var (
@@ -65,6 +80,10 @@ var (
 		Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 	}
 
+	// supportedFsTypes are the filesystems the node plugin can format and
+	// resize; an empty fstype defaults to ext4
+	supportedFsTypes = sets.NewString("btrfs", "ext3", "ext4", "xfs")
+
 	// maxVolumesPerServerErrorMessage is the error message returned by the cloudscale.ch
 	// API when the per-server volume limit would be exceeded.
 	maxVolumesPerServerErrorMessageRe = regexp.MustCompile("Due to internal limitations, it is currently not possible to attach more than \\d+ volumes")
@@ -87,7 +106,11 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 
 	if req.AccessibilityRequirements != nil {
 		for _, t := range req.AccessibilityRequirements.Requisite {
+			// the segment of created volumes or the one reported by NodeGetInfo
 			zone, ok := t.Segments["zone"]
+			if !ok {
+				zone, ok = t.Segments[topologyZoneKey]
+			}
 			if !ok {
 				continue // nothing to do
 			}
@@ -111,6 +134,45 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	switch roundingPolicy := req.Parameters[RoundingPolicyAttribute]; roundingPolicy {
+	case "", roundingPolicyRoundUp, roundingPolicyRoundUpCamel:
+	case roundingPolicyError:
+		if err := checkSizeNotRounded(req.CapacityRange, storageType, sizeGB); err != nil {
+			return nil, status.Error(codes.OutOfRange, err.Error())
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid rounding policy %q, must be %q or %q", roundingPolicy, roundingPolicyRoundUp, roundingPolicyError)
+	}
+
+	ext4Params := map[string]string{}
+	for _, key := range ext4Attributes {
+		if value := req.Parameters[key]; value != "" {
+			ext4Params[key] = value
+		}
+	}
+	// the auto profile is resolved here, as the node does not know the type
+	// and size of the volume
+	ext4Profile, err := resolveExt4Profile(ext4Params[Ext4ProfileAttribute], storageType, sizeGB)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if ext4Profile != "" {
+		ext4Params[Ext4ProfileAttribute] = ext4Profile
+	}
+	if _, err := ext4MkfsOptions(ext4Params); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := ext4MountOptions(ext4Params); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if _, err := parseMountOwnership(req.Parameters); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := parseBlockOwnership(req.Parameters); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	volumeName := req.Name
 
 	luksEncrypted := "false"
@@ -121,7 +183,19 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		luksEncrypted = "true"
 	}
 
-	ll := d.log.WithFields(logrus.Fields{
+	eraseMode := req.Parameters[EraseOnDeleteAttribute]
+	if eraseMode != "" {
+		if err := validateEraseMode(eraseMode, luksEncrypted == "true"); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	deletionPolicy := req.Parameters[DeletionPolicyAttribute]
+	if err := validateDeletionPolicy(deletionPolicy, eraseMode); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	ll := d.logFor(ctx).WithFields(logrus.Fields{
 		"volume_name":             volumeName,
 		"storage_size_giga_bytes": sizeGB,
 		"method":                  "create_volume",
@@ -132,20 +206,13 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	ll.Info("create volume called")
 
 	// get volume first, if it's created do no thing
-	volumes, err := d.cloudscaleClient.Volumes.List(ctx, cloudscale.WithNameFilter(volumeName))
+	existing, err := d.findVolumeByName(ctx, volumeName)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
 
 	csiVolume := csi.Volume{
 		CapacityBytes: int64(sizeGB) * GB,
-		AccessibleTopology: []*csi.Topology{
-			{
-				Segments: map[string]string{
-					"zone": d.zone,
-				},
-			},
-		},
 		VolumeContext: map[string]string{
 			PublishInfoVolumeName:  volumeName,
 			LuksEncryptedAttribute: luksEncrypted,
@@ -157,12 +224,30 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		csiVolume.VolumeContext[LuksKeySizeAttribute] = req.Parameters[LuksKeySizeAttribute]
 	}
 
-	// volume already exist, do nothing
-	if len(volumes) != 0 {
-		if len(volumes) > 1 {
-			return nil, fmt.Errorf("fatal issue: duplicate volume %q exists", volumeName)
+	if req.Parameters[DiscardAttribute] == "true" {
+		csiVolume.VolumeContext[DiscardAttribute] = "true"
+	}
+	if req.Parameters[DiscardBeforeFormatAttribute] == "true" {
+		csiVolume.VolumeContext[DiscardBeforeFormatAttribute] = "true"
+	}
+	for key, value := range ext4Params {
+		csiVolume.VolumeContext[key] = value
+	}
+	for _, key := range ownershipAttributes {
+		if value := req.Parameters[key]; value != "" {
+			csiVolume.VolumeContext[key] = value
 		}
-		vol := volumes[0]
+	}
+	// the claim labels the metrics of the volume on the node
+	for _, key := range []string{pvcNameKey, pvcNamespaceKey} {
+		if value := req.Parameters[key]; value != "" {
+			csiVolume.VolumeContext[key] = value
+		}
+	}
+
+	// volume already exist, do nothing
+	if existing != nil {
+		vol := existing
 
 		if vol.SizeGB != sizeGB {
 			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("invalid option requested size: %d", sizeGB))
@@ -170,6 +255,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 
 		ll.Info("volume already created")
 		csiVolume.VolumeId = vol.UUID
+		csiVolume.AccessibleTopology = d.volumeTopology(vol)
 		return &csi.CreateVolumeResponse{Volume: &csiVolume}, nil
 	}
 
@@ -179,14 +265,28 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		Type:   storageType,
 	}
 	volumeReq.Zone = d.zone
+	volumeReq.Tags = cloudscale.TagMap{managedByTag: managedByTagValue}
+	if eraseMode != "" {
+		volumeReq.Tags[eraseOnDeleteTag] = eraseMode
+	}
+	if deletionPolicy == deletionPolicyDetach {
+		volumeReq.Tags[deletionPolicyTag] = deletionPolicy
+	}
 
 	ll.WithField("volume_req", volumeReq).Info("creating volume")
 	vol, err := d.cloudscaleClient.Volumes.Create(ctx, volumeReq)
 	if err != nil {
+		if !isDefiniteFailure(err) {
+			// the volume might have been created, the retry has to look
+			// it up in the API
+			d.volumeIndex.invalidate()
+		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	d.volumeIndex.add(volumeName, vol.UUID)
 
 	csiVolume.VolumeId = vol.UUID
+	csiVolume.AccessibleTopology = d.volumeTopology(vol)
 	resp := &csi.CreateVolumeResponse{Volume: &csiVolume}
 
 	ll.WithField("response", resp).Info("volume created")
@@ -199,13 +299,40 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 		return nil, status.Error(codes.InvalidArgument, "DeleteVolume Volume ID must be provided")
 	}
 
-	ll := d.log.WithFields(logrus.Fields{
+	ll := d.logFor(ctx).WithFields(logrus.Fields{
 		"volume_id": req.VolumeId,
 		"method":    "delete_volume",
 	})
 	ll.Info("delete volume called")
 
-	err := d.cloudscaleClient.Volumes.Delete(ctx, req.VolumeId)
+	// the volume is never deleted without knowing its tags, as they decide
+	// whether it is retained or erased first
+	vol, err := d.cloudscaleClient.Volumes.Get(ctx, req.VolumeId)
+	if err != nil {
+		var errResp *cloudscale.ErrorResponse
+		if errors.As(err, &errResp) && errResp.StatusCode == http.StatusNotFound {
+			// To make it idempotent, the volume might already have been
+			// deleted, so a 404 is ok.
+			ll.WithError(err).Warn("assuming volume is already deleted")
+			d.volumeIndex.remove(req.VolumeId)
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if vol.Tags[deletionPolicyTag] == deletionPolicyDetach {
+		if err := d.releaseVolume(ctx, vol, ll); err != nil {
+			return nil, err
+		}
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	if vol.Tags[eraseOnDeleteTag] != "" {
+		if err := d.eraseVolume(ctx, vol, ll); err != nil {
+			return nil, err
+		}
+	}
+
+	err = d.cloudscaleClient.Volumes.Delete(ctx, req.VolumeId)
 	if err != nil {
 		errorResponse, ok := err.(*cloudscale.ErrorResponse)
 		if ok {
@@ -216,16 +343,64 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 					"error": err,
 					"resp":  errorResponse,
 				}).Warn("assuming volume is already deleted")
+				d.volumeIndex.remove(req.VolumeId)
 				return &csi.DeleteVolumeResponse{}, nil
 			}
 		}
 		return nil, err
 	}
 
+	d.volumeIndex.remove(req.VolumeId)
+
 	ll.Info("volume is deleted")
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// volumeTopology returns the topology of the given volume, which is the zone
+// the API reports for the volume rather than the zone of the controller. The
+// zone of the controller is only used if the API does not report one.
+func (d *Driver) volumeTopology(vol *cloudscale.Volume) []*csi.Topology {
+	zone := vol.Zone.Slug
+	if zone == "" {
+		zone = d.zone
+	}
+	return []*csi.Topology{
+		{
+			Segments: map[string]string{
+				volumeTopologyKey(d.orchestrator): zone,
+			},
+		},
+	}
+}
+
+// findVolumeByName returns the volume with the given name or nil if there is
+// none. The volume is looked up in the index of the volume names and then
+// fetched, so that the API does not have to be queried for unknown names.
+func (d *Driver) findVolumeByName(ctx context.Context, name string) (*cloudscale.Volume, error) {
+	volumeIDs, err := d.volumeIndex.lookup(ctx, d.cloudscaleClient.Volumes, name)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if len(volumeIDs) > 1 {
+		return nil, fmt.Errorf("fatal issue: duplicate volume %q exists", name)
+	}
+
+	for _, volumeID := range volumeIDs {
+		vol, err := d.cloudscaleClient.Volumes.Get(ctx, volumeID)
+		if err != nil {
+			var errResp *cloudscale.ErrorResponse
+			if errors.As(err, &errResp) && errResp.StatusCode == http.StatusNotFound {
+				// deleted outside of the driver
+				d.volumeIndex.remove(volumeID)
+				return nil, nil
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return vol, nil
+	}
+	return nil, nil
+}
+
 // ControllerPublishVolume attaches the given volume to the node
 func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	if req.VolumeId == "" {
@@ -248,17 +423,23 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		return nil, status.Error(codes.AlreadyExists, "read only Volumes are not supported")
 	}
 
-	ll := d.log.WithFields(logrus.Fields{
+	ll := d.logFor(ctx).WithFields(logrus.Fields{
 		"volume_id": req.VolumeId,
 		"node_id":   req.NodeId,
 		"method":    "controller_publish_volume",
 	})
 	ll.Info("controller publish volume called")
 
+	volume, err := d.cloudscaleClient.Volumes.Get(ctx, req.VolumeId)
+	if err != nil {
+		return nil, reraiseNotFound(err, ll, "fetch volume")
+	}
+
 	attachRequest := &cloudscale.VolumeRequest{
 		ServerUUIDs: &[]string{req.NodeId},
 	}
-	err := d.cloudscaleClient.Volumes.Update(ctx, req.VolumeId, attachRequest)
+	addAttachHistory(attachRequest, volume, attachOperation, []string{req.NodeId})
+	err = d.cloudscaleClient.Volumes.Update(ctx, req.VolumeId, attachRequest)
 	if err != nil {
 		if maxVolumesPerServerErrorMessageRe.MatchString(err.Error()) {
 			return nil, status.Errorf(codes.ResourceExhausted, err.Error())
@@ -268,13 +449,11 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 	}
 
 	ll.Info("volume is attached")
-	volume, err := d.cloudscaleClient.Volumes.Get(ctx, req.VolumeId)
-	if err != nil {
-		return nil, reraiseNotFound(err, ll, "fetch volume")
-	}
+
 	return &csi.ControllerPublishVolumeResponse{
 		PublishContext: map[string]string{
 			PublishInfoVolumeName:  volume.Name,
+			PublishInfoVolumeSize:  strconv.FormatInt(int64(volume.SizeGB)*GB, 10),
 			LuksEncryptedAttribute: req.VolumeContext[LuksEncryptedAttribute],
 			LuksCipherAttribute:    req.VolumeContext[LuksCipherAttribute],
 			LuksKeySizeAttribute:   req.VolumeContext[LuksKeySizeAttribute],
@@ -288,7 +467,7 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume ID must be provided")
 	}
 
-	ll := d.log.WithFields(logrus.Fields{
+	ll := d.logFor(ctx).WithFields(logrus.Fields{
 		"volume_id": req.VolumeId,
 		"node_id":   req.NodeId,
 		"method":    "controller_unpublish_volume",
@@ -296,7 +475,7 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 	ll.Info("controller unpublish volume called")
 
 	// check if volume exist before trying to detach it
-	_, err := d.cloudscaleClient.Volumes.Get(ctx, req.VolumeId)
+	volume, err := d.cloudscaleClient.Volumes.Get(ctx, req.VolumeId)
 	if err != nil {
 		errorResponse, ok := err.(*cloudscale.ErrorResponse)
 		if ok {
@@ -308,9 +487,21 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 		return nil, err
 	}
 
+	// the node ID is optional, the volume is detached from all servers if
+	// it's empty
+	var detached []string
+	if volume.ServerUUIDs != nil {
+		for _, serverUUID := range *volume.ServerUUIDs {
+			if req.NodeId == "" || req.NodeId == serverUUID {
+				detached = append(detached, serverUUID)
+			}
+		}
+	}
+
 	detachRequest := &cloudscale.VolumeRequest{
 		ServerUUIDs: &[]string{},
 	}
+	addAttachHistory(detachRequest, volume, detachOperation, detached)
 	err = d.cloudscaleClient.Volumes.Update(ctx, req.VolumeId, detachRequest)
 	if err != nil {
 		return nil, reraiseNotFound(err, ll, "unpublish volume")
@@ -331,7 +522,7 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume Capabilities must be provided")
 	}
 
-	ll := d.log.WithFields(logrus.Fields{
+	ll := d.logFor(ctx).WithFields(logrus.Fields{
 		"volume_id":              req.VolumeId,
 		"volume_capabilities":    req.VolumeCapabilities,
 		"supported_capabilities": supportedAccessMode,
@@ -372,24 +563,29 @@ func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 		return nil, status.Errorf(codes.Aborted, "pagination not supported")
 	}
 
-	ll := d.log.WithFields(logrus.Fields{
+	ll := d.logFor(ctx).WithFields(logrus.Fields{
 		"req_starting_token": req.StartingToken,
 		"method":             "list_volumes",
 	})
 	ll.Info("list volumes called")
 
-	volumes, err := d.cloudscaleClient.Volumes.List(ctx)
+	volumes, err := listAllVolumes(ctx, d.cloudscaleClient.Volumes)
 	if err != nil {
 		return nil, err
 	}
 
 	var entries []*csi.ListVolumesResponse_Entry
 	for _, vol := range volumes {
+		publishedNodes, condition := volumeStatus(&vol)
 		entries = append(entries, &csi.ListVolumesResponse_Entry{
 			Volume: &csi.Volume{
 				VolumeId:      vol.UUID,
 				CapacityBytes: int64(vol.SizeGB * GB),
 			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: publishedNodes,
+				VolumeCondition:  condition,
+			},
 		})
 	}
 
@@ -404,7 +600,7 @@ func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 // GetCapacity returns the capacity of the storage pool
 func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
 	// TODO(arslan): check if we can provide this information somehow
-	d.log.WithFields(logrus.Fields{
+	d.logFor(ctx).WithFields(logrus.Fields{
 		"params": req.Parameters,
 		"method": "get_capacity",
 	}).Warn("get capacity is not implemented")
@@ -430,6 +626,9 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 
 		// TODO(arslan): enable once snapshotting is supported
 		// csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
@@ -445,7 +644,7 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 		Capabilities: caps,
 	}
 
-	d.log.WithFields(logrus.Fields{
+	d.logFor(ctx).WithFields(logrus.Fields{
 		"response": resp,
 		"method":   "controller_get_capabilities",
 	}).Info("controller get capabilities called")
@@ -455,7 +654,7 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 // CreateSnapshot will be called by the CO to create a new snapshot from a
 // source volume on behalf of a user.
 func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	d.log.WithFields(logrus.Fields{
+	d.logFor(ctx).WithFields(logrus.Fields{
 		"req":    req,
 		"method": "create_snapshot",
 	}).Warn("create snapshot is not implemented")
@@ -464,7 +663,7 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 
 // DeleteSnapshost will be called by the CO to delete a snapshot.
 func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	d.log.WithFields(logrus.Fields{
+	d.logFor(ctx).WithFields(logrus.Fields{
 		"req":    req,
 		"method": "delete_snapshot",
 	}).Warn("delete snapshot is not implemented")
@@ -476,7 +675,7 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 // ListSnapshots shold not list a snapshot that is being created but has not
 // been cut successfully yet.
 func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	d.log.WithFields(logrus.Fields{
+	d.logFor(ctx).WithFields(logrus.Fields{
 		"req":    req,
 		"method": "list_snapshots",
 	}).Warn("list snapshots is not implemented")
@@ -500,7 +699,7 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 		return nil, status.Errorf(codes.OutOfRange, "ControllerExpandVolume invalid capacity range: %v", err)
 	}
 
-	log := d.log.WithFields(logrus.Fields{
+	log := d.logFor(ctx).WithFields(logrus.Fields{
 		"volume_id": req.VolumeId,
 		"method":    "controller_expand_volume",
 	})
@@ -512,9 +711,13 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 			"current_volume_size":   volume.SizeGB,
 			"requested_volume_size": resizeGigaBytes,
 		}).Info("skipping volume resize because current volume size exceeds requested volume size")
+		d.metrics.addExpandSkipped()
+		d.recordClaimEvent(ctx, volume, expandSkippedReason, fmt.Sprintf(
+			"The volume is not resized as it has %s already, which is not less than the requested %s. The capacity of the claim is set to the size of the volume.",
+			formatBytes(int64(volume.SizeGB)*GB), formatBytes(int64(resizeGigaBytes)*GB)), log)
 		// even if the volume is resized independently from the control panel, we still need to resize the node fs when resize is requested
 		// in this case, the claim capacity will be resized to the volume capacity, requested capcity will be ignored to make the PV and PVC capacities consistent
-		return &csi.ControllerExpandVolumeResponse{CapacityBytes: int64(volume.SizeGB) * GB, NodeExpansionRequired: true}, nil
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: int64(volume.SizeGB) * GB, NodeExpansionRequired: nodeExpansionRequired(req.GetVolumeCapability(), log)}, nil
 	}
 
 	volumeReq := &cloudscale.VolumeRequest{
@@ -528,24 +731,69 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 	log = log.WithField("new_volume_size", resizeGigaBytes)
 	log.Info("volume was resized")
 
-	nodeExpansionRequired := true
-	if req.GetVolumeCapability() != nil {
-		switch req.GetVolumeCapability().GetAccessType().(type) {
-		case *csi.VolumeCapability_Block:
-			log.Info("node expansion is not required for block volumes")
-			nodeExpansionRequired = false
-		}
-	}
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: int64(resizeGigaBytes) * GB, NodeExpansionRequired: nodeExpansionRequired(req.GetVolumeCapability(), log)}, nil
+}
 
-	return &csi.ControllerExpandVolumeResponse{CapacityBytes: int64(resizeGigaBytes) * GB, NodeExpansionRequired: nodeExpansionRequired}, nil
+// nodeExpansionRequired returns false for block volumes, which are used as
+// they are, without a filesystem or luks mapping to be grown on the node
+func nodeExpansionRequired(capability *csi.VolumeCapability, log *logrus.Entry) bool {
+	if _, ok := capability.GetAccessType().(*csi.VolumeCapability_Block); ok {
+		log.Info("node expansion is not required for block volumes")
+		return false
+	}
+	return true
 }
 
-// ControllerGetVolume gets a specific volume.
-// The call is used for the CSI health check feature
-// (https://github.com/kubernetes/enhancements/pull/1077) which we do not
-// support yet.
+// ControllerGetVolume gets a specific volume with the nodes it is published
+// to and its condition. The call is used by the external-health-monitor for
+// the volume health monitoring
+// (https://github.com/kubernetes/enhancements/pull/1077), a volume missing in
+// the cloudscale.ch API is reported with NotFound.
 func (d *Driver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume Volume ID must be provided")
+	}
+
+	ll := d.logFor(ctx).WithFields(logrus.Fields{
+		"volume_id": req.VolumeId,
+		"method":    "controller_get_volume",
+	})
+	ll.Info("controller get volume called")
+
+	vol, err := d.cloudscaleClient.Volumes.Get(ctx, req.VolumeId)
+	if err != nil {
+		return nil, reraiseNotFound(err, ll, "getting volume")
+	}
+
+	publishedNodes, condition := volumeStatus(vol)
+	resp := &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      vol.UUID,
+			CapacityBytes: int64(vol.SizeGB * GB),
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodes,
+			VolumeCondition:  condition,
+		},
+	}
+
+	ll.WithField("response", resp).Info("volume is found")
+	return resp, nil
+}
+
+// volumeStatus returns the servers the volume is attached to and its
+// condition, which the external-health-monitor reports on the PVC. The
+// cloudscale.ch API has no health of volumes, so every existing volume is
+// normal; a deleted volume fails ControllerGetVolume with NotFound instead.
+func volumeStatus(vol *cloudscale.Volume) ([]string, *csi.VolumeCondition) {
+	var publishedNodes []string
+	if vol.ServerUUIDs != nil {
+		publishedNodes = *vol.ServerUUIDs
+	}
+	return publishedNodes, &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "volume exists",
+	}
 }
 
 // calculateStorageGB extracts the storage size in GB from the given capacity
@@ -596,6 +844,24 @@ func calculateStorageGB(capRange *csi.CapacityRange, storageType string) (int, e
 	return int(sizeGB), nil
 }
 
+// checkSizeNotRounded returns an error if the required size of the capacity
+// range was rounded up to the size increment of the volume type. The size of
+// volumes without a required size is not checked.
+func checkSizeNotRounded(capRange *csi.CapacityRange, storageType string, sizeGB int) error {
+	requiredBytes := capRange.GetRequiredBytes()
+	if requiredBytes <= 0 || requiredBytes == int64(sizeGB)*GB {
+		return nil
+	}
+
+	sizeIncrements := SSDStepSizeGB
+	if storageType == "bulk" {
+		sizeIncrements = BulkStepSizeGB
+	}
+	return fmt.Errorf("required size %v is not a multiple of %v, the size increment of type '%s', and would be rounded up to %v; request a multiple of %v or set %s to %q",
+		formatBytes(requiredBytes), formatBytes(int64(sizeIncrements)*GB), storageType, formatBytes(int64(sizeGB)*GB),
+		formatBytes(int64(sizeIncrements)*GB), RoundingPolicyAttribute, roundingPolicyRoundUp)
+}
+
 func formatBytes(inputBytes int64) string {
 	output := float64(inputBytes)
 	unit := ""
@@ -635,6 +901,10 @@ func validateCapabilities(caps []*csi.VolumeCapability) []string {
 		switch accessType.(type) {
 		case *csi.VolumeCapability_Block:
 		case *csi.VolumeCapability_Mount:
+			fsType := cap.GetMount().GetFsType()
+			if fsType != "" && !supportedFsTypes.Has(fsType) {
+				violations.Insert(fmt.Sprintf("unsupported fstype %q, supported are %s", fsType, strings.Join(supportedFsTypes.List(), ", ")))
+			}
 		default:
 			violations.Insert("unsupported access type")
 		}
@@ -1,9 +1,19 @@
 package driver
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
-	"testing"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestCalculateStorageGBEmpty(t *testing.T) {
@@ -89,3 +99,351 @@ func calcStorageGbBulk(reqGb int, limitGb int) (int, error) {
 		}
 	}
 }
+
+func TestCreateVolumeRoundingPolicy(t *testing.T) {
+	driver := createDriverForTest(t)
+
+	req := makeCreateVolumeRequest(randString(32), 10, "bulk", false)
+	req.Parameters[RoundingPolicyAttribute] = "error"
+	_, err := driver.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+	assert.Contains(t, err.Error(), "required size 10Gi is not a multiple of 100Gi")
+
+	req = makeCreateVolumeRequest(randString(32), 200, "bulk", false)
+	req.Parameters[RoundingPolicyAttribute] = "error"
+	resp, err := driver.CreateVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200*GB), resp.Volume.CapacityBytes)
+
+	for _, policy := range []string{"round-up", "roundUp"} {
+		req = makeCreateVolumeRequest(randString(32), 10, "bulk", false)
+		req.Parameters[RoundingPolicyAttribute] = policy
+		resp, err = driver.CreateVolume(context.Background(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(100*GB), resp.Volume.CapacityBytes)
+	}
+
+	req = makeCreateVolumeRequest(randString(32), 10, "bulk", false)
+	req.Parameters[RoundingPolicyAttribute] = "roundDown"
+	_, err = driver.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCreateVolumeExt4DataMode(t *testing.T) {
+	driver := createDriverForTest(t)
+
+	req := makeCreateVolumeRequest(randString(32), 100, "bulk", false)
+	req.Parameters[Ext4DataModeAttribute] = "journal"
+	req.Parameters[Ext4CommitIntervalAttribute] = "30"
+	resp, err := driver.CreateVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "journal", resp.Volume.VolumeContext[Ext4DataModeAttribute])
+	assert.Equal(t, "30", resp.Volume.VolumeContext[Ext4CommitIntervalAttribute])
+
+	req = makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.Parameters[Ext4DataModeAttribute] = "unordered"
+	_, err = driver.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCreateVolumeInvalidEraseMode(t *testing.T) {
+	driver := createDriverForTest(t)
+
+	req := makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.Parameters[EraseOnDeleteAttribute] = "shred"
+	_, err := driver.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// crypto erase is only possible for luks volumes
+	req = makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.Parameters[EraseOnDeleteAttribute] = "crypto"
+	_, err = driver.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCreateVolumeFsType(t *testing.T) {
+	driver := createDriverForTest(t)
+
+	for _, fsType := range []string{"", "ext4", "xfs", "btrfs"} {
+		req := makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+		req.VolumeCapabilities[0].GetMount().FsType = fsType
+		_, err := driver.CreateVolume(context.Background(), req)
+		assert.NoError(t, err, fsType)
+	}
+
+	// the volume must not be created, as it could not be staged
+	req := makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.VolumeCapabilities[0].GetMount().FsType = "zfs"
+	_, err := driver.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), `unsupported fstype "zfs", supported are btrfs, ext3, ext4, xfs`)
+
+	volumes, err := driver.cloudscaleClient.Volumes.List(context.Background(), cloudscale.WithNameFilter(req.Name))
+	assert.NoError(t, err)
+	assert.Empty(t, volumes)
+}
+
+func TestCreateVolumeTopology(t *testing.T) {
+	driver := createDriverForTest(t)
+	driver.zone = "rma1"
+
+	req := makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.AccessibilityRequirements = &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{{Segments: map[string]string{topologyZoneKey: "lpg1"}}},
+	}
+	_, err := driver.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	req.AccessibilityRequirements.Requisite[0].Segments[topologyZoneKey] = "rma1"
+	resp, err := driver.CreateVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"zone": "rma1"}, resp.Volume.AccessibleTopology[0].Segments)
+
+	// Nomad requires the topology of the volume to equal the one of the node
+	driver.orchestrator = OrchestratorNomad
+	req = makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	resp, err = driver.CreateVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{topologyZoneKey: "rma1"}, resp.Volume.AccessibleTopology[0].Segments)
+}
+
+func TestCreateVolumeTopologyOfVolume(t *testing.T) {
+	driver := createDriverForTest(t)
+	driver.zone = "rma1"
+	ctx := context.Background()
+
+	// a volume created in another zone, e.g. by an earlier controller
+	name := randString(32)
+	_, err := driver.cloudscaleClient.Volumes.Create(ctx, &cloudscale.VolumeRequest{
+		ZonalResourceRequest: cloudscale.ZonalResourceRequest{Zone: "lpg1"},
+		Name:                 name,
+		SizeGB:               1,
+	})
+	assert.NoError(t, err)
+
+	resp, err := driver.CreateVolume(ctx, makeCreateVolumeRequest(name, 1, "ssd", false))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"zone": "lpg1"}, resp.Volume.AccessibleTopology[0].Segments)
+
+	// the zone of the controller is used if the API reports none
+	assert.Equal(t, "rma1", driver.volumeTopology(&cloudscale.Volume{})[0].Segments["zone"])
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	serverId := "987654"
+	driver := &Driver{
+		serverId: serverId,
+		cloudscaleClient: cloudscalefake.NewClient(map[string]*cloudscale.Server{
+			serverId: {UUID: serverId},
+		}),
+		mounter: mounter.NewFake(),
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	created, err := driver.CreateVolume(ctx, makeCreateVolumeRequest(randString(32), 1, "ssd", false))
+	assert.NoError(t, err)
+	volumeID := created.Volume.VolumeId
+
+	_, err = driver.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           serverId,
+		VolumeCapability: makeVolumeCapabilityObject(false)[0],
+	})
+	assert.NoError(t, err)
+
+	resp, err := driver.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	assert.NoError(t, err)
+	assert.Equal(t, volumeID, resp.Volume.VolumeId)
+	assert.Equal(t, []string{serverId}, resp.Status.PublishedNodeIds)
+	assert.False(t, resp.Status.VolumeCondition.Abnormal)
+
+	list, err := driver.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	if assert.Len(t, list.Entries, 1) {
+		assert.Equal(t, []string{serverId}, list.Entries[0].Status.PublishedNodeIds)
+		assert.False(t, list.Entries[0].Status.VolumeCondition.Abnormal)
+	}
+
+	_, err = driver.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = driver.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestDeleteVolumeErasesVolume(t *testing.T) {
+	serverId := "987654"
+	driver := &Driver{
+		serverId: serverId,
+		cloudscaleClient: cloudscalefake.NewClient(map[string]*cloudscale.Server{
+			serverId: {UUID: serverId},
+		}),
+		mounter: mounter.NewFake(),
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	req := makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.Parameters[EraseOnDeleteAttribute] = "zero"
+	resp, err := driver.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	volumeID := resp.Volume.VolumeId
+
+	_, err = driver.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           serverId,
+		VolumeCapability: makeVolumeCapabilityObject(false)[0],
+	})
+	assert.NoError(t, err)
+	_, err = driver.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   serverId,
+	})
+	assert.NoError(t, err)
+
+	// the erase is requested from the server which last had the volume
+	deleteReq := &csi.DeleteVolumeRequest{VolumeId: volumeID}
+	_, err = driver.DeleteVolume(ctx, deleteReq)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	vol, err := driver.cloudscaleClient.Volumes.Get(ctx, volumeID)
+	assert.NoError(t, err)
+	assert.Equal(t, serverId, vol.Tags[eraseServerTag])
+
+	_, err = driver.DeleteVolume(ctx, deleteReq)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	driver.eraseRequestedVolumes(ctx, driver.log)
+	vol, err = driver.cloudscaleClient.Volumes.Get(ctx, volumeID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, vol.Tags[erasedTag])
+	assert.Empty(t, *vol.ServerUUIDs)
+
+	_, err = driver.DeleteVolume(ctx, deleteReq)
+	assert.NoError(t, err)
+	_, err = driver.cloudscaleClient.Volumes.Get(ctx, volumeID)
+	assert.Error(t, err)
+}
+
+// failingEraseMounter fails to erase the volumes
+type failingEraseMounter struct {
+	mounter.Mounter
+}
+
+func (m *failingEraseMounter) Erase(ctx context.Context, source, mode string) error {
+	return errors.New("blkdiscard failed")
+}
+
+func TestEraseOnNodeFailureDetachesVolume(t *testing.T) {
+	serverId := "987654"
+	driver := &Driver{
+		serverId: serverId,
+		cloudscaleClient: cloudscalefake.NewClient(map[string]*cloudscale.Server{
+			serverId: {UUID: serverId},
+		}),
+		mounter: &failingEraseMounter{Mounter: mounter.NewFake()},
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	req := makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.Parameters[EraseOnDeleteAttribute] = "zero"
+	resp, err := driver.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	vol, err := driver.cloudscaleClient.Volumes.Get(ctx, resp.Volume.VolumeId)
+	assert.NoError(t, err)
+
+	// a listing without the servers must not panic
+	vol.ServerUUIDs = nil
+	assert.Error(t, driver.eraseOnNode(ctx, vol, driver.log))
+
+	// the volume attached for the erase is detached again
+	vol, err = driver.cloudscaleClient.Volumes.Get(ctx, resp.Volume.VolumeId)
+	assert.NoError(t, err)
+	assert.Empty(t, *vol.ServerUUIDs)
+	assert.Empty(t, vol.Tags[erasedTag])
+}
+
+func TestDeleteVolumeNeverAttachedIsNotErased(t *testing.T) {
+	driver := createDriverForTest(t)
+	ctx := context.Background()
+
+	req := makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.Parameters[EraseOnDeleteAttribute] = "zero"
+	resp, err := driver.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+
+	_, err = driver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId})
+	assert.NoError(t, err)
+}
+
+func TestDeleteVolumeEraseGetFails(t *testing.T) {
+	serverId := "987654"
+	failGet := false
+	driver := &Driver{
+		serverId: serverId,
+		cloudscaleClient: cloudscalefake.NewClient(map[string]*cloudscale.Server{
+			serverId: {UUID: serverId},
+		}, cloudscalefake.WithErrorInjection(func(call cloudscalefake.Call) error {
+			if failGet && call.Service == "volumes" && call.Method == "Get" {
+				return &cloudscale.ErrorResponse{StatusCode: http.StatusInternalServerError}
+			}
+			return nil
+		})),
+		mounter: mounter.NewFake(),
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	req := makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.Parameters[EraseOnDeleteAttribute] = "zero"
+	resp, err := driver.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	volumeID := resp.Volume.VolumeId
+
+	failGet = true
+	_, err = driver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	// the volume is not deleted without being erased
+	failGet = false
+	_, err = driver.cloudscaleClient.Volumes.Get(ctx, volumeID)
+	assert.NoError(t, err)
+
+	// a volume which is already gone is deleted
+	_, err = driver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "unknown"})
+	assert.NoError(t, err)
+}
+
+func TestControllerExpandVolumeNodeExpansion(t *testing.T) {
+	driver := createDriverForTest(t)
+	ctx := context.Background()
+
+	created, err := driver.CreateVolume(ctx, makeCreateVolumeRequest(randString(32), 10, "ssd", false))
+	assert.NoError(t, err)
+
+	filesystem := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}
+	block := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+	for _, tc := range []struct {
+		name       string
+		capability *csi.VolumeCapability
+		sizeGB     int64
+		required   bool
+	}{
+		{name: "filesystem", capability: filesystem, sizeGB: 20, required: true},
+		{name: "block", capability: block, sizeGB: 30, required: false},
+		// the volume might have been resized outside of Kubernetes
+		{name: "filesystem skipped", capability: filesystem, sizeGB: 5, required: true},
+		{name: "block skipped", capability: block, sizeGB: 5, required: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := driver.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+				VolumeId:         created.Volume.VolumeId,
+				CapacityRange:    &csi.CapacityRange{RequiredBytes: tc.sizeGB * GB},
+				VolumeCapability: tc.capability,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.required, resp.NodeExpansionRequired)
+		})
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DeletionPolicyAttribute defines what DeleteVolume does with the
+	// volume; either "delete" (the default) or "detach", which only detaches
+	// the volume and tags it as released, so that it can be reviewed and
+	// deleted by hand
+	DeletionPolicyAttribute = DriverName + "/deletion-policy"
+
+	deletionPolicyDelete = "delete"
+	deletionPolicyDetach = "detach"
+
+	// deletionPolicyTag is the tag of the cloudscale.ch volume used to
+	// remember the deletion policy until the volume is deleted
+	deletionPolicyTag = "csi-cloudscale-deletion-policy"
+
+	// releasedTag marks the volumes which were released by DeleteVolume
+	// instead of being deleted, the value is the time of the release
+	releasedTag = "csi-cloudscale-released-at"
+)
+
+// validateDeletionPolicy checks that the given deletion policy is supported
+// for a volume with the given erase mode.
+func validateDeletionPolicy(policy string, eraseMode string) error {
+	switch policy {
+	case "", deletionPolicyDelete:
+		return nil
+	case deletionPolicyDetach:
+		if eraseMode != "" {
+			return fmt.Errorf("deletion policy %q cannot be combined with %s", policy, EraseOnDeleteAttribute)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid deletion policy %q, must be %q or %q", policy, deletionPolicyDelete, deletionPolicyDetach)
+	}
+}
+
+// releaseVolume detaches the given volume from all servers and tags it as
+// released instead of deleting it. The detach is recorded in the attach
+// history and both are done with a single update, so that a volume is never
+// detached without being tagged.
+func (d *Driver) releaseVolume(ctx context.Context, vol *cloudscale.Volume, ll *logrus.Entry) error {
+	attached := vol.ServerUUIDs != nil && len(*vol.ServerUUIDs) > 0
+	if !attached && vol.Tags[releasedTag] != "" {
+		ll.Info("volume is already released")
+		return nil
+	}
+
+	now := time.Now()
+	tags := cloudscale.TagMap{}
+	for key, value := range vol.Tags {
+		tags[key] = value
+	}
+	if attached {
+		for _, serverUUID := range *vol.ServerUUIDs {
+			tags, _ = withAttachHistoryEntry(tags, attachHistoryEntry(now, detachOperation, serverUUID))
+		}
+	}
+	if tags[releasedTag] == "" {
+		tags[releasedTag] = now.UTC().Format(time.RFC3339)
+	}
+
+	req := &cloudscale.VolumeRequest{ServerUUIDs: &[]string{}}
+	req.Tags = tags
+	if err := d.cloudscaleClient.Volumes.Update(ctx, vol.UUID, req); err != nil {
+		return status.Errorf(codes.Internal, "releasing volume %s: %v", vol.UUID, err)
+	}
+
+	ll.WithField("released_at", tags[releasedTag]).Info("volume is detached and released instead of deleted")
+	return nil
+}
@@ -0,0 +1,127 @@
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateVolumeDeletionPolicy(t *testing.T) {
+	driver := createDriverForTest(t)
+	ctx := context.Background()
+
+	req := makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.Parameters[DeletionPolicyAttribute] = "keep"
+	_, err := driver.CreateVolume(ctx, req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req = makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.Parameters[DeletionPolicyAttribute] = deletionPolicyDetach
+	req.Parameters[EraseOnDeleteAttribute] = mounter.EraseModeZero
+	_, err = driver.CreateVolume(ctx, req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req = makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.Parameters[DeletionPolicyAttribute] = deletionPolicyDelete
+	created, err := driver.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	vol, err := driver.cloudscaleClient.Volumes.Get(ctx, created.Volume.VolumeId)
+	assert.NoError(t, err)
+	assert.NotContains(t, vol.Tags, deletionPolicyTag)
+}
+
+func TestDeleteVolumeDetachPolicy(t *testing.T) {
+	serverId := "987654"
+	var updates int
+	driver := &Driver{
+		serverId: serverId,
+		cloudscaleClient: cloudscalefake.NewClient(map[string]*cloudscale.Server{
+			serverId: {UUID: serverId},
+		}, cloudscalefake.WithErrorInjection(func(call cloudscalefake.Call) error {
+			if call.Service == "volumes" && call.Method == "Update" {
+				updates++
+			}
+			return nil
+		})),
+		mounter: mounter.NewFake(),
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	req := makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.Parameters[DeletionPolicyAttribute] = deletionPolicyDetach
+	created, err := driver.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	volumeID := created.Volume.VolumeId
+
+	_, err = driver.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           serverId,
+		VolumeCapability: makeVolumeCapabilityObject(false)[0],
+	})
+	assert.NoError(t, err)
+
+	updates = 0
+	_, err = driver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	assert.NoError(t, err)
+	// detach and tags are a single update
+	assert.Equal(t, 1, updates)
+
+	vol, err := driver.cloudscaleClient.Volumes.Get(ctx, volumeID)
+	assert.NoError(t, err)
+	assert.Empty(t, *vol.ServerUUIDs)
+	assert.NotEmpty(t, vol.Tags[releasedTag])
+	assert.Equal(t, managedByTagValue, vol.Tags[managedByTag])
+	history := attachHistory(vol.Tags)
+	if assert.Len(t, history, 2) {
+		assert.True(t, strings.HasSuffix(history[1], " detach "+serverId), history[1])
+	}
+
+	// retries leave the released volume alone
+	_, err = driver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, updates)
+	again, err := driver.cloudscaleClient.Volumes.Get(ctx, volumeID)
+	assert.NoError(t, err)
+	assert.Equal(t, vol.Tags, again.Tags)
+}
+
+func TestDeleteVolumeDetachPolicyGetFails(t *testing.T) {
+	failGet := false
+	driver := &Driver{
+		cloudscaleClient: cloudscalefake.NewClient(nil, cloudscalefake.WithErrorInjection(func(call cloudscalefake.Call) error {
+			if failGet && call.Service == "volumes" && call.Method == "Get" {
+				return &cloudscale.ErrorResponse{StatusCode: 503}
+			}
+			return nil
+		})),
+		mounter: mounter.NewFake(),
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	req := makeCreateVolumeRequest(randString(32), 1, "ssd", false)
+	req.Parameters[DeletionPolicyAttribute] = deletionPolicyDetach
+	created, err := driver.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	volumeID := created.Volume.VolumeId
+
+	// the volume must not be deleted without its tags
+	failGet = true
+	_, err = driver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	failGet = false
+	vol, err := driver.cloudscaleClient.Volumes.Get(ctx, volumeID)
+	assert.NoError(t, err)
+	assert.Empty(t, vol.Tags[releasedTag])
+}
@@ -0,0 +1,202 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"k8s.io/mount-utils"
+)
+
+// DiskInfo describes a volume mounted on the node from the node's
+// perspective. It is served as JSON by the debug endpoint of the node plugin.
+type DiskInfo struct {
+	PVCName        string `json:"pvcName"`
+	PVCVolumeMode  string `json:"pvcVolumeMode"`
+	DeviceName     string `json:"deviceName"`
+	DeviceSize     int    `json:"deviceSize"`
+	Filesystem     string `json:"filesystem"`
+	FilesystemUUID string `json:"filesystemUUID"`
+	FilesystemSize int    `json:"filesystemSize"`
+	DeviceSource   string `json:"deviceSource"`
+	Luks           string `json:"luks,omitempty"`
+	Cipher         string `json:"cipher,omitempty"`
+	Keysize        int    `json:"keysize,omitempty"`
+}
+
+// serveDebug serves the debug endpoint on the given listener until it is
+// closed. The endpoint is meant for operators and the integration tests.
+func (d *Driver) serveDebug(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/diskinfo", d.handleDiskInfo)
+
+	d.log.WithField("addr", listener.Addr().String()).Info("debug endpoint started")
+	err := http.Serve(listener, mux)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		d.log.WithError(err).Error("debug endpoint failed")
+	}
+}
+
+func (d *Driver) handleDiskInfo(w http.ResponseWriter, r *http.Request) {
+	disks, err := getDiskInfo(r.Context(), d.orchestrator)
+	if err != nil {
+		d.log.WithError(err).Error("failed to get disk info")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(disks); err != nil {
+		d.log.WithError(err).Error("failed to write disk info")
+	}
+}
+
+// getDiskInfo returns information about the volumes that are staged or
+// published by the container orchestrator on this node.
+func getDiskInfo(ctx context.Context, orchestrator string) ([]DiskInfo, error) {
+	mountPoints, err := mount.New("").List()
+	if err != nil {
+		return nil, err
+	}
+
+	var filesystemDevices, blockDevices []string
+	pvcNames := map[string]string{}
+	for _, mp := range mountPoints {
+		if !isCSIMountPath(orchestrator, mp.Path) {
+			continue
+		}
+
+		device := mp.Device
+		switch {
+		case strings.HasPrefix(device, "/dev/"):
+			if _, ok := pvcNames[device]; !ok {
+				filesystemDevices = append(filesystemDevices, device)
+			}
+		case isBlockPublishPath(orchestrator, mp.Path):
+			// the device file of block volumes is bind mounted
+			device = mp.Path
+			if _, ok := pvcNames[device]; !ok {
+				blockDevices = append(blockDevices, device)
+			}
+		default:
+			continue
+		}
+
+		if pvcNames[device] == "" {
+			pvcNames[device] = volumeNameFromPath(orchestrator, mp.Path)
+		}
+	}
+
+	sort.Strings(filesystemDevices)
+	sort.Strings(blockDevices)
+
+	disks := make([]DiskInfo, 0, len(filesystemDevices)+len(blockDevices))
+	for _, device := range append(filesystemDevices, blockDevices...) {
+		disk, err := getDeviceInfo(ctx, device, pvcNames[device])
+		if err != nil {
+			return nil, err
+		}
+		disks = append(disks, disk)
+	}
+	return disks, nil
+}
+
+// getDeviceInfo returns the information about a single device. The device is
+// either a device node or the bind mount of a block volume.
+func getDeviceInfo(ctx context.Context, device, pvcName string) (DiskInfo, error) {
+	disk := DiskInfo{
+		PVCName:        pvcName,
+		PVCVolumeMode:  "Filesystem",
+		DeviceName:     device,
+		FilesystemSize: -1,
+	}
+	if !strings.HasPrefix(device, "/dev/") {
+		disk.PVCVolumeMode = "Block"
+	}
+
+	if strings.HasPrefix(device, "/dev/mapper/") {
+		status, err := mounter.LuksStatus(ctx, device)
+		if err != nil {
+			return disk, err
+		}
+		disk.PVCName = filepath.Base(device)
+		disk.Luks = status["type"]
+		disk.Cipher = status["cipher"]
+		disk.DeviceSource = status["device"]
+		if fields := strings.Fields(status["keysize"]); len(fields) > 0 {
+			disk.Keysize, _ = strconv.Atoi(fields[0])
+		}
+	} else {
+		source, err := filepath.EvalSymlinks(device)
+		if err != nil {
+			return disk, err
+		}
+		disk.DeviceSource = source
+	}
+
+	// the size of luks volumes includes the header
+	size, err := mounter.DeviceSize(disk.DeviceSource)
+	if err != nil {
+		return disk, err
+	}
+	disk.DeviceSize = int(size)
+
+	f, err := os.Open(device)
+	if err != nil {
+		return disk, err
+	}
+	defer f.Close()
+
+	if disk.Filesystem, err = mounter.ProbeSignature(f); err != nil {
+		return disk, fmt.Errorf("checking filesystem type of %s failed: %v", device, err)
+	}
+	if disk.FilesystemUUID, err = mounter.FilesystemUUID(f); err != nil {
+		return disk, fmt.Errorf("checking filesystem uuid of %s failed: %v", device, err)
+	}
+	if disk.Filesystem == "ext4" {
+		size, err := mounter.ExtFilesystemSize(f)
+		if err != nil {
+			return disk, fmt.Errorf("checking filesystem size of %s failed: %v", device, err)
+		}
+		disk.FilesystemSize = int(size)
+	}
+
+	return disk, nil
+}
+
+// pvcNameFromPath returns the name of the persistent volume in a path that
+// kubelet uses for staging or publishing it, e.g.
+// /var/lib/kubelet/pods/<uid>/volumes/kubernetes.io~csi/pvc-<uuid>/mount
+func pvcNameFromPath(path string) string {
+	for _, element := range strings.Split(path, "/") {
+		if strings.HasPrefix(element, "pvc-") {
+			return element
+		}
+	}
+	return ""
+}
@@ -0,0 +1,13 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPvcNameFromPath(t *testing.T) {
+	assert.Equal(t, "pvc-1234", pvcNameFromPath("/var/lib/kubelet/pods/abcd/volumes/kubernetes.io~csi/pvc-1234/mount"))
+	assert.Equal(t, "pvc-1234", pvcNameFromPath("/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/pvc-1234/dev/abcd"))
+	assert.Equal(t, "", pvcNameFromPath("/var/lib/kubelet/plugins/kubernetes.io/csi/pv/my-volume/globalmount"))
+}
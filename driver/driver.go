@@ -19,16 +19,21 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime/debug"
 	"sync"
+	"time"
 
 	"github.com/cloudscale-ch/cloudscale-go-sdk"
-	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 	"google.golang.org/grpc"
@@ -59,9 +64,123 @@ type Driver struct {
 
 	srv              *grpc.Server
 	cloudscaleClient *cloudscale.Client
-	mounter          Mounter
+	mounter          mounter.Mounter
+	luksKeyProvider  LuksKeyProvider
 	log              *logrus.Entry
 
+	// fstrimInterval defines how often staged volumes are trimmed; periodic
+	// trimming is disabled if it is zero.
+	fstrimInterval time.Duration
+	stop           chan struct{}
+
+	// settingsMu protects the settings which are reloaded from the config
+	// file, maxVolumesPerNode and publishMountOptions
+	settingsMu sync.RWMutex
+
+	// maxVolumesPerNode overrides the number of volumes advertised in
+	// NodeGetInfo; the environment or the default is used if it is zero.
+	maxVolumesPerNode int64
+
+	// publishMountOptions are added to the bind mount of every published
+	// filesystem volume
+	publishMountOptions []string
+
+	// defaultMaxVolumesPerNode and defaultPublishMountOptions are the
+	// settings without the config file, which they revert to once they are
+	// removed from it
+	defaultMaxVolumesPerNode   int64
+	defaultPublishMountOptions []string
+
+	// otherVolumes is the number of volumes attached to the server outside
+	// of CSI, which is counted when the node plugin starts
+	otherVolumes int64
+
+	// maxEphemeralVolumeSize is the maximum size of an ephemeral inline
+	// volume in bytes; unlimited if zero
+	maxEphemeralVolumeSize int64
+
+	// cleanupOnStart enables the cleanup of stale staging mounts and luks
+	// mappings when the driver starts
+	cleanupOnStart bool
+
+	// debugAddr is the address of the debug endpoint, which serves the disk
+	// info of the node; disabled if empty.
+	debugAddr     string
+	debugListener net.Listener
+	// luksHeaderAddr is the loopback address of the endpoint which backs up
+	// luks headers; disabled if empty.
+	luksHeaderAddr     string
+	luksHeaderListener net.Listener
+
+	// metricsAddr is the address of the metrics endpoint; disabled if empty.
+	metricsAddr     string
+	metricsListener net.Listener
+	metrics         *metrics
+
+	// slowOperationThreshold is the duration after which a gRPC call is
+	// logged as slow; disabled if zero
+	slowOperationThreshold time.Duration
+
+	// grpcServer tunes the gRPC server
+	grpcServer GRPCServerConfig
+
+	// tlsEndpoint serves the controller on TCP with mutual TLS if its
+	// address is set, tlsSrv is its server
+	tlsEndpoint TLSEndpointConfig
+	tlsSrv      *grpc.Server
+
+	// nodeClient lists the nodes to fence in fencingInterval and to label in
+	// nodeLabelInterval; each is disabled if its interval is zero
+	nodeClient        nodeClient
+	fencingInterval   time.Duration
+	nodeLabelInterval time.Duration
+
+	// claimEvents reports events on the claims of the volumes; disabled if
+	// nil
+	claimEvents claimEventClient
+
+	// podClient lists the pods of the node named orphanNodeName to clean up
+	// the publish target paths of deleted pods in orphanInterval; disabled if
+	// the interval is zero
+	podClient      podClient
+	orphanNodeName string
+	orphanInterval time.Duration
+
+	// staged are the volumes staged on the node, whose usage is exported
+	// by the metrics endpoint
+	staged stagedVolumes
+
+	// orchestrator is the container orchestrator the driver is a CSI plugin
+	// of, which decides how staging and publish paths are recognized and
+	// whether the features of Kubernetes are available
+	orchestrator string
+
+	// mode selects the checks of the readiness endpoint, healthAddr is its
+	// address; disabled if empty.
+	mode           string
+	healthAddr     string
+	healthListener net.Listener
+	health         *healthChecker
+
+	// apiCheckInterval is how often the controller checks the API, the
+	// readiness fails after apiCheckFailureThreshold failed checks in a row
+	apiCheckInterval         time.Duration
+	apiCheckFailureThreshold int
+
+	// tracer exports traces of the gRPC calls and the API requests if
+	// configured with the OpenTelemetry environment variables
+	tracer *tracer
+
+	// configFile is reloaded periodically if set, config is its content
+	configFile string
+	config     *Config
+
+	// volumeLocks serializes the node operations per volume
+	volumeLocks volumeLocks
+
+	// volumeIndex finds existing volumes by name in CreateVolume
+	volumeIndex volumeIndex
+
 	// ready defines whether the driver is ready to function. This value will
 	// be used by the `Identity` service via the `Probe()` method.
 	readyMu sync.Mutex // protects ready
@@ -70,44 +189,331 @@ type Driver struct {
 
 // NewDriver returns a CSI plugin that contains the necessary gRPC
 // interfaces to interact with Kubernetes over unix domain sockets for
-// managaing cloudscale.ch Volumes
-func NewDriver(ep, token, urlstr string) (*Driver, error) {
-	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{
-		AccessToken: token,
-	})
-	oauthClient := oauth2.NewClient(context.Background(), tokenSource)
+// managaing cloudscale.ch Volumes. It is configured with the given options;
+// the server ID is read from the metadata service and the zone is taken from
+// the server in the cloudscale.ch API, unless they are given.
+func NewDriver(opts ...Option) (*Driver, error) {
+	o := &options{
+		endpoint:          DefaultEndpoint,
+		apiURL:            DefaultAPIURL,
+		deviceWaitTimeout: DefaultDeviceWaitTimeout,
+		mode:              ModeAll,
+		orchestrator:      OrchestratorKubernetes,
+		maxEphemeralSize:  DefaultMaxEphemeralVolumeSize,
 
-	metadataClient := cloudscale.NewMetadataClient(nil)
-	metadata, err := metadataClient.GetMetadata()
-	if err != nil {
-		return nil, fmt.Errorf("couldn't get metadata: %s", err)
+		slowOperationThreshold:   DefaultSlowOperationThreshold,
+		apiCheckInterval:         DefaultAPICheckInterval,
+		apiCheckFailureThreshold: DefaultAPICheckFailureThreshold,
+	}
+	for _, opt := range opts {
+		opt(o)
 	}
 
-	// We don't have any other information than the availability zone. Just use
-	// it as the zone for now.
-	zone := metadata.AvailabilityZone
-	serverId := metadata.Meta.CloudscaleUUID
+	// the config file takes precedence over the other options; the
+	// reloadable settings revert to the other options once they are removed
+	// from the file
+	defaultMaxVolumesPerNode, defaultPublishMountOptions := o.maxVolumesPerNode, o.publishMountOptions
+	var config *Config
+	if o.configFile != "" {
+		var err error
+		config, err = LoadConfig(o.configFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, opt := range config.Options() {
+			opt(o)
+		}
+	}
 
-	cloudscaleClient := cloudscale.NewClient(oauthClient)
-	baseURL, err := url.Parse(urlstr)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't parse url: %s", err)
+	if err := validatePublishMountOptions(o.publishMountOptions); err != nil {
+		return nil, err
+	}
+	if err := o.grpcServer.validate(); err != nil {
+		return nil, err
+	}
+	if err := o.tlsEndpoint.validate(o.mode); err != nil {
+		return nil, err
+	}
+	if !isValidOrchestrator(o.orchestrator) {
+		return nil, fmt.Errorf("invalid container orchestrator %q, must be one of %q, %q or %q", o.orchestrator, OrchestratorKubernetes, OrchestratorNomad, OrchestratorSwarm)
+	}
+	if o.fencingInterval < 0 || o.nodeLabelInterval < 0 {
+		return nil, errors.New("the node fencing and node labeler intervals must be positive")
+	}
+	if o.fencingInterval != 0 || o.nodeLabelInterval != 0 {
+		if o.orchestrator != OrchestratorKubernetes {
+			return nil, errors.New("the node fencing and node labeler use the Kubernetes nodes and are only available with Kubernetes")
+		}
+		if o.mode == ModeNode {
+			return nil, errors.New("the node fencing and node labeler are for the controller and cannot be used in node mode")
+		}
+	}
+	if o.claimEvents {
+		if o.orchestrator != OrchestratorKubernetes {
+			return nil, errors.New("the claim events are only available with Kubernetes")
+		}
+		if o.mode == ModeNode {
+			return nil, errors.New("the claim events are for the controller and cannot be used in node mode")
+		}
+	}
+	if o.luksHeaderAddr != "" {
+		if err := validateLoopbackAddr(o.luksHeaderAddr); err != nil {
+			return nil, err
+		}
+	}
+	if o.orphanInterval < 0 {
+		return nil, errors.New("the orphan cleanup interval must be positive")
+	}
+	if o.orphanInterval != 0 {
+		if o.orchestrator != OrchestratorKubernetes {
+			return nil, errors.New("the orphan cleanup uses the Kubernetes pods and is only available with Kubernetes")
+		}
+		if o.mode == ModeController {
+			return nil, errors.New("the orphan cleanup is for the node and cannot be used in controller mode")
+		}
+		if o.orphanNodeName == "" {
+			return nil, errors.New("the orphan cleanup needs the name of the node")
+		}
+	}
+	if o.apiCheckInterval <= 0 || o.apiCheckFailureThreshold <= 0 {
+		return nil, errors.New("the API check interval and failure threshold must be positive")
+	}
+	if !isValidMode(o.mode) {
+		return nil, fmt.Errorf("invalid mode %q, must be one of %q, %q or %q", o.mode, ModeAll, ModeController, ModeNode)
+	}
+
+	logger := o.log
+	if logger == nil {
+		logger = logrus.NewEntry(logrus.New())
+	}
+	addRedactHook(logger.Logger)
+
+	serverId := o.serverID
+
+	if o.fakeCloudscale {
+		logger.Warn("using an in-memory fake of the cloudscale.ch API, volumes are not real")
+		if o.cloudscaleClient == nil {
+			o.cloudscaleClient = cloudscalefake.NewClient(nil, cloudscalefake.WithServerRegistration())
+		}
+		if serverId == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("couldn't get hostname as server ID: %s", err)
+			}
+			serverId = hostname
+		}
+		if o.zone == "" {
+			o.zone = cloudscalefake.Zone
+		}
+	}
+
+	// a controller outside of a cloudscale.ch server, e.g. on a developer
+	// laptop, only needs the zone
+	outOfCluster := serverId == "" && o.zone != "" && o.mode == ModeController
+	if outOfCluster {
+		logger.WithField("zone", o.zone).Info("running the controller without a server, the metadata service is not used")
+	}
+
+	// the metadata is optional if the server ID is given, the zone is taken
+	// from the API in that case
+	var metadataZone string
+	if !outOfCluster && (serverId == "" || o.zone == "") {
+		metadataClient := cloudscale.NewMetadataClient(nil)
+		metadata, err := metadataClient.GetMetadata()
+		if err != nil {
+			if serverId == "" {
+				return nil, fmt.Errorf("couldn't get metadata: %s", err)
+			}
+			logger.WithError(err).Warn("couldn't get metadata")
+		} else {
+			metadataZone = metadata.AvailabilityZone
+			switch {
+			case serverId == "":
+				serverId = metadata.Meta.CloudscaleUUID
+			case serverId != metadata.Meta.CloudscaleUUID:
+				logger.WithFields(logrus.Fields{
+					"server_id":          serverId,
+					"metadata_server_id": metadata.Meta.CloudscaleUUID,
+				}).Warn("the given server ID differs from the one in the metadata, using the given one")
+			}
+		}
+	}
+
+	if serverId == "" && !outOfCluster {
+		return nil, errors.New("the server ID is neither given nor found in the metadata")
+	}
+
+	apiMetrics := newMetrics()
+	tracer := newTracerFromEnv(logger)
+	cloudscaleClient := o.cloudscaleClient
+	if cloudscaleClient == nil {
+		var tokenSource oauth2.TokenSource = oauth2.StaticTokenSource(&oauth2.Token{
+			AccessToken: o.token,
+		})
+		if o.tokenFile != "" {
+			tokenSource = &fileTokenSource{path: o.tokenFile}
+			if _, err := tokenSource.Token(); err != nil {
+				return nil, err
+			}
+		}
+
+		var failover *tokenFailover
+		if len(o.fallbackTokens) > 0 || len(o.fallbackTokenFiles) > 0 {
+			sources := []oauth2.TokenSource{tokenSource}
+			for _, token := range o.fallbackTokens {
+				sources = append(sources, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}))
+			}
+			for _, path := range o.fallbackTokenFiles {
+				source := &fileTokenSource{path: path}
+				if _, err := source.Token(); err != nil {
+					return nil, err
+				}
+				sources = append(sources, source)
+			}
+			failover = newTokenFailover(sources, logger, apiMetrics)
+			tokenSource = failover
+		}
+
+		transport, err := newAPITransport(o.proxyURL, o.caBundle)
+		if err != nil {
+			return nil, err
+		}
+		// oauth2.NewClient is not used, as it caches tokens without an
+		// expiry forever, which breaks the rotation of the token file
+		var apiTransport http.RoundTripper = &oauth2.Transport{
+			Source: tokenSource,
+			Base: &requestIDTransport{
+				base: &apiUsageTransport{
+					base: &tracingTransport{
+						base:   &metricsTransport{base: transport, metrics: apiMetrics},
+						tracer: tracer,
+					},
+				},
+			},
+		}
+		if failover != nil {
+			apiTransport = &tokenFailoverTransport{base: apiTransport, failover: failover}
+		}
+		oauthClient := &http.Client{Transport: apiTransport}
+
+		cloudscaleClient = cloudscale.NewClient(oauthClient)
+		cloudscaleClient.UserAgent = userAgent()
+		baseURL, err := url.Parse(o.apiURL)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse url: %s", err)
+		}
+		cloudscaleClient.BaseURL = baseURL
 	}
-	cloudscaleClient.BaseURL = baseURL
 
-	log := logrus.New().WithFields(logrus.Fields{
-		"zone":    zone,
+	log := logger.WithFields(logrus.Fields{
 		"node_id": serverId,
 		"version": version,
 	})
 
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	zone := o.zone
+	if zone == "" {
+		var err error
+		zone, err = resolveZone(ctx, cloudscaleClient, serverId, metadataZone, log)
+		if err != nil {
+			return nil, err
+		}
+	} else if outOfCluster {
+		// fail fast on an invalid token
+		if _, err := cloudscaleClient.Regions.List(ctx); err != nil {
+			var errResp *cloudscale.ErrorResponse
+			if errors.As(err, &errResp) && isAuthFailure(errResp.StatusCode) {
+				return nil, fmt.Errorf("the cloudscale.ch API token is invalid: %v", err)
+			}
+			log.WithError(err).Warn("couldn't reach the API")
+		}
+	} else if _, err := cloudscaleClient.Servers.Get(ctx, serverId); err != nil {
+		// fail fast on an invalid token or server ID as well
+		if err := invalidConfigurationError(err, serverId); err != nil {
+			return nil, err
+		}
+		log.WithError(err).Warn("couldn't get the server from the API")
+	}
+	log = log.WithField("zone", zone)
+
+	nodes := o.nodeClient
+	if (o.fencingInterval != 0 || o.nodeLabelInterval != 0) && nodes == nil {
+		var err error
+		nodes, err = newNodeClient(o.kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	claimEvents := o.claimEventClient
+	if o.claimEvents && claimEvents == nil {
+		var err error
+		claimEvents, err = newClaimEventClient(o.kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pods := o.podClient
+	if o.orphanInterval != 0 && pods == nil {
+		var err error
+		pods, err = newPodClient(o.kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m := o.mounter
+	if m == nil {
+		m = mounter.New(log, o.deviceWaitTimeout)
+	}
+	for _, wrap := range o.mounterWrappers {
+		m = wrap(m)
+	}
+
 	return &Driver{
-		endpoint:         ep,
+		endpoint:         o.endpoint,
 		serverId:         serverId,
 		zone:             zone,
 		cloudscaleClient: cloudscaleClient,
-		mounter:          newMounter(log),
+		mounter:          m,
+		luksKeyProvider:  o.luksKeyProvider,
 		log:              log,
+		fstrimInterval:   o.fstrimInterval,
+
+		maxVolumesPerNode:   o.maxVolumesPerNode,
+		publishMountOptions: o.publishMountOptions,
+		cleanupOnStart:      o.cleanupOnStart,
+		debugAddr:           o.debugAddr,
+		luksHeaderAddr:      o.luksHeaderAddr,
+		metricsAddr:         o.metricsAddr,
+		metrics:             apiMetrics,
+		tracer:              tracer,
+		mode:                o.mode,
+		orchestrator:        o.orchestrator,
+		grpcServer:          o.grpcServer,
+		tlsEndpoint:         o.tlsEndpoint,
+		nodeClient:          nodes,
+		fencingInterval:     o.fencingInterval,
+		nodeLabelInterval:   o.nodeLabelInterval,
+		claimEvents:         claimEvents,
+		podClient:           pods,
+		orphanNodeName:      o.orphanNodeName,
+		orphanInterval:      o.orphanInterval,
+		healthAddr:          o.healthAddr,
+		configFile:          o.configFile,
+		config:              config,
+
+		defaultMaxVolumesPerNode:   defaultMaxVolumesPerNode,
+		defaultPublishMountOptions: defaultPublishMountOptions,
+
+		maxEphemeralVolumeSize: o.maxEphemeralSize,
+
+		slowOperationThreshold:   o.slowOperationThreshold,
+		apiCheckInterval:         o.apiCheckInterval,
+		apiCheckFailureThreshold: o.apiCheckFailureThreshold,
 	}, nil
 }
 
@@ -141,22 +547,103 @@ func (d *Driver) Run() error {
 		return fmt.Errorf("failed to listen: %v", err)
 	}
 
-	// log response errors for better observability
-	errHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		resp, err := handler(ctx, req)
+	d.srv = grpc.NewServer(d.grpcServerOptions()...)
+	d.registerServices(d.srv)
+
+	if d.tlsEndpoint.Addr != "" {
+		d.tlsSrv, err = d.newTLSServer()
+		if err != nil {
+			return err
+		}
+		tlsListener, err := net.Listen("tcp", d.tlsEndpoint.Addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on TLS address: %v", err)
+		}
+		d.log.WithField("addr", tlsListener.Addr().String()).Info("TLS endpoint started")
+		go func() {
+			if err := d.tlsSrv.Serve(tlsListener); err != nil {
+				d.log.WithError(err).Error("TLS endpoint failed")
+			}
+		}()
+	}
+
+	if d.cleanupOnStart {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		d.cleanupStaleVolumes(ctx)
+		cancel()
+	}
+
+	if d.mode == ModeAll || d.mode == ModeNode {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		d.countOtherVolumes(ctx)
+		cancel()
+	}
+
+	if d.debugAddr != "" {
+		d.debugListener, err = net.Listen("tcp", d.debugAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on debug address: %v", err)
+		}
+		go d.serveDebug(d.debugListener)
+	}
+
+	if d.luksHeaderAddr != "" {
+		d.luksHeaderListener, err = net.Listen("tcp", d.luksHeaderAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on luks header address: %v", err)
+		}
+		go d.serveLuksHeader(d.luksHeaderListener)
+	}
+
+	d.health = newHealthChecker(addr)
+	if d.healthAddr != "" {
+		d.healthListener, err = net.Listen("tcp", d.healthAddr)
 		if err != nil {
-			d.log.WithError(err).WithField("method", info.FullMethod).Error("method failed")
+			return fmt.Errorf("failed to listen on health address: %v", err)
 		}
-		return resp, err
+		go d.serveHealth(d.healthListener)
 	}
 
-	d.srv = grpc.NewServer(grpc.UnaryInterceptor(errHandler))
-	csi.RegisterIdentityServer(d.srv, d)
-	csi.RegisterControllerServer(d.srv, d)
-	csi.RegisterNodeServer(d.srv, d)
+	if d.metricsAddr != "" {
+		d.metricsListener, err = net.Listen("tcp", d.metricsAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on metrics address: %v", err)
+		}
+		go d.serveMetrics(d.metricsListener)
+	}
+
+	d.stop = make(chan struct{})
+	if d.fstrimInterval > 0 {
+		go d.runFstrimLoop(d.fstrimInterval, d.stop)
+	}
+	if d.mode == ModeAll || d.mode == ModeNode {
+		go d.runEraseLoop(eraseCheckInterval, d.stop)
+	}
+	if d.tracer != nil {
+		go d.tracer.run(d.stop)
+	}
+	if d.mode == ModeAll || d.mode == ModeController {
+		go d.runAPICheckLoop(d.apiCheckInterval, d.stop)
+	}
+	if d.fencingInterval > 0 {
+		go d.runFencingLoop(d.nodeClient, d.fencingInterval, d.stop)
+	}
+	if d.nodeLabelInterval > 0 {
+		go newNodeLabeler(d, d.nodeClient).run(d.nodeLabelInterval, d.stop)
+	}
+	if d.orphanInterval > 0 {
+		go newOrphanCleaner(d, d.podClient, d.orphanNodeName).run(d.orphanInterval, d.stop)
+	}
+	if d.configFile != "" {
+		go d.watchConfig(d.configFile, d.config, configPollInterval, d.stop)
+	}
 
 	d.ready = true // we're now ready to go!
-	d.log.WithField("addr", addr).Info("server started")
+	d.log.WithFields(logrus.Fields{
+		"addr":           addr,
+		"commit":         commit,
+		"git_tree_state": gitTreeState,
+	}).Info("server started")
 	return d.srv.Serve(listener)
 }
 
@@ -166,6 +653,27 @@ func (d *Driver) Stop() {
 	d.ready = false
 	d.readyMu.Unlock()
 
+	if d.stop != nil {
+		close(d.stop)
+	}
+
+	if d.debugListener != nil {
+		d.debugListener.Close()
+	}
+	if d.luksHeaderListener != nil {
+		d.luksHeaderListener.Close()
+	}
+	if d.metricsListener != nil {
+		d.metricsListener.Close()
+	}
+	if d.healthListener != nil {
+		d.healthListener.Close()
+	}
+
+	if d.tlsSrv != nil {
+		d.tlsSrv.Stop()
+	}
+
 	d.log.Info("server stopped")
 	d.srv.Stop()
 }
@@ -178,6 +686,48 @@ func GetVersion() string {
 	return version
 }
 
+// init fills in the version information from the build info of the Go
+// toolchain for builds without ldflags, e.g. with "go install" or "go run".
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		if version == "" {
+			version = "dev"
+		}
+		return
+	}
+
+	if version == "" {
+		version = info.Main.Version
+		if version == "" || version == "(devel)" {
+			version = "dev"
+		}
+	}
+
+	if commit != "" {
+		return
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			commit = setting.Value
+		case "vcs.modified":
+			gitTreeState = "clean"
+			if setting.Value == "true" {
+				gitTreeState = "dirty"
+			}
+		}
+	}
+}
+
+// userAgent identifies the driver build in requests to the cloudscale.ch API
+func userAgent() string {
+	if commit == "" {
+		return fmt.Sprintf("csi-cloudscale/%s", version)
+	}
+	return fmt.Sprintf("csi-cloudscale/%s (%s)", version, commit)
+}
+
 // GetCommit returns the current commit hash value, as inserted at build time.
 func GetCommit() string {
 	return commit
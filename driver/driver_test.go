@@ -19,20 +19,20 @@ package driver
 
 import (
 	"context"
-	"errors"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
 	"github.com/google/uuid"
-	"k8s.io/mount-utils"
 	"math/rand"
 	"net/http"
-	"net/url"
 	"os"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
 	"github.com/kubernetes-csi/csi-test/v5/pkg/sanity"
 	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
 )
 
 func init() {
@@ -45,7 +45,7 @@ const (
 
 type idGenerator struct{}
 
-var DefaultZone = cloudscale.Zone{Slug: "dev1"}
+var DefaultZone = cloudscale.Zone{Slug: cloudscalefake.Zone}
 
 func TestDriverSuite(t *testing.T) {
 	socket := "/tmp/csi.sock"
@@ -58,17 +58,18 @@ func TestDriverSuite(t *testing.T) {
 	initialServers := map[string]*cloudscale.Server{
 		serverId: {UUID: serverId},
 	}
-	cloudscaleClient := NewFakeClient(initialServers)
-	fm := &fakeMounter{
-		mounted: map[string]string{},
-	}
-	driver := &Driver{
-		endpoint:         endpoint,
-		serverId:         serverId,
-		zone:             DefaultZone.Slug,
-		cloudscaleClient: cloudscaleClient,
-		mounter:          fm,
-		log:              logrus.New().WithField("test_enabed", true),
+	cloudscaleClient := cloudscalefake.NewClient(initialServers)
+	fm := mounter.NewFake()
+	driver, err := NewDriver(
+		WithEndpoint(endpoint),
+		WithServerID(serverId),
+		WithZone(DefaultZone.Slug),
+		WithCloudscaleClient(cloudscaleClient),
+		WithMounter(fm),
+		WithLogger(logrus.New().WithField("test_enabed", true)),
+	)
+	if err != nil {
+		t.Fatalf("failed to create driver: %s", err)
 	}
 	defer driver.Stop()
 
@@ -85,302 +86,144 @@ func TestDriverSuite(t *testing.T) {
 	cfg.IDGen = &idGenerator{}
 	cfg.IdempotentCount = 5
 	cfg.TestNodeVolumeAttachLimit = true
-	cfg.CheckPath = fm.checkMountPath
+	cfg.CheckPath = checkMountPath(fm)
 	cfg.TestNodeVolumeAttachLimit = true
 
 	sanity.Test(t, cfg)
 }
 
-func NewFakeClient(initialServers map[string]*cloudscale.Server) *cloudscale.Client {
-	userAgent := "cloudscale/" + "fake"
-	fakeClient := &cloudscale.Client{BaseURL: nil, UserAgent: userAgent}
-
-	fakeClient.Servers = FakeServerServiceOperations{
-		fakeClient: fakeClient,
-		servers:    initialServers,
-	}
-	fakeClient.Volumes = FakeVolumeServiceOperations{
-		fakeClient: fakeClient,
-		volumes:    make(map[string]*cloudscale.Volume),
-	}
-
-	return fakeClient
-}
-
-type fakeMounter struct {
-	mounted map[string]string
-}
-
-func (f *fakeMounter) Format(source string, fsType string, luksContext LuksContext) error {
-	return nil
-}
-
-func (f *fakeMounter) Mount(source string, target string, fsType string, luksContext LuksContext, options ...string) error {
-	f.mounted[target] = source
-	return nil
-}
-
-func (f *fakeMounter) Unmount(target string, luksContext LuksContext) error {
-	delete(f.mounted, target)
-	return nil
-}
-
-func (f *fakeMounter) GetDeviceName(_ mount.Interface, mountPath string) (string, error) {
-	if _, ok := f.mounted[mountPath]; ok {
-		return "/mnt/sda1", nil
+// checkMountPath reports the mounts of the fake mounter to the sanity tests
+func checkMountPath(f *mounter.Fake) func(string) (sanity.PathKind, error) {
+	return func(path string) (sanity.PathKind, error) {
+		isMounted, err := f.IsMounted(path)
+		if err != nil {
+			return "", err
+		}
+		if isMounted {
+			return sanity.PathIsDir, nil
+		}
+		return sanity.PathIsNotFound, nil
 	}
-
-	return "", nil
 }
 
-func (f *fakeMounter) FindAbsoluteDeviceByIDPath(volumeName string) (string, error) {
-	return "/dev/sdb", nil
-}
-
-func (f *fakeMounter) IsFormatted(source string, luksContext LuksContext) (bool, error) {
-	return true, nil
-}
-func (f *fakeMounter) IsMounted(target string) (bool, error) {
-	_, ok := f.mounted[target]
-	return ok, nil
-}
-
-func (f *fakeMounter) checkMountPath(path string) (sanity.PathKind, error) {
-	isMounted, err := f.IsMounted(path)
-	if err != nil {
-		return "", err
-	}
-	if isMounted {
-		return sanity.PathIsDir, nil
+func randString(n int) string {
+	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letterBytes[rand.Intn(len(letterBytes))]
 	}
-	return sanity.PathIsNotFound, nil
-}
-
-func (f *fakeMounter) GetStatistics(volumePath string) (volumeStatistics, error) {
-	return volumeStatistics{
-		availableBytes: 3 * GB,
-		totalBytes:     10 * GB,
-		usedBytes:      7 * GB,
-
-		availableInodes: 3000,
-		totalInodes:     10000,
-		usedInodes:      7000,
-	}, nil
-}
-
-func (f *fakeMounter) HasRequiredSize(log *logrus.Entry, path string, requiredSize int64) (bool, error) {
-	return true, nil
+	return string(b)
 }
 
-func (f *fakeMounter) FinalizeVolumeAttachmentAndFindPath(logger *logrus.Entry, target string) (*string, error) {
-	path := "SomePath"
-	return &path, nil
+func (g *idGenerator) GenerateUniqueValidVolumeID() string {
+	return uuid.New().String()
 }
 
-type FakeVolumeServiceOperations struct {
-	fakeClient *cloudscale.Client
-	volumes    map[string]*cloudscale.Volume
+func (g *idGenerator) GenerateInvalidVolumeID() string {
+	return g.GenerateUniqueValidVolumeID()
 }
 
-func (f FakeVolumeServiceOperations) Create(ctx context.Context, createRequest *cloudscale.VolumeRequest) (*cloudscale.Volume, error) {
-	id := randString(32)
-	vol := &cloudscale.Volume{
-		UUID:        id,
-		Name:        createRequest.Name,
-		SizeGB:      createRequest.SizeGB,
-		Type:        createRequest.Type,
-		ServerUUIDs: createRequest.ServerUUIDs,
-	}
-	vol.Zone = DefaultZone
-	if vol.ServerUUIDs == nil {
-		noservers := make([]string, 0, 1)
-		vol.ServerUUIDs = &noservers
-	}
-
-	f.volumes[id] = vol
-
-	return vol, nil
+func (g *idGenerator) GenerateUniqueValidNodeID() string {
+	return strconv.Itoa(numDroplets * 10)
 }
 
-func (f FakeVolumeServiceOperations) Get(ctx context.Context, volumeID string) (*cloudscale.Volume, error) {
-	vol, ok := f.volumes[volumeID]
-	if ok != true {
-		return nil, generateNotFoundError()
-	}
-	return vol, nil
+func (g *idGenerator) GenerateInvalidNodeID() string {
+	return "not-an-integer"
 }
 
-func (f FakeVolumeServiceOperations) List(ctx context.Context, modifiers ...cloudscale.ListRequestModifier) ([]cloudscale.Volume, error) {
-	var volumes []cloudscale.Volume
-
-	for _, vol := range f.volumes {
-		volumes = append(volumes, *vol)
-	}
-
-	if len(modifiers) == 0 {
-		return volumes, nil
-	}
-	if len(modifiers) > 1 {
-		panic("implement me (support for more than one modifier)")
-	}
+func TestNewDriverFakeCloudscale(t *testing.T) {
+	d, err := NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()))
+	assert.NoError(t, err)
 
-	params := extractParams(modifiers)
-
-	if filterName := params.Get("name"); filterName != "" {
-		filtered := make([]cloudscale.Volume, 0, 1)
-		for _, vol := range volumes {
-			if vol.Name == filterName {
-				filtered = append(filtered, vol)
-			}
-		}
-		return filtered, nil
-	}
+	hostname, err := os.Hostname()
+	assert.NoError(t, err)
+	assert.Equal(t, hostname, d.serverId)
+	assert.Equal(t, cloudscalefake.Zone, d.zone)
 
-	panic("implement me (support for unknown param)")
+	// every node of the sandbox is a known server
+	server, err := d.cloudscaleClient.Servers.Get(context.Background(), "node-2")
+	assert.NoError(t, err)
+	assert.Equal(t, cloudscalefake.Zone, server.Zone.Slug)
 }
 
-func extractParams(modifiers []cloudscale.ListRequestModifier) url.Values {
-	// undoing the cloudscale.WithNameFilter(volumeName) magic
-
-	modifierFunc := modifiers[0]
-	req, _ := http.NewRequest("GET", "http://example.com", nil)
-	modifierFunc(req)
-	params, err := url.ParseQuery(req.URL.RawQuery)
-	if err != nil {
-		panic("unexpected error")
-	}
-	return params
-}
-
-func (f FakeVolumeServiceOperations) Update(ctx context.Context, volumeID string, updateRequest *cloudscale.VolumeRequest) error {
-	vol, ok := f.volumes[volumeID]
-	if ok != true {
-		return generateNotFoundError()
-	}
-
-	if updateRequest.ServerUUIDs != nil {
-		if serverUUIDs := *updateRequest.ServerUUIDs; serverUUIDs != nil {
-			if len(serverUUIDs) > 1 {
-				return errors.New("multi attach is not implemented")
-			}
-			if len(serverUUIDs) == 1 {
-				for _, serverUUID := range serverUUIDs {
-					_, err := f.fakeClient.Servers.Get(nil, serverUUID)
-					if err != nil {
-						return err
-					}
-
-					volumesCount := getVolumesPerServer(f, serverUUID)
-					if volumesCount >= fallbackMaxVolumesPerNode {
-						return &cloudscale.ErrorResponse{
-							StatusCode: 400,
-							Message:    map[string]string{"detail": "Due to internal limitations, it is currently not possible to attach more than 128 volumes"},
-						}
-					}
-				}
-			}
-
-			vol.ServerUUIDs = &serverUUIDs
-			return nil
-		}
-	}
-	if vol.SizeGB < updateRequest.SizeGB {
-		vol.SizeGB = updateRequest.SizeGB
+func TestNewDriverOutOfCluster(t *testing.T) {
+	var calls []cloudscalefake.Call
+	client := cloudscalefake.NewClient(nil, cloudscalefake.WithErrorInjection(func(call cloudscalefake.Call) error {
+		calls = append(calls, call)
 		return nil
-	}
-	panic("implement me")
-}
+	}))
 
-func getVolumesPerServer(f FakeVolumeServiceOperations, serverUUID string) int {
-	volumesCount := 0
-	for _, v := range f.volumes {
-		for _, uuid := range *v.ServerUUIDs {
-			if uuid == serverUUID {
-				volumesCount++
-			}
-		}
-	}
-	return volumesCount
-}
+	d, err := NewDriver(WithCloudscaleClient(client), WithZone("rma1"), WithMode(ModeController), WithMounter(mounter.NewFake()))
+	assert.NoError(t, err)
+	assert.Equal(t, "", d.serverId)
+	assert.Equal(t, "rma1", d.zone)
+	// the token is checked without a server
+	assert.Equal(t, []cloudscalefake.Call{{Service: "regions", Method: "List"}}, calls)
 
-func (f FakeVolumeServiceOperations) Delete(ctx context.Context, volumeID string) error {
-	delete(f.volumes, volumeID)
-	return nil
+	client = cloudscalefake.NewClient(nil, cloudscalefake.WithErrorInjection(func(call cloudscalefake.Call) error {
+		return &cloudscale.ErrorResponse{StatusCode: http.StatusUnauthorized}
+	}))
+	_, err = NewDriver(WithCloudscaleClient(client), WithZone("rma1"), WithMode(ModeController), WithMounter(mounter.NewFake()))
+	assert.Error(t, err)
 }
 
-type FakeServerServiceOperations struct {
-	fakeClient *cloudscale.Client
-	servers    map[string]*cloudscale.Server
-}
+func TestNewDriverContainerOrchestrator(t *testing.T) {
+	d, err := NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()))
+	assert.NoError(t, err)
+	assert.Equal(t, OrchestratorKubernetes, d.orchestrator)
 
-func (f *fakeMounter) IsBlockDevice(volumePath string) (bool, error) {
-	return false, nil
-}
+	d, err = NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()), WithContainerOrchestrator(OrchestratorNomad))
+	assert.NoError(t, err)
+	assert.Equal(t, OrchestratorNomad, d.orchestrator)
 
-func (f FakeServerServiceOperations) Create(ctx context.Context, createRequest *cloudscale.ServerRequest) (*cloudscale.Server, error) {
-	panic("implement me")
-}
+	d, err = NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()), WithContainerOrchestrator(OrchestratorSwarm))
+	assert.NoError(t, err)
+	assert.Equal(t, OrchestratorSwarm, d.orchestrator)
 
-func (f FakeServerServiceOperations) Get(ctx context.Context, serverID string) (*cloudscale.Server, error) {
-	server, ok := f.servers[serverID]
-	if ok != true {
-		return nil, generateNotFoundError()
-	}
-	return server, nil
+	_, err = NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()), WithContainerOrchestrator("mesos"))
+	assert.Error(t, err)
 }
 
-func (f FakeServerServiceOperations) Update(ctx context.Context, serverID string, updateRequest *cloudscale.ServerUpdateRequest) error {
-	panic("implement me")
+// countingMounter counts the formats and passes everything else to the
+// wrapped mounter
+type countingMounter struct {
+	mounter.Mounter
+	formats int
 }
 
-func (f FakeServerServiceOperations) Delete(ctx context.Context, serverID string) error {
-	panic("implement me")
+func (m *countingMounter) Format(ctx context.Context, source, fsType string, luksContext mounter.LuksContext, mkfsOptions ...string) error {
+	m.formats++
+	return m.Mounter.Format(ctx, source, fsType, luksContext, mkfsOptions...)
 }
 
-func (f FakeServerServiceOperations) List(ctx context.Context, modifiers ...cloudscale.ListRequestModifier) ([]cloudscale.Server, error) {
-	panic("implement me")
-}
-
-func (f FakeServerServiceOperations) Reboot(ctx context.Context, serverID string) error {
-	panic("implement me")
-}
-
-func (f FakeServerServiceOperations) Start(ctx context.Context, serverID string) error {
-	panic("implement me")
-}
-
-func (f FakeServerServiceOperations) Stop(ctx context.Context, serverID string) error {
-	panic("implement me")
-}
-
-func generateNotFoundError() *cloudscale.ErrorResponse {
-	return &cloudscale.ErrorResponse{
-		StatusCode: 404,
-		Message:    map[string]string{"detail": "not found"},
+func TestNewDriverMounterWrapper(t *testing.T) {
+	fm := mounter.NewFake()
+	var wrapped []*countingMounter
+	wrap := func(m mounter.Mounter) mounter.Mounter {
+		cm := &countingMounter{Mounter: m}
+		wrapped = append(wrapped, cm)
+		return cm
 	}
-}
+	d, err := NewDriver(WithFakeCloudscale(true), WithMounter(fm), WithMounterWrapper(wrap), WithMounterWrapper(wrap))
+	assert.NoError(t, err)
 
-func randString(n int) string {
-	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+	if assert.Len(t, wrapped, 2) {
+		assert.Same(t, fm, wrapped[0].Mounter)
+		assert.Same(t, wrapped[0], wrapped[1].Mounter)
+		assert.Same(t, wrapped[1], d.mounter)
 	}
-	return string(b)
-}
 
-func (g *idGenerator) GenerateUniqueValidVolumeID() string {
-	return uuid.New().String()
+	assert.NoError(t, d.mounter.Format(context.Background(), "/dev/sdb", "ext4", mounter.LuksContext{}))
+	assert.Equal(t, 1, wrapped[0].formats)
+	assert.Equal(t, 1, wrapped[1].formats)
 }
 
-func (g *idGenerator) GenerateInvalidVolumeID() string {
-	return g.GenerateUniqueValidVolumeID()
-}
+func TestUserAgent(t *testing.T) {
+	defer func(v, c string) { version, commit = v, c }(version, commit)
 
-func (g *idGenerator) GenerateUniqueValidNodeID() string {
-	return strconv.Itoa(numDroplets * 10)
-}
+	version, commit = "v3.5.3", ""
+	assert.Equal(t, "csi-cloudscale/v3.5.3", userAgent())
 
-func (g *idGenerator) GenerateInvalidNodeID() string {
-	return "not-an-integer"
+	commit = "53839fe"
+	assert.Equal(t, "csi-cloudscale/v3.5.3 (53839fe)", userAgent())
 }
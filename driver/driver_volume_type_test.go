@@ -3,6 +3,8 @@ package driver
 import (
 	"context"
 	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -176,10 +178,10 @@ func makeVolumeCapabilityObject(block bool) []*csi.VolumeCapability {
 
 func createDriverForTest(t *testing.T) *Driver {
 	initialServers := map[string]*cloudscale.Server{}
-	cloudscaleClient := NewFakeClient(initialServers)
+	cloudscaleClient := cloudscalefake.NewClient(initialServers)
 
 	return &Driver{
-		mounter:          &fakeMounter{},
+		mounter:          mounter.NewFake(),
 		log:              logrus.New().WithField("test_enabled", true),
 		cloudscaleClient: cloudscaleClient,
 	}
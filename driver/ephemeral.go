@@ -0,0 +1,287 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// EphemeralSizeAttribute defines the size of an ephemeral inline volume,
+	// given as a Kubernetes quantity (e.g. "10Gi")
+	EphemeralSizeAttribute = DriverName + "/size"
+
+	// ephemeralContextKey is set to "true" by kubelet in the volume context
+	// of ephemeral inline volumes
+	ephemeralContextKey = "csi.storage.k8s.io/ephemeral"
+
+	// kubelet generates the IDs of ephemeral inline volumes with this prefix
+	ephemeralVolumeIDPrefix = "csi-"
+
+	// ephemeralTag marks cloudscale.ch volumes that were created for an
+	// ephemeral inline volume and are deleted when it is unpublished
+	ephemeralTag = "csi-cloudscale-ephemeral"
+)
+
+// isEphemeralVolume returns true if the publish request is for an ephemeral
+// inline volume
+func isEphemeralVolume(req *csi.NodePublishVolumeRequest) bool {
+	return req.VolumeContext[ephemeralContextKey] == "true"
+}
+
+// nodePublishEphemeralVolume creates a scratch volume for an ephemeral inline
+// volume, attaches it to this node, formats it and mounts it to the target
+// path. As kubelet does not stage ephemeral volumes, the volume is mounted
+// to the target path directly.
+func (d *Driver) nodePublishEphemeralVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	mnt := req.VolumeCapability.GetMount()
+	if mnt == nil {
+		return nil, status.Error(codes.InvalidArgument, "ephemeral inline volumes only support the mount access type")
+	}
+
+	volumeContext := req.VolumeContext
+	storageType := volumeContext[StorageTypeAttribute]
+	if storageType == "" {
+		storageType = "ssd"
+	}
+	if storageType != "ssd" && storageType != "bulk" {
+		return nil, status.Error(codes.InvalidArgument, "invalid volume type requested. Only 'ssd' or 'bulk' are supported")
+	}
+
+	var capRange *csi.CapacityRange
+	if size := volumeContext[EphemeralSizeAttribute]; size != "" {
+		quantity, err := resource.ParseQuantity(size)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid size %q: %v", size, err)
+		}
+		capRange = &csi.CapacityRange{RequiredBytes: quantity.Value()}
+	}
+	sizeGB, err := calculateStorageGB(capRange, storageType)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// unlike PVCs, inline volumes are not subject to storage quotas
+	if d.maxEphemeralVolumeSize > 0 && int64(sizeGB)*GB > d.maxEphemeralVolumeSize {
+		return nil, status.Errorf(codes.OutOfRange, "the ephemeral volume of %s exceeds the maximum size of %s",
+			formatBytes(int64(sizeGB)*GB), formatBytes(d.maxEphemeralVolumeSize))
+	}
+
+	ll := d.logFor(ctx).WithFields(logrus.Fields{
+		"volume_id":               req.VolumeId,
+		"target_path":             req.TargetPath,
+		"storage_size_giga_bytes": sizeGB,
+		"type":                    storageType,
+		"method":                  "node_publish_ephemeral_volume",
+	})
+	ll.Info("node publish ephemeral volume called")
+
+	secrets := req.Secrets
+	luksEncrypted := volumeContext[LuksEncryptedAttribute] == "true"
+	if luksEncrypted {
+		secrets, err = resolveLuksKey(ctx, d.luksKeyProvider, secrets)
+		if err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
+
+	vol, err := d.findEphemeralVolume(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if vol == nil {
+		volumeReq := &cloudscale.VolumeRequest{
+			Name:   req.VolumeId,
+			SizeGB: sizeGB,
+			Type:   storageType,
+		}
+		volumeReq.Zone = d.zone
+		volumeReq.Tags = cloudscale.TagMap{
+			managedByTag: managedByTagValue,
+			ephemeralTag: "true",
+		}
+
+		ll.Info("creating ephemeral volume")
+		vol, err = d.cloudscaleClient.Volumes.Create(ctx, volumeReq)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if err := d.attachEphemeralVolume(ctx, vol, ll); err != nil {
+		return nil, err
+	}
+
+	sourcePtr, err := d.mounter.FinalizeVolumeAttachmentAndFindPath(ctx, ll, vol.UUID)
+	if err != nil {
+		if _, ok := err.(*mounter.DeviceNotFoundError); ok {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		return nil, err
+	}
+	source := *sourcePtr
+
+	luksContext := getLuksContext(secrets, map[string]string{
+		LuksEncryptedAttribute: fmt.Sprintf("%t", luksEncrypted),
+		PublishInfoVolumeName:  req.VolumeId,
+		LuksCipherAttribute:    volumeContext[LuksCipherAttribute],
+		LuksKeySizeAttribute:   volumeContext[LuksKeySizeAttribute],
+	}, mounter.VolumeLifecycleNodeStageVolume)
+
+	fsType := "ext4"
+	if mnt.FsType != "" {
+		fsType = mnt.FsType
+	}
+
+	options := append([]string{}, mnt.MountFlags...)
+	if req.Readonly {
+		options = append(options, "ro")
+	}
+
+	ll = ll.WithFields(logrus.Fields{
+		"source":         source,
+		"fs_type":        fsType,
+		"mount_options":  options,
+		"luks_encrypted": luksContext.EncryptionEnabled,
+	})
+
+	formatted, err := d.mounter.IsFormatted(ctx, source, luksContext)
+	if err != nil {
+		return nil, err
+	}
+	if !formatted {
+		if err := d.mounter.VerifyDevice(source, vol.UUID, int64(vol.SizeGB)*GB); err != nil {
+			if _, ok := err.(*mounter.DeviceMismatchError); ok {
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		ll.Info("formatting the ephemeral volume")
+		if err := d.mounter.Format(ctx, source, fsType, luksContext); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	mounted, err := d.mounter.IsMounted(req.TargetPath)
+	if err != nil {
+		return nil, err
+	}
+	if !mounted {
+		ll.Info("mounting the ephemeral volume")
+		if err := d.mounter.Mount(ctx, source, req.TargetPath, fsType, luksContext, options...); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	ll.Info("publishing ephemeral volume is finished")
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// nodeUnpublishEphemeralVolume unmounts an ephemeral inline volume and
+// deletes the scratch volume. It returns false if the volume is not an
+// ephemeral inline volume.
+func (d *Driver) nodeUnpublishEphemeralVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest, ll *logrus.Entry) (bool, error) {
+	// only the IDs generated by kubelet can belong to ephemeral volumes,
+	// which saves an API request for all other volumes
+	if !isKubernetes(d.orchestrator) || !strings.HasPrefix(req.VolumeId, ephemeralVolumeIDPrefix) {
+		return false, nil
+	}
+
+	vol, err := d.findEphemeralVolume(ctx, req.VolumeId)
+	if err != nil {
+		return false, err
+	}
+	if vol == nil {
+		return false, nil
+	}
+
+	ll = ll.WithField("ephemeral_volume", vol.UUID)
+
+	// closes the luks mapping of encrypted volumes as well
+	err = d.mounter.Unmount(ctx, req.TargetPath, mounter.LuksContext{VolumeLifecycle: mounter.VolumeLifecycleNodeUnstageVolume})
+	if err != nil {
+		return true, err
+	}
+
+	ll.Info("detaching ephemeral volume")
+	err = d.cloudscaleClient.Volumes.Update(ctx, vol.UUID, &cloudscale.VolumeRequest{
+		ServerUUIDs: &[]string{},
+	})
+	if err != nil {
+		return true, reraiseNotFound(err, ll, "detaching ephemeral volume")
+	}
+
+	ll.Info("deleting ephemeral volume")
+	err = d.cloudscaleClient.Volumes.Delete(ctx, vol.UUID)
+	if err != nil {
+		if errorResponse, ok := err.(*cloudscale.ErrorResponse); ok && errorResponse.StatusCode == http.StatusNotFound {
+			return true, nil
+		}
+		return true, status.Error(codes.Internal, err.Error())
+	}
+	return true, nil
+}
+
+// findEphemeralVolume returns the volume created for the ephemeral inline
+// volume with the given ID or nil if there is none
+func (d *Driver) findEphemeralVolume(ctx context.Context, volumeID string) (*cloudscale.Volume, error) {
+	volumes, err := d.cloudscaleClient.Volumes.List(ctx, cloudscale.WithNameFilter(volumeID))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	for _, vol := range volumes {
+		if vol.Tags[ephemeralTag] == "true" {
+			return &vol, nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *Driver) attachEphemeralVolume(ctx context.Context, vol *cloudscale.Volume, ll *logrus.Entry) error {
+	if vol.ServerUUIDs != nil {
+		for _, serverUUID := range *vol.ServerUUIDs {
+			if serverUUID == d.serverId {
+				return nil
+			}
+			return status.Errorf(codes.FailedPrecondition, "ephemeral volume %s is attached to server %s", vol.UUID, serverUUID)
+		}
+	}
+
+	ll.WithField("server_id", d.serverId).Info("attaching ephemeral volume")
+	err := d.cloudscaleClient.Volumes.Update(ctx, vol.UUID, &cloudscale.VolumeRequest{
+		ServerUUIDs: &[]string{d.serverId},
+	})
+	if err != nil {
+		if maxVolumesPerServerErrorMessageRe.MatchString(err.Error()) {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return reraiseNotFound(err, ll, "attaching ephemeral volume")
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// EraseOnDeleteAttribute defines how the data of a volume is destroyed
+	// before the volume is deleted; must be one of "discard", "zero" or
+	// "crypto"
+	EraseOnDeleteAttribute = DriverName + "/erase-on-delete"
+
+	// eraseOnDeleteTag is the tag of the cloudscale.ch volume used to
+	// remember the erase mode until the volume is deleted
+	eraseOnDeleteTag = "csi-cloudscale-erase-on-delete"
+
+	// eraseServerTag is set by DeleteVolume to the server which last had
+	// the volume attached, the node plugin on this server erases the volume
+	eraseServerTag = "csi-cloudscale-erase-server"
+
+	// erasedTag is set by the node plugin to the time the volume was erased
+	erasedTag = "csi-cloudscale-erased-at"
+
+	// eraseCheckInterval is how often the node plugin looks for volumes to
+	// erase
+	eraseCheckInterval = 30 * time.Second
+)
+
+// validateEraseMode checks that the given erase mode is supported for the
+// volume.
+func validateEraseMode(mode string, luksEncrypted bool) error {
+	switch mode {
+	case mounter.EraseModeDiscard, mounter.EraseModeZero:
+		return nil
+	case mounter.EraseModeCrypto:
+		if !luksEncrypted {
+			return fmt.Errorf("erase mode %q requires a luks encrypted volume", mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid erase mode %q, must be one of %q, %q or %q", mode, mounter.EraseModeDiscard, mounter.EraseModeZero, mounter.EraseModeCrypto)
+	}
+}
+
+// eraseVolume makes sure the data of the given volume is destroyed before it
+// is deleted. The volume is erased by the node plugin on the server which
+// last had the volume attached, as this server is in the zone of the volume
+// and has access to the devices. The request and the result of the erase are
+// kept in the tags of the volume, so that they survive restarts of the
+// controller and the node plugin. codes.Aborted is returned until the volume
+// is erased, the CO retries DeleteVolume later.
+func (d *Driver) eraseVolume(ctx context.Context, vol *cloudscale.Volume, ll *logrus.Entry) error {
+	if vol.Tags[erasedTag] != "" {
+		ll.WithField("erased_at", vol.Tags[erasedTag]).Info("volume is erased")
+		return nil
+	}
+
+	serverUUID := vol.Tags[eraseServerTag]
+	if serverUUID == "" {
+		serverUUID = lastAttachedServer(vol.Tags)
+		if serverUUID == "" {
+			// the volume is blank, as only the node plugin writes to it
+			ll.Warn("volume was never attached, there is nothing to erase")
+			return nil
+		}
+
+		tags := cloudscale.TagMap{}
+		for key, value := range vol.Tags {
+			tags[key] = value
+		}
+		tags[eraseServerTag] = serverUUID
+		req := &cloudscale.VolumeRequest{}
+		req.Tags = tags
+		if err := d.cloudscaleClient.Volumes.Update(ctx, vol.UUID, req); err != nil {
+			return status.Errorf(codes.Internal, "requesting the erase of volume %s: %v", vol.UUID, err)
+		}
+		ll.WithField("server_id", serverUUID).Info("requested the erase of the volume")
+		return status.Errorf(codes.Aborted, "erasing volume %s has been requested from server %s", vol.UUID, serverUUID)
+	}
+
+	if _, err := d.cloudscaleClient.Servers.Get(ctx, serverUUID); err != nil {
+		var errResp *cloudscale.ErrorResponse
+		if errors.As(err, &errResp) && errResp.StatusCode == http.StatusNotFound {
+			return status.Errorf(codes.FailedPrecondition, "volume %s cannot be erased, server %s which last had it attached no longer exists", vol.UUID, serverUUID)
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	return status.Errorf(codes.Aborted, "erasing volume %s on server %s is still in progress", vol.UUID, serverUUID)
+}
+
+// lastAttachedServer returns the server of the newest attachment in the
+// attach history or an empty string if the volume was never attached.
+func lastAttachedServer(tags cloudscale.TagMap) string {
+	entries := attachHistory(tags)
+	for i := len(entries) - 1; i >= 0; i-- {
+		fields := strings.Fields(entries[i])
+		if len(fields) == 3 && fields[1] == attachOperation {
+			return fields[2]
+		}
+	}
+	return ""
+}
+
+// runEraseLoop periodically erases the volumes which DeleteVolume requested
+// this node to erase. It returns once stop is closed and an erase in progress
+// is done, as erasing runs to completion like formatting; the volume stays
+// locked meanwhile. An erase interrupted by a restart is started again, as the
+// request is kept in the tags of the volume.
+func (d *Driver) runEraseLoop(interval time.Duration, stop <-chan struct{}) {
+	ll := d.log.WithFields(logrus.Fields{
+		"method":   "erase",
+		"interval": interval,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		d.eraseRequestedVolumes(ctx, ll)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// eraseRequestedVolumes erases the volumes tagged to be erased by this node
+func (d *Driver) eraseRequestedVolumes(ctx context.Context, ll *logrus.Entry) {
+	volumes, err := d.cloudscaleClient.Volumes.List(ctx, withTag(eraseServerTag, d.serverId))
+	if err != nil {
+		ll.WithError(err).Error("failed to list the volumes to erase")
+		return
+	}
+
+	for i := range volumes {
+		vol := &volumes[i]
+		if vol.Tags[eraseServerTag] != d.serverId || vol.Tags[erasedTag] != "" {
+			continue
+		}
+		vll := ll.WithFields(logrus.Fields{
+			"volume_id":  vol.UUID,
+			"erase_mode": vol.Tags[eraseOnDeleteTag],
+		})
+		if err := d.eraseOnNode(ctx, vol, vll); err != nil {
+			vll.WithError(err).Error("erasing volume failed")
+			continue
+		}
+		vll.Info("volume was erased")
+	}
+}
+
+// eraseOnNode attaches the given volume to this node, erases it, and then
+// detaches and tags it as erased with a single update.
+func (d *Driver) eraseOnNode(ctx context.Context, vol *cloudscale.Volume, ll *logrus.Entry) error {
+	unlock, err := d.lockVolume(vol.UUID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	attachedHere := false
+	if vol.ServerUUIDs != nil {
+		for _, serverUUID := range *vol.ServerUUIDs {
+			if serverUUID != d.serverId {
+				return fmt.Errorf("volume is attached to server %s", serverUUID)
+			}
+			attachedHere = true
+		}
+	}
+	if !attachedHere {
+		ll.Info("attaching volume to erase it")
+		err := d.cloudscaleClient.Volumes.Update(ctx, vol.UUID, &cloudscale.VolumeRequest{
+			ServerUUIDs: &[]string{d.serverId},
+		})
+		if err != nil {
+			return fmt.Errorf("attaching volume failed: %v", err)
+		}
+	}
+
+	source, err := d.mounter.FinalizeVolumeAttachmentAndFindPath(ctx, ll, vol.UUID)
+	if err == nil {
+		ll.WithField("source", *source).Info("erasing volume")
+		err = d.mounter.Erase(ctx, *source, vol.Tags[eraseOnDeleteTag])
+	}
+	if err != nil {
+		// the volume is not left attached to this node until the next
+		// attempt, which attaches it again
+		if !attachedHere {
+			detachErr := d.cloudscaleClient.Volumes.Update(ctx, vol.UUID, &cloudscale.VolumeRequest{
+				ServerUUIDs: &[]string{},
+			})
+			if detachErr != nil {
+				ll.WithError(detachErr).Warn("detaching the volume after the failed erase failed")
+			}
+		}
+		return err
+	}
+
+	tags := cloudscale.TagMap{}
+	for key, value := range vol.Tags {
+		tags[key] = value
+	}
+	tags[erasedTag] = time.Now().UTC().Format(time.RFC3339)
+	req := &cloudscale.VolumeRequest{ServerUUIDs: &[]string{}}
+	req.Tags = tags
+	if err := d.cloudscaleClient.Volumes.Update(ctx, vol.UUID, req); err != nil {
+		return fmt.Errorf("detaching erased volume failed: %v", err)
+	}
+	return nil
+}
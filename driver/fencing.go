@@ -0,0 +1,180 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	coreclient "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// FenceTaint fences a node, all volumes of the driver are detached from
+	// its server. It is meant for nodes which are known to be down.
+	FenceTaint = DriverName + "/fenced"
+	// outOfServiceTaint is the taint of the non-graceful node shutdown of
+	// Kubernetes, which fences the node as well
+	outOfServiceTaint = "node.kubernetes.io/out-of-service"
+
+	// DefaultFencingInterval is how often the tainted nodes are fenced by
+	// default
+	DefaultFencingInterval = 10 * time.Second
+
+	// nodeIDAnnotation maps the CSI drivers of a node to its node IDs, which
+	// are the server IDs for this driver
+	nodeIDAnnotation = "csi.volume.kubernetes.io/nodeid"
+)
+
+// nodeClient is the part of the Kubernetes Node client used by the node
+// fencing and the node labeler
+type nodeClient interface {
+	List(ctx context.Context, opts metav1.ListOptions) (*corev1.NodeList, error)
+	Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*corev1.Node, error)
+}
+
+// newNodeClient returns a Node client using the given kubeconfig, or the
+// service account of the pod if it is empty
+func newNodeClient(kubeconfig string) (nodeClient, error) {
+	config, err := kubernetesConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := coreclient.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create the Kubernetes client: %v", err)
+	}
+	return client.Nodes(), nil
+}
+
+// isFenced returns true if the node has the fence or the out-of-service
+// taint
+func isFenced(node *corev1.Node) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == FenceTaint || taint.Key == outOfServiceTaint {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeServerID returns the server ID of the node, which the node plugin
+// registered as its node ID
+func nodeServerID(node *corev1.Node) (string, error) {
+	annotation := node.Annotations[nodeIDAnnotation]
+	if annotation == "" {
+		return "", fmt.Errorf("node %s has no %s annotation", node.Name, nodeIDAnnotation)
+	}
+	var nodeIDs map[string]string
+	if err := json.Unmarshal([]byte(annotation), &nodeIDs); err != nil {
+		return "", fmt.Errorf("node %s has an invalid %s annotation: %v", node.Name, nodeIDAnnotation, err)
+	}
+	serverID := nodeIDs[DriverName]
+	if serverID == "" {
+		return "", fmt.Errorf("node %s is not registered by %s", node.Name, DriverName)
+	}
+	return serverID, nil
+}
+
+// runFencingLoop fences the tainted nodes in the given interval until stop
+// is closed. With multiple controller replicas, every replica fences; the
+// detaches are idempotent.
+func (d *Driver) runFencingLoop(client nodeClient, interval time.Duration, stop <-chan struct{}) {
+	ll := d.log.WithFields(logrus.Fields{
+		"method":   "node_fencing",
+		"interval": interval,
+	})
+	ll.Info("starting node fencing")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			d.fenceNodes(ctx, client, ll)
+			cancel()
+		}
+	}
+}
+
+// fenceNodes detaches the volumes of the driver from the servers of all
+// tainted nodes. The volumes attached to a fenced server are detached again
+// in every run, e.g. if the attacher still had an attachment in flight.
+func (d *Driver) fenceNodes(ctx context.Context, client nodeClient, ll *logrus.Entry) {
+	nodes, err := client.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		ll.WithError(err).Warn("couldn't list the nodes")
+		return
+	}
+
+	fenced := map[string]string{}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if !isFenced(node) {
+			continue
+		}
+		serverID, err := nodeServerID(node)
+		if err != nil {
+			ll.WithError(err).Warn("couldn't fence node")
+			continue
+		}
+		fenced[serverID] = node.Name
+	}
+	if len(fenced) == 0 {
+		return
+	}
+
+	volumes, err := listAllVolumes(ctx, d.cloudscaleClient.Volumes)
+	if err != nil {
+		ll.WithError(err).Warn("couldn't list the volumes of the fenced nodes")
+		return
+	}
+	for _, vol := range volumes {
+		if !IsManagedVolume(vol) || vol.ServerUUIDs == nil {
+			continue
+		}
+		for _, serverID := range *vol.ServerUUIDs {
+			nodeName, ok := fenced[serverID]
+			if !ok {
+				continue
+			}
+			ll := ll.WithFields(logrus.Fields{
+				"node":      nodeName,
+				"server_id": serverID,
+				"volume_id": vol.UUID,
+			})
+			ll.Warn("detaching volume from fenced node")
+			err := d.cloudscaleClient.Volumes.Update(ctx, vol.UUID, &cloudscale.VolumeRequest{
+				ServerUUIDs: &[]string{},
+			})
+			if err != nil {
+				ll.WithError(err).Error("couldn't detach volume from fenced node")
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fakeNodes stores nodes and applies merge patches of their labels
+type fakeNodes struct {
+	mu      sync.Mutex
+	nodes   []corev1.Node
+	patches int
+}
+
+func (f *fakeNodes) List(ctx context.Context, opts metav1.ListOptions) (*corev1.NodeList, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := &corev1.NodeList{}
+	for _, node := range f.nodes {
+		list.Items = append(list.Items, *node.DeepCopy())
+	}
+	return list, nil
+}
+
+func (f *fakeNodes) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*corev1.Node, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var patch struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	for i := range f.nodes {
+		node := &f.nodes[i]
+		if node.Name != name {
+			continue
+		}
+		if node.Labels == nil {
+			node.Labels = map[string]string{}
+		}
+		for key, value := range patch.Metadata.Labels {
+			node.Labels[key] = value
+		}
+		f.patches++
+		return node.DeepCopy(), nil
+	}
+	return nil, apierrors.NewNotFound(corev1.Resource("nodes"), name)
+}
+
+func testNode(name, serverID string, taints ...string) corev1.Node {
+	node := corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{nodeIDAnnotation: `{"` + DriverName + `":"` + serverID + `"}`},
+		},
+	}
+	for _, key := range taints {
+		node.Spec.Taints = append(node.Spec.Taints, corev1.Taint{Key: key, Effect: corev1.TaintEffectNoExecute})
+	}
+	return node
+}
+
+func TestIsFenced(t *testing.T) {
+	node := testNode("node-1", "1")
+	assert.False(t, isFenced(&node))
+	node = testNode("node-1", "1", "node.kubernetes.io/unreachable")
+	assert.False(t, isFenced(&node))
+	node = testNode("node-1", "1", FenceTaint)
+	assert.True(t, isFenced(&node))
+	node = testNode("node-1", "1", outOfServiceTaint)
+	assert.True(t, isFenced(&node))
+}
+
+func TestNodeServerID(t *testing.T) {
+	node := testNode("node-1", "987654")
+	serverID, err := nodeServerID(&node)
+	assert.NoError(t, err)
+	assert.Equal(t, "987654", serverID)
+
+	node.Annotations[nodeIDAnnotation] = `{"other.csi.driver":"1"}`
+	_, err = nodeServerID(&node)
+	assert.Error(t, err)
+
+	node.Annotations[nodeIDAnnotation] = "invalid"
+	_, err = nodeServerID(&node)
+	assert.Error(t, err)
+
+	delete(node.Annotations, nodeIDAnnotation)
+	_, err = nodeServerID(&node)
+	assert.Error(t, err)
+}
+
+func TestFenceNodes(t *testing.T) {
+	client := cloudscalefake.NewClient(map[string]*cloudscale.Server{
+		"1": {UUID: "1"},
+		"2": {UUID: "2"},
+	})
+	driver := &Driver{
+		cloudscaleClient: client,
+		mounter:          mounter.NewFake(),
+		log:              logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	attach := func(name, serverID string) string {
+		vol, err := client.Volumes.Create(ctx, &cloudscale.VolumeRequest{Name: name, SizeGB: 1})
+		assert.NoError(t, err)
+		err = client.Volumes.Update(ctx, vol.UUID, &cloudscale.VolumeRequest{ServerUUIDs: &[]string{serverID}})
+		assert.NoError(t, err)
+		return vol.UUID
+	}
+	fencedVolume := attach("pvc-1", "1")
+	otherVolume := attach("manual", "1")
+	healthyVolume := attach("pvc-2", "2")
+
+	nodes := &fakeNodes{nodes: []corev1.Node{testNode("node-1", "1", FenceTaint), testNode("node-2", "2")}}
+	driver.fenceNodes(ctx, nodes, driver.log)
+
+	servers := func(volumeID string) []string {
+		vol, err := client.Volumes.Get(ctx, volumeID)
+		assert.NoError(t, err)
+		return *vol.ServerUUIDs
+	}
+	assert.Empty(t, servers(fencedVolume))
+	// only the volumes of the driver are detached
+	assert.Equal(t, []string{"1"}, servers(otherVolume))
+	assert.Equal(t, []string{"2"}, servers(healthyVolume))
+}
+
+func TestNewDriverNodeFencing(t *testing.T) {
+	d, err := NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()), WithNodeFencing(0),
+		func(o *options) { o.nodeClient = &fakeNodes{} })
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultFencingInterval, d.fencingInterval)
+	assert.NotNil(t, d.nodeClient)
+
+	_, err = NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()), WithNodeFencing(0), WithMode(ModeNode),
+		func(o *options) { o.nodeClient = &fakeNodes{} })
+	assert.Error(t, err)
+}
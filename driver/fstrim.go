@@ -0,0 +1,99 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/mount-utils"
+)
+
+const (
+	// DiscardAttribute is used to pass the information if the volume should
+	// be mounted with the discard option to `NodeStageVolume`
+	DiscardAttribute = DriverName + "/discard"
+
+	// DiscardBeforeFormatAttribute is used to pass the information if the
+	// whole device should be discarded before it is formatted to
+	// `NodeStageVolume`
+	DiscardBeforeFormatAttribute = DriverName + "/discard-before-format"
+)
+
+// listStagingTargetPaths returns the staging target paths of all volumes
+// which are currently staged with a filesystem on this node.
+func listStagingTargetPaths(orchestrator string) ([]string, error) {
+	mountPoints, err := mount.New("").List()
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, mp := range mountPoints {
+		if strings.HasPrefix(mp.Device, "/dev/") && isStagingTargetPath(orchestrator, mp.Path) {
+			paths = append(paths, mp.Path)
+		}
+	}
+	return paths, nil
+}
+
+// runFstrimLoop periodically runs fstrim on all staged volumes, so that
+// deleted data is released to the storage backend. It returns once stop is
+// closed.
+func (d *Driver) runFstrimLoop(interval time.Duration, stop <-chan struct{}) {
+	ll := d.log.WithFields(logrus.Fields{
+		"method":   "fstrim",
+		"interval": interval,
+	})
+	ll.Info("starting periodic fstrim")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		paths, err := listStagingTargetPaths(d.orchestrator)
+		if err != nil {
+			ll.WithError(err).Error("failed to list staged volumes")
+			continue
+		}
+
+		for _, path := range paths {
+			if err := fstrim(path); err != nil {
+				ll.WithError(err).WithField("staging_target_path", path).Warn("fstrim failed")
+				continue
+			}
+			ll.WithField("staging_target_path", path).Info("fstrim finished")
+		}
+	}
+}
+
+func fstrim(target string) error {
+	out, err := exec.Command("fstrim", target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fstrim failed: %v cmd: 'fstrim %s' output: %q", err, target, string(out))
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCServerConfig tunes the gRPC server of the CSI endpoint. Zero values
+// keep the defaults of grpc-go.
+type GRPCServerConfig struct {
+	// MaxConcurrentStreams limits the number of concurrent calls per
+	// connection, e.g. of kubelet or a sidecar
+	MaxConcurrentStreams uint32
+
+	// MaxRecvMsgSize is the maximum size of a request in bytes; grpc-go
+	// defaults to 4 MiB
+	MaxRecvMsgSize int
+
+	// KeepaliveTime is the idle time after which the server pings a client
+	// to check that the connection is alive; grpc-go defaults to 2 hours
+	KeepaliveTime time.Duration
+
+	// KeepaliveTimeout is how long the server waits for the response to a
+	// ping before closing the connection; grpc-go defaults to 20 seconds
+	KeepaliveTimeout time.Duration
+
+	// Reflection enables the gRPC reflection service, so that the CSI
+	// socket can be queried with tools like grpcurl
+	Reflection bool
+}
+
+func (c GRPCServerConfig) validate() error {
+	if c.MaxRecvMsgSize < 0 {
+		return errors.New("the max. gRPC receive message size must not be negative")
+	}
+	if c.KeepaliveTime < 0 || c.KeepaliveTimeout < 0 {
+		return errors.New("the gRPC keepalive time and timeout must not be negative")
+	}
+	return nil
+}
+
+// grpcServerOptions returns the options of the gRPC server, which include
+// the interceptors of the driver
+func (d *Driver) grpcServerOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(d.requestIDInterceptor, d.tracingInterceptor, d.metricsInterceptor, d.logInterceptor, d.contextInterceptor),
+	}
+
+	c := d.grpcServer
+	if c.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(c.MaxConcurrentStreams))
+	}
+	if c.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(c.MaxRecvMsgSize))
+	}
+	if c.KeepaliveTime > 0 || c.KeepaliveTimeout > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    c.KeepaliveTime,
+			Timeout: c.KeepaliveTimeout,
+		}))
+	}
+	return opts
+}
+
+// contextInterceptor reports the failure of a call whose context is done as
+// canceled or as exceeded deadline instead of as internal error. The failure
+// is caused by the cancellation in that case, e.g. a killed command, and the
+// sidecars retry these calls instead of reporting them as failed.
+func (d *Driver) contextInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err == nil || ctx.Err() == nil {
+		return resp, err
+	}
+
+	switch status.Code(err) {
+	case codes.Internal, codes.Unknown:
+		st, _ := status.FromError(err)
+		return resp, status.Error(status.FromContextError(ctx.Err()).Code(), st.Message())
+	}
+	return resp, err
+}
+
+// registerServices registers the CSI services of the driver and, if enabled,
+// the reflection service with the given gRPC server
+func (d *Driver) registerServices(srv *grpc.Server) {
+	csi.RegisterIdentityServer(srv, d)
+	csi.RegisterControllerServer(srv, d)
+	csi.RegisterNodeServer(srv, d)
+
+	if d.grpcServer.Reflection {
+		reflection.Register(srv)
+	}
+}
@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCServerOptions(t *testing.T) {
+	d := &Driver{}
+	assert.Len(t, d.grpcServerOptions(), 1)
+
+	d.grpcServer = GRPCServerConfig{
+		MaxConcurrentStreams: 10,
+		MaxRecvMsgSize:       1 << 20,
+		KeepaliveTime:        time.Minute,
+	}
+	assert.Len(t, d.grpcServerOptions(), 4)
+}
+
+func TestGRPCServerConfigValidate(t *testing.T) {
+	assert.NoError(t, GRPCServerConfig{}.validate())
+	assert.Error(t, GRPCServerConfig{MaxRecvMsgSize: -1}.validate())
+	assert.Error(t, GRPCServerConfig{KeepaliveTimeout: -time.Second}.validate())
+}
+
+func TestRegisterServicesReflection(t *testing.T) {
+	const reflectionService = "grpc.reflection.v1alpha.ServerReflection"
+
+	d := &Driver{}
+	srv := grpc.NewServer()
+	d.registerServices(srv)
+	assert.Contains(t, srv.GetServiceInfo(), "csi.v1.Node")
+	assert.NotContains(t, srv.GetServiceInfo(), reflectionService)
+
+	d.grpcServer.Reflection = true
+	srv = grpc.NewServer()
+	d.registerServices(srv)
+	assert.Contains(t, srv.GetServiceInfo(), reflectionService)
+}
+
+func TestContextInterceptor(t *testing.T) {
+	d := &Driver{}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	failing := func(err error) grpc.UnaryHandler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, err
+		}
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := d.contextInterceptor(canceled, nil, info, failing(status.Error(codes.Internal, "mkfs failed: signal: killed")))
+	assert.Equal(t, codes.Canceled, status.Code(err))
+	assert.Contains(t, err.Error(), "mkfs failed")
+
+	_, err = d.contextInterceptor(canceled, nil, info, failing(errors.New("context canceled")))
+	assert.Equal(t, codes.Canceled, status.Code(err))
+
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	_, err = d.contextInterceptor(expired, nil, info, failing(status.Error(codes.Internal, "udevadm settle failed")))
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// other codes are kept, e.g. to retry on Unavailable
+	_, err = d.contextInterceptor(canceled, nil, info, failing(status.Error(codes.Unavailable, "not yet")))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// errors of calls whose context is not done are kept as well
+	_, err = d.contextInterceptor(context.Background(), nil, info, failing(status.Error(codes.Internal, "mkfs failed")))
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
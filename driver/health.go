@@ -0,0 +1,238 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ModeAll runs the health checks of the controller and the node plugin
+	ModeAll = "all"
+	// ModeController runs the health checks of the controller plugin
+	ModeController = "controller"
+	// ModeNode runs the health checks of the node plugin
+	ModeNode = "node"
+
+	// DefaultAPICheckInterval is how often the controller checks the
+	// cloudscale.ch API by default
+	DefaultAPICheckInterval = 30 * time.Second
+	// DefaultAPICheckFailureThreshold is the number of consecutive failed
+	// API checks after which the controller is not ready by default
+	DefaultAPICheckFailureThreshold = 3
+
+	healthCheckTimeout = 5 * time.Second
+)
+
+// requiredNodeTools are the binaries the node plugin executes to format,
+// mount, resize and encrypt volumes
+var requiredNodeTools = []string{
+	"mount",
+	"umount",
+	"mkfs.ext4",
+	"mkfs.xfs",
+	"resize2fs",
+	"xfs_growfs",
+	"cryptsetup",
+	"blockdev",
+	"udevadm",
+}
+
+// isValidMode returns true for the modes the driver can run in
+func isValidMode(mode string) bool {
+	switch mode {
+	case ModeAll, ModeController, ModeNode:
+		return true
+	}
+	return false
+}
+
+// healthChecker runs the checks of the health endpoints
+type healthChecker struct {
+	mu          sync.Mutex
+	apiFailures int
+	apiErr      error
+	lookPath    func(string) (string, error)
+	checkSocket func() error
+}
+
+// serveHealth serves /healthz and /readyz on the given listener until it is
+// closed.
+func (d *Driver) serveHealth(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, d.checkLiveness())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, d.checkReadiness())
+	})
+
+	d.log.WithField("addr", listener.Addr().String()).Info("health endpoint started")
+	err := http.Serve(listener, mux)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		d.log.WithError(err).Error("health endpoint failed")
+	}
+}
+
+func writeHealth(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// checkLiveness returns an error if the gRPC server does not serve the CSI
+// socket
+func (d *Driver) checkLiveness() error {
+	d.readyMu.Lock()
+	ready := d.ready
+	d.readyMu.Unlock()
+	if !ready {
+		return errors.New("the gRPC server is not running")
+	}
+
+	if err := d.health.checkSocket(); err != nil {
+		return fmt.Errorf("the CSI socket is not available: %v", err)
+	}
+	return nil
+}
+
+// checkReadiness returns an error if the driver cannot serve requests: the
+// controller needs the cloudscale.ch API and the node needs the tools to
+// format and mount volumes. The API is checked periodically by
+// runAPICheckLoop, the readiness only fails after several failed checks in a
+// row, so that a single hiccup of the API does not take the controller out of
+// service.
+func (d *Driver) checkReadiness() error {
+	if err := d.checkLiveness(); err != nil {
+		return err
+	}
+
+	if d.mode == ModeAll || d.mode == ModeController {
+		d.health.mu.Lock()
+		failures, apiErr := d.health.apiFailures, d.health.apiErr
+		d.health.mu.Unlock()
+		if failures >= d.apiCheckFailureThreshold {
+			return fmt.Errorf("the cloudscale.ch API check failed %d times in a row: %v", failures, apiErr)
+		}
+	}
+
+	if d.mode == ModeAll || d.mode == ModeNode {
+		var missing []string
+		for _, tool := range requiredNodeTools {
+			if _, err := d.health.lookPath(tool); err != nil {
+				missing = append(missing, tool)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("required tools are missing: %s", strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
+
+// runAPICheckLoop checks the cloudscale.ch API in the given interval until
+// the stop channel is closed
+func (d *Driver) runAPICheckLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		d.checkAPI(ctx)
+		cancel()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAPI gets the server of the driver, or the regions if there is none,
+// from the cloudscale.ch API and records the number of consecutive failures.
+// An invalid token is logged as such, as it will not recover by itself.
+func (d *Driver) checkAPI(ctx context.Context) {
+	var err error
+	if d.serverId == "" {
+		// the controller runs outside of a cloudscale.ch server
+		_, err = d.cloudscaleClient.Regions.List(ctx)
+	} else {
+		_, err = d.cloudscaleClient.Servers.Get(ctx, d.serverId)
+	}
+
+	d.health.mu.Lock()
+	if err != nil {
+		d.health.apiFailures++
+	} else {
+		d.health.apiFailures = 0
+	}
+	d.health.apiErr = err
+	failures := d.health.apiFailures
+	d.health.mu.Unlock()
+
+	d.metrics.setAPICheck(failures, failures < d.apiCheckFailureThreshold)
+
+	if err == nil {
+		return
+	}
+	ll := d.log.WithFields(logrus.Fields{
+		"method":   "check_api",
+		"failures": failures,
+	}).WithError(err)
+
+	var errResp *cloudscale.ErrorResponse
+	if errors.As(err, &errResp) && isAuthFailure(errResp.StatusCode) {
+		ll.Error("the cloudscale.ch API rejected the token")
+	} else {
+		ll.Warn("the cloudscale.ch API check failed")
+	}
+}
+
+// dialSocket returns a function checking that the unix socket at the given
+// address accepts connections
+func dialSocket(addr string) func() error {
+	return func() error {
+		conn, err := net.DialTimeout("unix", addr, healthCheckTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+func newHealthChecker(socket string) *healthChecker {
+	return &healthChecker{
+		lookPath:    exec.LookPath,
+		checkSocket: dialSocket(socket),
+	}
+}
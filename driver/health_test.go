@@ -0,0 +1,137 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newHealthTestDriver(mode string) *Driver {
+	return &Driver{
+		serverId: "987654",
+		cloudscaleClient: cloudscalefake.NewClient(map[string]*cloudscale.Server{
+			"987654": {UUID: "987654"},
+		}),
+		log:   logrus.NewEntry(logrus.New()),
+		mode:  mode,
+		ready: true,
+
+		apiCheckFailureThreshold: DefaultAPICheckFailureThreshold,
+		health: &healthChecker{
+			lookPath:    func(file string) (string, error) { return "/usr/sbin/" + file, nil },
+			checkSocket: func() error { return nil },
+		},
+	}
+}
+
+func TestCheckLiveness(t *testing.T) {
+	d := newHealthTestDriver(ModeAll)
+	assert.NoError(t, d.checkLiveness())
+
+	d.health.checkSocket = func() error { return errors.New("connection refused") }
+	assert.EqualError(t, d.checkLiveness(), "the CSI socket is not available: connection refused")
+
+	d.ready = false
+	assert.EqualError(t, d.checkLiveness(), "the gRPC server is not running")
+}
+
+func TestCheckReadiness(t *testing.T) {
+	d := newHealthTestDriver(ModeNode)
+	assert.NoError(t, d.checkReadiness())
+
+	d.health.lookPath = func(file string) (string, error) {
+		if file == "cryptsetup" || file == "mkfs.xfs" {
+			return "", errors.New("not found")
+		}
+		return "/usr/sbin/" + file, nil
+	}
+	assert.EqualError(t, d.checkReadiness(), "required tools are missing: mkfs.xfs, cryptsetup")
+
+	// the controller does not need the tools
+	d.mode = ModeController
+	assert.NoError(t, d.checkReadiness())
+
+	d = newHealthTestDriver(ModeController)
+	d.checkAPI(context.Background())
+	assert.NoError(t, d.checkReadiness())
+}
+
+func TestCheckAPI(t *testing.T) {
+	d := newHealthTestDriver(ModeController)
+	d.metrics = newMetrics()
+	d.serverId = "unknown"
+
+	// the readiness only fails after several failed checks in a row
+	for i := 1; i < DefaultAPICheckFailureThreshold; i++ {
+		d.checkAPI(context.Background())
+		assert.NoError(t, d.checkReadiness())
+	}
+	d.checkAPI(context.Background())
+	assert.Error(t, d.checkReadiness())
+
+	out := scrapeMetrics(t, d)
+	assert.Contains(t, out, "cloudscale_api_check_consecutive_failures 3\n")
+	assert.Contains(t, out, "cloudscale_api_up 0\n")
+
+	// a successful check resets the failures
+	d.serverId = "987654"
+	d.checkAPI(context.Background())
+	assert.NoError(t, d.checkReadiness())
+
+	out = scrapeMetrics(t, d)
+	assert.Contains(t, out, "cloudscale_api_check_consecutive_failures 0\n")
+	assert.Contains(t, out, "cloudscale_api_up 1\n")
+}
+
+func TestCheckAPIOutOfCluster(t *testing.T) {
+	d := newHealthTestDriver(ModeController)
+	d.serverId = ""
+
+	for i := 0; i < DefaultAPICheckFailureThreshold; i++ {
+		d.checkAPI(context.Background())
+	}
+	assert.NoError(t, d.checkReadiness())
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	d := newHealthTestDriver(ModeNode)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go d.serveHealth(listener)
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/healthz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	d.health.lookPath = func(string) (string, error) { return "", errors.New("not found") }
+	resp, err = http.Get("http://" + listener.Addr().String() + "/readyz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestDialSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "csi.sock")
+	assert.Error(t, dialSocket(socket)())
+
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	defer listener.Close()
+	assert.NoError(t, dialSocket(socket)())
+}
+
+func TestWriteHealth(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeHealth(rec, nil)
+	assert.Equal(t, "ok\n", rec.Body.String())
+}
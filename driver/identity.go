@@ -32,7 +32,7 @@ func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoReques
 		VendorVersion: version,
 	}
 
-	d.log.WithFields(logrus.Fields{
+	d.logFor(ctx).WithFields(logrus.Fields{
 		"response": resp,
 		"method":   "get_plugin_info",
 	}).Info("get plugin info called")
@@ -67,7 +67,7 @@ func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCa
 		},
 	}
 
-	d.log.WithFields(logrus.Fields{
+	d.logFor(ctx).WithFields(logrus.Fields{
 		"response": resp,
 		"method":   "get_plugin_capabilities",
 	}).Info("get plugin capabitilies called")
@@ -76,7 +76,7 @@ func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCa
 
 // Probe returns the health and readiness of the plugin
 func (d *Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	d.log.WithField("method", "probe").Info("probe called")
+	d.logFor(ctx).WithField("method", "probe").Info("probe called")
 	d.readyMu.Lock()
 	defer d.readyMu.Unlock()
 
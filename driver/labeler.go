@@ -0,0 +1,182 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// DefaultNodeLabelInterval is how often the nodes are labeled by default
+	DefaultNodeLabelInterval = time.Minute
+
+	// well-known topology labels of Kubernetes
+	topologyZoneLabel   = "topology.kubernetes.io/zone"
+	topologyRegionLabel = "topology.kubernetes.io/region"
+
+	// providerIDPrefix is the prefix of the provider ID the cloudscale.ch
+	// cloud controller manager sets on the nodes
+	providerIDPrefix = "cloudscale://"
+)
+
+// nodeLabeler labels the nodes with the zone and region of their servers.
+// The zone of a server never changes, so it is only looked up once.
+type nodeLabeler struct {
+	driver *Driver
+	client nodeClient
+	log    *logrus.Entry
+
+	zones   map[string]string
+	regions map[string]string
+}
+
+func newNodeLabeler(d *Driver, client nodeClient) *nodeLabeler {
+	return &nodeLabeler{
+		driver: d,
+		client: client,
+		log:    d.log.WithField("method", "node_labeler"),
+		zones:  map[string]string{},
+	}
+}
+
+// run labels the nodes in the given interval until stop is closed. With
+// multiple controller replicas, every replica sets the same labels.
+func (l *nodeLabeler) run(interval time.Duration, stop <-chan struct{}) {
+	l.log.WithField("interval", interval).Info("starting node labeler")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		l.labelNodes(ctx)
+		cancel()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// labelNodes sets the zone and region labels of all nodes whose server is
+// known
+func (l *nodeLabeler) labelNodes(ctx context.Context) {
+	nodes, err := l.client.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		l.log.WithError(err).Warn("couldn't list the nodes")
+		return
+	}
+
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		ll := l.log.WithField("node", node.Name)
+
+		serverID := nodeServerIDOrProviderID(node)
+		if serverID == "" {
+			ll.Debug("the server of the node is not known yet")
+			continue
+		}
+		labels, err := l.topologyLabels(ctx, serverID)
+		if err != nil {
+			ll.WithError(err).Warn("couldn't get the zone of the node")
+			continue
+		}
+
+		missing := map[string]string{}
+		for key, value := range labels {
+			if node.Labels[key] != value {
+				missing[key] = value
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{"labels": missing},
+		})
+		if err != nil {
+			ll.WithError(err).Error("couldn't create the label patch")
+			continue
+		}
+		if _, err := l.client.Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			ll.WithError(err).Warn("couldn't label the node")
+			continue
+		}
+		ll.WithField("labels", missing).Info("labeled the node")
+	}
+}
+
+// topologyLabels returns the labels of the zone and region of the given
+// server. The region label is left out if the region of the zone is unknown.
+func (l *nodeLabeler) topologyLabels(ctx context.Context, serverID string) (map[string]string, error) {
+	zone, ok := l.zones[serverID]
+	if !ok {
+		server, err := l.driver.cloudscaleClient.Servers.Get(ctx, serverID)
+		if err != nil {
+			return nil, err
+		}
+		zone = server.Zone.Slug
+		l.zones[serverID] = zone
+	}
+
+	if l.regions == nil {
+		regions, err := l.driver.cloudscaleClient.Regions.List(ctx)
+		if err != nil {
+			l.log.WithError(err).Warn("couldn't list the regions")
+		} else {
+			l.regions = map[string]string{}
+			for _, region := range regions {
+				for _, z := range region.Zones {
+					l.regions[z.Slug] = region.Slug
+				}
+			}
+		}
+	}
+
+	labels := map[string]string{
+		topologyZoneKey:   zone,
+		topologyZoneLabel: zone,
+	}
+	if region := l.regions[zone]; region != "" {
+		labels[topologyRegionLabel] = region
+	}
+	return labels, nil
+}
+
+// nodeServerIDOrProviderID returns the server ID the node plugin registered
+// for the node, or the one in the provider ID set by the cloud controller
+// manager before the node plugin runs
+func nodeServerIDOrProviderID(node *corev1.Node) string {
+	if serverID, err := nodeServerID(node); err == nil {
+		return serverID
+	}
+	if strings.HasPrefix(node.Spec.ProviderID, providerIDPrefix) {
+		return strings.TrimPrefix(node.Spec.ProviderID, providerIDPrefix)
+	}
+	return ""
+}
@@ -0,0 +1,59 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNodeLabeler(t *testing.T) {
+	var calls []cloudscalefake.Call
+	client := cloudscalefake.NewClient(map[string]*cloudscale.Server{
+		"1": {UUID: "1", ZonalResource: cloudscale.ZonalResource{Zone: cloudscale.Zone{Slug: cloudscalefake.Zone}}},
+		"2": {UUID: "2", ZonalResource: cloudscale.ZonalResource{Zone: cloudscale.Zone{Slug: cloudscalefake.Zone}}},
+	}, cloudscalefake.WithErrorInjection(func(call cloudscalefake.Call) error {
+		calls = append(calls, call)
+		return nil
+	}))
+	driver := &Driver{
+		cloudscaleClient: client,
+		log:              logrus.New().WithField("test_enabled", true),
+	}
+
+	registered := testNode("node-1", "1")
+	// the cloud controller manager sets the provider ID before the node
+	// plugin registers the node
+	unregistered := corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-2"},
+		Spec:       corev1.NodeSpec{ProviderID: "cloudscale://2"},
+	}
+	unknown := corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}}
+	nodes := &fakeNodes{nodes: []corev1.Node{registered, unregistered, unknown}}
+
+	labeler := newNodeLabeler(driver, nodes)
+	labeler.labelNodes(context.Background())
+
+	expected := map[string]string{
+		topologyZoneKey:     cloudscalefake.Zone,
+		topologyZoneLabel:   cloudscalefake.Zone,
+		topologyRegionLabel: "dev",
+	}
+	list, err := nodes.List(context.Background(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, list.Items[0].Labels)
+	assert.Equal(t, expected, list.Items[1].Labels)
+	assert.Empty(t, list.Items[2].Labels)
+	assert.Equal(t, 2, nodes.patches)
+
+	// labeled nodes are not patched again and the zones are cached
+	calls = nil
+	labeler.labelNodes(context.Background())
+	assert.Equal(t, 2, nodes.patches)
+	assert.Empty(t, calls)
+}
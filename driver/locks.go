@@ -0,0 +1,65 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// volumeLocks keeps track of the volumes with an operation in progress. Only
+// operations on the same volume are serialized, operations on different
+// volumes run in parallel. The zero value is ready to use.
+type volumeLocks struct {
+	mu    sync.Mutex // protects inUse
+	inUse map[string]struct{}
+}
+
+// tryAcquire locks the given volume and returns true, or returns false if
+// there is an operation on the volume in progress already.
+func (l *volumeLocks) tryAcquire(volumeID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inUse == nil {
+		l.inUse = make(map[string]struct{})
+	}
+	if _, ok := l.inUse[volumeID]; ok {
+		return false
+	}
+	l.inUse[volumeID] = struct{}{}
+	return true
+}
+
+func (l *volumeLocks) release(volumeID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.inUse, volumeID)
+}
+
+// lockVolume locks the given volume for the duration of a node operation. As
+// recommended by the CSI spec, codes.Aborted is returned if there is another
+// operation on the volume in progress; the CO retries the call later.
+func (d *Driver) lockVolume(volumeID string) (func(), error) {
+	if !d.volumeLocks.tryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", volumeID)
+	}
+	return func() { d.volumeLocks.release(volumeID) }, nil
+}
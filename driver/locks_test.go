@@ -0,0 +1,47 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeLocks(t *testing.T) {
+	var locks volumeLocks
+
+	assert.True(t, locks.tryAcquire("vol-1"))
+	assert.False(t, locks.tryAcquire("vol-1"))
+	assert.True(t, locks.tryAcquire("vol-2"), "other volumes are not locked")
+
+	locks.release("vol-1")
+	assert.True(t, locks.tryAcquire("vol-1"))
+}
+
+func TestNodeOperationOnLockedVolume(t *testing.T) {
+	d := &Driver{
+		mounter: mounter.NewFake(),
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+
+	unlock, err := d.lockVolume("vol-1")
+	assert.NoError(t, err)
+
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: "/staging",
+	})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	unlock()
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: "/staging",
+	})
+	assert.NoError(t, err)
+}
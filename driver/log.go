@@ -0,0 +1,136 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// NewLogger returns a logger writing to stderr in the given format, either
+// "text" or "json", with the given level, e.g. "info" or "debug".
+func NewLogger(format, level string) (*logrus.Entry, error) {
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+
+	switch format {
+	case "", "text":
+		logger.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return nil, fmt.Errorf("invalid log format %q, must be \"text\" or \"json\"", format)
+	}
+
+	if level != "" {
+		lvl, err := logrus.ParseLevel(level)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level %q: %v", level, err)
+		}
+		logger.SetLevel(lvl)
+	}
+
+	return logrus.NewEntry(logger), nil
+}
+
+type apiUsageKey struct{}
+
+// apiUsage records the calls to the cloudscale.ch API made for a gRPC call
+// and the time spent waiting for them
+type apiUsage struct {
+	calls int64
+	nanos int64
+}
+
+func (u *apiUsage) callCount() int64 {
+	return atomic.LoadInt64(&u.calls)
+}
+
+func (u *apiUsage) duration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&u.nanos))
+}
+
+// withAPIUsage returns a context recording the calls to the cloudscale.ch API
+// made with it. The usage of an outer interceptor is reused, so that all
+// interceptors see the same calls.
+func withAPIUsage(ctx context.Context) (context.Context, *apiUsage) {
+	if usage, ok := ctx.Value(apiUsageKey{}).(*apiUsage); ok {
+		return ctx, usage
+	}
+	usage := &apiUsage{}
+	return context.WithValue(ctx, apiUsageKey{}, usage), usage
+}
+
+// apiUsageTransport records the calls to the cloudscale.ch API per request
+// context, so that slow operations can be attributed to the API
+type apiUsageTransport struct {
+	base http.RoundTripper
+}
+
+func (t *apiUsageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	usage, ok := req.Context().Value(apiUsageKey{}).(*apiUsage)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	atomic.AddInt64(&usage.calls, 1)
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	atomic.AddInt64(&usage.nanos, int64(time.Since(start)))
+	return resp, err
+}
+
+// logInterceptor logs every gRPC call with its duration in seconds and the
+// volume ID of the request, if any. Failed calls are logged as errors, all
+// others on the debug level. Calls taking longer than the slow operation
+// threshold are additionally logged as warnings with the number of API calls
+// they made.
+func (d *Driver) logInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, usage := withAPIUsage(ctx)
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	duration := time.Since(start)
+
+	ll := d.logFor(ctx).WithFields(logrus.Fields{
+		"method":   info.FullMethod,
+		"duration": duration.Seconds(),
+	})
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		ll = ll.WithField("volume_id", r.GetVolumeId())
+	}
+
+	if d.slowOperationThreshold > 0 && duration > d.slowOperationThreshold {
+		ll.WithFields(logrus.Fields{
+			"api_calls": usage.callCount(),
+			"threshold": d.slowOperationThreshold.Seconds(),
+		}).Warn("slow operation")
+	}
+
+	if err != nil {
+		// log response errors for better observability
+		ll.WithError(err).Error("method failed")
+	} else {
+		ll.Debug("method finished")
+	}
+	return resp, err
+}
@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestNewLogger(t *testing.T) {
+	log, err := NewLogger("json", "debug")
+	assert.NoError(t, err)
+	assert.IsType(t, &logrus.JSONFormatter{}, log.Logger.Formatter)
+	assert.Equal(t, logrus.DebugLevel, log.Logger.Level)
+
+	log, err = NewLogger("", "")
+	assert.NoError(t, err)
+	assert.IsType(t, &logrus.TextFormatter{}, log.Logger.Formatter)
+	assert.Equal(t, logrus.InfoLevel, log.Logger.Level)
+
+	_, err = NewLogger("xml", "info")
+	assert.Error(t, err)
+	_, err = NewLogger("text", "verbose")
+	assert.Error(t, err)
+}
+
+func TestLogInterceptor(t *testing.T) {
+	log, err := NewLogger("json", "debug")
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	log.Logger.SetOutput(&buf)
+	d := &Driver{log: log.WithField("node_id", "987654")}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, errors.New("staging failed")
+	}
+	_, err = d.logInterceptor(context.Background(), &csi.NodeStageVolumeRequest{VolumeId: "vol-1"}, info, handler)
+	assert.Error(t, err)
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "error", entry["level"])
+	assert.Equal(t, "/csi.v1.Node/NodeStageVolume", entry["method"])
+	assert.Equal(t, "vol-1", entry["volume_id"])
+	assert.Equal(t, "987654", entry["node_id"])
+	assert.Equal(t, "staging failed", entry["error"])
+	assert.Contains(t, entry, "duration")
+}
+
+func TestLogInterceptorSlowOperation(t *testing.T) {
+	log, err := NewLogger("json", "info")
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	log.Logger.SetOutput(&buf)
+	d := &Driver{log: log, slowOperationThreshold: time.Millisecond}
+
+	client := &http.Client{Transport: &apiUsageTransport{
+		base: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerPublishVolume"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		for i := 0; i < 2; i++ {
+			apiReq, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.example.com/v1/volumes", nil)
+			resp, err := client.Do(apiReq)
+			assert.NoError(t, err)
+			resp.Body.Close()
+		}
+		time.Sleep(5 * time.Millisecond)
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+	_, err = d.logInterceptor(context.Background(), &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1"}, info, handler)
+	assert.NoError(t, err)
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "warning", entry["level"])
+	assert.Equal(t, "slow operation", entry["msg"])
+	assert.Equal(t, "vol-1", entry["volume_id"])
+	assert.Equal(t, float64(2), entry["api_calls"])
+
+	// fast calls are not logged on the info level
+	buf.Reset()
+	d.slowOperationThreshold = time.Minute
+	_, err = d.logInterceptor(context.Background(), &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1"}, info, handler)
+	assert.NoError(t, err)
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,88 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// LuksEncryptedAttribute is used to pass the information if the volume should be
+	// encrypted with luks to `NodeStageVolume`
+	LuksEncryptedAttribute = DriverName + "/luks-encrypted"
+
+	// LuksCipherAttribute is used to pass the information about the luks encryption
+	// cypher to `NodeStageVolume`
+	LuksCipherAttribute = DriverName + "/luks-cipher"
+
+	// LuksKeySizeAttribute is used to pass the information about the luks key size
+	// to `NodeStageVolume`
+	LuksKeySizeAttribute = DriverName + "/luks-key-size"
+
+	// LuksKeyAttribute is the key of the luks key used in the map of secrets passed from the CO
+	LuksKeyAttribute = "luksKey"
+)
+
+// getLuksContext returns the luks context of a volume from the secrets and
+// the volume context passed by the CO
+func getLuksContext(secrets map[string]string, context map[string]string, lifecycle mounter.VolumeLifecycle) mounter.LuksContext {
+	if context[LuksEncryptedAttribute] != "true" {
+		return mounter.LuksContext{
+			EncryptionEnabled: false,
+			VolumeLifecycle:   lifecycle,
+		}
+	}
+
+	luksKey := secrets[LuksKeyAttribute]
+	luksCipher := context[LuksCipherAttribute]
+	luksKeySize := context[LuksKeySizeAttribute]
+	volumeName := context[PublishInfoVolumeName]
+
+	return mounter.LuksContext{
+		EncryptionEnabled: true,
+		EncryptionKey:     luksKey,
+		EncryptionCipher:  luksCipher,
+		EncryptionKeySize: luksKeySize,
+		VolumeName:        volumeName,
+		VolumeLifecycle:   lifecycle,
+	}
+}
+
+// luksStatusError returns the gRPC status of a failed cryptsetup command: a
+// wrong luks key is not resolved by retrying, a device or mapping still busy
+// after the retries of the mounter likely is. Other errors get the given
+// code.
+func luksStatusError(err error, code codes.Code) error {
+	var inUseErr *mounter.LuksMappingInUseError
+	if errors.As(err, &inUseErr) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	var cryptsetupErr *mounter.CryptsetupError
+	if errors.As(err, &cryptsetupErr) {
+		switch {
+		case cryptsetupErr.WrongPassphrase():
+			code = codes.InvalidArgument
+		case cryptsetupErr.Busy():
+			code = codes.Unavailable
+		}
+	}
+	return status.Error(code, err.Error())
+}
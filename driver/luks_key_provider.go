@@ -0,0 +1,237 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// LuksKeyRefAttribute is the key of the luks key reference used in the map
+	// of secrets passed from the CO. The reference is resolved by the
+	// configured LuksKeyProvider at stage time.
+	LuksKeyRefAttribute = "luksKeyRef"
+
+	// LuksKeyCiphertextAttribute is the key of the wrapped luks key used in
+	// the map of secrets passed from the CO. It is only used by key providers
+	// that decrypt a stored ciphertext, such as the Vault transit engine.
+	LuksKeyCiphertextAttribute = "luksKeyCiphertext"
+
+	vaultKVRefPrefix      = "kv:"
+	vaultTransitRefPrefix = "transit:"
+)
+
+// LuksKeyProvider resolves a luks key reference into the actual passphrase,
+// so that the passphrase itself never has to be stored in a Kubernetes secret.
+type LuksKeyProvider interface {
+	// GetKey returns the luks passphrase for the given reference. The
+	// secrets passed from the CO are handed in as well, as some providers
+	// need additional information (e.g. a wrapped key) to resolve the key.
+	GetKey(ctx context.Context, ref string, secrets map[string]string) (string, error)
+}
+
+// resolveLuksKey returns the secrets with the luks key filled in. If the
+// secrets already contain a plain luks key or no key reference, they are
+// returned unchanged.
+func resolveLuksKey(ctx context.Context, provider LuksKeyProvider, secrets map[string]string) (map[string]string, error) {
+	if secrets[LuksKeyAttribute] != "" {
+		return secrets, nil
+	}
+
+	ref := secrets[LuksKeyRefAttribute]
+	if ref == "" {
+		return secrets, nil
+	}
+
+	if provider == nil {
+		return nil, fmt.Errorf("luks key reference %q given, but no luks key provider is configured", ref)
+	}
+
+	key, err := provider.GetKey(ctx, ref, secrets)
+	if err != nil {
+		return nil, fmt.Errorf("resolving luks key reference %q failed: %v", ref, err)
+	}
+
+	resolved := make(map[string]string, len(secrets)+1)
+	for k, v := range secrets {
+		resolved[k] = v
+	}
+	resolved[LuksKeyAttribute] = key
+	return resolved, nil
+}
+
+// vaultKeyProvider fetches luks keys from HashiCorp Vault. Two kinds of
+// references are supported:
+//
+//	kv:<mount>/<path>#<field>   reads the key from a KV version 2 secret
+//	transit:<mount>/<key-name>  decrypts the luksKeyCiphertext secret with
+//	                            the given transit key
+type vaultKeyProvider struct {
+	addr      string
+	tokenFile string
+	client    *http.Client
+}
+
+// NewVaultKeyProvider returns a LuksKeyProvider backed by the Vault server at
+// addr. The Vault token is read from tokenFile on every request, so that it can
+// be rotated without restarting the plugin. If tokenFile is empty, the token is
+// taken from the VAULT_TOKEN environment variable.
+func NewVaultKeyProvider(addr, tokenFile string) LuksKeyProvider {
+	return &vaultKeyProvider{
+		addr:      strings.TrimSuffix(addr, "/"),
+		tokenFile: tokenFile,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (v *vaultKeyProvider) GetKey(ctx context.Context, ref string, secrets map[string]string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, vaultKVRefPrefix):
+		return v.getKVKey(ctx, strings.TrimPrefix(ref, vaultKVRefPrefix))
+	case strings.HasPrefix(ref, vaultTransitRefPrefix):
+		ciphertext := secrets[LuksKeyCiphertextAttribute]
+		if ciphertext == "" {
+			return "", fmt.Errorf("transit reference requires %q in the secret", LuksKeyCiphertextAttribute)
+		}
+		return v.decryptTransitKey(ctx, strings.TrimPrefix(ref, vaultTransitRefPrefix), ciphertext)
+	default:
+		return "", fmt.Errorf("unsupported vault reference, must start with %q or %q", vaultKVRefPrefix, vaultTransitRefPrefix)
+	}
+}
+
+func (v *vaultKeyProvider) getKVKey(ctx context.Context, ref string) (string, error) {
+	secretPath, field, ok := strings.Cut(ref, "#")
+	if !ok || field == "" {
+		return "", errors.New("kv reference must be of the form kv:<mount>/<path>#<field>")
+	}
+	mount, path, ok := strings.Cut(secretPath, "/")
+	if !ok || path == "" {
+		return "", errors.New("kv reference must be of the form kv:<mount>/<path>#<field>")
+	}
+
+	var resp struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodGet, "/v1/"+mount+"/data/"+path, nil, &resp); err != nil {
+		return "", err
+	}
+
+	value, ok := resp.Data.Data[field].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("field %q not found in vault secret %q", field, secretPath)
+	}
+	return value, nil
+}
+
+func (v *vaultKeyProvider) decryptTransitKey(ctx context.Context, ref, ciphertext string) (string, error) {
+	mount, keyName, ok := strings.Cut(ref, "/")
+	if !ok || keyName == "" {
+		return "", errors.New("transit reference must be of the form transit:<mount>/<key-name>")
+	}
+
+	req := map[string]string{"ciphertext": ciphertext}
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodPost, "/v1/"+mount+"/decrypt/"+keyName, req, &resp); err != nil {
+		return "", err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return "", fmt.Errorf("couldn't decode plaintext returned by vault: %v", err)
+	}
+	if len(plaintext) == 0 {
+		return "", errors.New("vault returned an empty plaintext")
+	}
+	return string(plaintext), nil
+}
+
+func (v *vaultKeyProvider) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	token, err := v.token()
+	if err != nil {
+		return err
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	// never include the response body in the error, it might contain the key
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault request %s %s failed with status %d", method, path, resp.StatusCode)
+	}
+
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("couldn't unmarshal vault response: %v", err)
+	}
+	return nil
+}
+
+func (v *vaultKeyProvider) token() (string, error) {
+	if v.tokenFile == "" {
+		token := os.Getenv("VAULT_TOKEN")
+		if token == "" {
+			return "", errors.New("no vault token file configured and VAULT_TOKEN is not set")
+		}
+		return token, nil
+	}
+
+	data, err := ioutil.ReadFile(v.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read vault token file: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,106 @@
+package driver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeVault(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.test" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/secret/data/luks/pvc-1":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"data": map[string]interface{}{"key": "kv-secret"},
+				},
+			})
+		case "/v1/transit/decrypt/luks":
+			var req map[string]string
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, "vault:v1:abc", req["ciphertext"])
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"plaintext": base64.StdEncoding.EncodeToString([]byte("transit-secret")),
+				},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestVaultKeyProviderKV(t *testing.T) {
+	vault := newFakeVault(t)
+	defer vault.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("s.test\n"), 0600))
+
+	provider := NewVaultKeyProvider(vault.URL, tokenFile)
+	key, err := provider.GetKey(context.Background(), "kv:secret/luks/pvc-1#key", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "kv-secret", key)
+
+	_, err = provider.GetKey(context.Background(), "kv:secret/luks/pvc-1#missing", nil)
+	assert.Error(t, err)
+
+	_, err = provider.GetKey(context.Background(), "kv:secret/luks/pvc-2#key", nil)
+	assert.Error(t, err)
+}
+
+func TestVaultKeyProviderTransit(t *testing.T) {
+	vault := newFakeVault(t)
+	defer vault.Close()
+
+	t.Setenv("VAULT_TOKEN", "s.test")
+
+	provider := NewVaultKeyProvider(vault.URL, "")
+	key, err := provider.GetKey(context.Background(), "transit:transit/luks", map[string]string{
+		LuksKeyCiphertextAttribute: "vault:v1:abc",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "transit-secret", key)
+
+	_, err = provider.GetKey(context.Background(), "transit:transit/luks", nil)
+	assert.Error(t, err)
+}
+
+func TestResolveLuksKey(t *testing.T) {
+	vault := newFakeVault(t)
+	defer vault.Close()
+
+	t.Setenv("VAULT_TOKEN", "s.test")
+	provider := NewVaultKeyProvider(vault.URL, "")
+
+	// a plain key takes precedence over a reference
+	secrets, err := resolveLuksKey(context.Background(), provider, map[string]string{
+		LuksKeyAttribute:    "plain",
+		LuksKeyRefAttribute: "kv:secret/luks/pvc-1#key",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", secrets[LuksKeyAttribute])
+
+	secrets, err = resolveLuksKey(context.Background(), provider, map[string]string{
+		LuksKeyRefAttribute: "kv:secret/luks/pvc-1#key",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "kv-secret", secrets[LuksKeyAttribute])
+
+	_, err = resolveLuksKey(context.Background(), nil, map[string]string{
+		LuksKeyRefAttribute: "kv:secret/luks/pvc-1#key",
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,110 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLuksStatusError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{
+			name: "wrong passphrase",
+			err:  &mounter.CryptsetupError{Action: "luksOpen", ExitCode: 2, Stderr: "No key available with this passphrase.", Err: errors.New("exit status 2")},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "busy",
+			err:  &mounter.CryptsetupError{Action: "close", ExitCode: 5, Stderr: "Device pvc-1 is still in use.", Err: errors.New("exit status 5")},
+			code: codes.Unavailable,
+		},
+		{
+			name: "other cryptsetup error",
+			err:  &mounter.CryptsetupError{Action: "luksFormat", ExitCode: 1, Stderr: "Invalid cipher.", Err: errors.New("exit status 1")},
+			code: codes.Internal,
+		},
+		{
+			name: "mapping in use",
+			err:  &mounter.LuksMappingInUseError{Mapping: "pvc-1", Err: errors.New("the mapping is still open after closing it")},
+			code: codes.Unavailable,
+		},
+		{
+			name: "other error",
+			err:  errors.New("mount failed"),
+			code: codes.Internal,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := luksStatusError(tc.err, codes.Internal)
+			assert.Equal(t, tc.code, status.Code(err))
+			assert.Equal(t, tc.err.Error(), status.Convert(err).Message())
+		})
+	}
+}
+
+// unstageMounter fails to close the luks mapping
+type unstageMounter struct {
+	mounter.Mounter
+	unmountErr error
+	closeErr   error
+	closes     int
+}
+
+func (m *unstageMounter) Unmount(ctx context.Context, target string, luksContext mounter.LuksContext) error {
+	if err := m.Mounter.Unmount(ctx, target, luksContext); err != nil {
+		return err
+	}
+	return m.unmountErr
+}
+
+func (m *unstageMounter) CloseLuksMapping(ctx context.Context, volumeID string) error {
+	m.closes++
+	return m.closeErr
+}
+
+func TestNodeUnstageVolumeLuksMapping(t *testing.T) {
+	const volumeID = "2f2e7b8a-4b5f-4d9c-9a1b-0123456789ab"
+	const stagingPath = "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount"
+	busy := &mounter.CryptsetupError{Action: "close", ExitCode: 5, Stderr: "Device pvc-1 is still in use.", Err: errors.New("exit status 5")}
+
+	fm := mounter.NewFake()
+	um := &unstageMounter{
+		Mounter:    fm,
+		unmountErr: busy,
+		closeErr:   &mounter.LuksMappingInUseError{Mapping: "pvc-1", Err: busy},
+	}
+	driver := &Driver{
+		mounter: um,
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	driver.staged.add(volumeID, stagedVolume{stagingPath: stagingPath})
+	assert.NoError(t, fm.Mount(context.Background(), "/dev/mapper/pvc-1", stagingPath, "ext4", mounter.LuksContext{}))
+	req := &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath}
+
+	// the staging target path is unmounted, but the mapping stays open
+	_, err := driver.NodeUnstageVolume(context.Background(), req)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Empty(t, fm.Mounts())
+	assert.Equal(t, 1, um.closes)
+	ids, _ := driver.staged.list()
+	assert.Equal(t, []string{volumeID}, ids)
+
+	// the retry closes the mapping although the path is unmounted already
+	um.closeErr = nil
+	_, err = driver.NodeUnstageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, um.closes)
+	ids, _ = driver.staged.list()
+	assert.Empty(t, ids)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/sirupsen/logrus"
+)
+
+// serveLuksHeader serves the backup of luks headers on /luks/header until
+// the listener is closed. The listener is bound to the loopback interface,
+// so that the endpoint is only reachable through an exec into the node
+// plugin, which the RBAC of Kubernetes restricts.
+func (d *Driver) serveLuksHeader(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/luks/header", d.handleLuksHeader)
+
+	d.log.WithField("addr", listener.Addr().String()).Info("luks header endpoint started")
+	err := http.Serve(listener, mux)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		d.log.WithError(err).Error("luks header endpoint failed")
+	}
+}
+
+// validateLoopbackAddr checks that the given address is on the loopback
+// interface
+func validateLoopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid luks header address %q: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("the luks header address %q must be on the loopback interface, e.g. 127.0.0.1:9811", addr)
+	}
+	return nil
+}
+
+// handleLuksHeader backs up the luks header of the volume given by the volume
+// query parameter. Headers cannot be restored through the endpoint, as that
+// would allow to overwrite the header of any encrypted volume on the node.
+func (d *Driver) handleLuksHeader(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	volumeID := r.URL.Query().Get("volume")
+	if volumeID == "" {
+		http.Error(w, "volume query parameter missing", http.StatusBadRequest)
+		return
+	}
+
+	unlock, err := d.lockVolume(volumeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer unlock()
+
+	device, err := d.mounter.FindAbsoluteDeviceByIDPath(volumeID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("volume %s is not attached to this node: %v", volumeID, err), http.StatusNotFound)
+		return
+	}
+
+	ll := d.log.WithFields(logrus.Fields{
+		"volume_id": volumeID,
+		"device":    device,
+		"method":    "luks_header",
+	})
+
+	dir, err := ioutil.TempDir("", "luks-header")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "header")
+
+	if err := mounter.LuksHeaderBackup(r.Context(), device, file, ll); err != nil {
+		ll.WithError(err).Error("failed to back up luks header")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, f); err != nil {
+		ll.WithError(err).Error("failed to write luks header backup")
+	}
+}
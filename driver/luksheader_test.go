@@ -0,0 +1,41 @@
+package driver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleLuksHeader(t *testing.T) {
+	d := &Driver{log: logrus.New().WithField("test_enabled", true)}
+
+	rec := httptest.NewRecorder()
+	d.handleLuksHeader(rec, httptest.NewRequest(http.MethodPut, "/luks/header?volume=1234", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET", rec.Header().Get("Allow"))
+
+	rec = httptest.NewRecorder()
+	d.handleLuksHeader(rec, httptest.NewRequest(http.MethodGet, "/luks/header", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	unlock, err := d.lockVolume("1234")
+	assert.NoError(t, err)
+	defer unlock()
+
+	rec = httptest.NewRecorder()
+	d.handleLuksHeader(rec, httptest.NewRequest(http.MethodGet, "/luks/header?volume=1234", nil))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestValidateLoopbackAddr(t *testing.T) {
+	assert.NoError(t, validateLoopbackAddr("127.0.0.1:9811"))
+	assert.NoError(t, validateLoopbackAddr("[::1]:9811"))
+	assert.NoError(t, validateLoopbackAddr("localhost:9811"))
+	assert.Error(t, validateLoopbackAddr(":9811"))
+	assert.Error(t, validateLoopbackAddr("0.0.0.0:9811"))
+	assert.Error(t, validateLoopbackAddr("10.0.0.1:9811"))
+	assert.Error(t, validateLoopbackAddr("127.0.0.1"))
+}
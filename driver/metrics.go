@@ -0,0 +1,315 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	apiRequestErrorCode    = "error"
+	apiRequestResourceNone = "none"
+	latencyPartTotal       = "total"
+	latencyPartAPI         = "cloudscale_api"
+)
+
+// latencyMethods are the calls until a volume is usable by a pod, their
+// latency is recorded with the time spent waiting for the cloudscale.ch API
+var latencyMethods = map[string]bool{
+	"/csi.v1.Controller/CreateVolume":            true,
+	"/csi.v1.Controller/ControllerPublishVolume": true,
+	"/csi.v1.Node/NodeStageVolume":               true,
+}
+
+// uuidPattern matches the IDs in the paths of the cloudscale.ch API
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// operationBuckets are the buckets of csi-lib-utils in seconds
+var operationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15, 25, 50, 120, 300, 600}
+
+// metrics collects the metrics of the driver. The metrics follow the
+// conventions of csi-lib-utils, so that the dashboards for the CSI sidecars
+// work for the plugin as well. A nil value discards all observations.
+type metrics struct {
+	registry *prometheus.Registry
+
+	operations  *prometheus.HistogramVec
+	inFlight    *prometheus.GaugeVec
+	latency     *prometheus.HistogramVec
+	apiRequests *prometheus.HistogramVec
+	apiEndpoint *prometheus.HistogramVec
+	apiTotal    *prometheus.CounterVec
+	// expandSkipped counts the expansions which did not resize the volume,
+	// as it was not smaller than requested
+	expandSkipped prometheus.Counter
+
+	// the API check and token metrics are only registered once the
+	// controller checks the API or fallback tokens are configured
+	apiCheckOnce     sync.Once
+	apiCheckFailures prometheus.Gauge
+	apiCheckUp       prometheus.Gauge
+	tokenOnce        sync.Once
+	tokenFailovers   prometheus.Counter
+	tokenIndex       prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	driverLabel := prometheus.Labels{"driver_name": DriverName}
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		operations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "csi_plugin_operations_seconds",
+			Help:        "Time taken by the CSI operations",
+			ConstLabels: driverLabel,
+			Buckets:     operationBuckets,
+		}, []string{"method_name", "grpc_status_code"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "csi_plugin_inflight_operations",
+			Help:        "Number of CSI operations in progress",
+			ConstLabels: driverLabel,
+		}, []string{"method_name"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "csi_plugin_provisioning_latency_seconds",
+			Help:        "Time taken by the CSI operations until a volume is usable, in total and waiting for the cloudscale.ch API",
+			ConstLabels: driverLabel,
+			Buckets:     operationBuckets,
+		}, []string{"method_name", "grpc_status_code", "part"}),
+		apiRequests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cloudscale_api_request_duration_seconds",
+			Help:    "Time taken by the requests to the cloudscale.ch API",
+			Buckets: operationBuckets,
+		}, []string{"method", "resource", "code"}),
+		apiEndpoint: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cloudscale_api_endpoint_request_duration_seconds",
+			Help:    "Time taken by the requests to the cloudscale.ch API by endpoint",
+			Buckets: operationBuckets,
+		}, []string{"method", "endpoint", "status_class"}),
+		apiTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudscale_api_requests_total",
+			Help: "Number of requests to the cloudscale.ch API",
+		}, []string{"method", "endpoint", "status_class"}),
+		expandSkipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "csi_plugin_expand_skipped_total",
+			Help:        "Number of volume expansions skipped as the volume was not smaller than requested",
+			ConstLabels: driverLabel,
+		}),
+		apiCheckFailures: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cloudscale_api_check_consecutive_failures",
+			Help: "Number of consecutive failed checks of the cloudscale.ch API",
+		}),
+		apiCheckUp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cloudscale_api_up",
+			Help: "Whether the cloudscale.ch API is considered available by the readiness check",
+		}),
+		tokenFailovers: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cloudscale_api_token_failovers_total",
+			Help: "Number of times the driver failed over to the next cloudscale.ch API token",
+		}),
+		tokenIndex: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cloudscale_api_token_index",
+			Help: "Position of the cloudscale.ch API token in use, 0 being the primary token",
+		}),
+	}
+	m.registry.MustRegister(m.operations, m.inFlight, m.latency, m.apiRequests, m.apiEndpoint, m.apiTotal, m.expandSkipped)
+	return m
+}
+
+func (m *metrics) observeOperation(method, code string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.operations.WithLabelValues(method, code).Observe(duration.Seconds())
+}
+
+func (m *metrics) observeLatency(method, code string, total, api time.Duration) {
+	if m == nil {
+		return
+	}
+	m.latency.WithLabelValues(method, code, latencyPartTotal).Observe(total.Seconds())
+	m.latency.WithLabelValues(method, code, latencyPartAPI).Observe(api.Seconds())
+}
+
+func (m *metrics) addInFlight(method string, delta float64) {
+	if m == nil {
+		return
+	}
+	m.inFlight.WithLabelValues(method).Add(delta)
+}
+
+func (m *metrics) observeAPIRequest(method, path, code, statusClass string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	endpoint := apiEndpoint(path)
+	m.apiRequests.WithLabelValues(method, apiResource(path), code).Observe(duration.Seconds())
+	m.apiEndpoint.WithLabelValues(method, endpoint, statusClass).Observe(duration.Seconds())
+	m.apiTotal.WithLabelValues(method, endpoint, statusClass).Inc()
+}
+
+func (m *metrics) setAPICheck(failures int, up bool) {
+	if m == nil {
+		return
+	}
+	m.apiCheckOnce.Do(func() {
+		m.registry.MustRegister(m.apiCheckFailures, m.apiCheckUp)
+	})
+	m.apiCheckFailures.Set(float64(failures))
+	if up {
+		m.apiCheckUp.Set(1)
+	} else {
+		m.apiCheckUp.Set(0)
+	}
+}
+
+func (m *metrics) addExpandSkipped() {
+	if m == nil {
+		return
+	}
+	m.expandSkipped.Inc()
+}
+
+// setTokenIndex records the position of the token in use
+func (m *metrics) setTokenIndex(index int) {
+	if m == nil {
+		return
+	}
+	m.tokenOnce.Do(func() {
+		m.registry.MustRegister(m.tokenFailovers, m.tokenIndex)
+	})
+	m.tokenIndex.Set(float64(index))
+}
+
+func (m *metrics) addTokenFailover(index int) {
+	if m == nil {
+		return
+	}
+	m.tokenFailovers.Inc()
+	m.setTokenIndex(index)
+}
+
+// metricsInterceptor records the duration, the status code and the number of
+// in-flight gRPC calls per method. For the calls in latencyMethods, the time
+// spent waiting for the cloudscale.ch API is recorded as well.
+func (d *Driver) metricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	d.metrics.addInFlight(info.FullMethod, 1)
+	defer d.metrics.addInFlight(info.FullMethod, -1)
+
+	ctx, usage := withAPIUsage(ctx)
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	duration := time.Since(start)
+
+	code := status.Code(err).String()
+	d.metrics.observeOperation(info.FullMethod, code, duration)
+	if latencyMethods[info.FullMethod] {
+		d.metrics.observeLatency(info.FullMethod, code, duration, usage.duration())
+	}
+	return resp, err
+}
+
+// metricsHandler returns the handler of the metrics endpoint. The node
+// plugin exports the usage of the staged volumes as well.
+func (d *Driver) metricsHandler() http.Handler {
+	gatherers := prometheus.Gatherers{d.metrics.registry}
+	if d.mode != ModeController {
+		volumes := prometheus.NewRegistry()
+		volumes.MustRegister(&volumeCollector{d: d})
+		gatherers = append(gatherers, volumes)
+	}
+	return promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{
+		ErrorLog: d.log.WithField("method", "metrics"),
+	})
+}
+
+// serveMetrics serves the metrics on the given listener until it is closed.
+func (d *Driver) serveMetrics(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", d.metricsHandler())
+
+	d.log.WithField("addr", listener.Addr().String()).Info("metrics endpoint started")
+	err := http.Serve(listener, mux)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		d.log.WithError(err).Error("metrics endpoint failed")
+	}
+}
+
+// metricsTransport records the requests to the cloudscale.ch API
+type metricsTransport struct {
+	base    http.RoundTripper
+	metrics *metrics
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+
+	code := apiRequestErrorCode
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	t.metrics.observeAPIRequest(req.Method, req.URL.Path, code, statusClass(resp, err), time.Since(start))
+	return resp, err
+}
+
+// apiResource returns the resource of an API path, e.g. "volumes" for
+// /v1/volumes/<uuid>, so that the UUIDs do not end up in the labels
+func apiResource(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 || parts[1] == "" {
+		return apiRequestResourceNone
+	}
+	return parts[1]
+}
+
+// apiEndpoint returns the path of an API request with the IDs replaced by
+// "{id}", e.g. "/v1/volumes/{id}" for /v1/volumes/<uuid>
+func apiEndpoint(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range parts {
+		if uuidPattern.MatchString(part) {
+			parts[i] = "{id}"
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// statusClass groups the status code of an API response, rate limiting is
+// kept apart from the other client errors so that it can be alerted on
+func statusClass(resp *http.Response, err error) string {
+	switch {
+	case err != nil:
+		return apiRequestErrorCode
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return "429"
+	default:
+		return fmt.Sprintf("%dxx", resp.StatusCode/100)
+	}
+}
@@ -0,0 +1,183 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// scrapeMetrics returns the response of the metrics endpoint of the driver,
+// which must be valid in the Prometheus text format
+func scrapeMetrics(t *testing.T, d *Driver) string {
+	rec := httptest.NewRecorder()
+	d.metricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var parser expfmt.TextParser
+	_, err := parser.TextToMetricFamilies(bytes.NewReader(rec.Body.Bytes()))
+	assert.NoError(t, err)
+	return rec.Body.String()
+}
+
+func newMetricsTestDriver(m *metrics) *Driver {
+	return &Driver{
+		metrics: m,
+		mode:    ModeController,
+		log:     logrus.NewEntry(logrus.New()),
+	}
+}
+
+func TestMetricsInterceptor(t *testing.T) {
+	d := newMetricsTestDriver(newMetrics())
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+
+	_, err := d.metricsInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		assert.Contains(t, scrapeMetrics(t, d), `csi_plugin_inflight_operations{driver_name="csi.cloudscale.ch",method_name="/csi.v1.Node/NodeStageVolume"} 1`)
+		return nil, status.Error(codes.Aborted, "busy")
+	})
+	assert.Error(t, err)
+	_, err = d.metricsInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	assert.NoError(t, err)
+
+	out := scrapeMetrics(t, d)
+	assert.Contains(t, out, "# TYPE csi_plugin_operations_seconds histogram\n")
+	assert.Contains(t, out, `csi_plugin_operations_seconds_count{driver_name="csi.cloudscale.ch",grpc_status_code="Aborted",method_name="/csi.v1.Node/NodeStageVolume"} 1`)
+	assert.Contains(t, out, `csi_plugin_operations_seconds_bucket{driver_name="csi.cloudscale.ch",grpc_status_code="OK",method_name="/csi.v1.Node/NodeStageVolume",le="+Inf"} 1`)
+	assert.Contains(t, out, `csi_plugin_inflight_operations{driver_name="csi.cloudscale.ch",method_name="/csi.v1.Node/NodeStageVolume"} 0`)
+
+	// a driver without metrics discards them
+	d = &Driver{}
+	_, err = d.metricsInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestMetricsInterceptorLatency(t *testing.T) {
+	d := newMetricsTestDriver(newMetrics())
+	client := &http.Client{Transport: &apiUsageTransport{
+		base: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			time.Sleep(10 * time.Millisecond)
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		apiReq, _ := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.example.com/v1/volumes", nil)
+		resp, err := client.Do(apiReq)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		time.Sleep(10 * time.Millisecond)
+		return nil, nil
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	_, err := d.metricsInterceptor(context.Background(), nil, info, handler)
+	assert.NoError(t, err)
+	// other calls are not recorded
+	_, err = d.metricsInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ListVolumes"}, handler)
+	assert.NoError(t, err)
+
+	families, err := d.metrics.registry.Gather()
+	assert.NoError(t, err)
+	sums := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "csi_plugin_provisioning_latency_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			assert.Equal(t, info.FullMethod, labels["method_name"])
+			sums[labels["part"]] = m.GetHistogram().GetSampleSum()
+		}
+	}
+	assert.Len(t, sums, 2)
+	assert.GreaterOrEqual(t, sums["cloudscale_api"], 0.01)
+	assert.Greater(t, sums["total"], sums["cloudscale_api"])
+
+	assert.Contains(t, scrapeMetrics(t, d), `csi_plugin_provisioning_latency_seconds_count{driver_name="csi.cloudscale.ch",grpc_status_code="OK",method_name="/csi.v1.Controller/CreateVolume",part="cloudscale_api"} 1`)
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	m := newMetrics()
+	m.observeOperation("m", "OK", 300*time.Millisecond)
+	m.observeOperation("m", "OK", 2*time.Second)
+	m.observeOperation("m", "OK", time.Hour)
+
+	out := scrapeMetrics(t, newMetricsTestDriver(m))
+	assert.Contains(t, out, `grpc_status_code="OK",method_name="m",le="0.25"} 0`)
+	assert.Contains(t, out, `grpc_status_code="OK",method_name="m",le="0.5"} 1`)
+	assert.Contains(t, out, `grpc_status_code="OK",method_name="m",le="2.5"} 2`)
+	assert.Contains(t, out, `grpc_status_code="OK",method_name="m",le="600"} 2`)
+	assert.Contains(t, out, `grpc_status_code="OK",method_name="m",le="+Inf"} 3`)
+	assert.Contains(t, out, `csi_plugin_operations_seconds_sum{driver_name="csi.cloudscale.ch",grpc_status_code="OK",method_name="m"} 3602.3`)
+}
+
+func TestMetricsTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	m := newMetrics()
+	client := &http.Client{Transport: &metricsTransport{base: http.DefaultTransport, metrics: m}}
+	_, err := client.Get(server.URL + "/v1/volumes/2f2e7b8a-4b5f-4d9c-9d8e-3b1c2a9e8f7d")
+	assert.NoError(t, err)
+
+	client = &http.Client{Transport: &metricsTransport{base: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}), metrics: m}}
+	_, err = client.Post(server.URL+"/v1/volumes", "application/json", nil)
+	assert.Error(t, err)
+
+	out := scrapeMetrics(t, newMetricsTestDriver(m))
+	assert.Contains(t, out, `cloudscale_api_request_duration_seconds_count{code="404",method="GET",resource="volumes"} 1`)
+	assert.Contains(t, out, `cloudscale_api_request_duration_seconds_count{code="error",method="POST",resource="volumes"} 1`)
+	assert.Contains(t, out, "# TYPE cloudscale_api_requests_total counter\n")
+	assert.Contains(t, out, `cloudscale_api_requests_total{endpoint="/v1/volumes/{id}",method="GET",status_class="4xx"} 1`)
+	assert.Contains(t, out, `cloudscale_api_requests_total{endpoint="/v1/volumes",method="POST",status_class="error"} 1`)
+	assert.Contains(t, out, `cloudscale_api_endpoint_request_duration_seconds_bucket{endpoint="/v1/volumes/{id}",method="GET",status_class="4xx",le="+Inf"} 1`)
+	// the API check and token metrics are left out until they are used
+	assert.NotContains(t, out, "cloudscale_api_up")
+	assert.NotContains(t, out, "cloudscale_api_token_index")
+}
+
+func TestAPIEndpoint(t *testing.T) {
+	assert.Equal(t, "/v1/volumes/{id}", apiEndpoint("/v1/volumes/2f2e7b8a-4b5f-4d9c-9d8e-3b1c2a9e8f7d"))
+	assert.Equal(t, "/v1/servers", apiEndpoint("/v1/servers/"))
+	assert.Equal(t, "/", apiEndpoint("/"))
+}
+
+func TestStatusClass(t *testing.T) {
+	for code, class := range map[int]string{200: "2xx", 204: "2xx", 404: "4xx", 429: "429", 503: "5xx"} {
+		assert.Equal(t, class, statusClass(&http.Response{StatusCode: code}, nil), code)
+	}
+	assert.Equal(t, "error", statusClass(nil, errors.New("connection refused")))
+}
+
+func TestAPIResource(t *testing.T) {
+	assert.Equal(t, "volumes", apiResource("/v1/volumes/2f2e7b8a-4b5f-4d9c-9d8e-3b1c2a9e8f7d"))
+	assert.Equal(t, "servers", apiResource("/v1/servers"))
+	assert.Equal(t, "none", apiResource("/"))
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,192 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// Ext4ProfileAttribute selects a set of mkfs.ext4 options; must be one
+	// of "default", "bulk-optimized" or "auto"
+	Ext4ProfileAttribute = DriverName + "/ext4-profile"
+
+	// Ext4InodeRatioAttribute sets the bytes-per-inode ratio of mkfs.ext4
+	Ext4InodeRatioAttribute = DriverName + "/ext4-inode-ratio"
+
+	// Ext4BigallocAttribute enables the bigalloc feature with 64 KiB clusters
+	// if set to "true"
+	Ext4BigallocAttribute = DriverName + "/ext4-bigalloc"
+
+	// Ext4LazyInitAttribute controls whether the inode tables and the journal
+	// are initialized lazily after mounting; "true" or "false"
+	Ext4LazyInitAttribute = DriverName + "/ext4-lazy-init"
+
+	// Ext4ReservedBlocksPercentageAttribute sets the percentage of blocks
+	// reserved for the super-user; defaults to 0
+	Ext4ReservedBlocksPercentageAttribute = DriverName + "/ext4-reserved-blocks-percentage"
+
+	// Ext4DataModeAttribute selects the data journaling mode the volume is
+	// mounted with; must be one of "ordered", "journal" or "writeback"
+	Ext4DataModeAttribute = DriverName + "/ext4-data-mode"
+
+	// Ext4CommitIntervalAttribute sets the interval in seconds in which the
+	// data and metadata are synced to the volume, the kernel default is 5
+	Ext4CommitIntervalAttribute = DriverName + "/ext4-commit-interval"
+
+	ext4ProfileDefault       = "default"
+	ext4ProfileBulkOptimized = "bulk-optimized"
+	ext4ProfileAuto          = "auto"
+
+	// the auto profile uses the bulk-optimized profile for bulk volumes of
+	// at least this size
+	ext4ProfileAutoMinSizeGB = 1000
+
+	// a large inode ratio keeps mkfs fast and leaves more space for data
+	// on volumes that mostly hold large files
+	bulkOptimizedInodeRatio = 1024 * 1024
+
+	bigallocClusterSize = 64 * 1024
+
+	ext4DataModeOrdered   = "ordered"
+	ext4DataModeJournal   = "journal"
+	ext4DataModeWriteback = "writeback"
+
+	// a longer commit interval risks losing more data on a crash than it
+	// could possibly gain in throughput
+	ext4MaxCommitInterval = 300
+)
+
+// ext4Attributes lists the volume parameters that are passed on to the node
+// in the volume context to format the volume.
+var ext4Attributes = []string{
+	Ext4ProfileAttribute,
+	Ext4InodeRatioAttribute,
+	Ext4BigallocAttribute,
+	Ext4LazyInitAttribute,
+	Ext4ReservedBlocksPercentageAttribute,
+	Ext4DataModeAttribute,
+	Ext4CommitIntervalAttribute,
+}
+
+// resolveExt4Profile validates the ext4 profile and resolves the "auto"
+// profile based on the type and size of the volume.
+func resolveExt4Profile(profile, storageType string, sizeGB int) (string, error) {
+	switch profile {
+	case "", ext4ProfileDefault, ext4ProfileBulkOptimized:
+		return profile, nil
+	case ext4ProfileAuto:
+		if storageType == "bulk" && sizeGB >= ext4ProfileAutoMinSizeGB {
+			return ext4ProfileBulkOptimized, nil
+		}
+		return ext4ProfileDefault, nil
+	default:
+		return "", fmt.Errorf("invalid ext4 profile %q, must be one of %q, %q or %q",
+			profile, ext4ProfileDefault, ext4ProfileBulkOptimized, ext4ProfileAuto)
+	}
+}
+
+// ext4MkfsOptions returns the additional mkfs.ext4 options for the given
+// volume parameters. The profile sets the defaults, which are overridden by
+// the individual parameters.
+func ext4MkfsOptions(params map[string]string) ([]string, error) {
+	inodeRatio := 0
+	lazyInit := ""
+
+	switch params[Ext4ProfileAttribute] {
+	case "", ext4ProfileDefault:
+	case ext4ProfileBulkOptimized:
+		inodeRatio = bulkOptimizedInodeRatio
+		lazyInit = "true"
+	default:
+		return nil, fmt.Errorf("invalid ext4 profile %q", params[Ext4ProfileAttribute])
+	}
+
+	if value := params[Ext4InodeRatioAttribute]; value != "" {
+		ratio, err := strconv.Atoi(value)
+		// mkfs.ext4 accepts ratios between 1 KiB and 64 MiB
+		if err != nil || ratio < 1024 || ratio > 64*1024*1024 {
+			return nil, fmt.Errorf("invalid ext4 inode ratio %q, must be between 1024 and 67108864", value)
+		}
+		inodeRatio = ratio
+	}
+
+	if value := params[Ext4LazyInitAttribute]; value != "" {
+		if value != "true" && value != "false" {
+			return nil, fmt.Errorf("invalid ext4 lazy init %q, must be \"true\" or \"false\"", value)
+		}
+		lazyInit = value
+	}
+
+	var options []string
+	if value := params[Ext4ReservedBlocksPercentageAttribute]; value != "" {
+		percentage, err := strconv.ParseFloat(value, 64)
+		// mkfs.ext4 refuses to reserve more than half of the blocks
+		if err != nil || percentage < 0 || percentage > 50 {
+			return nil, fmt.Errorf("invalid ext4 reserved blocks percentage %q, must be between 0 and 50", value)
+		}
+		// overrides the default of reserving no blocks at all
+		options = append(options, "-m", value)
+	}
+
+	if inodeRatio != 0 {
+		options = append(options, "-i", strconv.Itoa(inodeRatio))
+	}
+
+	switch lazyInit {
+	case "true":
+		options = append(options, "-E", "lazy_itable_init=1,lazy_journal_init=1")
+	case "false":
+		options = append(options, "-E", "lazy_itable_init=0,lazy_journal_init=0")
+	}
+
+	switch params[Ext4BigallocAttribute] {
+	case "", "false":
+	case "true":
+		options = append(options, "-O", "bigalloc", "-C", strconv.Itoa(bigallocClusterSize))
+	default:
+		return nil, fmt.Errorf("invalid ext4 bigalloc %q, must be \"true\" or \"false\"", params[Ext4BigallocAttribute])
+	}
+
+	return options, nil
+}
+
+// ext4MountOptions returns the mount options of the ext4 staging mount for
+// the given volume parameters.
+func ext4MountOptions(params map[string]string) ([]string, error) {
+	var options []string
+
+	switch mode := params[Ext4DataModeAttribute]; mode {
+	case "":
+	case ext4DataModeOrdered, ext4DataModeJournal, ext4DataModeWriteback:
+		options = append(options, "data="+mode)
+	default:
+		return nil, fmt.Errorf("invalid ext4 data mode %q, must be one of %q, %q or %q",
+			mode, ext4DataModeOrdered, ext4DataModeJournal, ext4DataModeWriteback)
+	}
+
+	if value := params[Ext4CommitIntervalAttribute]; value != "" {
+		interval, err := strconv.Atoi(value)
+		if err != nil || interval < 1 || interval > ext4MaxCommitInterval {
+			return nil, fmt.Errorf("invalid ext4 commit interval %q, must be between 1 and %d seconds", value, ext4MaxCommitInterval)
+		}
+		options = append(options, "commit="+value)
+	}
+
+	return options, nil
+}
@@ -0,0 +1,111 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveExt4Profile(t *testing.T) {
+	profile, err := resolveExt4Profile(ext4ProfileAuto, "bulk", 2000)
+	assert.NoError(t, err)
+	assert.Equal(t, ext4ProfileBulkOptimized, profile)
+
+	profile, err = resolveExt4Profile(ext4ProfileAuto, "bulk", 100)
+	assert.NoError(t, err)
+	assert.Equal(t, ext4ProfileDefault, profile)
+
+	profile, err = resolveExt4Profile(ext4ProfileAuto, "ssd", 2000)
+	assert.NoError(t, err)
+	assert.Equal(t, ext4ProfileDefault, profile)
+
+	_, err = resolveExt4Profile("fast", "ssd", 1)
+	assert.Error(t, err)
+}
+
+func TestExt4MkfsOptions(t *testing.T) {
+	options, err := ext4MkfsOptions(map[string]string{})
+	assert.NoError(t, err)
+	assert.Empty(t, options)
+
+	options, err = ext4MkfsOptions(map[string]string{
+		Ext4ProfileAttribute: ext4ProfileBulkOptimized,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-i", "1048576", "-E", "lazy_itable_init=1,lazy_journal_init=1"}, options)
+
+	// individual parameters override the profile
+	options, err = ext4MkfsOptions(map[string]string{
+		Ext4ProfileAttribute:    ext4ProfileBulkOptimized,
+		Ext4InodeRatioAttribute: "65536",
+		Ext4LazyInitAttribute:   "false",
+		Ext4BigallocAttribute:   "true",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-i", "65536", "-E", "lazy_itable_init=0,lazy_journal_init=0", "-O", "bigalloc", "-C", "65536"}, options)
+
+	options, err = ext4MkfsOptions(map[string]string{
+		Ext4ReservedBlocksPercentageAttribute: "0.5",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-m", "0.5"}, options)
+
+	for _, params := range []map[string]string{
+		{Ext4ProfileAttribute: ext4ProfileAuto},
+		{Ext4InodeRatioAttribute: "12"},
+		{Ext4LazyInitAttribute: "yes"},
+		{Ext4BigallocAttribute: "1"},
+		{Ext4ReservedBlocksPercentageAttribute: "51"},
+		{Ext4ReservedBlocksPercentageAttribute: "five"},
+	} {
+		_, err := ext4MkfsOptions(params)
+		assert.Error(t, err, "%v", params)
+	}
+}
+
+func TestExt4MountOptions(t *testing.T) {
+	options, err := ext4MountOptions(map[string]string{})
+	assert.NoError(t, err)
+	assert.Empty(t, options)
+
+	options, err = ext4MountOptions(map[string]string{
+		Ext4DataModeAttribute:       ext4DataModeJournal,
+		Ext4CommitIntervalAttribute: "30",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"data=journal", "commit=30"}, options)
+
+	for _, params := range []map[string]string{
+		{Ext4DataModeAttribute: "unordered"},
+		{Ext4CommitIntervalAttribute: "0"},
+		{Ext4CommitIntervalAttribute: "301"},
+		{Ext4CommitIntervalAttribute: "5s"},
+	} {
+		_, err := ext4MountOptions(params)
+		assert.Error(t, err, "%v", params)
+	}
+}
+
+func TestStagingMountOptionsExt4(t *testing.T) {
+	volumeContext := map[string]string{
+		Ext4DataModeAttribute:       ext4DataModeWriteback,
+		Ext4CommitIntervalAttribute: "60",
+	}
+	mnt := &csi.VolumeCapability_MountVolume{MountFlags: []string{"noatime"}}
+
+	options, err := stagingMountOptions(mnt, "ext4", false, volumeContext)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"noatime", "data=writeback", "commit=60"}, options)
+
+	// other filesystems and read-only mounts are not journaled
+	options, err = stagingMountOptions(mnt, "xfs", false, volumeContext)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"noatime"}, options)
+	options, err = stagingMountOptions(mnt, "ext4", true, volumeContext)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"noatime", "ro", "noload"}, options)
+
+	_, err = stagingMountOptions(mnt, "ext4", false, map[string]string{Ext4DataModeAttribute: "unordered"})
+	assert.Error(t, err)
+}
@@ -27,14 +27,18 @@ package driver
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/mount-utils"
-	utilexec "k8s.io/utils/exec"
 	"os"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -45,6 +49,16 @@ const (
 	//   - 1 for /var/lib/docker
 	//   - 1 additional volume outside of CSI
 	fallbackMaxVolumesPerNode = 125
+	maxVolumesPerServer       = 128
+
+	// managedByTag marks the cloudscale.ch volumes created by this driver,
+	// so that they can be told apart from volumes attached for other reasons
+	managedByTag      = "csi-cloudscale-managed-by"
+	managedByTagValue = DriverName
+
+	// volumes created before the managedByTag was introduced are
+	// recognized by the name the external-provisioner gives them
+	provisionerVolumeNamePrefix = "pvc-"
 
 	volumeModeBlock      = "block"
 	volumeModeFilesystem = "filesystem"
@@ -55,7 +69,7 @@ const (
 // volume to a staging path. Once mounted, NodePublishVolume will make sure to
 // mount it to the appropriate path
 func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	d.log.Info("node stage volume called")
+	d.logFor(ctx).Info("node stage volume called")
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume ID must be provided")
 	}
@@ -68,11 +82,21 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be provided")
 	}
 
+	unlock, err := d.lockVolume(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	// Apparently sometimes we need to call udevadm trigger to get the volume
 	// properly registered in /dev/disk. More information can be found here:
 	// https://github.com/cloudscale-ch/csi-cloudscale/issues/9
-	sourcePtr, err := d.mounter.FinalizeVolumeAttachmentAndFindPath(d.log.WithFields(logrus.Fields{"volume_id": req.VolumeId}), req.VolumeId)
+	sourcePtr, err := d.mounter.FinalizeVolumeAttachmentAndFindPath(ctx, d.logFor(ctx).WithFields(logrus.Fields{"volume_id": req.VolumeId}), req.VolumeId)
 	if err != nil {
+		if _, ok := err.(*mounter.DeviceNotFoundError); ok {
+			// the CO retries the stage call
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
 		return nil, err
 	}
 	source := *sourcePtr
@@ -87,26 +111,50 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		return nil, status.Error(codes.InvalidArgument, "Could not find the volume by name")
 	}
 
-	luksContext := getLuksContext(req.Secrets, publishContext, VolumeLifecycleNodeStageVolume)
+	secrets := req.Secrets
+	if publishContext[LuksEncryptedAttribute] == "true" {
+		secrets, err = resolveLuksKey(ctx, d.luksKeyProvider, secrets)
+		if err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
+
+	luksContext := getLuksContext(secrets, publishContext, mounter.VolumeLifecycleNodeStageVolume)
+	readOnly := isReadOnlyCapability(req.VolumeCapability)
+	luksContext.ReadOnly = readOnly
+
+	staged := stagedVolume{
+		pvName:       volumeName,
+		pvcName:      req.VolumeContext[pvcNameKey],
+		pvcNamespace: req.VolumeContext[pvcNamespaceKey],
+		stagingPath:  req.StagingTargetPath,
+		device:       source,
+		readWrite:    !readOnly,
+	}
 
 	// If it is a block volume, we do nothing for stage volume
 	// because we bind mount the absolute device path to a file
 	switch req.VolumeCapability.GetAccessType().(type) {
 	case *csi.VolumeCapability_Block:
+		staged.block = true
+		d.staged.add(req.VolumeId, staged)
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
 	target := req.StagingTargetPath
 
 	mnt := req.VolumeCapability.GetMount()
-	options := mnt.MountFlags
-
 	fsType := "ext4"
 	if mnt.FsType != "" {
 		fsType = mnt.FsType
 	}
 
-	ll := d.log.WithFields(logrus.Fields{
+	options, err := stagingMountOptions(mnt, fsType, readOnly, req.VolumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	ll := d.logFor(ctx).WithFields(logrus.Fields{
 		"volume_id":           req.VolumeId,
 		"volume_mode":         volumeModeFilesystem,
 		"volume_name":         volumeName,
@@ -118,18 +166,53 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		"mount_options":       options,
 		"method":              "node_stage_volume",
 		"luks_encrypted":      luksContext.EncryptionEnabled,
+		"read_only":           readOnly,
 	})
 
-	formatted, err := d.mounter.IsFormatted(source, luksContext)
+	formatted, err := d.mounter.IsFormatted(ctx, source, luksContext)
 	if err != nil {
-		return nil, err
+		return nil, luksStatusError(err, codes.Internal)
 	}
 
+	if !formatted && readOnly {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is not formatted and cannot be staged read-only", req.VolumeId)
+	}
 	if !formatted {
-		ll.Info("formatting the volume for staging")
-		if err := d.mounter.Format(source, fsType, luksContext); err != nil {
+		// volumes attached by earlier versions lack the size
+		var sizeBytes int64
+		if size := publishContext[PublishInfoVolumeSize]; size != "" {
+			sizeBytes, err = strconv.ParseInt(size, 10, 64)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid volume size %q: %v", size, err)
+			}
+		}
+
+		if err := d.mounter.VerifyDevice(source, req.VolumeId, sizeBytes); err != nil {
+			if _, ok := err.(*mounter.DeviceMismatchError); ok {
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
 			return nil, status.Error(codes.Internal, err.Error())
 		}
+
+		if req.VolumeContext[DiscardBeforeFormatAttribute] == "true" {
+			ll.Info("discarding the volume before formatting")
+			if err := d.mounter.Discard(ctx, source); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+
+		var mkfsOptions []string
+		if fsType == "ext4" {
+			mkfsOptions, err = ext4MkfsOptions(req.VolumeContext)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+		}
+
+		ll.WithField("mkfs_options", mkfsOptions).Info("formatting the volume for staging")
+		if err := d.mounter.Format(ctx, source, fsType, luksContext, mkfsOptions...); err != nil {
+			return nil, luksStatusError(err, codes.Internal)
+		}
 	} else {
 		ll.Info("source device is already formatted")
 	}
@@ -142,13 +225,29 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	}
 
 	if !mounted {
-		if err := d.mounter.Mount(source, target, fsType, luksContext, options...); err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+		if err := d.mounter.Mount(ctx, source, target, fsType, luksContext, options...); err != nil {
+			if _, ok := err.(*mounter.FilesystemMismatchError); ok {
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
+			return nil, luksStatusError(err, codes.Internal)
 		}
 	} else {
 		ll.Info("source device is already mounted to the target path")
 	}
 
+	ownership, err := parseMountOwnership(req.VolumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if ownership.isSet() && readOnly {
+		ll.Warn("not setting up the root directory of the read-only staging mount")
+	} else if ownership.isSet() {
+		if err := d.mounter.SetOwnership(target, ownership.uid, ownership.gid, ownership.mode); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	d.staged.add(req.VolumeId, staged)
 	ll.Info("formatting and mounting stage volume is finished")
 	return &csi.NodeStageVolumeResponse{}, nil
 }
@@ -163,9 +262,15 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 		return nil, status.Error(codes.InvalidArgument, "NodeUnstageVolume Staging Target Path must be provided")
 	}
 
-	luksContext := LuksContext{VolumeLifecycle: VolumeLifecycleNodeUnstageVolume}
+	unlock, err := d.lockVolume(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-	ll := d.log.WithFields(logrus.Fields{
+	luksContext := mounter.LuksContext{VolumeLifecycle: mounter.VolumeLifecycleNodeUnstageVolume}
+
+	ll := d.logFor(ctx).WithFields(logrus.Fields{
 		"volume_id":           req.VolumeId,
 		"staging_target_path": req.StagingTargetPath,
 		"method":              "node_unstage_volume",
@@ -179,25 +284,56 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 
 	if mounted {
 		ll.Info("unmounting the staging target path")
-		err := d.mounter.Unmount(req.StagingTargetPath, luksContext)
-		if err != nil {
-			return nil, err
+		err := d.mounter.Unmount(ctx, req.StagingTargetPath, luksContext)
+		var cryptsetupErr *mounter.CryptsetupError
+		if errors.As(err, &cryptsetupErr) {
+			// the staging target path is unmounted, closing the luks
+			// mapping is tried again below
+			ll.WithError(err).Warn("failed to close the luks mapping after unmounting")
+		} else if err != nil {
+			return nil, luksStatusError(err, codes.Internal)
 		}
 	} else {
 		ll.Info("staging target path is already unmounted")
 	}
 
+	// the luks mapping is left open if closing it failed before, which must
+	// not be reported as success, as the volume is detached afterwards
+	if err := d.mounter.CloseLuksMapping(ctx, req.VolumeId); err != nil {
+		ll.WithError(err).Error("failed to close the luks mapping of the volume")
+		return nil, luksStatusError(err, codes.Internal)
+	}
+
+	d.staged.remove(req.VolumeId)
 	ll.Info("unmounting stage volume is finished")
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 // NodePublishVolume mounts the volume mounted to the staging path to the target path
 func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	d.log.Info("node publish volume called")
+	d.logFor(ctx).Info("node publish volume called")
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Volume ID must be provided")
 	}
 
+	unlock, err := d.lockVolume(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// ephemeral inline volumes are not staged and are handled separately,
+	// they only exist in Kubernetes
+	if isKubernetes(d.orchestrator) && isEphemeralVolume(req) {
+		if req.TargetPath == "" {
+			return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Target Path must be provided")
+		}
+		if req.VolumeCapability == nil {
+			return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Volume Capability must be provided")
+		}
+		return d.nodePublishEphemeralVolume(ctx, req)
+	}
+
 	if req.StagingTargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Staging Target Path must be provided")
 	}
@@ -214,27 +350,34 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	if publishContext == nil {
 		return nil, status.Error(codes.InvalidArgument, "PublishContext must be provided")
 	}
-	luksContext := getLuksContext(req.Secrets, publishContext, VolumeLifecycleNodePublishVolume)
+	luksContext := getLuksContext(req.Secrets, publishContext, mounter.VolumeLifecycleNodePublishVolume)
 
-	ll := d.log.WithFields(logrus.Fields{
+	ll := d.logFor(ctx).WithFields(logrus.Fields{
 		"volume_id":           req.VolumeId,
 		"staging_target_path": req.StagingTargetPath,
 		"target_path":         req.TargetPath,
 		"method":              "node_publish_volume",
 		"luks_encrypted":      luksContext.EncryptionEnabled,
+		"readonly":            req.Readonly,
 	})
 
+	// the mounter applies the read-only flag with a remount if needed and
+	// additionally marks raw block devices as read-only; volumes with a
+	// reader-only access mode are always published read-only
 	options := []string{"bind"}
-	if req.Readonly {
+	if req.Readonly || isReadOnlyCapability(req.VolumeCapability) {
 		options = append(options, "ro")
 	}
 
-	var err error
 	switch req.GetVolumeCapability().GetAccessType().(type) {
 	case *csi.VolumeCapability_Block:
-		err = d.nodePublishVolumeForBlock(req, luksContext, options, ll)
+		err = d.nodePublishVolumeForBlock(ctx, req, luksContext, options, ll)
 	case *csi.VolumeCapability_Mount:
-		err = d.nodePublishVolumeForFileSystem(req, luksContext, options, ll)
+		err = d.restoreStagingMount(ctx, req, ll)
+		if err != nil {
+			return nil, err
+		}
+		err = d.nodePublishVolumeForFileSystem(ctx, req, luksContext, options, ll)
 	default:
 		return nil, status.Error(codes.InvalidArgument, "Unknown access type")
 	}
@@ -257,16 +400,31 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 		return nil, status.Error(codes.InvalidArgument, "NodeUnpublishVolume Target Path must be provided")
 	}
 
-	luksContext := LuksContext{VolumeLifecycle: VolumeLifecycleNodeUnpublishVolume}
+	unlock, err := d.lockVolume(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	luksContext := mounter.LuksContext{VolumeLifecycle: mounter.VolumeLifecycleNodeUnpublishVolume}
 
-	ll := d.log.WithFields(logrus.Fields{
+	ll := d.logFor(ctx).WithFields(logrus.Fields{
 		"volume_id":   req.VolumeId,
 		"target_path": req.TargetPath,
 		"method":      "node_unpublish_volume",
 	})
 	ll.Info("node unpublish volume called")
 
-	err := d.mounter.Unmount(req.TargetPath, luksContext)
+	ephemeral, err := d.nodeUnpublishEphemeralVolume(ctx, req, ll)
+	if err != nil {
+		return nil, err
+	}
+	if ephemeral {
+		ll.Info("unpublishing ephemeral volume is finished")
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	err = d.mounter.Unmount(ctx, req.TargetPath, luksContext)
 	if err != nil {
 		return nil, err
 	}
@@ -299,9 +457,23 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 				},
 			},
 		},
+		&csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
+		&csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+				},
+			},
+		},
 	}
 
-	d.log.WithFields(logrus.Fields{
+	d.logFor(ctx).WithFields(logrus.Fields{
 		"node_capabilities": nscaps,
 		"method":            "node_get_capabilities",
 	}).Info("node get capabilities called")
@@ -310,6 +482,17 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 	}, nil
 }
 
+// isSELinuxMountOption returns true if the given mount option sets an SELinux
+// context, as passed by the CO for drivers supporting SELinux mounts.
+func isSELinuxMountOption(option string) bool {
+	for _, prefix := range []string{"context=", "fscontext=", "defcontext=", "rootcontext="} {
+		if strings.HasPrefix(option, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func getEnvAsInt(key string, fallback int64) int64 {
 	if valueStr, ok := os.LookupEnv(key); ok {
 		if value, err := strconv.ParseInt(valueStr, 10, 64); err == nil {
@@ -324,9 +507,23 @@ func getEnvAsInt(key string, fallback int64) int64 {
 // knows where to place the workload. The result of this function will be used
 // by the CO in ControllerPublishVolume.
 func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	d.log.WithField("method", "node_get_info").Info("node get info called")
+	d.logFor(ctx).WithField("method", "node_get_info").Info("node get info called")
 
-	maxVolumesPerNode := getEnvAsInt("CLOUDSCALE_MAX_CSI_VOLUMES_PER_NODE", fallbackMaxVolumesPerNode)
+	d.settingsMu.RLock()
+	maxVolumesPerNode := d.maxVolumesPerNode
+	d.settingsMu.RUnlock()
+	if maxVolumesPerNode <= 0 {
+		maxVolumesPerNode = getEnvAsInt("CLOUDSCALE_MAX_CSI_VOLUMES_PER_NODE", fallbackMaxVolumesPerNode)
+	}
+
+	// the root disk and volumes attached manually take up slots as well
+	if available := maxVolumesPerServer - d.otherVolumes; d.otherVolumes > 0 && available < maxVolumesPerNode {
+		d.logFor(ctx).WithFields(logrus.Fields{
+			"configured_max_volumes": maxVolumesPerNode,
+			"available_max_volumes":  available,
+		}).Info("lowering the max volumes per node because of volumes attached outside of CSI")
+		maxVolumesPerNode = available
+	}
 
 	return &csi.NodeGetInfoResponse{
 		NodeId:            d.serverId,
@@ -335,16 +532,78 @@ func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (
 		// make sure that the driver works on this particular region only
 		AccessibleTopology: &csi.Topology{
 			Segments: map[string]string{
-				"csi.cloudscale.ch/zone": d.zone,
+				topologyZoneKey: d.zone,
 			},
 		},
 	}, nil
 }
 
+// countOtherVolumes counts the volumes attached to the server for other
+// reasons than CSI, such as the root disk or volumes attached manually, as
+// they take up attachment slots as well. Volumes attached by the driver carry
+// the managedByTag. The volumes are only counted when the node plugin starts,
+// as kubelet reads the max volumes per node when the plugin registers.
+func (d *Driver) countOtherVolumes(ctx context.Context) {
+	ll := d.log.WithField("method", "count_other_volumes")
+
+	server, err := d.cloudscaleClient.Servers.Get(ctx, d.serverId)
+	if err != nil {
+		ll.WithError(err).Warn("could not determine the number of non-CSI volumes attached to the server, using the configured limit")
+		return
+	}
+	volumes, err := listAllVolumes(ctx, d.cloudscaleClient.Volumes)
+	if err != nil {
+		ll.WithError(err).Warn("could not determine the number of non-CSI volumes attached to the server, using the configured limit")
+		return
+	}
+	managed := make(map[string]bool, len(volumes))
+	for _, vol := range volumes {
+		managed[vol.UUID] = vol.Tags[managedByTag] == managedByTagValue
+	}
+
+	var otherVolumes int64
+	for _, stub := range server.Volumes {
+		if !managed[stub.UUID] {
+			otherVolumes++
+		}
+	}
+	if otherVolumes > maxVolumesPerServer {
+		otherVolumes = maxVolumesPerServer
+	}
+	d.otherVolumes = otherVolumes
+	ll.WithField("other_volumes", otherVolumes).Info("counted the volumes attached outside of CSI")
+}
+
+// IsManagedVolume returns true if the volume was created by this driver
+func IsManagedVolume(vol cloudscale.Volume) bool {
+	if vol.Tags[managedByTag] == managedByTagValue {
+		return true
+	}
+	return strings.HasPrefix(vol.Name, provisionerVolumeNamePrefix)
+}
+
+// allowedPublishMountOptions are the mount options that can be enforced for
+// all published volumes
+var allowedPublishMountOptions = map[string]bool{
+	"ro":     true,
+	"noexec": true,
+	"nosuid": true,
+	"nodev":  true,
+}
+
+func validatePublishMountOptions(options []string) error {
+	for _, option := range options {
+		if !allowedPublishMountOptions[option] && !mounter.IsPropagationOption(option) {
+			return fmt.Errorf("unsupported publish mount option %q", option)
+		}
+	}
+	return nil
+}
+
 // NodeGetVolumeStats returns the volume capacity statistics available for the
 // the given volume.
 func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	ll := d.log.WithField("method", "node_get_volume_stats")
+	ll := d.logFor(ctx).WithField("method", "node_get_volume_stats")
 	ll.Info("node get volume stats called")
 
 	if req.VolumeId == "" {
@@ -362,7 +621,36 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 	}
 
 	if !mounted {
-		return nil, status.Errorf(codes.NotFound, "volume path %q is not mounted", volumePath)
+		if _, err := os.Stat(volumePath); os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %q is not mounted", volumePath)
+		}
+
+		// the path still exists, but the mount is gone
+		ll.WithField("volume_path", volumePath).Warn("volume path is not mounted anymore")
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("volume path %s is not mounted", volumePath),
+			},
+		}, nil
+	}
+
+	// a read-only staging mount is only abnormal if the volume is known to
+	// have been staged read-write
+	staged, _ := d.staged.get(req.VolumeId)
+	conditionMessage, err := d.mounter.GetVolumeCondition(volumePath, req.StagingTargetPath, !staged.readWrite)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check condition of volume path %q: %s", volumePath, err)
+	}
+	volumeCondition := &csi.VolumeCondition{
+		Abnormal: conditionMessage != "",
+		Message:  conditionMessage,
+	}
+	if volumeCondition.Abnormal {
+		ll.WithFields(logrus.Fields{
+			"volume_path": volumePath,
+			"condition":   conditionMessage,
+		}).Warn("volume condition is abnormal")
 	}
 
 	isBlock, err := d.mounter.IsBlockDevice(volumePath)
@@ -370,53 +658,67 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 		return nil, status.Errorf(codes.Internal, "failed to determine if %q is block device: %s", volumePath, err)
 	}
 
-	stats, err := d.mounter.GetStatistics(volumePath)
+	stats, err := d.mounter.GetStatistics(ctx, volumePath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to retrieve capacity statistics for volume path %q: %s", volumePath, err)
 	}
 
+	// volumes staged before the node plugin started are learned here
+	if req.StagingTargetPath != "" {
+		if device, err := d.mounter.FindAbsoluteDeviceByIDPath(req.VolumeId); err == nil {
+			d.staged.learn(req.VolumeId, stagedVolume{
+				pvName:      volumeNameFromPath(d.orchestrator, volumePath),
+				stagingPath: req.StagingTargetPath,
+				device:      device,
+				block:       isBlock,
+			})
+		}
+	}
+
 	// only can retrieve total capacity for a block device
 	if isBlock {
 		ll.WithFields(logrus.Fields{
 			"volume_mode": volumeModeBlock,
-			"bytes_total": stats.totalBytes,
+			"bytes_total": stats.TotalBytes,
 		}).Info("node capacity statistics retrieved")
 
 		return &csi.NodeGetVolumeStatsResponse{
 			Usage: []*csi.VolumeUsage{
 				{
 					Unit:  csi.VolumeUsage_BYTES,
-					Total: stats.totalBytes,
+					Total: stats.TotalBytes,
 				},
 			},
+			VolumeCondition: volumeCondition,
 		}, nil
 	}
 
 	ll.WithFields(logrus.Fields{
 		"volume_mode":      volumeModeFilesystem,
-		"bytes_available":  stats.availableBytes,
-		"bytes_total":      stats.totalBytes,
-		"bytes_used":       stats.usedBytes,
-		"inodes_available": stats.availableInodes,
-		"inodes_total":     stats.totalInodes,
-		"inodes_used":      stats.usedInodes,
+		"bytes_available":  stats.AvailableBytes,
+		"bytes_total":      stats.TotalBytes,
+		"bytes_used":       stats.UsedBytes,
+		"inodes_available": stats.AvailableInodes,
+		"inodes_total":     stats.TotalInodes,
+		"inodes_used":      stats.UsedInodes,
 	}).Info("node capacity statistics retrieved")
 
 	return &csi.NodeGetVolumeStatsResponse{
 		Usage: []*csi.VolumeUsage{
 			&csi.VolumeUsage{
-				Available: stats.availableBytes,
-				Total:     stats.totalBytes,
-				Used:      stats.usedBytes,
+				Available: stats.AvailableBytes,
+				Total:     stats.TotalBytes,
+				Used:      stats.UsedBytes,
 				Unit:      csi.VolumeUsage_BYTES,
 			},
 			&csi.VolumeUsage{
-				Available: stats.availableInodes,
-				Total:     stats.totalInodes,
-				Used:      stats.usedInodes,
+				Available: stats.AvailableInodes,
+				Total:     stats.TotalInodes,
+				Used:      stats.UsedInodes,
 				Unit:      csi.VolumeUsage_INODES,
 			},
 		},
+		VolumeCondition: volumeCondition,
 	}, nil
 }
 
@@ -436,7 +738,13 @@ func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolume
 		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume volume path not provided")
 	}
 
-	log := d.log.WithFields(logrus.Fields{
+	unlock, err := d.lockVolume(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	log := d.logFor(ctx).WithFields(logrus.Fields{
 		"volume_id":   req.VolumeId,
 		"volume_path": req.VolumePath,
 		"method":      "node_expand_volume",
@@ -446,6 +754,8 @@ func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolume
 	if req.GetVolumeCapability() != nil {
 		switch req.GetVolumeCapability().GetAccessType().(type) {
 		case *csi.VolumeCapability_Block:
+			// block volumes cannot be encrypted with luks, the pod sees
+			// the larger device without any expansion on the node
 			log.Info("filesystem expansion is skipped for block volumes")
 			return &csi.NodeExpandVolumeResponse{}, nil
 		}
@@ -460,13 +770,12 @@ func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolume
 		return nil, status.Errorf(codes.NotFound, "NodeExpandVolume volume path %q is not mounted", volumePath)
 	}
 
-	mounter := mount.New("")
-	devicePath, err := d.mounter.GetDeviceName(mounter, volumePath)
+	devicePath, err := d.mounter.GetDeviceName(mount.New(""), volumePath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "NodeExpandVolume unable to get device path for %q: %v", volumePath, err)
 	}
 
-	isLuks, _, err := isLuksMapping(devicePath)
+	isLuks, _, err := mounter.IsLuksMapping(ctx, devicePath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "NodeExpandVolume unable to test if volume %q at %q is encrypted with luks: %v", volumePath, devicePath, err)
 	}
@@ -474,7 +783,7 @@ func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolume
 	log = log.WithFields(logrus.Fields{
 		"device_path": devicePath,
 	})
-	hasRequiredSize, err := d.mounter.HasRequiredSize(log, source, req.CapacityRange.RequiredBytes)
+	hasRequiredSize, err := d.mounter.HasRequiredSize(ctx, log, source, req.CapacityRange.RequiredBytes)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "NodeExpandVolume unable to test if volume %q at %q has required size: %v", volumePath, source, err)
 	}
@@ -489,15 +798,14 @@ func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolume
 		log.WithFields(logrus.Fields{
 			"device_path": devicePath,
 		}).Info("resizing luks container")
-		err := luksResize(devicePath)
+		err := mounter.LuksResize(ctx, devicePath)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "NodeExpandVolume unable resize luks container for volume %q at %q: %v", volumePath, devicePath, err)
 		}
 	}
 
-	r := mount.NewResizeFs(utilexec.New())
 	log.Info("resizing volume")
-	if _, err := r.Resize(devicePath, volumePath); err != nil {
+	if err := d.mounter.ResizeFilesystem(ctx, devicePath, volumePath); err != nil {
 		return nil, status.Errorf(codes.Internal, "NodeExpandVolume could not resize volume %q (%q):  %v", volumeID, req.GetVolumePath(), err)
 	}
 
@@ -505,14 +813,22 @@ func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolume
 	return &csi.NodeExpandVolumeResponse{}, nil
 }
 
-func (d *Driver) nodePublishVolumeForFileSystem(req *csi.NodePublishVolumeRequest, luksContext LuksContext, mountOptions []string, log *logrus.Entry) error {
+func (d *Driver) nodePublishVolumeForFileSystem(ctx context.Context, req *csi.NodePublishVolumeRequest, luksContext mounter.LuksContext, mountOptions []string, log *logrus.Entry) error {
 	source := req.StagingTargetPath
 	target := req.TargetPath
 
 	mnt := req.VolumeCapability.GetMount()
 	for _, flag := range mnt.MountFlags {
+		// the SELinux context is applied when mounting the staging path and
+		// is inherited by the bind mount, which does not accept it again
+		if isSELinuxMountOption(flag) {
+			continue
+		}
 		mountOptions = append(mountOptions, flag)
 	}
+	d.settingsMu.RLock()
+	mountOptions = append(mountOptions, d.publishMountOptions...)
+	d.settingsMu.RUnlock()
 
 	fsType := "ext4"
 	if mnt.FsType != "" {
@@ -527,14 +843,163 @@ func (d *Driver) nodePublishVolumeForFileSystem(req *csi.NodePublishVolumeReques
 	})
 
 	log.Info("mounting the volume")
-	if err := d.mounter.Mount(source, target, fsType, luksContext, mountOptions...); err != nil {
+	if err := d.mounter.Mount(ctx, source, target, fsType, luksContext, mountOptions...); err != nil {
 		return status.Error(codes.Internal, err.Error())
 	}
 
+	if mnt.VolumeMountGroup != "" {
+		gid, err := strconv.Atoi(mnt.VolumeMountGroup)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid volume mount group %q: %v", mnt.VolumeMountGroup, err)
+		}
+
+		// the files of a read-only mount cannot be changed, like kubelet,
+		// the group is not applied to them
+		if req.Readonly || isReadOnlyCapability(req.VolumeCapability) {
+			log.WithField("volume_mount_group", gid).Info("not applying volume mount group to the read-only mount")
+			return nil
+		}
+
+		log.WithField("volume_mount_group", gid).Info("applying volume mount group")
+		if err := d.mounter.SetVolumeMountGroup(ctx, target, gid); err != nil {
+			return status.Errorf(codes.Internal, "failed to apply volume mount group %d: %v", gid, err)
+		}
+	}
+
 	return nil
 }
 
-func (d *Driver) nodePublishVolumeForBlock(req *csi.NodePublishVolumeRequest, luksContext LuksContext, mountOptions []string, log *logrus.Entry) error {
+// restoreStagingMount mounts the staging target path again if it is not
+// mounted anymore, e.g. because the node was rebooted and kubelet publishes
+// the volume without staging it first. Otherwise, the empty staging directory
+// would be bind mounted into the pod. The volume is never formatted here, as
+// it has been staged before.
+func (d *Driver) restoreStagingMount(ctx context.Context, req *csi.NodePublishVolumeRequest, log *logrus.Entry) error {
+	mounted, err := d.mounter.IsMounted(req.StagingTargetPath)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return nil
+	}
+
+	log.Warn("staging target path is not mounted, staging the volume again")
+
+	sourcePtr, err := d.mounter.FinalizeVolumeAttachmentAndFindPath(ctx, log, req.VolumeId)
+	if err != nil {
+		if _, ok := err.(*mounter.DeviceNotFoundError); ok {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		return err
+	}
+	source := *sourcePtr
+
+	// the luks key is only available if it is passed to NodePublishVolume
+	// as well, e.g. by setting the node publish secret of the storage class
+	secrets := req.Secrets
+	if req.PublishContext[LuksEncryptedAttribute] == "true" {
+		secrets, err = resolveLuksKey(ctx, d.luksKeyProvider, secrets)
+		if err != nil {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if secrets[LuksKeyAttribute] == "" {
+			return status.Errorf(codes.FailedPrecondition, "staging target path %s is not mounted and the luks key is required to stage volume %s again",
+				req.StagingTargetPath, req.VolumeId)
+		}
+	}
+	luksContext := getLuksContext(secrets, req.PublishContext, mounter.VolumeLifecycleNodeStageVolume)
+	readOnly := isReadOnlyCapability(req.VolumeCapability)
+	luksContext.ReadOnly = readOnly
+
+	mnt := req.VolumeCapability.GetMount()
+	fsType := "ext4"
+	if mnt.FsType != "" {
+		fsType = mnt.FsType
+	}
+
+	formatted, err := d.mounter.IsFormatted(ctx, source, luksContext)
+	if err != nil {
+		return luksStatusError(err, codes.Internal)
+	}
+	if !formatted {
+		return status.Errorf(codes.FailedPrecondition, "staging target path %s is not mounted and device %s of volume %s is not formatted",
+			req.StagingTargetPath, source, req.VolumeId)
+	}
+
+	options, err := stagingMountOptions(mnt, fsType, readOnly, req.VolumeContext)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	log.WithFields(logrus.Fields{
+		"source":        source,
+		"fs_type":       fsType,
+		"mount_options": options,
+	}).Info("mounting the volume for staging")
+	if err := d.mounter.Mount(ctx, source, req.StagingTargetPath, fsType, luksContext, options...); err != nil {
+		if _, ok := err.(*mounter.FilesystemMismatchError); ok {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return luksStatusError(err, codes.Internal)
+	}
+	return nil
+}
+
+// readOnlyMountOptions keep the filesystems from writing to the device when
+// they are mounted read-only, e.g. by replaying their journal
+var readOnlyMountOptions = map[string][]string{
+	"ext3":  {"noload"},
+	"ext4":  {"noload"},
+	"xfs":   {"norecovery"},
+	"btrfs": {"nologreplay"},
+}
+
+// isReadOnlyCapability returns true if the volume is used read-only, which is
+// the case for the reader-only access modes and the "ro" mount flag
+func isReadOnlyCapability(capability *csi.VolumeCapability) bool {
+	switch capability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	for _, flag := range capability.GetMount().GetMountFlags() {
+		if flag == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// stagingMountOptions returns the options of the staging mount of a
+// filesystem volume. A read-only staging mount does not write to the device
+// at all, so that the superblock is never seen read-write, and is not
+// discarded or journaled either.
+func stagingMountOptions(mnt *csi.VolumeCapability_MountVolume, fsType string, readOnly bool, volumeContext map[string]string) ([]string, error) {
+	options := append([]string{}, mnt.MountFlags...)
+	if readOnly {
+		present := make(map[string]bool, len(options))
+		for _, option := range options {
+			present[option] = true
+		}
+		for _, option := range append([]string{"ro"}, readOnlyMountOptions[fsType]...) {
+			if !present[option] {
+				options = append(options, option)
+			}
+		}
+		return options, nil
+	}
+	if volumeContext[DiscardAttribute] == "true" {
+		options = append(options, "discard")
+	}
+	if fsType == "ext4" {
+		ext4Options, err := ext4MountOptions(volumeContext)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, ext4Options...)
+	}
+	return options, nil
+}
+
+func (d *Driver) nodePublishVolumeForBlock(ctx context.Context, req *csi.NodePublishVolumeRequest, luksContext mounter.LuksContext, mountOptions []string, log *logrus.Entry) error {
 	volumeId := req.VolumeId
 
 	source, err := d.mounter.FindAbsoluteDeviceByIDPath(volumeId)
@@ -550,8 +1015,20 @@ func (d *Driver) nodePublishVolumeForBlock(req *csi.NodePublishVolumeRequest, lu
 		"mount_options": mountOptions,
 	})
 
+	// the device node is shared by the bind mount at the target, which
+	// might be read-only
+	ownership, err := parseBlockOwnership(req.VolumeContext)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if ownership.isSet() {
+		if err := d.mounter.SetOwnership(source, ownership.uid, ownership.gid, ownership.mode); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
 	log.Info("mounting the volume")
-	if err := d.mounter.Mount(source, target, "", luksContext, mountOptions...); err != nil {
+	if err := d.mounter.Mount(ctx, source, target, "", luksContext, mountOptions...); err != nil {
 		return status.Errorf(codes.Internal, err.Error())
 	}
 
@@ -0,0 +1,552 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNodeGetInfoSubtractsOtherVolumes(t *testing.T) {
+	serverId := "987654"
+	server := &cloudscale.Server{UUID: serverId}
+	var apiCalls int
+	driver := &Driver{
+		serverId: serverId,
+		cloudscaleClient: cloudscalefake.NewClient(map[string]*cloudscale.Server{serverId: server},
+			cloudscalefake.WithErrorInjection(func(cloudscalefake.Call) error {
+				apiCalls++
+				return nil
+			})),
+		mounter: mounter.NewFake(),
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	csiVolume, err := driver.CreateVolume(ctx, makeCreateVolumeRequest(randString(32), 1, "ssd", false))
+	assert.NoError(t, err)
+	legacyVolume, err := driver.cloudscaleClient.Volumes.Create(ctx, &cloudscale.VolumeRequest{Name: "pvc-1234", SizeGB: 1})
+	assert.NoError(t, err)
+	manualVolume, err := driver.cloudscaleClient.Volumes.Create(ctx, &cloudscale.VolumeRequest{Name: "pvc-data", SizeGB: 1})
+	assert.NoError(t, err)
+
+	// volumes created by earlier versions are tagged once they are published
+	_, err = driver.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         legacyVolume.UUID,
+		NodeId:           serverId,
+		VolumeCapability: makeVolumeCapabilityObject(false)[0],
+	})
+	assert.NoError(t, err)
+
+	server.Volumes = []cloudscale.VolumeStub{
+		{Type: "ssd", UUID: "root-volume"},
+		{Type: "ssd", UUID: csiVolume.Volume.VolumeId},
+		{Type: "ssd", UUID: legacyVolume.UUID},
+		{Type: "ssd", UUID: manualVolume.UUID},
+	}
+	driver.countOtherVolumes(ctx)
+	assert.Equal(t, int64(2), driver.otherVolumes)
+
+	// the volumes are counted once, not for every call
+	apiCalls = 0
+	t.Setenv("CLOUDSCALE_MAX_CSI_VOLUMES_PER_NODE", "127")
+	resp, err := driver.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(maxVolumesPerServer-2), resp.MaxVolumesPerNode)
+	assert.Zero(t, apiCalls)
+
+	// a lower configured limit takes precedence
+	t.Setenv("CLOUDSCALE_MAX_CSI_VOLUMES_PER_NODE", "10")
+	resp, err = driver.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), resp.MaxVolumesPerNode)
+
+	// the flag takes precedence over the environment
+	driver.maxVolumesPerNode = 20
+	resp, err = driver.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), resp.MaxVolumesPerNode)
+}
+
+func TestNodePublishEphemeralVolume(t *testing.T) {
+	serverId := "987654"
+	driver := &Driver{
+		serverId: serverId,
+		cloudscaleClient: cloudscalefake.NewClient(map[string]*cloudscale.Server{
+			serverId: {UUID: serverId},
+		}),
+		mounter: mounter.NewFake(),
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	volumeID := "csi-0123456789abcdef"
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   volumeID,
+		TargetPath: "/var/lib/kubelet/pods/1/volumes/kubernetes.io~csi/scratch/mount",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{
+			ephemeralContextKey:    "true",
+			EphemeralSizeAttribute: "5Gi",
+		},
+	}
+
+	_, err := driver.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+
+	// publishing again must not create another volume
+	_, err = driver.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+
+	volumes, err := driver.cloudscaleClient.Volumes.List(ctx, cloudscale.WithNameFilter(volumeID))
+	assert.NoError(t, err)
+	if assert.Len(t, volumes, 1) {
+		assert.Equal(t, 5, volumes[0].SizeGB)
+		assert.Equal(t, []string{serverId}, *volumes[0].ServerUUIDs)
+		assert.Equal(t, "true", volumes[0].Tags[ephemeralTag])
+	}
+
+	_, err = driver.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   volumeID,
+		TargetPath: req.TargetPath,
+	})
+	assert.NoError(t, err)
+
+	volumes, err = driver.cloudscaleClient.Volumes.List(ctx, cloudscale.WithNameFilter(volumeID))
+	assert.NoError(t, err)
+	assert.Empty(t, volumes)
+
+	// block volumes cannot be used inline
+	req.VolumeCapability.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+	_, err = driver.NodePublishVolume(ctx, req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodePublishEphemeralVolumeMaxSize(t *testing.T) {
+	serverId := "987654"
+	driver := &Driver{
+		serverId: serverId,
+		cloudscaleClient: cloudscalefake.NewClient(map[string]*cloudscale.Server{
+			serverId: {UUID: serverId},
+		}),
+		mounter:                mounter.NewFake(),
+		log:                    logrus.New().WithField("test_enabled", true),
+		maxEphemeralVolumeSize: 50 * GB,
+	}
+	ctx := context.Background()
+
+	volumeID := "csi-0123456789abcdef"
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   volumeID,
+		TargetPath: "/var/lib/kubelet/pods/1/volumes/kubernetes.io~csi/scratch/mount",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{
+			ephemeralContextKey:    "true",
+			EphemeralSizeAttribute: "60Gi",
+		},
+	}
+
+	_, err := driver.NodePublishVolume(ctx, req)
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// bulk volumes are rounded up to 100 GB before the comparison
+	req.VolumeContext[EphemeralSizeAttribute] = "10Gi"
+	req.VolumeContext[StorageTypeAttribute] = "bulk"
+	_, err = driver.NodePublishVolume(ctx, req)
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	volumes, err := driver.cloudscaleClient.Volumes.List(ctx, cloudscale.WithNameFilter(volumeID))
+	assert.NoError(t, err)
+	assert.Empty(t, volumes)
+
+	req.VolumeContext[StorageTypeAttribute] = "ssd"
+	_, err = driver.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+}
+
+func TestNodePublishEphemeralVolumeSwarm(t *testing.T) {
+	serverId := "987654"
+	driver := &Driver{
+		serverId: serverId,
+		cloudscaleClient: cloudscalefake.NewClient(map[string]*cloudscale.Server{
+			serverId: {UUID: serverId},
+		}),
+		mounter:      mounter.NewFake(),
+		log:          logrus.New().WithField("test_enabled", true),
+		orchestrator: OrchestratorSwarm,
+	}
+	ctx := context.Background()
+
+	// only kubelet publishes ephemeral inline volumes, which are staged
+	// like any other volume otherwise
+	volumeID := "csi-0123456789abcdef"
+	_, err := driver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:   volumeID,
+		TargetPath: "/data/published/" + volumeID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{ephemeralContextKey: "true"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	volumes, err := driver.cloudscaleClient.Volumes.List(ctx, cloudscale.WithNameFilter(volumeID))
+	assert.NoError(t, err)
+	assert.Empty(t, volumes)
+}
+
+func TestValidatePublishMountOptions(t *testing.T) {
+	assert.NoError(t, validatePublishMountOptions(nil))
+	assert.NoError(t, validatePublishMountOptions([]string{"noexec", "nosuid", "nodev", "rslave"}))
+	assert.Error(t, validatePublishMountOptions([]string{"noexec", "exec"}))
+}
+
+func TestNodePublishRestoresStagingMount(t *testing.T) {
+	fm := mounter.NewFake()
+	driver := &Driver{
+		mounter: fm,
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          "2f2e7b8a-4b5f-4d9c-9a1b-0123456789ab",
+		StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount",
+		TargetPath:        "/var/lib/kubelet/pods/1/volumes/kubernetes.io~csi/pvc-1/mount",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		PublishContext: map[string]string{PublishInfoVolumeName: "pvc-1"},
+	}
+
+	// the staging mount is gone after a reboot
+	_, err := driver.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Contains(t, fm.Mounts(), req.StagingTargetPath)
+	assert.Equal(t, req.StagingTargetPath, fm.Mounts()[req.TargetPath])
+
+	// the luks key is required to open the volume again
+	assert.NoError(t, fm.Unmount(context.Background(), req.StagingTargetPath, mounter.LuksContext{}))
+	assert.NoError(t, fm.Unmount(context.Background(), req.TargetPath, mounter.LuksContext{}))
+	req.PublishContext[LuksEncryptedAttribute] = "true"
+	_, err = driver.NodePublishVolume(ctx, req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.NotContains(t, fm.Mounts(), req.TargetPath)
+
+	req.Secrets = map[string]string{LuksKeyAttribute: "secret"}
+	_, err = driver.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Contains(t, fm.Mounts(), req.StagingTargetPath)
+}
+
+// stagingMounter records the staging mounts and reports the device as
+// formatted or not
+type stagingMounter struct {
+	mounter.Mounter
+	unformatted bool
+	formats     int
+	ownerships  int
+	options     []string
+	luksContext mounter.LuksContext
+}
+
+func (m *stagingMounter) IsFormatted(ctx context.Context, source string, luksContext mounter.LuksContext) (bool, error) {
+	return !m.unformatted, nil
+}
+
+func (m *stagingMounter) Format(ctx context.Context, source, fsType string, luksContext mounter.LuksContext, mkfsOptions ...string) error {
+	m.formats++
+	return nil
+}
+
+func (m *stagingMounter) Mount(ctx context.Context, source, target, fsType string, luksContext mounter.LuksContext, options ...string) error {
+	m.options = options
+	m.luksContext = luksContext
+	return m.Mounter.Mount(ctx, source, target, fsType, luksContext, options...)
+}
+
+func (m *stagingMounter) SetOwnership(target string, uid, gid int, mode os.FileMode) error {
+	m.ownerships++
+	return nil
+}
+
+func TestNodeStageVolumeReadOnly(t *testing.T) {
+	stageRequest := func(mode csi.VolumeCapability_AccessMode_Mode, fsType string, flags ...string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "2f2e7b8a-4b5f-4d9c-9a1b-0123456789ab",
+			StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount",
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType, MountFlags: flags}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			},
+			PublishContext: map[string]string{PublishInfoVolumeName: "pvc-1"},
+			VolumeContext: map[string]string{
+				DiscardAttribute:   "true",
+				MountUIDAttribute:  "1000",
+				MountModeAttribute: "0770",
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		req     *csi.NodeStageVolumeRequest
+		options []string
+	}{
+		{
+			name:    "writer",
+			req:     stageRequest(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "ext4"),
+			options: []string{"discard"},
+		},
+		{
+			name:    "reader only",
+			req:     stageRequest(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, "ext4"),
+			options: []string{"ro", "noload"},
+		},
+		{
+			name:    "ro mount flag",
+			req:     stageRequest(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "xfs", "ro", "noatime"),
+			options: []string{"ro", "noatime", "norecovery"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sm := &stagingMounter{Mounter: mounter.NewFake()}
+			driver := &Driver{
+				mounter: sm,
+				log:     logrus.New().WithField("test_enabled", true),
+			}
+
+			_, err := driver.NodeStageVolume(context.Background(), tc.req)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.options, sm.options)
+
+			readOnly := tc.options[0] == "ro"
+			assert.Equal(t, readOnly, sm.luksContext.ReadOnly)
+			if readOnly {
+				assert.Equal(t, 0, sm.ownerships)
+			} else {
+				assert.Equal(t, 1, sm.ownerships)
+			}
+		})
+	}
+
+	// an unformatted volume is neither formatted nor mounted read-only
+	fm := mounter.NewFake()
+	sm := &stagingMounter{Mounter: fm, unformatted: true}
+	driver := &Driver{
+		mounter: sm,
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	_, err := driver.NodeStageVolume(context.Background(), stageRequest(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, "ext4"))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, 0, sm.formats)
+	assert.Empty(t, fm.Mounts())
+}
+
+func TestNodeStageAndPublishSELinuxContext(t *testing.T) {
+	sm := &stagingMounter{Mounter: mounter.NewFake()}
+	driver := &Driver{
+		mounter: sm,
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	seLinuxContext := `context="system_u:object_r:container_file_t:s0:c0,c1"`
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{seLinuxContext, "noatime"}}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	stagingTargetPath := "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount"
+
+	// the context is applied when the filesystem is mounted for staging
+	_, err := driver.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "2f2e7b8a-4b5f-4d9c-9a1b-0123456789ab",
+		StagingTargetPath: stagingTargetPath,
+		VolumeCapability:  capability,
+		PublishContext:    map[string]string{PublishInfoVolumeName: "pvc-1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{seLinuxContext, "noatime"}, sm.options)
+
+	// and inherited by the bind mount, which rejects it
+	_, err = driver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "2f2e7b8a-4b5f-4d9c-9a1b-0123456789ab",
+		StagingTargetPath: stagingTargetPath,
+		TargetPath:        "/var/lib/kubelet/pods/1/volumes/kubernetes.io~csi/pvc-1/mount",
+		VolumeCapability:  capability,
+		PublishContext:    map[string]string{PublishInfoVolumeName: "pvc-1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bind", "noatime"}, sm.options)
+}
+
+// conditionMounter reports the staging mount as read-only, as the kernel
+// does after errors or for volumes staged read-only
+type conditionMounter struct {
+	mounter.Mounter
+}
+
+func (m *conditionMounter) GetVolumeCondition(volumePath, stagingTargetPath string, readOnly bool) (string, error) {
+	if readOnly {
+		return "", nil
+	}
+	return "filesystem at " + stagingTargetPath + " is read-only", nil
+}
+
+func TestNodeGetVolumeStatsReadOnlyStaging(t *testing.T) {
+	fm := mounter.NewFake()
+	driver := &Driver{
+		mounter: &conditionMounter{Mounter: fm},
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	stage := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.NodeGetVolumeStatsRequest {
+		req := &csi.NodeStageVolumeRequest{
+			VolumeId:          "2f2e7b8a-4b5f-4d9c-9a1b-0123456789ab",
+			StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount",
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			},
+			PublishContext: map[string]string{PublishInfoVolumeName: "pvc-1"},
+		}
+		_, err := driver.NodeStageVolume(ctx, req)
+		assert.NoError(t, err)
+		return &csi.NodeGetVolumeStatsRequest{
+			VolumeId:          req.VolumeId,
+			VolumePath:        req.StagingTargetPath,
+			StagingTargetPath: req.StagingTargetPath,
+		}
+	}
+
+	// a volume staged read-only is healthy
+	resp, err := driver.NodeGetVolumeStats(ctx, stage(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY))
+	assert.NoError(t, err)
+	assert.False(t, resp.VolumeCondition.Abnormal)
+
+	// a volume staged read-write was remounted read-only by the kernel
+	_, err = driver.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "2f2e7b8a-4b5f-4d9c-9a1b-0123456789ab",
+		StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount",
+	})
+	assert.NoError(t, err)
+	resp, err = driver.NodeGetVolumeStats(ctx, stage(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER))
+	assert.NoError(t, err)
+	assert.True(t, resp.VolumeCondition.Abnormal)
+	assert.Contains(t, resp.VolumeCondition.Message, "read-only")
+}
+
+// mountGroupMounter records the volume mount groups applied to the targets
+type mountGroupMounter struct {
+	mounter.Mounter
+	groups map[string]int
+}
+
+func (m *mountGroupMounter) SetVolumeMountGroup(ctx context.Context, target string, gid int) error {
+	m.groups[target] = gid
+	return nil
+}
+
+func TestNodePublishVolumeMountGroupReadOnly(t *testing.T) {
+	fm := mounter.NewFake()
+	mm := &mountGroupMounter{Mounter: fm, groups: map[string]int{}}
+	driver := &Driver{
+		mounter: mm,
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+
+	publish := func(target string, mode csi.VolumeCapability_AccessMode_Mode, readOnly bool) {
+		_, err := driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "2f2e7b8a-4b5f-4d9c-9a1b-0123456789ab",
+			StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount",
+			TargetPath:        target,
+			Readonly:          readOnly,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: "2000"}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			},
+			PublishContext: map[string]string{PublishInfoVolumeName: "pvc-1"},
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, fm.Mounts(), target)
+	}
+
+	publish("/var/lib/kubelet/pods/1/volumes/kubernetes.io~csi/pvc-1/mount", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false)
+	publish("/var/lib/kubelet/pods/2/volumes/kubernetes.io~csi/pvc-1/mount", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, true)
+	publish("/var/lib/kubelet/pods/3/volumes/kubernetes.io~csi/pvc-1/mount", csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, false)
+
+	// only the read-write mount gets the group
+	assert.Equal(t, map[string]int{"/var/lib/kubelet/pods/1/volumes/kubernetes.io~csi/pvc-1/mount": 2000}, mm.groups)
+}
+
+// resizeMounter records the filesystems resized
+type resizeMounter struct {
+	mounter.Mounter
+	resized []string
+}
+
+func (m *resizeMounter) ResizeFilesystem(ctx context.Context, devicePath, mountPath string) error {
+	m.resized = append(m.resized, mountPath)
+	return nil
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	fm := mounter.NewFake()
+	rm := &resizeMounter{Mounter: fm}
+	driver := &Driver{
+		mounter: rm,
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	stagingPath := "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount"
+	assert.NoError(t, fm.Mount(ctx, "/dev/sdb", stagingPath, "ext4", mounter.LuksContext{}))
+
+	_, err := driver.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
+		VolumeId:      "2f2e7b8a-4b5f-4d9c-9a1b-0123456789ab",
+		VolumePath:    stagingPath,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * GB},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{stagingPath}, rm.resized)
+
+	// the device of a block volume is used as it is
+	_, err = driver.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
+		VolumeId:      "3f2e7b8a-4b5f-4d9c-9a1b-0123456789ab",
+		VolumePath:    "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-2/pod-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * GB},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{stagingPath}, rm.resized)
+
+	// a filesystem which is not mounted cannot be resized
+	_, err = driver.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
+		VolumeId:      "4f2e7b8a-4b5f-4d9c-9a1b-0123456789ab",
+		VolumePath:    "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-3/globalmount",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * GB},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,431 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultEndpoint is the CSI endpoint kubelet expects the plugin on
+	DefaultEndpoint = "unix:///var/lib/kubelet/plugins/" + DriverName + "/csi.sock"
+
+	// DefaultAPIURL is the URL of the cloudscale.ch API
+	DefaultAPIURL = "https://api.cloudscale.ch/"
+
+	// DefaultDeviceWaitTimeout is how long the node plugin waits for the
+	// device of an attached volume to appear by default
+	DefaultDeviceWaitTimeout = 10 * time.Second
+
+	// DefaultSlowOperationThreshold is the duration after which a gRPC call
+	// is logged as slow by default
+	DefaultSlowOperationThreshold = 30 * time.Second
+
+	// DefaultMaxEphemeralVolumeSize is the maximum size of an ephemeral
+	// inline volume in bytes by default
+	DefaultMaxEphemeralVolumeSize = 100 * GB
+)
+
+// options holds the configuration of the driver until it is created
+type options struct {
+	endpoint  string
+	token     string
+	tokenFile string
+
+	fallbackTokens     []string
+	fallbackTokenFiles []string
+	apiURL             string
+	proxyURL           string
+	caBundle           string
+	serverID           string
+	zone               string
+
+	log              *logrus.Entry
+	cloudscaleClient *cloudscale.Client
+	mounter          mounter.Mounter
+	mounterWrappers  []func(mounter.Mounter) mounter.Mounter
+	luksKeyProvider  LuksKeyProvider
+
+	fstrimInterval      time.Duration
+	deviceWaitTimeout   time.Duration
+	maxVolumesPerNode   int64
+	publishMountOptions []string
+	maxEphemeralSize    int64
+	cleanupOnStart      bool
+	debugAddr           string
+	luksHeaderAddr      string
+	metricsAddr         string
+	healthAddr          string
+	mode                string
+	orchestrator        string
+	grpcServer          GRPCServerConfig
+	tlsEndpoint         TLSEndpointConfig
+	kubeconfig          string
+	fencingInterval     time.Duration
+	nodeLabelInterval   time.Duration
+	nodeClient          nodeClient
+	claimEvents         bool
+	claimEventClient    claimEventClient
+	orphanInterval      time.Duration
+	orphanNodeName      string
+	podClient           podClient
+
+	fakeCloudscale           bool
+	slowOperationThreshold   time.Duration
+	apiCheckInterval         time.Duration
+	apiCheckFailureThreshold int
+	configFile               string
+}
+
+// Option configures the driver returned by NewDriver.
+type Option func(*options)
+
+// WithEndpoint sets the CSI endpoint the driver listens on; only unix domain
+// sockets are supported. Defaults to DefaultEndpoint.
+func WithEndpoint(endpoint string) Option {
+	return func(o *options) {
+		o.endpoint = endpoint
+	}
+}
+
+// WithToken sets the token used to access the cloudscale.ch API. It is
+// ignored if a client is given with WithCloudscaleClient.
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+// WithTokenFile sets a file containing the token used to access the
+// cloudscale.ch API. The file is read on every request, so that the token can
+// be rotated without restarting the driver. It takes precedence over
+// WithToken and is ignored if a client is given with WithCloudscaleClient.
+func WithTokenFile(path string) Option {
+	return func(o *options) {
+		o.tokenFile = path
+	}
+}
+
+// WithFallbackTokens adds tokens that are used in the given order if the
+// cloudscale.ch API rejects the token in use, e.g. because it has been
+// revoked. It is ignored if a client is given with WithCloudscaleClient.
+func WithFallbackTokens(tokens ...string) Option {
+	return func(o *options) {
+		o.fallbackTokens = append(o.fallbackTokens, tokens...)
+	}
+}
+
+// WithFallbackTokenFiles is like WithFallbackTokens, but reads the tokens
+// from files on every request like WithTokenFile. The files are used after
+// the tokens given with WithFallbackTokens.
+func WithFallbackTokenFiles(paths ...string) Option {
+	return func(o *options) {
+		o.fallbackTokenFiles = append(o.fallbackTokenFiles, paths...)
+	}
+}
+
+// WithAPIURL sets the URL of the cloudscale.ch API. It is ignored if a client
+// is given with WithCloudscaleClient. Defaults to DefaultAPIURL.
+func WithAPIURL(url string) Option {
+	return func(o *options) {
+		o.apiURL = url
+	}
+}
+
+// WithProxyURL sets the proxy used to reach the cloudscale.ch API instead of
+// the one from the HTTPS_PROXY environment variable. It is ignored if a client
+// is given with WithCloudscaleClient.
+func WithProxyURL(proxyURL string) Option {
+	return func(o *options) {
+		o.proxyURL = proxyURL
+	}
+}
+
+// WithCABundle sets a PEM file with certificates that are trusted in addition
+// to the system roots when connecting to the cloudscale.ch API, e.g. of an
+// inspecting proxy. It is ignored if a client is given with
+// WithCloudscaleClient.
+func WithCABundle(path string) Option {
+	return func(o *options) {
+		o.caBundle = path
+	}
+}
+
+// WithFakeCloudscale replaces the cloudscale.ch API with an in-memory fake,
+// so that the driver can run without a cloudscale.ch account. The server ID
+// defaults to the hostname and the zone to cloudscalefake.Zone.
+func WithFakeCloudscale(enabled bool) Option {
+	return func(o *options) {
+		o.fakeCloudscale = enabled
+	}
+}
+
+// WithServerID sets the UUID of the server the driver runs on. It is read
+// from the metadata service by default.
+func WithServerID(serverID string) Option {
+	return func(o *options) {
+		o.serverID = serverID
+	}
+}
+
+// WithZone sets the zone of the server the driver runs on. It is taken from
+// the server in the cloudscale.ch API by default.
+func WithZone(zone string) Option {
+	return func(o *options) {
+		o.zone = zone
+	}
+}
+
+// WithLogger sets the logger of the driver.
+func WithLogger(log *logrus.Entry) Option {
+	return func(o *options) {
+		o.log = log
+	}
+}
+
+// WithCloudscaleClient sets the client used to access the cloudscale.ch API
+// instead of creating one from the token and the API URL.
+func WithCloudscaleClient(client *cloudscale.Client) Option {
+	return func(o *options) {
+		o.cloudscaleClient = client
+	}
+}
+
+// WithMounter sets the mounter used by the node plugin to format and mount
+// volumes.
+func WithMounter(m mounter.Mounter) Option {
+	return func(o *options) {
+		o.mounter = m
+	}
+}
+
+// WithMounterWrapper wraps the mounter of the node plugin, e.g. to log or
+// override single operations of the default mounter by embedding it. The
+// wrappers are applied in the order they are given.
+func WithMounterWrapper(wrap func(mounter.Mounter) mounter.Mounter) Option {
+	return func(o *options) {
+		o.mounterWrappers = append(o.mounterWrappers, wrap)
+	}
+}
+
+// WithLuksKeyProvider sets the provider used to resolve luks keys that are
+// passed by reference instead of in plain text.
+func WithLuksKeyProvider(provider LuksKeyProvider) Option {
+	return func(o *options) {
+		o.luksKeyProvider = provider
+	}
+}
+
+// WithFstrimInterval enables running fstrim on all staged volumes in the
+// given interval.
+func WithFstrimInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.fstrimInterval = interval
+	}
+}
+
+// WithDeviceWaitTimeout sets how long the node plugin waits for the device of
+// an attached volume to appear. It is ignored if a mounter is given with
+// WithMounter. Defaults to DefaultDeviceWaitTimeout.
+func WithDeviceWaitTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.deviceWaitTimeout = timeout
+	}
+}
+
+// WithMaxVolumesPerNode sets the number of volumes advertised in NodeGetInfo.
+// The environment or the default is used if it is zero.
+func WithMaxVolumesPerNode(maxVolumes int64) Option {
+	return func(o *options) {
+		o.maxVolumesPerNode = maxVolumes
+	}
+}
+
+// WithMaxEphemeralVolumeSize sets the maximum size of an ephemeral inline
+// volume in bytes, larger volumes are rejected. The size is compared after it
+// is rounded up to the size increment of the volume type. Defaults to
+// DefaultMaxEphemeralVolumeSize; unlimited if zero.
+func WithMaxEphemeralVolumeSize(size int64) Option {
+	return func(o *options) {
+		o.maxEphemeralSize = size
+	}
+}
+
+// WithPublishMountOptions sets mount options that are added to the bind mount
+// of every published filesystem volume.
+func WithPublishMountOptions(mountOptions []string) Option {
+	return func(o *options) {
+		o.publishMountOptions = mountOptions
+	}
+}
+
+// WithCleanupOnStart enables the cleanup of stale staging mounts and luks
+// mappings when the driver starts.
+func WithCleanupOnStart(cleanup bool) Option {
+	return func(o *options) {
+		o.cleanupOnStart = cleanup
+	}
+}
+
+// WithDebugAddr enables the debug endpoint on the given address.
+func WithDebugAddr(addr string) Option {
+	return func(o *options) {
+		o.debugAddr = addr
+	}
+}
+
+// WithLuksHeaderAddr enables the backup of luks headers on /luks/header of
+// an endpoint on the given address, which must be on the loopback interface.
+func WithLuksHeaderAddr(addr string) Option {
+	return func(o *options) {
+		o.luksHeaderAddr = addr
+	}
+}
+
+// WithMetricsAddr enables the Prometheus metrics endpoint on the given address.
+func WithMetricsAddr(addr string) Option {
+	return func(o *options) {
+		o.metricsAddr = addr
+	}
+}
+
+// WithHealthAddr enables the /healthz and /readyz endpoints on the given
+// address.
+func WithHealthAddr(addr string) Option {
+	return func(o *options) {
+		o.healthAddr = addr
+	}
+}
+
+// WithAPICheck sets how often the controller checks the cloudscale.ch API and
+// after how many failed checks in a row it is not ready anymore. Defaults to
+// DefaultAPICheckInterval and DefaultAPICheckFailureThreshold.
+func WithAPICheck(interval time.Duration, failureThreshold int) Option {
+	return func(o *options) {
+		o.apiCheckInterval = interval
+		o.apiCheckFailureThreshold = failureThreshold
+	}
+}
+
+// WithMode sets whether the driver runs as controller or node plugin, which
+// selects the readiness checks. Defaults to ModeAll.
+func WithMode(mode string) Option {
+	return func(o *options) {
+		o.mode = mode
+	}
+}
+
+// WithContainerOrchestrator sets the container orchestrator the driver is a
+// CSI plugin of, OrchestratorKubernetes, OrchestratorNomad or
+// OrchestratorSwarm. Defaults to OrchestratorKubernetes.
+func WithContainerOrchestrator(orchestrator string) Option {
+	return func(o *options) {
+		o.orchestrator = orchestrator
+	}
+}
+
+// WithSlowOperationThreshold logs a warning for every gRPC call taking
+// longer than the given duration. Zero disables the warnings. Defaults to
+// DefaultSlowOperationThreshold.
+func WithSlowOperationThreshold(threshold time.Duration) Option {
+	return func(o *options) {
+		o.slowOperationThreshold = threshold
+	}
+}
+
+// WithGRPCServerConfig tunes the gRPC server of the CSI endpoint.
+func WithGRPCServerConfig(config GRPCServerConfig) Option {
+	return func(o *options) {
+		o.grpcServer = config
+	}
+}
+
+// WithTLSEndpoint serves the identity and controller services on a TCP
+// endpoint with mutual TLS in addition to the unix socket.
+func WithTLSEndpoint(config TLSEndpointConfig) Option {
+	return func(o *options) {
+		o.tlsEndpoint = config
+	}
+}
+
+// WithNodeFencing detaches the volumes of the driver from the servers of
+// nodes with the FenceTaint or the out-of-service taint, checking the nodes
+// in the given interval. Zero uses DefaultFencingInterval.
+func WithNodeFencing(interval time.Duration) Option {
+	return func(o *options) {
+		if interval == 0 {
+			interval = DefaultFencingInterval
+		}
+		o.fencingInterval = interval
+	}
+}
+
+// WithNodeLabeler labels the nodes with the zone and region of their servers,
+// checking the nodes in the given interval. Zero uses
+// DefaultNodeLabelInterval.
+func WithNodeLabeler(interval time.Duration) Option {
+	return func(o *options) {
+		if interval == 0 {
+			interval = DefaultNodeLabelInterval
+		}
+		o.nodeLabelInterval = interval
+	}
+}
+
+// WithClaimEvents reports events on the claims of the volumes for the
+// operations which are otherwise only visible in the log of the controller,
+// e.g. an expansion which did not resize the volume.
+func WithClaimEvents() Option {
+	return func(o *options) {
+		o.claimEvents = true
+	}
+}
+
+// WithOrphanCleanup unmounts and removes the publish target paths of pods
+// which do not exist anymore on the node with the given name, checking the
+// paths in the given interval. Zero uses DefaultOrphanCleanupInterval.
+func WithOrphanCleanup(nodeName string, interval time.Duration) Option {
+	return func(o *options) {
+		if interval == 0 {
+			interval = DefaultOrphanCleanupInterval
+		}
+		o.orphanNodeName = nodeName
+		o.orphanInterval = interval
+	}
+}
+
+// WithKubeconfig sets the kubeconfig used to access Kubernetes, e.g. for a
+// controller running outside of the cluster. The service account of the pod
+// is used by default.
+func WithKubeconfig(path string) Option {
+	return func(o *options) {
+		o.kubeconfig = path
+	}
+}
+
+// WithConfigFile sets the config file, whose options take precedence over
+// the other options. The file is reloaded on changes; only MaxVolumesPerNode
+// and PublishMountOptions are applied without a restart.
+func WithConfigFile(path string) Option {
+	return func(o *options) {
+		o.configFile = path
+	}
+}
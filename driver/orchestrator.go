@@ -0,0 +1,123 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// OrchestratorKubernetes runs the driver as CSI plugin of Kubernetes
+	OrchestratorKubernetes = "kubernetes"
+	// OrchestratorNomad runs the driver as CSI plugin of HashiCorp Nomad
+	OrchestratorNomad = "nomad"
+	// OrchestratorSwarm runs the driver as cluster volume plugin of Docker
+	// Swarm
+	OrchestratorSwarm = "swarm"
+
+	// Docker stages and publishes the volumes of a plugin in these
+	// directories of its rootfs, followed by the volume ID
+	swarmStagingPath = "/data/staged"
+	swarmPublishPath = "/data/published"
+)
+
+// isValidOrchestrator returns true for the container orchestrators the driver
+// can be used with
+func isValidOrchestrator(orchestrator string) bool {
+	switch orchestrator {
+	case OrchestratorKubernetes, OrchestratorNomad, OrchestratorSwarm:
+		return true
+	}
+	return false
+}
+
+// isKubernetes returns true if the driver is a CSI plugin of Kubernetes,
+// which gates the features relying on kubelet, e.g. ephemeral inline volumes.
+// Drivers without an orchestrator are plugins of Kubernetes.
+func isKubernetes(orchestrator string) bool {
+	return orchestrator != OrchestratorNomad && orchestrator != OrchestratorSwarm
+}
+
+// volumeTopologyKey returns the topology segment of the zone in the
+// accessible topology of created volumes. Kubernetes has always been given
+// "zone", which is kept so that the node affinity of existing persistent
+// volumes does not change. Nomad and Swarm only place a volume on nodes
+// whose topology contains the one of the volume, so they are given the
+// segment reported by NodeGetInfo.
+func volumeTopologyKey(orchestrator string) string {
+	if isKubernetes(orchestrator) {
+		return "zone"
+	}
+	return topologyZoneKey
+}
+
+// isStagingTargetPath returns true if the given path looks like a staging
+// target path created by the container orchestrator for a CSI volume:
+// kubelet stages volumes in
+// /var/lib/kubelet/plugins/kubernetes.io/csi/<driver>/<hash>/globalmount,
+// Nomad in <stage_publish_base_dir>/staging/<namespace>/<volume>/<usage> and
+// Docker in /data/staged/<volume>.
+func isStagingTargetPath(orchestrator, path string) bool {
+	switch orchestrator {
+	case OrchestratorNomad:
+		return strings.Contains(path, "/staging/")
+	case OrchestratorSwarm:
+		return filepath.Dir(path) == swarmStagingPath
+	}
+	return strings.Contains(path, "/plugins/kubernetes.io/csi/") && filepath.Base(path) == "globalmount"
+}
+
+// isCSIMountPath returns true if the given path is used by the container
+// orchestrator to stage or publish a CSI volume.
+func isCSIMountPath(orchestrator, path string) bool {
+	switch orchestrator {
+	case OrchestratorNomad:
+		return strings.Contains(path, "/staging/") || strings.Contains(path, "/per-alloc/")
+	case OrchestratorSwarm:
+		return filepath.Dir(path) == swarmStagingPath || filepath.Dir(path) == swarmPublishPath
+	}
+	return strings.Contains(path, "kubernetes.io") && strings.Contains(path, "csi")
+}
+
+// isBlockPublishPath returns true if the given path is the bind mount of the
+// device file of a published block volume. Swarm only supports filesystem
+// volumes.
+func isBlockPublishPath(orchestrator, path string) bool {
+	switch orchestrator {
+	case OrchestratorNomad:
+		return strings.Contains(path, "/per-alloc/") && strings.Contains(filepath.Base(path), "block-device")
+	case OrchestratorSwarm:
+		return false
+	}
+	return strings.Contains(path, "volumeDevices/pvc")
+}
+
+// volumeNameFromPath returns the name of the volume in a path that the
+// container orchestrator uses for staging or publishing it. Nomad puts the
+// volume ID in front of the usage directory, e.g.
+// /local/csi/per-alloc/<alloc>/<volume>/rw-file-system-single-node-writer,
+// Docker only knows the ID of the cloudscale.ch volume.
+func volumeNameFromPath(orchestrator, path string) string {
+	switch orchestrator {
+	case OrchestratorNomad:
+		return filepath.Base(filepath.Dir(path))
+	case OrchestratorSwarm:
+		return filepath.Base(path)
+	}
+	return pvcNameFromPath(path)
+}
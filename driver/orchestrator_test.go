@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsStagingTargetPath(t *testing.T) {
+	assert.True(t, isStagingTargetPath(OrchestratorKubernetes, "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount"))
+	assert.True(t, isStagingTargetPath(OrchestratorKubernetes, "/var/lib/kubelet/plugins/kubernetes.io/csi/csi.cloudscale.ch/0123abcd/globalmount"))
+	assert.False(t, isStagingTargetPath(OrchestratorKubernetes, "/var/lib/kubelet/pods/1234/volumes/kubernetes.io~csi/pvc-1/mount"))
+	assert.False(t, isStagingTargetPath(OrchestratorKubernetes, "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1"))
+
+	assert.True(t, isStagingTargetPath(OrchestratorNomad, "/local/csi/staging/default/data/rw-file-system-single-node-writer"))
+	assert.False(t, isStagingTargetPath(OrchestratorNomad, "/local/csi/per-alloc/5678/data/rw-file-system-single-node-writer"))
+	assert.False(t, isStagingTargetPath(OrchestratorNomad, "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount"))
+
+	assert.True(t, isStagingTargetPath(OrchestratorSwarm, "/data/staged/0123abcd"))
+	assert.False(t, isStagingTargetPath(OrchestratorSwarm, "/data/published/0123abcd"))
+	assert.False(t, isStagingTargetPath(OrchestratorSwarm, "/data/staged"))
+}
+
+func TestIsCSIMountPath(t *testing.T) {
+	assert.True(t, isCSIMountPath(OrchestratorKubernetes, "/var/lib/kubelet/pods/1234/volumes/kubernetes.io~csi/pvc-1/mount"))
+	assert.False(t, isCSIMountPath(OrchestratorKubernetes, "/local/csi/per-alloc/5678/data/rw-file-system-single-node-writer"))
+
+	assert.True(t, isCSIMountPath(OrchestratorNomad, "/local/csi/staging/default/data/rw-file-system-single-node-writer"))
+	assert.True(t, isCSIMountPath(OrchestratorNomad, "/local/csi/per-alloc/5678/data/rw-file-system-single-node-writer"))
+	assert.False(t, isCSIMountPath(OrchestratorNomad, "/var/lib/kubelet/pods/1234/volumes/kubernetes.io~csi/pvc-1/mount"))
+
+	assert.True(t, isCSIMountPath(OrchestratorSwarm, "/data/staged/0123abcd"))
+	assert.True(t, isCSIMountPath(OrchestratorSwarm, "/data/published/0123abcd"))
+	assert.False(t, isCSIMountPath(OrchestratorSwarm, "/var/lib/docker/volumes/data/_data"))
+}
+
+func TestIsBlockPublishPath(t *testing.T) {
+	assert.True(t, isBlockPublishPath(OrchestratorKubernetes, "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/pvc-1/dev/abcd"))
+	assert.True(t, isBlockPublishPath(OrchestratorNomad, "/local/csi/per-alloc/5678/data/rw-block-device-single-node-writer"))
+	assert.False(t, isBlockPublishPath(OrchestratorNomad, "/local/csi/per-alloc/5678/data/rw-file-system-single-node-writer"))
+}
+
+func TestVolumeNameFromPath(t *testing.T) {
+	assert.Equal(t, "pvc-1234", volumeNameFromPath(OrchestratorKubernetes, "/var/lib/kubelet/pods/abcd/volumes/kubernetes.io~csi/pvc-1234/mount"))
+	assert.Equal(t, "data", volumeNameFromPath(OrchestratorNomad, "/local/csi/staging/default/data/rw-file-system-single-node-writer"))
+	assert.Equal(t, "data", volumeNameFromPath(OrchestratorNomad, "/local/csi/per-alloc/5678/data/rw-block-device-single-node-writer"))
+	assert.Equal(t, "0123abcd", volumeNameFromPath(OrchestratorSwarm, "/data/published/0123abcd"))
+}
+
+func TestVolumeTopologyKey(t *testing.T) {
+	assert.Equal(t, "zone", volumeTopologyKey(OrchestratorKubernetes))
+	assert.Equal(t, topologyZoneKey, volumeTopologyKey(OrchestratorNomad))
+	assert.Equal(t, topologyZoneKey, volumeTopologyKey(OrchestratorSwarm))
+}
+
+func TestIsKubernetes(t *testing.T) {
+	assert.True(t, isKubernetes(OrchestratorKubernetes))
+	assert.True(t, isKubernetes(""))
+	assert.False(t, isKubernetes(OrchestratorNomad))
+	assert.False(t, isKubernetes(OrchestratorSwarm))
+}
@@ -0,0 +1,234 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coreclient "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// DefaultOrphanCleanupInterval is how often the orphaned publish target
+	// paths are cleaned up by default
+	DefaultOrphanCleanupInterval = 10 * time.Minute
+
+	// kubeletPodsDir contains the directories of the pods on the node, with
+	// the publish target paths of filesystem volumes in
+	// <pod UID>/volumes/kubernetes.io~csi/<pv>/mount
+	kubeletPodsDir = "/var/lib/kubelet/pods"
+)
+
+// podClient is the part of the Kubernetes Pod client used by the orphan
+// cleanup
+type podClient interface {
+	List(ctx context.Context, opts metav1.ListOptions) (*corev1.PodList, error)
+}
+
+// newPodClient returns a Pod client using the given kubeconfig, or the
+// service account of the pod if it is empty
+func newPodClient(kubeconfig string) (podClient, error) {
+	config, err := kubernetesConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := coreclient.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create the Kubernetes client: %v", err)
+	}
+	return client.Pods(""), nil
+}
+
+// publishPath is the publish target path of a volume in the directory of a
+// pod
+type publishPath struct {
+	podUID     string
+	volumeID   string
+	volumeDir  string
+	targetPath string
+}
+
+// findPublishPaths returns the publish target paths of the volumes of the
+// driver in the given pods directory of kubelet, as recorded in the
+// vol_data.json kubelet writes next to them
+func findPublishPaths(podsDir string) []publishPath {
+	files, _ := filepath.Glob(filepath.Join(podsDir, "*", "volumes", "kubernetes.io~csi", "*", "vol_data.json"))
+
+	var paths []publishPath
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var volData struct {
+			DriverName   string `json:"driverName"`
+			VolumeHandle string `json:"volumeHandle"`
+		}
+		if err := json.Unmarshal(data, &volData); err != nil || volData.DriverName != DriverName {
+			continue
+		}
+
+		volumeDir := filepath.Dir(file)
+		rel, err := filepath.Rel(podsDir, volumeDir)
+		if err != nil {
+			continue
+		}
+		paths = append(paths, publishPath{
+			podUID:     strings.SplitN(rel, string(filepath.Separator), 2)[0],
+			volumeID:   volData.VolumeHandle,
+			volumeDir:  volumeDir,
+			targetPath: filepath.Join(volumeDir, "mount"),
+		})
+	}
+	return paths
+}
+
+// orphanCleaner unmounts and removes the publish target paths of pods which
+// do not exist anymore, e.g. as kubelet crashed while the pod was deleted and
+// never unpublished its volumes. A path is only cleaned up if its pod was
+// missing in the previous run as well, so that kubelet gets the chance to
+// tear down the volumes of pods which were just deleted itself.
+type orphanCleaner struct {
+	driver   *Driver
+	client   podClient
+	nodeName string
+	podsDir  string
+	log      *logrus.Entry
+
+	// missing are the target paths whose pod was missing in the previous run
+	missing map[string]bool
+}
+
+func newOrphanCleaner(d *Driver, client podClient, nodeName string) *orphanCleaner {
+	return &orphanCleaner{
+		driver:   d,
+		client:   client,
+		nodeName: nodeName,
+		podsDir:  kubeletPodsDir,
+		log: d.log.WithFields(logrus.Fields{
+			"method": "orphan_cleanup",
+			"node":   nodeName,
+		}),
+		missing: map[string]bool{},
+	}
+}
+
+// run cleans up the orphaned publish target paths in the given interval
+// until stop is closed
+func (c *orphanCleaner) run(interval time.Duration, stop <-chan struct{}) {
+	c.log.WithField("interval", interval).Info("starting orphan cleanup")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		c.cleanup(ctx)
+		cancel()
+	}
+}
+
+// cleanup unmounts and removes the publish target paths whose pod is gone
+func (c *orphanCleaner) cleanup(ctx context.Context) {
+	paths := findPublishPaths(c.podsDir)
+	if len(paths) == 0 {
+		c.missing = map[string]bool{}
+		return
+	}
+
+	// the pods are listed after the paths were found, so that the paths of
+	// pods created in between are not mistaken for orphans
+	pods, err := c.client.List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + c.nodeName})
+	if err != nil {
+		c.log.WithError(err).Warn("couldn't list the pods of the node")
+		return
+	}
+	existing := map[string]bool{}
+	for _, pod := range pods.Items {
+		existing[string(pod.UID)] = true
+	}
+
+	missing := map[string]bool{}
+	for _, path := range paths {
+		if existing[path.podUID] {
+			continue
+		}
+		missing[path.targetPath] = true
+		if !c.missing[path.targetPath] {
+			continue
+		}
+
+		ll := c.log.WithFields(logrus.Fields{
+			"pod_uid":     path.podUID,
+			"volume_id":   path.volumeID,
+			"target_path": path.targetPath,
+		})
+		if err := c.cleanupPath(ctx, path, ll); err != nil {
+			ll.WithError(err).Error("failed to clean up orphaned publish target path")
+		}
+	}
+	c.missing = missing
+}
+
+// cleanupPath unmounts the target path and removes it along with the
+// directory of the volume, so that kubelet can remove the directory of the
+// pod. Other files and directories are never removed.
+func (c *orphanCleaner) cleanupPath(ctx context.Context, path publishPath, ll *logrus.Entry) error {
+	unlock, err := c.driver.lockVolume(path.volumeID)
+	if err != nil {
+		// retried in the next run
+		return err
+	}
+	defer unlock()
+
+	mounted, err := c.driver.mounter.IsMounted(path.targetPath)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		ll.Warn("unmounting orphaned publish target path")
+		err := c.driver.mounter.Unmount(ctx, path.targetPath, mounter.LuksContext{VolumeLifecycle: mounter.VolumeLifecycleNodeUnpublishVolume})
+		if err != nil {
+			return err
+		}
+	}
+
+	ll.Info("removing orphaned publish target path")
+	for _, name := range []string{path.targetPath, filepath.Join(path.volumeDir, "vol_data.json"), path.volumeDir} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type fakePods struct {
+	pods []corev1.Pod
+	opts metav1.ListOptions
+}
+
+func (f *fakePods) List(ctx context.Context, opts metav1.ListOptions) (*corev1.PodList, error) {
+	f.opts = opts
+	return &corev1.PodList{Items: f.pods}, nil
+}
+
+// writePublishPath creates the directory of a published volume like kubelet
+func writePublishPath(t *testing.T, podsDir, podUID, pvName, driverName string) string {
+	volumeDir := filepath.Join(podsDir, podUID, "volumes", "kubernetes.io~csi", pvName)
+	assert.NoError(t, os.MkdirAll(filepath.Join(volumeDir, "mount"), 0750))
+	volData := `{"driverName":"` + driverName + `","volumeHandle":"vol-` + pvName + `","specVolID":"` + pvName + `"}`
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(volumeDir, "vol_data.json"), []byte(volData), 0644))
+	return filepath.Join(volumeDir, "mount")
+}
+
+func TestFindPublishPaths(t *testing.T) {
+	podsDir := t.TempDir()
+	target := writePublishPath(t, podsDir, "pod-1", "pvc-1", DriverName)
+	writePublishPath(t, podsDir, "pod-1", "pvc-2", "other.csi.example.com")
+
+	assert.Equal(t, []publishPath{{
+		podUID:     "pod-1",
+		volumeID:   "vol-pvc-1",
+		volumeDir:  filepath.Dir(target),
+		targetPath: target,
+	}}, findPublishPaths(podsDir))
+}
+
+func TestOrphanCleaner(t *testing.T) {
+	podsDir := t.TempDir()
+	fm := mounter.NewFake()
+	driver := &Driver{
+		mounter: fm,
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	pods := &fakePods{pods: []corev1.Pod{{ObjectMeta: metav1.ObjectMeta{UID: types.UID("pod-1")}}}}
+	cleaner := newOrphanCleaner(driver, pods, "node-1")
+	cleaner.podsDir = podsDir
+
+	existing := writePublishPath(t, podsDir, "pod-1", "pvc-1", DriverName)
+	orphaned := writePublishPath(t, podsDir, "pod-2", "pvc-2", DriverName)
+	foreign := writePublishPath(t, podsDir, "pod-3", "pvc-3", "other.csi.example.com")
+	for _, target := range []string{existing, orphaned, foreign} {
+		assert.NoError(t, fm.Mount(context.Background(), "/dev/sdb", target, "ext4", mounter.LuksContext{}))
+	}
+
+	// the orphaned path is only cleaned up once its pod was missing twice
+	cleaner.cleanup(context.Background())
+	assert.Equal(t, "spec.nodeName=node-1", pods.opts.FieldSelector)
+	assert.Len(t, fm.Mounts(), 3)
+	assert.DirExists(t, orphaned)
+
+	cleaner.cleanup(context.Background())
+	assert.NotContains(t, fm.Mounts(), orphaned)
+	assert.NoDirExists(t, filepath.Dir(orphaned))
+	assert.DirExists(t, filepath.Join(podsDir, "pod-2"))
+
+	assert.Contains(t, fm.Mounts(), existing)
+	assert.Contains(t, fm.Mounts(), foreign)
+	assert.DirExists(t, existing)
+	assert.DirExists(t, foreign)
+}
+
+func TestOrphanCleanerPodRecreated(t *testing.T) {
+	podsDir := t.TempDir()
+	driver := &Driver{
+		mounter: mounter.NewFake(),
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	pods := &fakePods{}
+	cleaner := newOrphanCleaner(driver, pods, "node-1")
+	cleaner.podsDir = podsDir
+	target := writePublishPath(t, podsDir, "pod-1", "pvc-1", DriverName)
+
+	// the pod only showed up in the API after the first run
+	cleaner.cleanup(context.Background())
+	pods.pods = []corev1.Pod{{ObjectMeta: metav1.ObjectMeta{UID: types.UID("pod-1")}}}
+	cleaner.cleanup(context.Background())
+	pods.pods = nil
+	cleaner.cleanup(context.Background())
+	assert.DirExists(t, target)
+}
+
+func TestNewDriverOrphanCleanup(t *testing.T) {
+	d, err := NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()), WithOrphanCleanup("node-1", 0),
+		func(o *options) { o.podClient = &fakePods{} })
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultOrphanCleanupInterval, d.orphanInterval)
+	assert.NotNil(t, d.podClient)
+
+	_, err = NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()), WithOrphanCleanup("", 0),
+		func(o *options) { o.podClient = &fakePods{} })
+	assert.Error(t, err)
+
+	_, err = NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()), WithOrphanCleanup("node-1", 0), WithMode(ModeController),
+		func(o *options) { o.podClient = &fakePods{} })
+	assert.Error(t, err)
+
+	_, err = NewDriver(WithFakeCloudscale(true), WithMounter(mounter.NewFake()), WithOrphanCleanup("node-1", 0), WithContainerOrchestrator(OrchestratorNomad),
+		func(o *options) { o.podClient = &fakePods{} })
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Kubernetes")
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const (
+	// MountUIDAttribute defines the owner of the root directory of the
+	// filesystem
+	MountUIDAttribute = DriverName + "/mount-uid"
+
+	// MountGIDAttribute defines the group of the root directory of the
+	// filesystem
+	MountGIDAttribute = DriverName + "/mount-gid"
+
+	// MountModeAttribute defines the permissions of the root directory of
+	// the filesystem as octal number (e.g. "0770")
+	MountModeAttribute = DriverName + "/mount-mode"
+
+	// BlockUIDAttribute defines the owner of the device node of a block
+	// volume
+	BlockUIDAttribute = DriverName + "/block-uid"
+
+	// BlockGIDAttribute defines the group of the device node of a block
+	// volume
+	BlockGIDAttribute = DriverName + "/block-gid"
+
+	// BlockModeAttribute defines the permissions of the device node of a
+	// block volume as octal number (e.g. "0660")
+	BlockModeAttribute = DriverName + "/block-mode"
+)
+
+// ownershipAttributes lists the volume parameters that are passed on to the
+// node in the volume context to set up the root directory of the filesystem
+// or the device node of a block volume.
+var ownershipAttributes = []string{
+	MountUIDAttribute,
+	MountGIDAttribute,
+	MountModeAttribute,
+	BlockUIDAttribute,
+	BlockGIDAttribute,
+	BlockModeAttribute,
+}
+
+// mountOwnership describes the ownership and permissions applied to the root
+// directory of a filesystem or to the device node of a block volume. A uid or
+// gid of -1 and a mode of 0 leave the respective property unchanged.
+type mountOwnership struct {
+	uid  int
+	gid  int
+	mode os.FileMode
+}
+
+func (o mountOwnership) isSet() bool {
+	return o.uid != -1 || o.gid != -1 || o.mode != 0
+}
+
+// parseMountOwnership reads the mount ownership from the volume parameters
+func parseMountOwnership(params map[string]string) (mountOwnership, error) {
+	return parseOwnership(params, MountUIDAttribute, MountGIDAttribute, MountModeAttribute, "mount", "0770")
+}
+
+// parseBlockOwnership reads the ownership of the device node of a block
+// volume from the volume parameters
+func parseBlockOwnership(params map[string]string) (mountOwnership, error) {
+	return parseOwnership(params, BlockUIDAttribute, BlockGIDAttribute, BlockModeAttribute, "block", "0660")
+}
+
+func parseOwnership(params map[string]string, uidKey, gidKey, modeKey, kind, exampleMode string) (mountOwnership, error) {
+	ownership := mountOwnership{uid: -1, gid: -1}
+
+	if value := params[uidKey]; value != "" {
+		uid, err := strconv.Atoi(value)
+		if err != nil || uid < 0 {
+			return ownership, fmt.Errorf("invalid %s uid %q, must be a non-negative number", kind, value)
+		}
+		ownership.uid = uid
+	}
+
+	if value := params[gidKey]; value != "" {
+		gid, err := strconv.Atoi(value)
+		if err != nil || gid < 0 {
+			return ownership, fmt.Errorf("invalid %s gid %q, must be a non-negative number", kind, value)
+		}
+		ownership.gid = gid
+	}
+
+	if value := params[modeKey]; value != "" {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode == 0 || mode > 07777 {
+			return ownership, fmt.Errorf("invalid %s mode %q, must be an octal number like %q", kind, value, exampleMode)
+		}
+		ownership.mode = os.FileMode(mode & 0777)
+		if mode&04000 != 0 {
+			ownership.mode |= os.ModeSetuid
+		}
+		if mode&02000 != 0 {
+			ownership.mode |= os.ModeSetgid
+		}
+		if mode&01000 != 0 {
+			ownership.mode |= os.ModeSticky
+		}
+	}
+
+	return ownership, nil
+}
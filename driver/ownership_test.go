@@ -0,0 +1,106 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseMountOwnership(t *testing.T) {
+	ownership, err := parseMountOwnership(map[string]string{})
+	assert.NoError(t, err)
+	assert.False(t, ownership.isSet())
+
+	ownership, err = parseMountOwnership(map[string]string{
+		MountUIDAttribute:  "1000",
+		MountGIDAttribute:  "2000",
+		MountModeAttribute: "2770",
+	})
+	assert.NoError(t, err)
+	assert.True(t, ownership.isSet())
+	assert.Equal(t, mountOwnership{uid: 1000, gid: 2000, mode: os.ModeSetgid | 0770}, ownership)
+
+	ownership, err = parseMountOwnership(map[string]string{MountGIDAttribute: "0"})
+	assert.NoError(t, err)
+	assert.Equal(t, mountOwnership{uid: -1, gid: 0}, ownership)
+
+	for _, params := range []map[string]string{
+		{MountUIDAttribute: "-1"},
+		{MountGIDAttribute: "users"},
+		{MountModeAttribute: "0999"},
+		{MountModeAttribute: "0"},
+	} {
+		_, err := parseMountOwnership(params)
+		assert.Error(t, err, "%v", params)
+	}
+}
+
+func TestParseBlockOwnership(t *testing.T) {
+	ownership, err := parseBlockOwnership(map[string]string{
+		MountUIDAttribute: "1000",
+	})
+	assert.NoError(t, err)
+	assert.False(t, ownership.isSet())
+
+	ownership, err = parseBlockOwnership(map[string]string{
+		BlockUIDAttribute:  "999",
+		BlockGIDAttribute:  "999",
+		BlockModeAttribute: "0660",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, mountOwnership{uid: 999, gid: 999, mode: 0660}, ownership)
+
+	_, err = parseBlockOwnership(map[string]string{BlockModeAttribute: "rw"})
+	assert.EqualError(t, err, `invalid block mode "rw", must be an octal number like "0660"`)
+}
+
+// ownershipMounter records the ownership set by the driver
+type ownershipMounter struct {
+	mounter.Mounter
+	target    string
+	ownership mountOwnership
+}
+
+func (m *ownershipMounter) SetOwnership(target string, uid, gid int, mode os.FileMode) error {
+	m.target = target
+	m.ownership = mountOwnership{uid: uid, gid: gid, mode: mode}
+	return nil
+}
+
+func TestNodePublishVolumeBlockOwnership(t *testing.T) {
+	om := &ownershipMounter{Mounter: mounter.NewFake()}
+	driver := &Driver{
+		mounter: om,
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          "2f2e7b8a-4b5f-4d9c-9a1b-0123456789ab",
+		StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/staging/pvc-1",
+		TargetPath:        "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-1/pod",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		PublishContext: map[string]string{PublishInfoVolumeName: "pvc-1"},
+		VolumeContext: map[string]string{
+			BlockGIDAttribute:  "999",
+			BlockModeAttribute: "0660",
+		},
+	}
+
+	_, err := driver.NodePublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/sdb", om.target)
+	assert.Equal(t, mountOwnership{uid: -1, gid: 999, mode: 0660}, om.ownership)
+
+	req.VolumeContext[BlockUIDAttribute] = "root"
+	_, err = driver.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,187 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"golang.org/x/oauth2"
+)
+
+// DefaultKubeletDir is the root directory of kubelet
+const DefaultKubeletDir = "/var/lib/kubelet"
+
+// preflightExecutables are the executables the node plugin runs to format,
+// open, resize and mount volumes
+var preflightExecutables = []string{
+	"cryptsetup",
+	"mkfs.ext4",
+	"mkfs.xfs",
+	"resize2fs",
+	"xfs_growfs",
+	"blockdev",
+	"blkid",
+	"udevadm",
+	"mount",
+	"umount",
+}
+
+// preflightProbeVolumeID is a volume which doesn't exist; updating it tells
+// whether the token may write without changing anything
+const preflightProbeVolumeID = "00000000-0000-0000-0000-000000000000"
+
+// PreflightConfig configures the checks of the runtime environment.
+type PreflightConfig struct {
+	// Mode selects the checks, the node checks are skipped for ModeController
+	Mode      string
+	Token     string
+	TokenFile string
+	APIURL    string
+	ProxyURL  string
+	CABundle  string
+	// KubeletDir is checked for being writable; skipped if empty
+	KubeletDir string
+}
+
+// PreflightCheck is the result of a single preflight check.
+type PreflightCheck struct {
+	Name string
+	Err  error
+}
+
+// Preflight checks that the runtime environment provides what the plugin
+// needs in the given mode: the executables, the metadata service, a valid
+// read/write API token and writable kubelet directories. All checks are run,
+// also if earlier ones fail.
+func Preflight(ctx context.Context, cfg PreflightConfig) []PreflightCheck {
+	var checks []PreflightCheck
+	node := cfg.Mode != ModeController
+
+	if node {
+		for _, name := range preflightExecutables {
+			_, err := exec.LookPath(name)
+			checks = append(checks, PreflightCheck{Name: "executable " + name, Err: err})
+		}
+
+		metadata, err := cloudscale.NewMetadataClient(nil).GetMetadata()
+		if err == nil && metadata.Meta.CloudscaleUUID == "" {
+			err = errors.New("the metadata contains no server UUID")
+		}
+		checks = append(checks, PreflightCheck{Name: "metadata service", Err: err})
+	}
+
+	client, err := preflightClient(cfg)
+	if err != nil {
+		checks = append(checks, PreflightCheck{Name: "API token", Err: err})
+	} else {
+		checks = append(checks, checkAPIToken(ctx, client)...)
+	}
+
+	if node && cfg.KubeletDir != "" {
+		for _, dir := range []string{filepath.Join(cfg.KubeletDir, "plugins"), filepath.Join(cfg.KubeletDir, "pods")} {
+			checks = append(checks, PreflightCheck{Name: "writable " + dir, Err: checkWritable(dir)})
+		}
+	}
+	return checks
+}
+
+// PrintPreflight writes a report of the checks and returns false if any of
+// them failed.
+func PrintPreflight(w io.Writer, checks []PreflightCheck) bool {
+	ok := true
+	for _, check := range checks {
+		if check.Err != nil {
+			ok = false
+			fmt.Fprintf(w, "[FAIL] %s: %v\n", check.Name, check.Err)
+			continue
+		}
+		fmt.Fprintf(w, "[ OK ] %s\n", check.Name)
+	}
+	if ok {
+		fmt.Fprintln(w, "all preflight checks passed")
+	} else {
+		fmt.Fprintln(w, "preflight checks failed")
+	}
+	return ok
+}
+
+func preflightClient(cfg PreflightConfig) (*cloudscale.Client, error) {
+	var tokenSource oauth2.TokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: cfg.Token})
+	if cfg.TokenFile != "" {
+		tokenSource = &fileTokenSource{path: cfg.TokenFile}
+	}
+	token, err := tokenSource.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("no access token given")
+	}
+
+	transport, err := newAPITransport(cfg.ProxyURL, cfg.CABundle)
+	if err != nil {
+		return nil, err
+	}
+	client := cloudscale.NewClient(&http.Client{Transport: &oauth2.Transport{Source: tokenSource, Base: transport}})
+	client.UserAgent = userAgent()
+	client.BaseURL, err = url.Parse(cfg.APIURL)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse url: %s", err)
+	}
+	return client, nil
+}
+
+// checkAPIToken checks that the token is accepted by the API and that it may
+// write, by updating a volume that doesn't exist
+func checkAPIToken(ctx context.Context, client *cloudscale.Client) []PreflightCheck {
+	if _, err := client.Volumes.List(ctx); err != nil {
+		return []PreflightCheck{{Name: "API token", Err: err}}
+	}
+	checks := []PreflightCheck{{Name: "API token"}}
+
+	err := client.Volumes.Update(ctx, preflightProbeVolumeID, &cloudscale.VolumeRequest{})
+	var errResp *cloudscale.ErrorResponse
+	switch {
+	case errors.As(err, &errResp) && errResp.StatusCode == http.StatusNotFound:
+		err = nil
+	case errors.As(err, &errResp) && errResp.StatusCode == http.StatusForbidden:
+		err = errors.New("the token is read-only, the driver needs a read/write token")
+	case err == nil:
+		err = fmt.Errorf("unexpectedly updated volume %s", preflightProbeVolumeID)
+	}
+	return append(checks, PreflightCheck{Name: "API token scope", Err: err})
+}
+
+// checkWritable checks that a file can be created in the directory
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".csi-cloudscale-preflight-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
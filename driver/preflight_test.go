@@ -0,0 +1,66 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckAPIToken(t *testing.T) {
+	ctx := context.Background()
+
+	checks := checkAPIToken(ctx, cloudscalefake.NewClient(nil))
+	assert.Equal(t, []PreflightCheck{{Name: "API token"}, {Name: "API token scope"}}, checks)
+
+	readOnly := cloudscalefake.NewClient(nil, cloudscalefake.WithErrorInjection(func(call cloudscalefake.Call) error {
+		if call.Method == "Update" {
+			return &cloudscale.ErrorResponse{StatusCode: http.StatusForbidden}
+		}
+		return nil
+	}))
+	checks = checkAPIToken(ctx, readOnly)
+	assert.Len(t, checks, 2)
+	assert.NoError(t, checks[0].Err)
+	assert.EqualError(t, checks[1].Err, "the token is read-only, the driver needs a read/write token")
+
+	invalid := cloudscalefake.NewClient(nil, cloudscalefake.WithErrorInjection(func(call cloudscalefake.Call) error {
+		return &cloudscale.ErrorResponse{StatusCode: http.StatusUnauthorized}
+	}))
+	checks = checkAPIToken(ctx, invalid)
+	assert.Len(t, checks, 1)
+	assert.Error(t, checks[0].Err)
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, checkWritable(dir))
+	assert.Error(t, checkWritable(filepath.Join(dir, "missing")))
+}
+
+func TestPreflightClient(t *testing.T) {
+	_, err := preflightClient(PreflightConfig{APIURL: DefaultAPIURL})
+	assert.EqualError(t, err, "no access token given")
+
+	client, err := preflightClient(PreflightConfig{Token: "secret", APIURL: DefaultAPIURL})
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultAPIURL, client.BaseURL.String())
+}
+
+func TestPrintPreflight(t *testing.T) {
+	var out bytes.Buffer
+	assert.True(t, PrintPreflight(&out, []PreflightCheck{{Name: "executable mount"}}))
+	assert.Equal(t, "[ OK ] executable mount\nall preflight checks passed\n", out.String())
+
+	out.Reset()
+	assert.False(t, PrintPreflight(&out, []PreflightCheck{
+		{Name: "executable mount"},
+		{Name: "metadata service", Err: assert.AnError},
+	}))
+	assert.Contains(t, out.String(), "[FAIL] metadata service: "+assert.AnError.Error())
+}
@@ -0,0 +1,154 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"strings"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// redacted replaces secret values in log output
+const redacted = "[REDACTED]"
+
+// isSecretKey returns true if the key of a map entry or a log field suggests
+// that its value is a secret, e.g. the luks key.
+func isSecretKey(key string) bool {
+	switch key {
+	case LuksKeyAttribute, LuksKeyCiphertextAttribute, "token":
+		return true
+	}
+
+	k := strings.ToLower(strings.ReplaceAll(key, "-", "_"))
+	for _, word := range []string{"passphrase", "password", "secret", "access_token", "api_token"} {
+		if strings.Contains(k, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactMap returns a copy of the map with the values of secret keys replaced.
+func redactMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		if isSecretKey(k) {
+			v = redacted
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// redactMessage returns a copy of the CSI request or response with all
+// secrets replaced. The values of secrets fields are replaced entirely, other
+// string maps like the volume context only for secret keys.
+func redactMessage(msg proto.Message) proto.Message {
+	if msg == nil {
+		return nil
+	}
+	clone := proto.Clone(msg)
+	redactProto(proto.MessageReflect(clone))
+	return clone
+}
+
+func redactProto(m protoreflect.Message) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapKey().Kind() != protoreflect.StringKind || fd.MapValue().Kind() != protoreflect.StringKind {
+				return true
+			}
+			mp := m.Mutable(fd).Map()
+			var keys []protoreflect.MapKey
+			mp.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+				keys = append(keys, k)
+				return true
+			})
+			for _, k := range keys {
+				if fd.Name() == "secrets" || isSecretKey(k.String()) {
+					mp.Set(k, protoreflect.ValueOfString(redacted))
+				}
+			}
+		case fd.IsList() && fd.Kind() == protoreflect.MessageKind:
+			list := m.Mutable(fd).List()
+			for i := 0; i < list.Len(); i++ {
+				redactProto(list.Get(i).Message())
+			}
+		case fd.Kind() == protoreflect.MessageKind:
+			redactProto(m.Mutable(fd).Message())
+		}
+		return true
+	})
+}
+
+// redactValue returns the value of a log field with all secrets replaced.
+func redactValue(key string, value interface{}) interface{} {
+	if isSecretKey(key) {
+		return redacted
+	}
+
+	switch v := value.(type) {
+	case proto.Message:
+		return redactMessage(v)
+	case map[string]string:
+		return redactMap(v)
+	case mounter.LuksContext:
+		return v.Redacted()
+	case *mounter.LuksContext:
+		if v == nil {
+			return v
+		}
+		return v.Redacted()
+	}
+	return value
+}
+
+// redactHook removes secrets from the fields of every log entry, so that
+// requests, responses and the maps they contain can be logged safely.
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	// the data is shared with the entry the fields were added to, so it is
+	// copied instead of modified
+	data := make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		data[k] = redactValue(k, v)
+	}
+	entry.Data = data
+	return nil
+}
+
+// addRedactHook adds the redact hook to the logger unless it is there already
+func addRedactHook(logger *logrus.Logger) {
+	for _, hook := range logger.Hooks[logrus.InfoLevel] {
+		if _, ok := hook.(redactHook); ok {
+			return
+		}
+	}
+	logger.AddHook(redactHook{})
+}
@@ -0,0 +1,75 @@
+package driver
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsSecretKey(t *testing.T) {
+	for _, key := range []string{LuksKeyAttribute, LuksKeyCiphertextAttribute, "token", "secrets", "csi.storage.k8s.io/node-stage-secret-name", "api-token", "luksPassphrase"} {
+		assert.True(t, isSecretKey(key), key)
+	}
+	for _, key := range []string{LuksKeySizeAttribute, LuksEncryptedAttribute, LuksKeyRefAttribute, "req_starting_token", "volume_id"} {
+		assert.False(t, isSecretKey(key), key)
+	}
+}
+
+func TestRedactMessage(t *testing.T) {
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId: "vol-1",
+		Secrets:  map[string]string{LuksKeyAttribute: "hunter2", "other": "value"},
+		VolumeContext: map[string]string{
+			LuksEncryptedAttribute: "true",
+			LuksKeyAttribute:       "hunter2",
+		},
+	}
+
+	redactedReq := redactMessage(req).(*csi.NodeStageVolumeRequest)
+	assert.Equal(t, "vol-1", redactedReq.VolumeId)
+	assert.Equal(t, map[string]string{LuksKeyAttribute: redacted, "other": redacted}, redactedReq.Secrets)
+	assert.Equal(t, "true", redactedReq.VolumeContext[LuksEncryptedAttribute])
+	assert.Equal(t, redacted, redactedReq.VolumeContext[LuksKeyAttribute])
+
+	// the original request is untouched
+	assert.Equal(t, "hunter2", req.Secrets[LuksKeyAttribute])
+	assert.Equal(t, "hunter2", req.VolumeContext[LuksKeyAttribute])
+
+	resp := &csi.CreateVolumeResponse{Volume: &csi.Volume{
+		VolumeContext: map[string]string{LuksKeyAttribute: "hunter2"},
+	}}
+	assert.Equal(t, redacted, redactMessage(resp).(*csi.CreateVolumeResponse).Volume.VolumeContext[LuksKeyAttribute])
+}
+
+func TestRedactHook(t *testing.T) {
+	for _, format := range []string{"text", "json"} {
+		t.Run(format, func(t *testing.T) {
+			log, err := NewLogger(format, "debug")
+			assert.NoError(t, err)
+			var buf bytes.Buffer
+			log.Logger.SetOutput(&buf)
+			addRedactHook(log.Logger)
+			addRedactHook(log.Logger)
+			assert.Len(t, log.Logger.Hooks[logrus.InfoLevel], 1)
+
+			ll := log.WithFields(logrus.Fields{
+				"req":             &csi.NodeStageVolumeRequest{Secrets: map[string]string{LuksKeyAttribute: "hunter2"}},
+				"publish_context": map[string]string{LuksKeyAttribute: "hunter2"},
+				"luks_context":    mounter.LuksContext{EncryptionKey: "hunter2"},
+				"token":           "hunter2",
+				"volume_id":       "vol-1",
+			})
+			ll.Debug("dumping request")
+
+			assert.NotContains(t, buf.String(), "hunter2")
+			assert.Contains(t, buf.String(), "vol-1")
+
+			// the fields of the entry are not modified
+			assert.Equal(t, "hunter2", ll.Data["token"])
+		})
+	}
+}
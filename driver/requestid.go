@@ -0,0 +1,110 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// requestIDMetadataKey is read from the gRPC metadata of incoming calls
+	// and returned in the response header, so that callers can pass their
+	// own request ID
+	requestIDMetadataKey = "x-request-id"
+
+	// requestIDHeader carries the request ID in calls to the cloudscale.ch API
+	requestIDHeader = "X-Request-ID"
+
+	maxRequestIDLength = 64
+)
+
+type requestIDKey struct{}
+
+// withRequestID returns a context carrying the request ID
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the request ID of the context or an empty
+// string if there is none
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// isValidRequestID returns true if the request ID given by a caller can be
+// logged safely
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDInterceptor assigns a request ID to every gRPC call. The ID given
+// by the caller in the metadata is used if it is valid, otherwise a new one
+// is generated.
+func (d *Driver) requestIDInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIDMetadataKey); len(ids) > 0 && isValidRequestID(ids[0]) {
+			id = ids[0]
+		}
+	}
+	if id == "" {
+		id = uuid.NewString()
+	}
+
+	// the header can only be set for calls over a gRPC server
+	_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadataKey, id))
+
+	return handler(withRequestID(ctx, id), req)
+}
+
+// logFor returns the logger of the driver with the request ID of the context
+func (d *Driver) logFor(ctx context.Context) *logrus.Entry {
+	if id := requestIDFromContext(ctx); id != "" {
+		return d.log.WithField("request_id", id)
+	}
+	return d.log
+}
+
+// requestIDTransport adds the request ID of the request context to the calls
+// to the cloudscale.ch API
+type requestIDTransport struct {
+	base http.RoundTripper
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := requestIDFromContext(req.Context()); id != "" {
+		// a RoundTripper must not modify the request
+		req = req.Clone(req.Context())
+		req.Header.Set(requestIDHeader, id)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestRequestIDInterceptor(t *testing.T) {
+	d := &Driver{log: logrus.NewEntry(logrus.New())}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerPublishVolume"}
+
+	var id string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		id = requestIDFromContext(ctx)
+		assert.Equal(t, id, d.logFor(ctx).Data["request_id"])
+		return nil, nil
+	}
+
+	_, err := d.requestIDInterceptor(context.Background(), nil, info, handler)
+	assert.NoError(t, err)
+	assert.Len(t, id, 36)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "attach-42"))
+	_, err = d.requestIDInterceptor(ctx, nil, info, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, "attach-42", id)
+
+	// IDs that cannot be logged safely are replaced
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "attach\n42"))
+	_, err = d.requestIDInterceptor(ctx, nil, info, handler)
+	assert.NoError(t, err)
+	assert.Len(t, id, 36)
+
+	assert.False(t, isValidRequestID(strings.Repeat("a", maxRequestIDLength+1)))
+	assert.NotContains(t, d.logFor(context.Background()).Data, "request_id")
+}
+
+func TestRequestIDTransport(t *testing.T) {
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get(requestIDHeader)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &requestIDTransport{base: http.DefaultTransport}}
+
+	req, err := http.NewRequestWithContext(withRequestID(context.Background(), "attach-42"), http.MethodGet, server.URL, nil)
+	assert.NoError(t, err)
+	_, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "attach-42", header)
+	assert.Empty(t, req.Header.Get(requestIDHeader))
+
+	req, err = http.NewRequest(http.MethodGet, server.URL, nil)
+	assert.NoError(t, err)
+	_, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Empty(t, header)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSEndpointConfig configures a TCP endpoint serving the identity and
+// controller services with mutual TLS, e.g. for a controller running outside
+// the cluster. The node service is only served on the unix socket, as it
+// has to run on the node of the volume.
+type TLSEndpointConfig struct {
+	// Addr is the address of the endpoint, e.g. ":9443"; disabled if empty
+	Addr string
+
+	// CertFile and KeyFile are the PEM encoded certificate and key of the
+	// server
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile contains the PEM encoded CA certificates the client
+	// certificates are verified with
+	ClientCAFile string
+}
+
+func (c TLSEndpointConfig) validate(mode string) error {
+	if c.Addr == "" {
+		return nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" || c.ClientCAFile == "" {
+		return errors.New("the TLS endpoint needs a certificate, a key and a client CA")
+	}
+	if mode == ModeNode {
+		return errors.New("the TLS endpoint serves the controller and cannot be used in node mode")
+	}
+	return nil
+}
+
+// tlsConfig returns a TLS config requiring client certificates signed by the
+// client CA
+func (c TLSEndpointConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load the TLS certificate: %v", err)
+	}
+
+	pem, err := ioutil.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the client CA: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in the client CA %s", c.ClientCAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// newTLSServer returns the gRPC server of the TLS endpoint, which serves the
+// identity and controller services only
+func (d *Driver) newTLSServer() (*grpc.Server, error) {
+	cfg, err := d.tlsEndpoint.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	srv := grpc.NewServer(append(d.grpcServerOptions(), grpc.Creds(credentials.NewTLS(cfg)))...)
+	csi.RegisterIdentityServer(srv, d)
+	csi.RegisterControllerServer(srv, d)
+	return srv, nil
+}
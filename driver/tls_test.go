@@ -0,0 +1,127 @@
+package driver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// newTestCert returns a certificate signed by the given parent, or a self
+// signed CA if parent is nil
+func newTestCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestTLSEndpoint(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caPEM, _ := newTestCert(t, "ca", nil, nil)
+	_, _, serverPEM, serverKeyPEM := newTestCert(t, "server", ca, caKey)
+	_, _, clientPEM, clientKeyPEM := newTestCert(t, "client", ca, caKey)
+
+	config := TLSEndpointConfig{
+		Addr:         "127.0.0.1:0",
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	assert.NoError(t, ioutil.WriteFile(config.CertFile, serverPEM, 0600))
+	assert.NoError(t, ioutil.WriteFile(config.KeyFile, serverKeyPEM, 0600))
+	assert.NoError(t, ioutil.WriteFile(config.ClientCAFile, caPEM, 0600))
+
+	d := &Driver{log: logrus.NewEntry(logrus.New()), tlsEndpoint: config}
+	srv, err := d.newTLSServer()
+	assert.NoError(t, err)
+	listener, err := net.Listen("tcp", config.Addr)
+	assert.NoError(t, err)
+	go srv.Serve(listener)
+	defer srv.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	dial := func(certs []tls.Certificate) csi.IdentityClient {
+		conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		})))
+		assert.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return csi.NewIdentityClient(conn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	assert.NoError(t, err)
+	resp, err := dial([]tls.Certificate{clientCert}).GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, DriverName, resp.Name)
+	}
+
+	// clients without a certificate are rejected
+	_, err = dial(nil).GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// the node service is only served on the unix socket
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert},
+	})))
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = csi.NewNodeClient(conn).NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestTLSEndpointConfigValidate(t *testing.T) {
+	assert.NoError(t, TLSEndpointConfig{}.validate(ModeNode))
+	assert.Error(t, TLSEndpointConfig{Addr: ":9443", CertFile: "tls.crt", KeyFile: "tls.key"}.validate(ModeController))
+	full := TLSEndpointConfig{Addr: ":9443", CertFile: "tls.crt", KeyFile: "tls.key", ClientCAFile: "ca.crt"}
+	assert.NoError(t, full.validate(ModeController))
+	assert.Error(t, full.validate(ModeNode))
+}
@@ -0,0 +1,132 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// fileTokenSource reads the cloudscale.ch API token from a file on every
+// request, so that the token can be rotated by updating the file, e.g. a
+// projected Secret, without restarting the plugin.
+type fileTokenSource struct {
+	path string
+}
+
+// Token returns the token currently stored in the file.
+func (f *fileTokenSource) Token() (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read token file: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("token file %s is empty", f.path)
+	}
+	return &oauth2.Token{AccessToken: token}, nil
+}
+
+// tokenFailover hands out the tokens of the cloudscale.ch API in order: a
+// token is used until the API rejects it, then the next one is used. After
+// the last token it starts over with the first one.
+type tokenFailover struct {
+	mu      sync.Mutex
+	sources []oauth2.TokenSource
+	current int
+
+	log     *logrus.Entry
+	metrics *metrics
+}
+
+func newTokenFailover(sources []oauth2.TokenSource, log *logrus.Entry, m *metrics) *tokenFailover {
+	m.setTokenIndex(0)
+	return &tokenFailover{sources: sources, log: log, metrics: m}
+}
+
+// Token returns the token currently in use.
+func (f *tokenFailover) Token() (*oauth2.Token, error) {
+	f.mu.Lock()
+	source := f.sources[f.current]
+	f.mu.Unlock()
+	return source.Token()
+}
+
+func (f *tokenFailover) index() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.current
+}
+
+// failover switches to the token after the given one. Nothing happens if
+// another request has failed over already.
+func (f *tokenFailover) failover(from, statusCode int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.current != from {
+		return
+	}
+	f.current = (from + 1) % len(f.sources)
+	f.metrics.addTokenFailover(f.current)
+	f.log.WithFields(logrus.Fields{
+		"from_token":  from,
+		"to_token":    f.current,
+		"status_code": statusCode,
+	}).Warn("the cloudscale.ch API rejected the token, failing over to the next one")
+}
+
+// tokenFailoverTransport retries a request rejected by the cloudscale.ch API
+// with the next token, until every token has been tried once.
+type tokenFailoverTransport struct {
+	base     http.RoundTripper
+	failover *tokenFailover
+}
+
+func (t *tokenFailoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		current := t.failover.index()
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || !isAuthFailure(resp.StatusCode) {
+			return resp, err
+		}
+		t.failover.failover(current, resp.StatusCode)
+
+		// give up once every token has been tried or if the body of the
+		// request cannot be sent again
+		if attempt == len(t.failover.sources) || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+		resp.Body.Close()
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = retry
+	}
+}
+
+func isAuthFailure(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
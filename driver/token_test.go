@@ -0,0 +1,116 @@
+package driver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestTokenFileClient(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "access-token")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("first\n"), 0600))
+	client := &http.Client{
+		Transport: &oauth2.Transport{Source: &fileTokenSource{path: path}},
+	}
+
+	_, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer first", authorization)
+
+	// the rotated token is used without creating a new client
+	assert.NoError(t, ioutil.WriteFile(path, []byte("second"), 0600))
+	_, err = client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer second", authorization)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(""), 0600))
+	_, err = client.Get(server.URL)
+	assert.Error(t, err)
+}
+
+func TestTokenFailover(t *testing.T) {
+	valid := map[string]bool{"Bearer second": true, "Bearer third": true}
+	var authorizations, bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		authorizations = append(authorizations, auth)
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if !valid[auth] {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	m := newMetrics()
+	failover := newTokenFailover([]oauth2.TokenSource{
+		oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "first"}),
+		oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "second"}),
+		oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "third"}),
+	}, logrus.NewEntry(logrus.New()), m)
+	client := &http.Client{Transport: &tokenFailoverTransport{
+		base:     &oauth2.Transport{Source: failover},
+		failover: failover,
+	}}
+
+	// the request is retried with the body after the first token is rejected
+	resp, err := client.Post(server.URL, "application/json", bytes.NewBufferString(`{"size_gb":1}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"Bearer first", "Bearer second"}, authorizations)
+	assert.Equal(t, []string{`{"size_gb":1}`, `{"size_gb":1}`}, bodies)
+
+	// the next token sticks
+	authorizations = nil
+	_, err = client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Bearer second"}, authorizations)
+
+	// the token is revoked
+	delete(valid, "Bearer second")
+	authorizations = nil
+	resp, err = client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"Bearer second", "Bearer third"}, authorizations)
+
+	out := scrapeMetrics(t, newMetricsTestDriver(m))
+	assert.Contains(t, out, "cloudscale_api_token_failovers_total 2\n")
+	assert.Contains(t, out, "cloudscale_api_token_index 2\n")
+
+	// every token is tried once before giving up
+	valid = map[string]bool{}
+	authorizations = nil
+	resp, err = client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, []string{"Bearer third", "Bearer first", "Bearer second"}, authorizations)
+}
+
+func TestTokenFailoverConcurrentFailures(t *testing.T) {
+	failover := newTokenFailover([]oauth2.TokenSource{
+		oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "first"}),
+		oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "second"}),
+		oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "third"}),
+	}, logrus.NewEntry(logrus.New()), nil)
+
+	// two requests rejected with the first token only skip it once
+	failover.failover(0, http.StatusUnauthorized)
+	failover.failover(0, http.StatusUnauthorized)
+	token, err := failover.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "second", token.AccessToken)
+}
@@ -0,0 +1,390 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The tracer exports spans in the OTLP/HTTP JSON encoding, which every
+// OpenTelemetry collector accepts, and is configured with the standard
+// OpenTelemetry environment variables.
+const (
+	traceparentKey = "traceparent"
+
+	defaultServiceName = "csi-cloudscale"
+
+	// span kinds and status codes of the OTLP protocol
+	spanKindServer  = 2
+	spanKindClient  = 3
+	spanStatusError = 2
+
+	traceExportInterval = 5 * time.Second
+	maxPendingSpans     = 2048
+)
+
+// span is a finished or running operation of a trace
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      string
+}
+
+// setError marks the span as failed
+func (s *span) setError(err error) {
+	if err != nil {
+		s.err = err.Error()
+	}
+}
+
+// traceparent formats the span as W3C trace context
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+// parseTraceparent returns the trace and span ID of a W3C trace context
+func parseTraceparent(value string) (traceID [16]byte, spanID [8]byte, ok bool) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return traceID, spanID, false
+	}
+	if traceID == [16]byte{} || spanID == [8]byte{} {
+		return traceID, spanID, false
+	}
+	return traceID, spanID, true
+}
+
+type spanKey struct{}
+
+// tracer records spans and exports them periodically. A nil tracer disables
+// tracing.
+type tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+	log         *logrus.Entry
+
+	mu      sync.Mutex
+	pending []*span
+}
+
+// newTracerFromEnv returns a tracer exporting to the endpoint configured in
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT, or nil if
+// tracing is not configured.
+func newTracerFromEnv(log *logrus.Entry) *tracer {
+	if os.Getenv("OTEL_TRACES_EXPORTER") == "none" || os.Getenv("OTEL_SDK_DISABLED") == "true" {
+		return nil
+	}
+
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+
+	headers := map[string]string{}
+	for _, env := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_HEADERS"} {
+		for _, pair := range strings.Split(os.Getenv(env), ",") {
+			if k, v, ok := strings.Cut(pair, "="); ok {
+				headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
+	return &tracer{
+		endpoint:    endpoint,
+		headers:     headers,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		log:         log.WithField("otlp_endpoint", endpoint),
+	}
+}
+
+// start starts a span, which is a child of the span in the context or of the
+// given remote parent in W3C trace context format.
+func (t *tracer) start(ctx context.Context, name string, kind int, remoteParent string) (context.Context, *span) {
+	s := &span{
+		name:  name,
+		kind:  kind,
+		start: time.Now(),
+		attrs: map[string]string{},
+	}
+
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else if traceID, spanID, ok := parseTraceparent(remoteParent); ok {
+		s.traceID = traceID
+		s.parentID = spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// finish ends the span and queues it for the export. The oldest spans are
+// dropped if the collector cannot keep up.
+func (t *tracer) finish(s *span) {
+	s.end = time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= maxPendingSpans {
+		t.pending = t.pending[1:]
+	}
+	t.pending = append(t.pending, s)
+}
+
+// run exports the finished spans periodically until the stop channel is
+// closed, then exports the remaining spans.
+func (t *tracer) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			t.flush()
+			return
+		case <-ticker.C:
+			t.flush()
+		}
+	}
+}
+
+func (t *tracer) flush() {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.export(spans); err != nil {
+		t.log.WithError(err).WithField("spans", len(spans)).Warn("failed to export traces")
+	}
+}
+
+func (t *tracer) export(spans []*span) error {
+	body, err := json.Marshal(t.otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// otlpAttributes returns the attributes sorted by key
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	result := make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		a := otlpAttribute{Key: k}
+		a.Value.StringValue = v
+		result = append(result, a)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+// otlpRequest returns the ExportTraceServiceRequest for the spans in the
+// JSON encoding of OTLP
+func (t *tracer) otlpRequest(spans []*span) map[string]interface{} {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			o.Status.Code = spanStatusError
+			o.Status.Message = s.err
+		}
+		otlpSpans = append(otlpSpans, o)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{
+						"service.name":    t.serviceName,
+						"service.version": version,
+					}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/cloudscale-ch/csi-cloudscale/driver"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+// tracingInterceptor records a server span for every gRPC call. The span
+// continues the trace given in the traceparent metadata, if any.
+func (d *Driver) tracingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if d.tracer == nil {
+		return handler(ctx, req)
+	}
+
+	var remoteParent string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(traceparentKey); len(values) > 0 {
+			remoteParent = values[0]
+		}
+	}
+
+	ctx, s := d.tracer.start(ctx, strings.TrimPrefix(info.FullMethod, "/"), spanKindServer, remoteParent)
+	s.attrs["rpc.system"] = "grpc"
+	s.attrs["rpc.method"] = info.FullMethod
+	s.attrs["csi.node_id"] = d.serverId
+	if id := requestIDFromContext(ctx); id != "" {
+		s.attrs["csi.request_id"] = id
+	}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		s.attrs["csi.volume_id"] = r.GetVolumeId()
+	}
+
+	resp, err := handler(ctx, req)
+	s.attrs["rpc.grpc.status_code"] = status.Code(err).String()
+	s.setError(err)
+	d.tracer.finish(s)
+	return resp, err
+}
+
+// tracingTransport records a client span for every request to the
+// cloudscale.ch API and passes the trace context on.
+type tracingTransport struct {
+	base   http.RoundTripper
+	tracer *tracer
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.tracer == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx, s := t.tracer.start(req.Context(), "cloudscale "+req.Method+" "+apiResource(req.URL.Path), spanKindClient, "")
+	s.attrs["http.method"] = req.Method
+	s.attrs["http.target"] = req.URL.Path
+	s.attrs["net.peer.name"] = req.URL.Hostname()
+
+	// a RoundTripper must not modify the request
+	req = req.Clone(ctx)
+	req.Header.Set(traceparentKey, s.traceparent())
+
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		s.attrs["http.status_code"] = strconv.Itoa(resp.StatusCode)
+		if resp.StatusCode >= 400 {
+			s.setError(fmt.Errorf("%s", resp.Status))
+		}
+	}
+	s.setError(err)
+	t.tracer.finish(s)
+	return resp, err
+}
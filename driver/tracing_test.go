@@ -0,0 +1,161 @@
+package driver
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, spanID, ok := parseTraceparent(testTraceparent)
+	assert.True(t, ok)
+	assert.Equal(t, byte(0x4b), traceID[0])
+	assert.Equal(t, byte(0xb7), spanID[7])
+
+	for _, value := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		_, _, ok := parseTraceparent(value)
+		assert.False(t, ok, value)
+	}
+}
+
+func TestNewTracerFromEnv(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	assert.Nil(t, newTracerFromEnv(log))
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318/")
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "authorization=Bearer abc, x-tenant=csi")
+	tr := newTracerFromEnv(log)
+	assert.Equal(t, "http://collector:4318/v1/traces", tr.endpoint)
+	assert.Equal(t, map[string]string{"authorization": "Bearer abc", "x-tenant": "csi"}, tr.headers)
+	assert.Equal(t, defaultServiceName, tr.serviceName)
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	assert.Nil(t, newTracerFromEnv(log))
+}
+
+func TestTracing(t *testing.T) {
+	var exported map[string]interface{}
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			body, _ := ioutil.ReadAll(r.Body)
+			assert.NoError(t, json.Unmarshal(body, &exported))
+			return
+		}
+		traceparent = r.Header.Get(traceparentKey)
+	}))
+	defer server.Close()
+
+	tr := &tracer{
+		endpoint:    server.URL + "/v1/traces",
+		serviceName: defaultServiceName,
+		client:      http.DefaultClient,
+		log:         logrus.NewEntry(logrus.New()),
+	}
+	d := &Driver{serverId: "987654", tracer: tr}
+	client := &http.Client{Transport: &tracingTransport{base: http.DefaultTransport, tracer: tr}}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(traceparentKey, testTraceparent))
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerPublishVolume"}
+	_, err := d.tracingInterceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		apiReq, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/v1/volumes/abc", nil)
+		_, err := client.Do(apiReq)
+		assert.NoError(t, err)
+		return nil, errors.New("attach failed")
+	})
+	assert.Error(t, err)
+
+	assert.Len(t, tr.pending, 2)
+	apiSpan, rpcSpan := tr.pending[0], tr.pending[1]
+	assert.Equal(t, "csi.v1.Controller/ControllerPublishVolume", rpcSpan.name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(rpcSpan.traceID[:]))
+	assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(rpcSpan.parentID[:]))
+	assert.Equal(t, "attach failed", rpcSpan.err)
+	assert.Equal(t, rpcSpan.traceID, apiSpan.traceID)
+	assert.Equal(t, rpcSpan.spanID, apiSpan.parentID)
+	assert.Equal(t, apiSpan.traceparent(), traceparent)
+	assert.Equal(t, "cloudscale GET volumes", apiSpan.name)
+
+	tr.flush()
+	assert.Empty(t, tr.pending)
+	resourceSpans := exported["resourceSpans"].([]interface{})
+	scopeSpans := resourceSpans[0].(map[string]interface{})["scopeSpans"].([]interface{})
+	spans := scopeSpans[0].(map[string]interface{})["spans"].([]interface{})
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[1].(map[string]interface{})["traceId"])
+	assert.Equal(t, float64(spanKindServer), spans[1].(map[string]interface{})["kind"])
+}
+
+func TestOTLPRequest(t *testing.T) {
+	tr := &tracer{serviceName: defaultServiceName}
+	traceID, parentID, _ := parseTraceparent(testTraceparent)
+	s := &span{
+		traceID:  traceID,
+		spanID:   [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		parentID: parentID,
+		name:     "csi.v1.Node/NodeStageVolume",
+		kind:     spanKindServer,
+		start:    time.Unix(1700000000, 0),
+		end:      time.Unix(1700000000, 500),
+		attrs:    map[string]string{"rpc.system": "grpc", "csi.volume_id": "vol"},
+	}
+	s.setError(errors.New("busy"))
+
+	body, err := json.Marshal(tr.otlpRequest([]*span{s}))
+	assert.NoError(t, err)
+	// the OTLP/JSON encoding of an ExportTraceServiceRequest
+	assert.JSONEq(t, `{"resourceSpans": [{
+		"resource": {"attributes": [
+			{"key": "service.name", "value": {"stringValue": "csi-cloudscale"}},
+			{"key": "service.version", "value": {"stringValue": "`+version+`"}}
+		]},
+		"scopeSpans": [{
+			"scope": {"name": "github.com/cloudscale-ch/csi-cloudscale/driver"},
+			"spans": [{
+				"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+				"spanId": "0102030405060708",
+				"parentSpanId": "00f067aa0ba902b7",
+				"name": "csi.v1.Node/NodeStageVolume",
+				"kind": 2,
+				"startTimeUnixNano": "1700000000000000000",
+				"endTimeUnixNano": "1700000000000000500",
+				"attributes": [
+					{"key": "csi.volume_id", "value": {"stringValue": "vol"}},
+					{"key": "rpc.system", "value": {"stringValue": "grpc"}}
+				],
+				"status": {"code": 2, "message": "busy"}
+			}]
+		}]
+	}]}`, string(body))
+}
+
+func TestTracingDisabled(t *testing.T) {
+	d := &Driver{}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	_, err := d.tracingInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		assert.Nil(t, ctx.Value(spanKey{}))
+		return nil, nil
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,62 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// newAPITransport returns the transport used to reach the cloudscale.ch API.
+// Without a proxy URL, the proxy is taken from the environment like for the
+// default transport. The certificates in the CA bundle are trusted in
+// addition to the system roots.
+func newAPITransport(proxyURL, caBundle string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if proxyURL != "" {
+		proxy, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse proxy url: %s", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if caBundle != "" {
+		pem, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read CA bundle: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", caBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,49 @@
+package driver
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAPITransportCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	transport, err := newAPITransport("", "")
+	assert.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	assert.Error(t, err)
+
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, ioutil.WriteFile(caBundle, cert, 0644))
+
+	transport, err = newAPITransport("", caBundle)
+	assert.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	assert.NoError(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(caBundle, []byte("invalid"), 0644))
+	_, err = newAPITransport("", caBundle)
+	assert.Error(t, err)
+}
+
+func TestNewAPITransportProxy(t *testing.T) {
+	var requested string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	transport, err := newAPITransport(proxy.URL, "")
+	assert.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get("http://api.example.com/v1/servers")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://api.example.com/v1/servers", requested)
+}
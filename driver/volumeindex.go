@@ -0,0 +1,121 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+)
+
+// volumeIndexTTL is how long the index of the volume names is used before it
+// is loaded again, which picks up volumes created outside of the driver
+const volumeIndexTTL = 10 * time.Minute
+
+// volumeIndexIdle is how long the index is used without lookups. The
+// sidecars of the controller elect the replica receiving the calls; a
+// replica does not receive calls while another one creates volumes, so an
+// index which was not used for a while might be missing volumes.
+const volumeIndexIdle = 30 * time.Second
+
+// volumeIndex maps the names of the volumes to their UUIDs, so that
+// CreateVolume does not have to list the volumes for every call to find out
+// whether the volume exists already. The index is loaded with one listing
+// and kept up to date by CreateVolume and DeleteVolume. It is invalidated if
+// it is unknown whether a volume was created, e.g. after a timeout. The zero
+// value is ready to use.
+type volumeIndex struct {
+	mu       sync.Mutex // protects the fields below
+	names    map[string][]string
+	loadedAt time.Time
+	usedAt   time.Time
+}
+
+// lookup returns the UUIDs of the volumes with the given name. The index is
+// loaded first if it was not loaded yet, was invalidated, has expired or was
+// idle; concurrent lookups wait for the load instead of listing the volumes
+// again.
+func (i *volumeIndex) lookup(ctx context.Context, volumes cloudscale.VolumeService, name string) ([]string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	if i.names == nil || now.Sub(i.loadedAt) > volumeIndexTTL || now.Sub(i.usedAt) > volumeIndexIdle {
+		list, err := listAllVolumes(ctx, volumes)
+		if err != nil {
+			return nil, err
+		}
+		i.names = make(map[string][]string, len(list))
+		for _, vol := range list {
+			i.names[vol.Name] = append(i.names[vol.Name], vol.UUID)
+		}
+		i.loadedAt = now
+	}
+	i.usedAt = now
+
+	return append([]string(nil), i.names[name]...), nil
+}
+
+// add records the creation of a volume
+func (i *volumeIndex) add(name, volumeID string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.names != nil {
+		i.names[name] = append(i.names[name], volumeID)
+	}
+}
+
+// remove records the deletion of a volume
+func (i *volumeIndex) remove(volumeID string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for name, ids := range i.names {
+		for n, id := range ids {
+			if id != volumeID {
+				continue
+			}
+			if len(ids) == 1 {
+				delete(i.names, name)
+			} else {
+				i.names[name] = append(ids[:n:n], ids[n+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// invalidate makes the next lookup load the index again
+func (i *volumeIndex) invalidate() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.names = nil
+}
+
+// isDefiniteFailure returns true if the API rejected a request, in which case
+// it was not carried out. A request might have been carried out despite other
+// errors, e.g. a timeout or an internal server error.
+func isDefiniteFailure(err error) bool {
+	var errResp *cloudscale.ErrorResponse
+	return errors.As(err, &errResp) && errResp.StatusCode < http.StatusInternalServerError
+}
@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateVolumeUsesVolumeIndex(t *testing.T) {
+	var lists int
+	var failCreate error
+	client := cloudscalefake.NewClient(nil, cloudscalefake.WithErrorInjection(func(call cloudscalefake.Call) error {
+		if call.Service != "volumes" {
+			return nil
+		}
+		switch call.Method {
+		case "List":
+			lists++
+		case "Create":
+			return failCreate
+		}
+		return nil
+	}))
+	driver := &Driver{
+		cloudscaleClient: client,
+		mounter:          mounter.NewFake(),
+		log:              logrus.New().WithField("test_enabled", true),
+	}
+	ctx := context.Background()
+
+	// a burst of creates lists the volumes once
+	var names []string
+	volumeIDs := map[string]string{}
+	for i := 0; i < 10; i++ {
+		name := randString(32)
+		resp, err := driver.CreateVolume(ctx, makeCreateVolumeRequest(name, 1, "ssd", false))
+		assert.NoError(t, err)
+		names = append(names, name)
+		volumeIDs[name] = resp.Volume.VolumeId
+	}
+	assert.Equal(t, 1, lists)
+
+	// retries return the existing volume
+	resp, err := driver.CreateVolume(ctx, makeCreateVolumeRequest(names[0], 1, "ssd", false))
+	assert.NoError(t, err)
+	assert.Equal(t, volumeIDs[names[0]], resp.Volume.VolumeId)
+	assert.Equal(t, 1, lists)
+
+	// a volume deleted through the driver or outside of it is created again
+	_, err = driver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeIDs[names[1]]})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Volumes.Delete(ctx, volumeIDs[names[2]]))
+	for _, name := range names[1:3] {
+		resp, err = driver.CreateVolume(ctx, makeCreateVolumeRequest(name, 1, "ssd", false))
+		assert.NoError(t, err)
+		assert.NotEqual(t, volumeIDs[name], resp.Volume.VolumeId)
+	}
+	assert.Equal(t, 1, lists)
+
+	// a rejected create leaves the index alone
+	failCreate = &cloudscale.ErrorResponse{StatusCode: http.StatusBadRequest}
+	_, err = driver.CreateVolume(ctx, makeCreateVolumeRequest(randString(32), 1, "ssd", false))
+	assert.Error(t, err)
+	assert.Equal(t, 1, lists)
+
+	// the volume might have been created despite an internal server error
+	failCreate = &cloudscale.ErrorResponse{StatusCode: http.StatusInternalServerError}
+	_, err = driver.CreateVolume(ctx, makeCreateVolumeRequest(randString(32), 1, "ssd", false))
+	assert.Error(t, err)
+	failCreate = nil
+	_, err = driver.CreateVolume(ctx, makeCreateVolumeRequest(randString(32), 1, "ssd", false))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, lists)
+
+	// volumes created outside of the driver are found once the index expired
+	external, err := client.Volumes.Create(ctx, &cloudscale.VolumeRequest{Name: randString(32), SizeGB: 1, Type: "ssd"})
+	assert.NoError(t, err)
+	driver.volumeIndex.loadedAt = time.Now().Add(-volumeIndexTTL - time.Second)
+	resp, err = driver.CreateVolume(ctx, makeCreateVolumeRequest(external.Name, 1, "ssd", false))
+	assert.NoError(t, err)
+	assert.Equal(t, external.UUID, resp.Volume.VolumeId)
+	assert.Equal(t, 3, lists)
+
+	// another replica might have created volumes while the index was idle
+	other, err := client.Volumes.Create(ctx, &cloudscale.VolumeRequest{Name: randString(32), SizeGB: 1, Type: "ssd"})
+	assert.NoError(t, err)
+	driver.volumeIndex.usedAt = time.Now().Add(-volumeIndexIdle - time.Second)
+	resp, err = driver.CreateVolume(ctx, makeCreateVolumeRequest(other.Name, 1, "ssd", false))
+	assert.NoError(t, err)
+	assert.Equal(t, other.UUID, resp.Volume.VolumeId)
+	assert.Equal(t, 4, lists)
+}
+
+func TestVolumeIndexRemove(t *testing.T) {
+	index := &volumeIndex{names: map[string][]string{
+		"a": {"1"},
+		"b": {"2", "3"},
+	}}
+
+	index.remove("2")
+	assert.Equal(t, map[string][]string{"a": {"1"}, "b": {"3"}}, index.names)
+	index.remove("1")
+	assert.Equal(t, map[string][]string{"b": {"3"}}, index.names)
+	index.remove("unknown")
+	assert.Equal(t, map[string][]string{"b": {"3"}}, index.names)
+
+	// the index is loaded from scratch after being invalidated
+	index.invalidate()
+	index.add("c", "4")
+	assert.Nil(t, index.names)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+)
+
+// volumeListPageSize is the number of volumes requested per page when listing
+// the volumes
+const volumeListPageSize = 500
+
+// listAllVolumes returns all volumes of the account. The cloudscale.ch API
+// currently lists all volumes with a single response and ignores the page
+// parameters, but should it paginate the listing for large accounts, the
+// pages are requested one after the other. A page with less or more than
+// volumeListPageSize volumes is the last one, and so is a page without new
+// volumes, which happens if the API ignored the parameters. Volumes moving
+// between pages while they are listed are only returned once.
+func listAllVolumes(ctx context.Context, volumes cloudscale.VolumeService) ([]cloudscale.Volume, error) {
+	var all []cloudscale.Volume
+	seen := make(map[string]bool)
+	for page := 1; ; page++ {
+		list, err := volumes.List(ctx, withPage(page, volumeListPageSize))
+		if err != nil {
+			return nil, err
+		}
+
+		added := 0
+		for _, vol := range list {
+			if seen[vol.UUID] {
+				continue
+			}
+			seen[vol.UUID] = true
+			all = append(all, vol)
+			added++
+		}
+		if len(list) != volumeListPageSize || added == 0 {
+			return all, nil
+		}
+	}
+}
+
+// withPage selects a page of a listing
+func withPage(page, pageSize int) cloudscale.ListRequestModifier {
+	return func(request *http.Request) {
+		query := request.URL.Query()
+		query.Set("page", strconv.Itoa(page))
+		query.Set("page_size", strconv.Itoa(pageSize))
+		request.URL.RawQuery = query.Encode()
+	}
+}
+
+// withTag selects the volumes with the given tag value
+func withTag(key, value string) cloudscale.ListRequestModifier {
+	return func(request *http.Request) {
+		query := request.URL.Query()
+		query.Set("tag:"+key, value)
+		request.URL.RawQuery = query.Encode()
+	}
+}
@@ -0,0 +1,101 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListVolumesPagination(t *testing.T) {
+	const volumeCount = 2*volumeListPageSize + 200
+
+	for _, tc := range []struct {
+		name      string
+		opts      []cloudscalefake.Option
+		listCalls int
+	}{
+		{
+			name:      "paginated",
+			opts:      []cloudscalefake.Option{cloudscalefake.WithVolumePagination()},
+			listCalls: 3,
+		},
+		{
+			name:      "not paginated",
+			listCalls: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var listCalls int
+			opts := append(tc.opts, cloudscalefake.WithErrorInjection(func(call cloudscalefake.Call) error {
+				if call.Service == "volumes" && call.Method == "List" {
+					listCalls++
+				}
+				return nil
+			}))
+			driver := &Driver{
+				cloudscaleClient: cloudscalefake.NewClient(nil, opts...),
+				mounter:          mounter.NewFake(),
+				log:              logrus.New().WithField("test_enabled", true),
+			}
+			ctx := context.Background()
+
+			names := make(map[string]string, volumeCount)
+			for i := 0; i < volumeCount; i++ {
+				vol, err := driver.cloudscaleClient.Volumes.Create(ctx, &cloudscale.VolumeRequest{
+					Name:   fmt.Sprintf("pvc-%d", i),
+					SizeGB: 1,
+				})
+				assert.NoError(t, err)
+				names[vol.UUID] = vol.Name
+			}
+
+			resp, err := driver.ListVolumes(ctx, &csi.ListVolumesRequest{})
+			assert.NoError(t, err)
+			assert.Len(t, resp.Entries, volumeCount)
+			listed := make(map[string]bool, len(resp.Entries))
+			for _, entry := range resp.Entries {
+				listed[entry.Volume.VolumeId] = true
+			}
+			assert.Len(t, listed, volumeCount)
+			assert.Equal(t, tc.listCalls, listCalls)
+
+			// the index knows the volumes of all pages
+			listCalls = 0
+			for volumeID, name := range names {
+				resp, err := driver.CreateVolume(ctx, makeCreateVolumeRequest(name, 1, "ssd", false))
+				assert.NoError(t, err)
+				assert.Equal(t, volumeID, resp.Volume.VolumeId)
+			}
+			assert.Equal(t, tc.listCalls, listCalls)
+		})
+	}
+}
+
+func TestListAllVolumesFullPage(t *testing.T) {
+	var listCalls int
+	client := cloudscalefake.NewClient(nil, cloudscalefake.WithErrorInjection(func(call cloudscalefake.Call) error {
+		if call.Method == "List" {
+			listCalls++
+		}
+		return nil
+	}))
+	ctx := context.Background()
+	for i := 0; i < volumeListPageSize; i++ {
+		_, err := client.Volumes.Create(ctx, &cloudscale.VolumeRequest{Name: fmt.Sprintf("pvc-%d", i), SizeGB: 1})
+		assert.NoError(t, err)
+	}
+
+	// the API ignores the page parameters, the second page has no new
+	// volumes and ends the listing
+	volumes, err := listAllVolumes(ctx, client.Volumes)
+	assert.NoError(t, err)
+	assert.Len(t, volumes, volumeListPageSize)
+	assert.Equal(t, 2, listCalls)
+}
@@ -0,0 +1,187 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// pvcNameKey and pvcNamespaceKey are the parameters with the claim of
+	// the volume which the external-provisioner passes to CreateVolume with
+	// --extra-create-metadata; they are passed on to the node in the volume
+	// context to label the metrics of the volume
+	pvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+)
+
+var (
+	volumeLabels = []string{"namespace", "persistentvolume", "persistentvolumeclaim", "volume_id"}
+
+	volumeCapacityDesc = prometheus.NewDesc("csi_plugin_volume_capacity_bytes",
+		"Capacity of the filesystem of the staged volume", volumeLabels, nil)
+	volumeAvailableDesc = prometheus.NewDesc("csi_plugin_volume_available_bytes",
+		"Available space in the filesystem of the staged volume", volumeLabels, nil)
+	volumeUsedDesc = prometheus.NewDesc("csi_plugin_volume_used_bytes",
+		"Used space in the filesystem of the staged volume", volumeLabels, nil)
+	volumeInodesDesc = prometheus.NewDesc("csi_plugin_volume_inodes",
+		"Number of inodes of the filesystem of the staged volume", volumeLabels, nil)
+	volumeInodesFreeDesc = prometheus.NewDesc("csi_plugin_volume_inodes_free",
+		"Number of free inodes of the filesystem of the staged volume", volumeLabels, nil)
+	volumeInodesUsedDesc = prometheus.NewDesc("csi_plugin_volume_inodes_used",
+		"Number of used inodes of the filesystem of the staged volume", volumeLabels, nil)
+	volumeDeviceSizeDesc = prometheus.NewDesc("csi_plugin_volume_device_size_bytes",
+		"Size of the device of the staged volume, including filesystem and block volumes", volumeLabels, nil)
+)
+
+// stagedVolume is a volume staged on the node
+type stagedVolume struct {
+	pvName       string
+	pvcName      string
+	pvcNamespace string
+	stagingPath  string
+	device       string
+	block        bool
+	// readWrite is set if the volume was staged read-write, it is unknown
+	// for the volumes learned from NodeGetVolumeStats
+	readWrite bool
+}
+
+// stagedVolumes keeps track of the volumes staged on the node for their
+// metrics. Volumes staged before the node plugin started are learned from
+// NodeGetVolumeStats, without their claim. The zero value is ready to use.
+type stagedVolumes struct {
+	mu      sync.Mutex
+	volumes map[string]stagedVolume // by volume ID
+}
+
+// add records the staging of a volume
+func (s *stagedVolumes) add(volumeID string, vol stagedVolume) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.volumes == nil {
+		s.volumes = map[string]stagedVolume{}
+	}
+	s.volumes[volumeID] = vol
+}
+
+// learn records a volume unless it is known already
+func (s *stagedVolumes) learn(volumeID string, vol stagedVolume) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.volumes[volumeID]; ok {
+		return
+	}
+	if s.volumes == nil {
+		s.volumes = map[string]stagedVolume{}
+	}
+	s.volumes[volumeID] = vol
+}
+
+// remove records the unstaging of a volume
+func (s *stagedVolumes) remove(volumeID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.volumes, volumeID)
+}
+
+// get returns the given volume and whether it is known
+func (s *stagedVolumes) get(volumeID string) (stagedVolume, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vol, ok := s.volumes[volumeID]
+	return vol, ok
+}
+
+// list returns the IDs of the staged volumes in order and the volumes
+func (s *stagedVolumes) list() ([]string, map[string]stagedVolume) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, len(s.volumes))
+	volumes := make(map[string]stagedVolume, len(s.volumes))
+	for id, vol := range s.volumes {
+		ids = append(ids, id)
+		volumes[id] = vol
+	}
+	sort.Strings(ids)
+	return ids, volumes
+}
+
+// volumeCollector collects the usage of the staged volumes when the metrics
+// are scraped. Volumes whose usage cannot be determined, e.g. as they are
+// being unstaged, are left out.
+type volumeCollector struct {
+	d *Driver
+}
+
+func (c *volumeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		volumeCapacityDesc, volumeAvailableDesc, volumeUsedDesc,
+		volumeInodesDesc, volumeInodesFreeDesc, volumeInodesUsedDesc,
+		volumeDeviceSizeDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *volumeCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+	ids, volumes := c.d.staged.list()
+	for _, id := range ids {
+		vol := volumes[id]
+		labels := []string{vol.pvcNamespace, vol.pvName, vol.pvcName, id}
+		gauge := func(desc *prometheus.Desc, value int64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value), labels...)
+		}
+		ll := c.d.log.WithFields(logrus.Fields{
+			"volume_id": id,
+			"method":    "volume_metrics",
+		})
+
+		device, err := c.d.mounter.GetStatistics(ctx, vol.device)
+		if err != nil {
+			ll.WithError(err).Debug("couldn't get the size of the device of the volume")
+			continue
+		}
+		gauge(volumeDeviceSizeDesc, device.TotalBytes)
+
+		if vol.block {
+			continue
+		}
+		stats, err := c.d.mounter.GetStatistics(ctx, vol.stagingPath)
+		if err != nil {
+			ll.WithError(err).Debug("couldn't get the usage of the filesystem of the volume")
+			continue
+		}
+		gauge(volumeCapacityDesc, stats.TotalBytes)
+		gauge(volumeAvailableDesc, stats.AvailableBytes)
+		gauge(volumeUsedDesc, stats.UsedBytes)
+		gauge(volumeInodesDesc, stats.TotalInodes)
+		gauge(volumeInodesFreeDesc, stats.AvailableInodes)
+		gauge(volumeInodesUsedDesc, stats.UsedInodes)
+	}
+}
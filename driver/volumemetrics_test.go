@@ -0,0 +1,73 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/mounter"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeMetrics(t *testing.T) {
+	driver := &Driver{
+		mounter: mounter.NewFake(),
+		metrics: newMetrics(),
+		mode:    ModeNode,
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+	stage := func(volumeID, pvName string, capability *csi.VolumeCapability) {
+		_, err := driver.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/" + pvName + "/globalmount",
+			VolumeCapability:  capability,
+			PublishContext:    map[string]string{PublishInfoVolumeName: pvName},
+			VolumeContext: map[string]string{
+				pvcNameKey:      "data-" + pvName,
+				pvcNamespaceKey: "default",
+			},
+		})
+		assert.NoError(t, err)
+	}
+	stage("11111111-0000-0000-0000-000000000000", "pvc-fs", &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	})
+	stage("22222222-0000-0000-0000-000000000000", "pvc-block", &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	})
+
+	out := scrapeMetrics(t, driver)
+	fsLabels := `{namespace="default",persistentvolume="pvc-fs",persistentvolumeclaim="data-pvc-fs",volume_id="11111111-0000-0000-0000-000000000000"}`
+	blockLabels := `{namespace="default",persistentvolume="pvc-block",persistentvolumeclaim="data-pvc-block",volume_id="22222222-0000-0000-0000-000000000000"}`
+	assert.Contains(t, out, "# TYPE csi_plugin_volume_used_bytes gauge\n")
+	assert.Contains(t, out, "csi_plugin_volume_capacity_bytes"+fsLabels+" 1.073741824e+10\n")
+	assert.Contains(t, out, "csi_plugin_volume_used_bytes"+fsLabels+" 7.516192768e+09\n")
+	assert.Contains(t, out, "csi_plugin_volume_inodes_free"+fsLabels+" 3000\n")
+	assert.Contains(t, out, "csi_plugin_volume_device_size_bytes"+fsLabels+" 1.073741824e+10\n")
+	assert.Contains(t, out, "csi_plugin_volume_device_size_bytes"+blockLabels+" 1.073741824e+10\n")
+	assert.NotContains(t, out, "csi_plugin_volume_capacity_bytes"+blockLabels)
+
+	// unstaged volumes are not exported anymore
+	_, err := driver.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "11111111-0000-0000-0000-000000000000",
+		StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-fs/globalmount",
+	})
+	assert.NoError(t, err)
+	out = scrapeMetrics(t, driver)
+	assert.NotContains(t, out, fsLabels)
+	assert.Contains(t, out, blockLabels)
+}
+
+func TestStagedVolumesLearn(t *testing.T) {
+	var staged stagedVolumes
+	staged.learn("vol", stagedVolume{pvName: "pvc-learned"})
+	staged.add("vol", stagedVolume{pvName: "pvc-1", pvcName: "data"})
+	staged.learn("vol", stagedVolume{pvName: "pvc-learned"})
+
+	ids, volumes := staged.list()
+	assert.Equal(t, []string{"vol"}, ids)
+	assert.Equal(t, "data", volumes["vol"].pvcName)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/sirupsen/logrus"
+)
+
+// topologyZoneKey is the topology segment reported by NodeGetInfo
+const topologyZoneKey = DriverName + "/zone"
+
+// resolveZone returns the zone of the server the driver runs on. The zone of
+// the server in the API takes precedence, the availability zone from the
+// metadata service is only used if the API cannot be reached. As this is the
+// first request to the API, an invalid token or server ID is reported here,
+// so that the driver does not start at all.
+func resolveZone(ctx context.Context, client *cloudscale.Client, serverID, metadataZone string, log *logrus.Entry) (string, error) {
+	server, err := client.Servers.Get(ctx, serverID)
+	if err != nil {
+		if err := invalidConfigurationError(err, serverID); err != nil {
+			return "", err
+		}
+		if metadataZone == "" {
+			return "", fmt.Errorf("couldn't get the zone of server %s: %v", serverID, err)
+		}
+		log.WithError(err).WithField("zone", metadataZone).Warn("couldn't get the server from the API, using the zone from the metadata")
+		return metadataZone, nil
+	}
+
+	zone := server.Zone.Slug
+	if zone == "" {
+		if metadataZone == "" {
+			return "", fmt.Errorf("the zone of server %s is unknown", serverID)
+		}
+		return metadataZone, nil
+	}
+
+	if metadataZone != "" && metadataZone != zone {
+		log.WithFields(logrus.Fields{
+			"metadata_zone": metadataZone,
+			"zone":          zone,
+		}).Warn("the zone in the metadata differs from the zone of the server, using the zone of the server")
+	}
+	return zone, nil
+}
+
+// invalidConfigurationError returns a descriptive error if the given error of
+// the API is caused by an invalid token or server ID, or nil otherwise.
+func invalidConfigurationError(err error, serverID string) error {
+	errorResponse, ok := err.(*cloudscale.ErrorResponse)
+	if !ok {
+		return nil
+	}
+
+	switch errorResponse.StatusCode {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("the cloudscale.ch API token is invalid: %v", err)
+	case http.StatusForbidden:
+		return fmt.Errorf("the cloudscale.ch API token is not allowed to access server %s: %v", serverID, err)
+	case http.StatusNotFound:
+		return fmt.Errorf("server %s does not exist or belongs to another project than the cloudscale.ch API token: %v", serverID, err)
+	default:
+		return nil
+	}
+}
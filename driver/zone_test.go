@@ -0,0 +1,52 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/cloudscalefake"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveZone(t *testing.T) {
+	client := cloudscalefake.NewClient(map[string]*cloudscale.Server{
+		"in-zone": {UUID: "in-zone", ZonalResource: cloudscale.ZonalResource{Zone: cloudscale.Zone{Slug: "rma1"}}},
+		"no-zone": {UUID: "no-zone"},
+	})
+	log := logrus.New().WithField("test_enabled", true)
+	ctx := context.Background()
+
+	for name, tc := range map[string]struct {
+		serverID     string
+		metadataZone string
+		zone         string
+		err          bool
+	}{
+		"server zone":            {serverID: "in-zone", zone: "rma1"},
+		"server zone takes prio": {serverID: "in-zone", metadataZone: "lpg1", zone: "rma1"},
+		"metadata zone":          {serverID: "no-zone", metadataZone: "lpg1", zone: "lpg1"},
+		"unknown zone":           {serverID: "no-zone", err: true},
+		"unknown server":         {serverID: "missing", metadataZone: "lpg1", err: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			zone, err := resolveZone(ctx, client, tc.serverID, tc.metadataZone, log)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.zone, zone)
+		})
+	}
+}
+
+func TestInvalidConfigurationError(t *testing.T) {
+	assert.Error(t, invalidConfigurationError(&cloudscale.ErrorResponse{StatusCode: 401}, "1234"))
+	assert.Error(t, invalidConfigurationError(&cloudscale.ErrorResponse{StatusCode: 403}, "1234"))
+	assert.Error(t, invalidConfigurationError(&cloudscale.ErrorResponse{StatusCode: 404}, "1234"))
+	assert.NoError(t, invalidConfigurationError(&cloudscale.ErrorResponse{StatusCode: 502}, "1234"))
+	assert.NoError(t, invalidConfigurationError(errors.New("connection refused"), "1234"))
+}
@@ -0,0 +1,514 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cloudscalefake provides a cloudscale.ch API client with an
+// in-memory backend for tests. It covers the servers and volumes as used by
+// the CSI driver: creating, listing, resizing, attaching, detaching and
+// deleting volumes. Latency and errors can be injected to test how callers
+// cope with a slow or failing API.
+package cloudscalefake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/google/uuid"
+)
+
+// Zone is the zone of the volumes and servers of the fake, unless another
+// zone is requested
+const Zone = "dev1"
+
+// maxVolumesPerServer is the number of volumes the fake attaches to a server
+// at most. It leaves room for the root volume and other volumes like the
+// limit of the driver.
+const maxVolumesPerServer = 125
+
+// Call describes a call to the fake API.
+type Call struct {
+	// Service is either "servers" or "volumes"
+	Service string
+	// Method is the method of the service, e.g. "Update"
+	Method string
+	// ID is the UUID of the server or volume, if any
+	ID string
+}
+
+// Option configures the fake.
+type Option func(*backend)
+
+// WithLatency delays every call by the given duration, or until the context
+// of the call is done.
+func WithLatency(latency time.Duration) Option {
+	return func(b *backend) {
+		b.latency = latency
+	}
+}
+
+// WithErrorInjection calls the given function before every call. If it returns
+// an error, the call fails with it without changing the state of the fake.
+// Return a *cloudscale.ErrorResponse to simulate an error of the API.
+func WithErrorInjection(inject func(Call) error) Option {
+	return func(b *backend) {
+		b.inject = inject
+	}
+}
+
+// WithServerRegistration makes the fake accept every server ID as an existing
+// server in Zone instead of returning not found for unknown servers.
+func WithServerRegistration() Option {
+	return func(b *backend) {
+		b.registerServers = true
+	}
+}
+
+// WithVolumePagination makes the fake list the volumes in pages selected by
+// the page and page_size list parameters, ordered by UUID. Without it, the
+// parameters are ignored and all volumes are listed, like the cloudscale.ch
+// API does.
+func WithVolumePagination() Option {
+	return func(b *backend) {
+		b.paginateVolumes = true
+	}
+}
+
+// backend holds the state of the fake, which is shared by the server and
+// volume services
+type backend struct {
+	mu      sync.Mutex
+	servers map[string]*cloudscale.Server
+	volumes map[string]*cloudscale.Volume
+
+	latency         time.Duration
+	inject          func(Call) error
+	registerServers bool
+	paginateVolumes bool
+}
+
+// NewClient returns a cloudscale.ch client with an in-memory backend knowing
+// the given servers. The servers are used as they are, so that tests can
+// change them later on, e.g. to add volumes attached outside of the fake.
+func NewClient(servers map[string]*cloudscale.Server, opts ...Option) *cloudscale.Client {
+	if servers == nil {
+		servers = map[string]*cloudscale.Server{}
+	}
+	b := &backend{
+		servers: servers,
+		volumes: map[string]*cloudscale.Volume{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	client := &cloudscale.Client{BaseURL: nil, UserAgent: "cloudscale/fake"}
+	client.Servers = serverService{b}
+	client.Volumes = volumeService{b}
+	client.Regions = regionService{b}
+	return client
+}
+
+// call applies the latency and the injected errors to a call
+func (b *backend) call(ctx context.Context, service, method, id string) error {
+	if b.latency > 0 {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		timer := time.NewTimer(b.latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if b.inject != nil {
+		return b.inject(Call{Service: service, Method: method, ID: id})
+	}
+	return nil
+}
+
+// server returns the server with the given ID; b.mu must be held
+func (b *backend) server(serverID string) (*cloudscale.Server, error) {
+	server, ok := b.servers[serverID]
+	if !ok {
+		if !b.registerServers || serverID == "" {
+			return nil, notFoundError()
+		}
+		server = &cloudscale.Server{
+			UUID: serverID,
+			Name: serverID,
+		}
+		server.Zone = cloudscale.Zone{Slug: Zone}
+		b.servers[serverID] = server
+	}
+	return server, nil
+}
+
+type volumeService struct {
+	*backend
+}
+
+func (f volumeService) Create(ctx context.Context, createRequest *cloudscale.VolumeRequest) (*cloudscale.Volume, error) {
+	if err := f.call(ctx, "volumes", "Create", ""); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	vol := &cloudscale.Volume{
+		UUID:   uuid.NewString(),
+		Name:   createRequest.Name,
+		SizeGB: createRequest.SizeGB,
+		Type:   createRequest.Type,
+	}
+	vol.Zone = cloudscale.Zone{Slug: Zone}
+	if createRequest.Zone != "" {
+		vol.Zone.Slug = createRequest.Zone
+	}
+	vol.Tags = createRequest.Tags
+
+	serverUUIDs := make([]string, 0, 1)
+	vol.ServerUUIDs = &serverUUIDs
+	f.volumes[vol.UUID] = vol
+
+	if createRequest.ServerUUIDs != nil {
+		if err := f.attach(vol, *createRequest.ServerUUIDs); err != nil {
+			delete(f.volumes, vol.UUID)
+			return nil, err
+		}
+	}
+
+	return copyVolume(vol), nil
+}
+
+func (f volumeService) Get(ctx context.Context, volumeID string) (*cloudscale.Volume, error) {
+	if err := f.call(ctx, "volumes", "Get", volumeID); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return nil, notFoundError()
+	}
+	return copyVolume(vol), nil
+}
+
+func (f volumeService) List(ctx context.Context, modifiers ...cloudscale.ListRequestModifier) ([]cloudscale.Volume, error) {
+	if err := f.call(ctx, "volumes", "List", ""); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var volumes []cloudscale.Volume
+	for _, vol := range f.volumes {
+		volumes = append(volumes, *copyVolume(vol))
+	}
+
+	if len(modifiers) == 0 {
+		return volumes, nil
+	}
+	if len(modifiers) > 1 {
+		return nil, errors.New("the fake client supports only one list modifier")
+	}
+
+	params := extractParams(modifiers)
+
+	if filterName := params.Get("name"); filterName != "" {
+		filtered := make([]cloudscale.Volume, 0, 1)
+		for _, vol := range volumes {
+			if vol.Name == filterName {
+				filtered = append(filtered, vol)
+			}
+		}
+		return filtered, nil
+	}
+	if params.Get("page") != "" || params.Get("page_size") != "" {
+		return f.page(volumes, params)
+	}
+	for key := range params {
+		if !strings.HasPrefix(key, "tag:") || len(params) > 1 {
+			break
+		}
+		filtered := make([]cloudscale.Volume, 0)
+		for _, vol := range volumes {
+			if vol.Tags[strings.TrimPrefix(key, "tag:")] == params.Get(key) {
+				filtered = append(filtered, vol)
+			}
+		}
+		return filtered, nil
+	}
+
+	return nil, fmt.Errorf("the fake client does not support the list parameters %s", params.Encode())
+}
+
+// page returns the volumes of the page selected by the page and page_size
+// parameters, or all of them if the fake does not paginate
+func (f volumeService) page(volumes []cloudscale.Volume, params url.Values) ([]cloudscale.Volume, error) {
+	if !f.paginateVolumes {
+		return volumes, nil
+	}
+	page, err := strconv.Atoi(params.Get("page"))
+	if err != nil || page < 1 {
+		return nil, &cloudscale.ErrorResponse{
+			StatusCode: http.StatusNotFound,
+			Message:    map[string]string{"detail": "Invalid page."},
+		}
+	}
+	pageSize, err := strconv.Atoi(params.Get("page_size"))
+	if err != nil || pageSize < 1 {
+		return nil, &cloudscale.ErrorResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    map[string]string{"page_size": "Invalid page size."},
+		}
+	}
+
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].UUID < volumes[j].UUID })
+	start := (page - 1) * pageSize
+	if start >= len(volumes) {
+		return []cloudscale.Volume{}, nil
+	}
+	end := start + pageSize
+	if end > len(volumes) {
+		end = len(volumes)
+	}
+	return volumes[start:end], nil
+}
+
+func extractParams(modifiers []cloudscale.ListRequestModifier) url.Values {
+	// undoing the cloudscale.WithNameFilter(volumeName) magic
+
+	modifierFunc := modifiers[0]
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	modifierFunc(req)
+	params, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		panic("unexpected error")
+	}
+	return params
+}
+
+func (f volumeService) Update(ctx context.Context, volumeID string, updateRequest *cloudscale.VolumeRequest) error {
+	if err := f.call(ctx, "volumes", "Update", volumeID); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return notFoundError()
+	}
+
+	if updateRequest.SizeGB != 0 {
+		// volumes can only be grown, like with the API
+		if updateRequest.SizeGB < vol.SizeGB {
+			return &cloudscale.ErrorResponse{
+				StatusCode: http.StatusBadRequest,
+				Message:    map[string]string{"size_gb": "Volumes cannot be shrunk"},
+			}
+		}
+		vol.SizeGB = updateRequest.SizeGB
+	}
+	if updateRequest.Tags != nil {
+		vol.Tags = updateRequest.Tags
+	}
+	if updateRequest.ServerUUIDs != nil {
+		return f.attach(vol, *updateRequest.ServerUUIDs)
+	}
+	return nil
+}
+
+// attach attaches the volume to the given servers, an empty list detaches
+// it; f.mu must be held
+func (f volumeService) attach(vol *cloudscale.Volume, serverUUIDs []string) error {
+	if len(serverUUIDs) > 1 {
+		return errors.New("multi attach is not implemented")
+	}
+	for _, serverUUID := range serverUUIDs {
+		if _, err := f.server(serverUUID); err != nil {
+			return err
+		}
+
+		if f.volumesPerServer(serverUUID) >= maxVolumesPerServer {
+			return &cloudscale.ErrorResponse{
+				StatusCode: http.StatusBadRequest,
+				Message:    map[string]string{"detail": "Due to internal limitations, it is currently not possible to attach more than 128 volumes"},
+			}
+		}
+	}
+
+	for _, serverUUID := range *vol.ServerUUIDs {
+		if server, ok := f.servers[serverUUID]; ok {
+			server.Volumes = removeVolumeStub(server.Volumes, vol.UUID)
+		}
+	}
+	for _, serverUUID := range serverUUIDs {
+		server := f.servers[serverUUID]
+		server.Volumes = append(server.Volumes, cloudscale.VolumeStub{
+			Type:       vol.Type,
+			UUID:       vol.UUID,
+			DevicePath: "/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_" + vol.UUID[:20],
+			SizeGB:     vol.SizeGB,
+		})
+	}
+
+	attached := append([]string{}, serverUUIDs...)
+	vol.ServerUUIDs = &attached
+	return nil
+}
+
+// volumesPerServer returns the number of volumes attached to the server;
+// f.mu must be held
+func (f volumeService) volumesPerServer(serverUUID string) int {
+	volumesCount := 0
+	for _, v := range f.volumes {
+		for _, uuid := range *v.ServerUUIDs {
+			if uuid == serverUUID {
+				volumesCount++
+			}
+		}
+	}
+	return volumesCount
+}
+
+func (f volumeService) Delete(ctx context.Context, volumeID string) error {
+	if err := f.call(ctx, "volumes", "Delete", volumeID); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if vol, ok := f.volumes[volumeID]; ok {
+		for _, serverUUID := range *vol.ServerUUIDs {
+			if server, ok := f.servers[serverUUID]; ok {
+				server.Volumes = removeVolumeStub(server.Volumes, volumeID)
+			}
+		}
+	}
+	delete(f.volumes, volumeID)
+	return nil
+}
+
+type serverService struct {
+	*backend
+}
+
+func (f serverService) Create(ctx context.Context, createRequest *cloudscale.ServerRequest) (*cloudscale.Server, error) {
+	panic("implement me")
+}
+
+func (f serverService) Get(ctx context.Context, serverID string) (*cloudscale.Server, error) {
+	if err := f.call(ctx, "servers", "Get", serverID); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	server, err := f.server(serverID)
+	if err != nil {
+		return nil, err
+	}
+	s := *server
+	s.Volumes = append([]cloudscale.VolumeStub{}, server.Volumes...)
+	return &s, nil
+}
+
+func (f serverService) Update(ctx context.Context, serverID string, updateRequest *cloudscale.ServerUpdateRequest) error {
+	panic("implement me")
+}
+
+func (f serverService) Delete(ctx context.Context, serverID string) error {
+	panic("implement me")
+}
+
+func (f serverService) List(ctx context.Context, modifiers ...cloudscale.ListRequestModifier) ([]cloudscale.Server, error) {
+	if err := f.call(ctx, "servers", "List", ""); err != nil {
+		return nil, err
+	}
+	if len(modifiers) > 0 {
+		return nil, errors.New("the fake client does not support server list modifiers")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var servers []cloudscale.Server
+	for _, server := range f.servers {
+		s := *server
+		s.Volumes = append([]cloudscale.VolumeStub{}, server.Volumes...)
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+func (f serverService) Reboot(ctx context.Context, serverID string) error {
+	panic("implement me")
+}
+
+func (f serverService) Start(ctx context.Context, serverID string) error {
+	panic("implement me")
+}
+
+func (f serverService) Stop(ctx context.Context, serverID string) error {
+	panic("implement me")
+}
+
+func notFoundError() *cloudscale.ErrorResponse {
+	return &cloudscale.ErrorResponse{
+		StatusCode: http.StatusNotFound,
+		Message:    map[string]string{"detail": "not found"},
+	}
+}
+
+func copyVolume(vol *cloudscale.Volume) *cloudscale.Volume {
+	v := *vol
+	serverUUIDs := append([]string{}, *vol.ServerUUIDs...)
+	v.ServerUUIDs = &serverUUIDs
+	return &v
+}
+
+func removeVolumeStub(stubs []cloudscale.VolumeStub, volumeID string) []cloudscale.VolumeStub {
+	var kept []cloudscale.VolumeStub
+	for _, stub := range stubs {
+		if stub.UUID != volumeID {
+			kept = append(kept, stub)
+		}
+	}
+	return kept
+}
+
+type regionService struct {
+	*backend
+}
+
+// List returns a single region with the zone of the fake
+func (f regionService) List(ctx context.Context) ([]cloudscale.Region, error) {
+	if err := f.call(ctx, "regions", "List", ""); err != nil {
+		return nil, err
+	}
+	return []cloudscale.Region{{Slug: "dev", Zones: []cloudscale.Zone{{Slug: Zone}}}}, nil
+}
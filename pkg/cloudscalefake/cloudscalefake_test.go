@@ -0,0 +1,161 @@
+package cloudscalefake
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttachDetach(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient(map[string]*cloudscale.Server{
+		"987654": {UUID: "987654"},
+	})
+
+	vol, err := client.Volumes.Create(ctx, &cloudscale.VolumeRequest{Name: "pvc-1", SizeGB: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, Zone, vol.Zone.Slug)
+	assert.Empty(t, *vol.ServerUUIDs)
+
+	err = client.Volumes.Update(ctx, vol.UUID, &cloudscale.VolumeRequest{ServerUUIDs: &[]string{"unknown"}})
+	assert.Error(t, err)
+
+	err = client.Volumes.Update(ctx, vol.UUID, &cloudscale.VolumeRequest{ServerUUIDs: &[]string{"987654"}})
+	assert.NoError(t, err)
+	server, err := client.Servers.Get(ctx, "987654")
+	assert.NoError(t, err)
+	assert.Len(t, server.Volumes, 1)
+	assert.Equal(t, vol.UUID, server.Volumes[0].UUID)
+
+	vol, err = client.Volumes.Get(ctx, vol.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"987654"}, *vol.ServerUUIDs)
+
+	err = client.Volumes.Update(ctx, vol.UUID, &cloudscale.VolumeRequest{ServerUUIDs: &[]string{}})
+	assert.NoError(t, err)
+	server, err = client.Servers.Get(ctx, "987654")
+	assert.NoError(t, err)
+	assert.Empty(t, server.Volumes)
+}
+
+func TestResize(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient(map[string]*cloudscale.Server{})
+
+	vol, err := client.Volumes.Create(ctx, &cloudscale.VolumeRequest{Name: "pvc-1", SizeGB: 5})
+	assert.NoError(t, err)
+
+	assert.NoError(t, client.Volumes.Update(ctx, vol.UUID, &cloudscale.VolumeRequest{SizeGB: 10}))
+	assert.Error(t, client.Volumes.Update(ctx, vol.UUID, &cloudscale.VolumeRequest{SizeGB: 2}))
+
+	vol, err = client.Volumes.Get(ctx, vol.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, vol.SizeGB)
+}
+
+func TestServerRegistration(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := NewClient(nil).Servers.Get(ctx, "node-2")
+	assert.Error(t, err)
+
+	server, err := NewClient(nil, WithServerRegistration()).Servers.Get(ctx, "node-2")
+	assert.NoError(t, err)
+	assert.Equal(t, Zone, server.Zone.Slug)
+}
+
+func TestRegions(t *testing.T) {
+	regions, err := NewClient(nil).Regions.List(context.Background())
+	assert.NoError(t, err)
+	if assert.Len(t, regions, 1) {
+		assert.Equal(t, []cloudscale.Zone{{Slug: Zone}}, regions[0].Zones)
+	}
+}
+
+func TestVolumePagination(t *testing.T) {
+	ctx := context.Background()
+	withPage := func(page, pageSize int) cloudscale.ListRequestModifier {
+		return func(r *http.Request) {
+			query := r.URL.Query()
+			query.Set("page", strconv.Itoa(page))
+			query.Set("page_size", strconv.Itoa(pageSize))
+			r.URL.RawQuery = query.Encode()
+		}
+	}
+
+	for _, paginate := range []bool{false, true} {
+		var opts []Option
+		if paginate {
+			opts = append(opts, WithVolumePagination())
+		}
+		client := NewClient(nil, opts...)
+		for i := 0; i < 5; i++ {
+			_, err := client.Volumes.Create(ctx, &cloudscale.VolumeRequest{Name: fmt.Sprintf("pvc-%d", i), SizeGB: 1})
+			assert.NoError(t, err)
+		}
+
+		first, err := client.Volumes.List(ctx, withPage(1, 2))
+		assert.NoError(t, err)
+		last, err := client.Volumes.List(ctx, withPage(3, 2))
+		assert.NoError(t, err)
+		beyond, err := client.Volumes.List(ctx, withPage(4, 2))
+		assert.NoError(t, err)
+
+		if !paginate {
+			// the parameters are ignored like by the API
+			assert.Len(t, first, 5)
+			continue
+		}
+		assert.Len(t, first, 2)
+		assert.Less(t, first[0].UUID, first[1].UUID)
+		assert.Len(t, last, 1)
+		assert.Empty(t, beyond)
+	}
+}
+
+func TestErrorInjection(t *testing.T) {
+	ctx := context.Background()
+	var calls []Call
+	client := NewClient(nil, WithErrorInjection(func(call Call) error {
+		calls = append(calls, call)
+		if call.Method == "Delete" {
+			return &cloudscale.ErrorResponse{StatusCode: 503}
+		}
+		return nil
+	}))
+
+	vol, err := client.Volumes.Create(ctx, &cloudscale.VolumeRequest{Name: "pvc-1", SizeGB: 1})
+	assert.NoError(t, err)
+	assert.Error(t, client.Volumes.Delete(ctx, vol.UUID))
+
+	// the failed call does not change the state
+	_, err = client.Volumes.Get(ctx, vol.UUID)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []Call{
+		{Service: "volumes", Method: "Create"},
+		{Service: "volumes", Method: "Delete", ID: vol.UUID},
+		{Service: "volumes", Method: "Get", ID: vol.UUID},
+	}, calls)
+}
+
+func TestLatency(t *testing.T) {
+	client := NewClient(nil, WithLatency(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := client.Volumes.List(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	client = NewClient(nil, WithLatency(10*time.Millisecond))
+	start := time.Now()
+	_, err = client.Volumes.List(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 10*time.Millisecond)
+}
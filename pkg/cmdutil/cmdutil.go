@@ -0,0 +1,78 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cmdutil provides the API clients shared by the command line tools
+// in cmd/.
+package cmdutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"golang.org/x/oauth2"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// NewCloudscaleClient returns a cloudscale.ch API client for the given
+// token, which defaults to $CLOUDSCALE_ACCESS_TOKEN.
+func NewCloudscaleClient(ctx context.Context, token, apiURL string) (*cloudscale.Client, error) {
+	if token == "" {
+		token = os.Getenv("CLOUDSCALE_ACCESS_TOKEN")
+	}
+	if token == "" {
+		return nil, errors.New("the cloudscale.ch access token must be set with --token or $CLOUDSCALE_ACCESS_TOKEN")
+	}
+	baseURL, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API URL %q: %v", apiURL, err)
+	}
+	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+	client := cloudscale.NewClient(oauth2.NewClient(ctx, tokenSource))
+	client.BaseURL = baseURL
+	return client, nil
+}
+
+// KubernetesConfig returns the config of the given kubeconfig, which
+// defaults to $KUBECONFIG, then ~/.kube/config.
+func KubernetesConfig(kubeconfig string) (*rest.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get the Kubernetes config: %v", err)
+	}
+	return config, nil
+}
+
+// NewKubernetesClient returns a Kubernetes client for the given kubeconfig;
+// see KubernetesConfig.
+func NewKubernetesClient(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := KubernetesConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create the Kubernetes client: %v", err)
+	}
+	return client, nil
+}
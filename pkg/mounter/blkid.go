@@ -0,0 +1,378 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mounter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// partitionTableSignature is returned by ProbeSignature for devices that
+// carry a partition table instead of a filesystem. It mirrors the value
+// mount-utils returns in that case, so that such devices are never treated
+// as unformatted.
+const partitionTableSignature = "unknown data, probably partitions"
+
+// unknownSignature is returned by getFilesystemType for devices on which
+// blkid found a signature without a type, so that they are never treated as
+// unformatted either.
+const unknownSignature = "unknown data"
+
+const (
+	extSuperblockOffset = 1024
+
+	// feature flags that are only used by ext4, see fs/ext4/ext4.h
+	ext4FeatureIncompatMask = 0x0040 | // extents
+		0x0080 | // 64bit
+		0x0100 | // mmp
+		0x0200 | // flex_bg
+		0x0400 | // ea_inode
+		0x1000 | // dirdata
+		0x2000 | // csum_seed
+		0x4000 | // largedir
+		0x8000 | // inline_data
+		0x10000 // encrypt
+	ext4FeatureROCompatMask = 0x0008 | // huge_file
+		0x0010 | // gdt_csum
+		0x0020 | // dir_nlink
+		0x0040 | // extra_isize
+		0x0400 // metadata_csum
+	ext3FeatureCompatHasJournal = 0x0004
+	ext4Feature64Bit            = 0x0080
+)
+
+// signature describes a magic value at a fixed offset identifying a filesystem
+type signature struct {
+	name   string
+	offset int64
+	magic  []byte
+}
+
+// signatures are checked in order, the first match wins. ext filesystems are
+// handled separately, as the type depends on the feature flags.
+var signatures = []signature{
+	{name: "crypto_LUKS", offset: 0, magic: []byte("LUKS\xba\xbe")},
+	{name: "xfs", offset: 0, magic: []byte("XFSB")},
+	{name: "btrfs", offset: 0x10040, magic: []byte("_BHRfS_M")},
+	{name: "swap", offset: 4096 - 10, magic: []byte("SWAPSPACE2")},
+	{name: "swap", offset: 4096 - 10, magic: []byte("SWAP-SPACE")},
+	{name: "LVM2_member", offset: 512 + 24, magic: []byte("LVM2 001")},
+	{name: "linux_raid_member", offset: 0, magic: []byte{0xfc, 0x4e, 0x2b, 0xa9}},
+	{name: "linux_raid_member", offset: 4096, magic: []byte{0xfc, 0x4e, 0x2b, 0xa9}},
+	{name: partitionTableSignature, offset: 512, magic: []byte("EFI PART")},
+}
+
+// blkidProbe probes the given device for the signatures ProbeSignature does
+// not know; replaced in tests
+var blkidProbe = probeWithBlkid
+
+// getFilesystemType returns the type of the filesystem on the given device or
+// an empty string if the device is not formatted. Devices without a signature
+// known to ProbeSignature, including every blank device, are probed with
+// blkid, so that the data of other filesystems and volume managers is never
+// taken for an empty device. blkid is therefore still required at runtime.
+func getFilesystemType(source string) (string, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return "", fmt.Errorf("checking filesystem type of %s failed: %v", source, err)
+	}
+	defer f.Close()
+
+	fsType, err := ProbeSignature(f)
+	if err != nil {
+		return "", fmt.Errorf("checking filesystem type of %s failed: %v", source, err)
+	}
+	if fsType != "" {
+		return fsType, nil
+	}
+
+	fsType, err = blkidProbe(source)
+	if err != nil {
+		return "", fmt.Errorf("checking filesystem type of %s failed: %v", source, err)
+	}
+	return fsType, nil
+}
+
+// probeWithBlkid returns the type of the signature blkid finds on the given
+// device, unknownSignature if the signature has no type, or an empty string
+// if blkid finds no signature at all.
+func probeWithBlkid(source string) (string, error) {
+	out, err := exec.Command("blkid", "-p", "-s", "TYPE", "-o", "value", source).CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+			// blkid exits with 2 if it found no signature
+			return "", nil
+		}
+		return "", fmt.Errorf("blkid failed: %v output: %q", err, string(out))
+	}
+
+	fsType := strings.TrimSpace(string(out))
+	if fsType == "" {
+		return unknownSignature, nil
+	}
+	return fsType, nil
+}
+
+// ProbeSignature reads the superblock signatures of the well-known
+// filesystems, LVM physical volumes and RAID members from the given device,
+// like blkid does. It returns an empty string if none of these signatures
+// was found, which does not mean that the device is empty; see
+// getFilesystemType.
+func ProbeSignature(r io.ReaderAt) (string, error) {
+	for _, sig := range signatures {
+		ok, err := hasMagic(r, sig.offset, sig.magic)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return sig.name, nil
+		}
+	}
+
+	extType, err := probeExt(r)
+	if err != nil || extType != "" {
+		return extType, err
+	}
+
+	// a dos partition table has a boot signature; ext filesystems checked
+	// above may carry one in their boot block as well
+	ok, err := hasMagic(r, 510, []byte{0x55, 0xaa})
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return partitionTableSignature, nil
+	}
+
+	return "", nil
+}
+
+// probeExt returns ext2, ext3 or ext4 depending on the features of the ext
+// superblock or an empty string if there is none
+func probeExt(r io.ReaderAt) (string, error) {
+	sb := make([]byte, 0x68)
+	if _, err := r.ReadAt(sb, extSuperblockOffset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if binary.LittleEndian.Uint16(sb[0x38:]) != 0xef53 {
+		return "", nil
+	}
+
+	compat := binary.LittleEndian.Uint32(sb[0x5c:])
+	incompat := binary.LittleEndian.Uint32(sb[0x60:])
+	roCompat := binary.LittleEndian.Uint32(sb[0x64:])
+
+	switch {
+	case incompat&ext4FeatureIncompatMask != 0 || roCompat&ext4FeatureROCompatMask != 0:
+		return "ext4", nil
+	case compat&ext3FeatureCompatHasJournal != 0:
+		return "ext3", nil
+	default:
+		return "ext2", nil
+	}
+}
+
+// xfsUUID returns the UUID of the xfs filesystem on the given device or nil if
+// the device does not carry an xfs filesystem
+func xfsUUID(source string) ([]byte, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return probeXFSUUID(f)
+}
+
+// FilesystemUUID returns the UUID of the ext or xfs filesystem on the given
+// device formatted like blkid does or an empty string for other filesystems
+func FilesystemUUID(r io.ReaderAt) (string, error) {
+	uuid, err := probeXFSUUID(r)
+	if err != nil {
+		return "", err
+	}
+
+	if uuid == nil {
+		ok, err := hasMagic(r, extSuperblockOffset+0x38, []byte{0x53, 0xef})
+		if err != nil || !ok {
+			return "", err
+		}
+		uuid = make([]byte, 16)
+		if _, err := r.ReadAt(uuid, extSuperblockOffset+0x68); err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]), nil
+}
+
+// ExtFilesystemSize returns the size of the ext filesystem on the given device
+// in bytes, as reported by dumpe2fs
+func ExtFilesystemSize(r io.ReaderAt) (int64, error) {
+	sb := make([]byte, 0x154)
+	if _, err := r.ReadAt(sb, extSuperblockOffset); err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint16(sb[0x38:]) != 0xef53 {
+		return 0, errors.New("no ext superblock found")
+	}
+
+	blocks := uint64(binary.LittleEndian.Uint32(sb[0x4:]))
+	if binary.LittleEndian.Uint32(sb[0x60:])&ext4Feature64Bit != 0 {
+		blocks |= uint64(binary.LittleEndian.Uint32(sb[0x150:])) << 32
+	}
+	blockSize := uint64(1024) << binary.LittleEndian.Uint32(sb[0x18:])
+	return int64(blocks * blockSize), nil
+}
+
+func probeXFSUUID(r io.ReaderAt) ([]byte, error) {
+	ok, err := hasMagic(r, 0, []byte("XFSB"))
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	// sb_uuid follows the magic, the block size and the block counts
+	uuid := make([]byte, 16)
+	if _, err := r.ReadAt(uuid, 32); err != nil {
+		return nil, err
+	}
+	return uuid, nil
+}
+
+func hasMagic(r io.ReaderAt, offset int64, magic []byte) (bool, error) {
+	buf := make([]byte, len(magic))
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		// devices smaller than the offset cannot carry the signature
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(buf, magic), nil
+}
+
+// incompleteFormat describes a signature left behind by an interrupted mkfs
+// or luksFormat. Such a device never held user data, so the signature can be
+// wiped safely before formatting the device again.
+type incompleteFormat struct {
+	reason string
+	offset int64
+	length int
+}
+
+const (
+	// sb_inprogress is set by mkfs.xfs until the filesystem is complete
+	xfsInProgressOffset = 126
+
+	luks1KeyslotsOffset = 208
+	luks1KeyslotSize    = 48
+	luks1KeyslotCount   = 8
+	luks1KeyEnabled     = 0x00ac71f3
+)
+
+// findIncompleteFormat returns the incomplete format on the given device or
+// nil if the device is empty or formatted completely.
+func findIncompleteFormat(source string) (*incompleteFormat, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("checking for incomplete format of %s failed: %v", source, err)
+	}
+	defer f.Close()
+
+	incomplete, err := probeIncompleteFormat(f)
+	if err != nil {
+		return nil, fmt.Errorf("checking for incomplete format of %s failed: %v", source, err)
+	}
+	return incomplete, nil
+}
+
+// probeIncompleteFormat detects xfs filesystems which are still marked as in
+// progress and luks1 headers without any enabled key slot. The data of the
+// latter can never be decrypted. luks2 headers are left alone, as they are
+// not created by the driver.
+func probeIncompleteFormat(r io.ReaderAt) (*incompleteFormat, error) {
+	ok, err := hasMagic(r, 0, []byte("XFSB"))
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		inProgress := make([]byte, 1)
+		if _, err := r.ReadAt(inProgress, xfsInProgressOffset); err != nil {
+			return nil, err
+		}
+		if inProgress[0] == 0 {
+			return nil, nil
+		}
+		return &incompleteFormat{reason: "xfs superblock is marked as in progress", offset: 0, length: 4}, nil
+	}
+
+	ok, err = hasMagic(r, 0, []byte("LUKS\xba\xbe\x00\x01"))
+	if err != nil || !ok {
+		return nil, err
+	}
+	keyslots := make([]byte, luks1KeyslotCount*luks1KeyslotSize)
+	if _, err := r.ReadAt(keyslots, luks1KeyslotsOffset); err != nil {
+		return nil, err
+	}
+	for i := 0; i < luks1KeyslotCount; i++ {
+		if binary.BigEndian.Uint32(keyslots[i*luks1KeyslotSize:]) == luks1KeyEnabled {
+			return nil, nil
+		}
+	}
+	return &incompleteFormat{reason: "luks header has no enabled key slot", offset: 0, length: 6}, nil
+}
+
+// wipeIncompleteFormat removes the signature of an incomplete format from the
+// given device, so that it is formatted from scratch.
+func wipeIncompleteFormat(source string, log *logrus.Entry) error {
+	incomplete, err := findIncompleteFormat(source)
+	if err != nil || incomplete == nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"source": source,
+		"reason": incomplete.reason,
+	}).Warn("wiping signature of an interrupted format")
+
+	f, err := os.OpenFile(source, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("wiping signature of %s failed: %v", source, err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt(make([]byte, incomplete.length), incomplete.offset); err != nil {
+		return fmt.Errorf("wiping signature of %s failed: %v", source, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("wiping signature of %s failed: %v", source, err)
+	}
+	return nil
+}
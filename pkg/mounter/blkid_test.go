@@ -0,0 +1,249 @@
+package mounter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newExtImage(compat, incompat, roCompat uint32) []byte {
+	img := make([]byte, 8192)
+	sb := img[extSuperblockOffset:]
+	binary.LittleEndian.PutUint16(sb[0x38:], 0xef53)
+	binary.LittleEndian.PutUint32(sb[0x5c:], compat)
+	binary.LittleEndian.PutUint32(sb[0x60:], incompat)
+	binary.LittleEndian.PutUint32(sb[0x64:], roCompat)
+	return img
+}
+
+func newImage(offset int, magic string) []byte {
+	img := make([]byte, 0x20000)
+	copy(img[offset:], magic)
+	return img
+}
+
+func withBootSignature(img []byte) []byte {
+	img[510], img[511] = 0x55, 0xaa
+	return img
+}
+
+// stubBlkid replaces the blkid fallback of getFilesystemType for the test
+func stubBlkid(t *testing.T, fsType string, err error) {
+	orig := blkidProbe
+	blkidProbe = func(string) (string, error) { return fsType, err }
+	t.Cleanup(func() { blkidProbe = orig })
+}
+
+func TestProbeSignature(t *testing.T) {
+	for name, tc := range map[string]struct {
+		image  []byte
+		fsType string
+	}{
+		"empty":        {image: make([]byte, 0x20000), fsType: ""},
+		"tiny":         {image: make([]byte, 16), fsType: ""},
+		"ext2":         {image: newExtImage(0, 0x2, 0), fsType: "ext2"},
+		"ext3":         {image: newExtImage(0x4, 0x2, 0x1), fsType: "ext3"},
+		"ext4":         {image: newExtImage(0x4, 0x2c2, 0x1), fsType: "ext4"},
+		"xfs":          {image: newImage(0, "XFSB"), fsType: "xfs"},
+		"btrfs":        {image: newImage(0x10040, "_BHRfS_M"), fsType: "btrfs"},
+		"luks":         {image: newImage(0, "LUKS\xba\xbe"), fsType: "crypto_LUKS"},
+		"swap":         {image: newImage(4086, "SWAPSPACE2"), fsType: "swap"},
+		"lvm2":         {image: newImage(512+24, "LVM2 001"), fsType: "LVM2_member"},
+		"md 1.2":       {image: newImage(4096, "\xfc\x4e\x2b\xa9"), fsType: "linux_raid_member"},
+		"gpt":          {image: newImage(512, "EFI PART"), fsType: partitionTableSignature},
+		"dos":          {image: newImage(510, "\x55\xaa"), fsType: partitionTableSignature},
+		"not ext":      {image: newImage(extSuperblockOffset+0x38, "\x53\xee"), fsType: ""},
+		"ext with mbr": {image: withBootSignature(newExtImage(0x4, 0x40, 0)), fsType: "ext4"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fsType, err := ProbeSignature(bytes.NewReader(tc.image))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.fsType, fsType)
+		})
+	}
+}
+
+func TestCheckFilesystemType(t *testing.T) {
+	stubBlkid(t, "", nil)
+	dir := t.TempDir()
+	device := filepath.Join(dir, "device")
+
+	assert.NoError(t, os.WriteFile(device, make([]byte, 8192), 0600))
+	assert.NoError(t, checkFilesystemType(device, "xfs"))
+
+	assert.NoError(t, os.WriteFile(device, newExtImage(0x4, 0x2, 0), 0600))
+	assert.NoError(t, checkFilesystemType(device, "ext4"))
+	assert.NoError(t, checkFilesystemType(device, "ext3"))
+
+	err := checkFilesystemType(device, "xfs")
+	if assert.IsType(t, &FilesystemMismatchError{}, err) {
+		assert.Equal(t, "ext3", err.(*FilesystemMismatchError).Existing)
+	}
+
+	assert.NoError(t, os.WriteFile(device, newImage(0, "XFSB"), 0600))
+	assert.IsType(t, &FilesystemMismatchError{}, checkFilesystemType(device, "ext4"))
+}
+
+func TestProbeXFSUUID(t *testing.T) {
+	img := newImage(0, "XFSB")
+	copy(img[32:], "0123456789abcdef")
+
+	uuid, err := probeXFSUUID(bytes.NewReader(img))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("0123456789abcdef"), uuid)
+
+	uuid, err = probeXFSUUID(bytes.NewReader(newExtImage(0, 0, 0)))
+	assert.NoError(t, err)
+	assert.Nil(t, uuid)
+}
+
+func newLuks1Image(enabledKeyslots ...int) []byte {
+	img := newImage(0, "LUKS\xba\xbe\x00\x01")
+	for i := 0; i < luks1KeyslotCount; i++ {
+		binary.BigEndian.PutUint32(img[luks1KeyslotsOffset+i*luks1KeyslotSize:], 0x0000dead)
+	}
+	for _, i := range enabledKeyslots {
+		binary.BigEndian.PutUint32(img[luks1KeyslotsOffset+i*luks1KeyslotSize:], luks1KeyEnabled)
+	}
+	return img
+}
+
+func TestProbeIncompleteFormat(t *testing.T) {
+	xfsInProgress := newImage(0, "XFSB")
+	xfsInProgress[xfsInProgressOffset] = 1
+
+	for name, tc := range map[string]struct {
+		image      []byte
+		incomplete bool
+	}{
+		"empty":                 {image: make([]byte, 0x20000)},
+		"ext4":                  {image: newExtImage(0x4, 0x2c2, 0x1)},
+		"xfs":                   {image: newImage(0, "XFSB")},
+		"xfs in progress":       {image: xfsInProgress, incomplete: true},
+		"luks1":                 {image: newLuks1Image(0)},
+		"luks1 last keyslot":    {image: newLuks1Image(7)},
+		"luks1 without keyslot": {image: newLuks1Image(), incomplete: true},
+		"luks2":                 {image: newImage(0, "LUKS\xba\xbe\x00\x02")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			incomplete, err := probeIncompleteFormat(bytes.NewReader(tc.image))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.incomplete, incomplete != nil)
+		})
+	}
+}
+
+func TestUnknownSignatureIsFormatted(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "device")
+	log := logrus.New().WithField("test_enabled", true)
+	assert.NoError(t, os.WriteFile(device, make([]byte, 8192), 0600))
+
+	// signatures which are only known to blkid are never formatted over
+	stubBlkid(t, "zfs_member", nil)
+	formatted, err := isVolumeFormatted(device, log)
+	assert.NoError(t, err)
+	assert.True(t, formatted)
+	err = checkFilesystemType(device, "ext4")
+	if assert.IsType(t, &FilesystemMismatchError{}, err) {
+		assert.Equal(t, "zfs_member", err.(*FilesystemMismatchError).Existing)
+	}
+
+	stubBlkid(t, "", errors.New("blkid not found"))
+	_, err = isVolumeFormatted(device, log)
+	assert.Error(t, err)
+
+	stubBlkid(t, "", nil)
+	formatted, err = isVolumeFormatted(device, log)
+	assert.NoError(t, err)
+	assert.False(t, formatted)
+}
+
+func TestProbeWithBlkid(t *testing.T) {
+	if _, err := exec.LookPath("blkid"); err != nil {
+		t.Skip("blkid is not installed")
+	}
+	device := filepath.Join(t.TempDir(), "device")
+
+	assert.NoError(t, os.WriteFile(device, make([]byte, 0x20000), 0600))
+	fsType, err := probeWithBlkid(device)
+	assert.NoError(t, err)
+	assert.Equal(t, "", fsType)
+
+	// a squashfs superblock, which ProbeSignature does not know
+	img := make([]byte, 0x20000)
+	copy(img, "hsqs")
+	binary.LittleEndian.PutUint32(img[12:], 1<<17) // block size
+	binary.LittleEndian.PutUint16(img[22:], 17)    // block log
+	binary.LittleEndian.PutUint16(img[28:], 4)     // major version
+	binary.LittleEndian.PutUint64(img[40:], 0x20000)
+	assert.NoError(t, os.WriteFile(device, img, 0600))
+	fsType, err = ProbeSignature(bytes.NewReader(img))
+	assert.NoError(t, err)
+	assert.Equal(t, "", fsType)
+	fsType, err = probeWithBlkid(device)
+	assert.NoError(t, err)
+	assert.Equal(t, "squashfs", fsType)
+}
+
+func TestWipeIncompleteFormat(t *testing.T) {
+	stubBlkid(t, "", nil)
+	device := filepath.Join(t.TempDir(), "device")
+	log := logrus.New().WithField("test_enabled", true)
+
+	assert.NoError(t, os.WriteFile(device, newLuks1Image(), 0600))
+	assert.NoError(t, wipeIncompleteFormat(device, log))
+	fsType, err := getFilesystemType(device)
+	assert.NoError(t, err)
+	assert.Equal(t, "", fsType)
+
+	assert.NoError(t, os.WriteFile(device, newLuks1Image(1), 0600))
+	assert.NoError(t, wipeIncompleteFormat(device, log))
+	fsType, err = getFilesystemType(device)
+	assert.NoError(t, err)
+	assert.Equal(t, "crypto_LUKS", fsType)
+}
+
+func TestFilesystemUUID(t *testing.T) {
+	ext := newExtImage(0, 0, 0)
+	copy(ext[extSuperblockOffset+0x68:], "\x01\x23\x45\x67\x89\xab\xcd\xef\x01\x23\x45\x67\x89\xab\xcd\xef")
+	uuid, err := FilesystemUUID(bytes.NewReader(ext))
+	assert.NoError(t, err)
+	assert.Equal(t, "01234567-89ab-cdef-0123-456789abcdef", uuid)
+
+	xfs := newImage(0, "XFSB")
+	copy(xfs[32:], "\xfe\xdc\xba\x98\x76\x54\x32\x10\xfe\xdc\xba\x98\x76\x54\x32\x10")
+	uuid, err = FilesystemUUID(bytes.NewReader(xfs))
+	assert.NoError(t, err)
+	assert.Equal(t, "fedcba98-7654-3210-fedc-ba9876543210", uuid)
+
+	uuid, err = FilesystemUUID(bytes.NewReader(newImage(0x10040, "_BHRfS_M")))
+	assert.NoError(t, err)
+	assert.Equal(t, "", uuid)
+}
+
+func TestExtFilesystemSize(t *testing.T) {
+	img := newExtImage(0, 0, 0)
+	binary.LittleEndian.PutUint32(img[extSuperblockOffset+0x4:], 1310720)
+	binary.LittleEndian.PutUint32(img[extSuperblockOffset+0x18:], 2)
+	size, err := ExtFilesystemSize(bytes.NewReader(img))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5*(1<<30)), size)
+
+	img = newExtImage(0, ext4Feature64Bit, 0)
+	binary.LittleEndian.PutUint32(img[extSuperblockOffset+0x4:], 0)
+	binary.LittleEndian.PutUint32(img[extSuperblockOffset+0x150:], 1)
+	binary.LittleEndian.PutUint32(img[extSuperblockOffset+0x18:], 2)
+	size, err = ExtFilesystemSize(bytes.NewReader(img))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<32)*4096, size)
+
+	_, err = ExtFilesystemSize(bytes.NewReader(newImage(0, "XFSB")))
+	assert.Error(t, err)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mounter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// VolumeSerials maps the resolved device paths in the given by-id directory
+// to the serials of the cloudscale.ch volumes they belong to, which are the
+// first 20 characters of the volume UUIDs.
+func VolumeSerials(dir string) map[string]string {
+	serials := map[string]string{}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return serials
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, "nvme-") {
+			name = nvmeNamespaceSuffixRe.ReplaceAllString(name, "")
+		}
+		if len(name) < 20 {
+			continue
+		}
+		serial := name[len(name)-20:]
+		if !isVolumeSerial(serial) {
+			continue
+		}
+
+		device, err := filepath.EvalSymlinks(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		serials[device] = serial
+	}
+	return serials
+}
+
+// isVolumeSerial returns true if the serial looks like the first 20
+// characters of a UUID, e.g. 2f2e7b8a-4b5f-4d9c-9
+func isVolumeSerial(serial string) bool {
+	if len(serial) != 20 {
+		return false
+	}
+	for i, c := range serial {
+		switch i {
+		case 8, 13, 18:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdef", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// BackingDevices returns the devices the given device is built on. For
+// device mapper devices, these are the slaves in sysfs (which might not
+// exist anymore), for all other devices it is the device itself.
+func BackingDevices(sysBlockPath, device string) []string {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		// the device node is gone
+		return []string{device}
+	}
+
+	slaves, err := ioutil.ReadDir(filepath.Join(sysBlockPath, filepath.Base(resolved), "slaves"))
+	if err != nil || len(slaves) == 0 {
+		return []string{resolved}
+	}
+
+	var devices []string
+	for _, slave := range slaves {
+		devices = append(devices, "/dev/"+slave.Name())
+	}
+	return devices
+}
+
+// DeviceSize returns the size of the given block device in bytes
+func DeviceSize(device string) (int64, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return f.Seek(0, io.SeekEnd)
+}
+
+// blkdiscard discards all blocks of the given device
+func blkdiscard(ctx context.Context, device string) error {
+	out, err := exec.CommandContext(ctx, "blkdiscard", device).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("blkdiscard failed: %v cmd: 'blkdiscard %s' output: %q", err, device, string(out))
+	}
+	return nil
+}
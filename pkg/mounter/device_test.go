@@ -0,0 +1,37 @@
+package mounter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsVolumeSerial(t *testing.T) {
+	assert.True(t, isVolumeSerial("2f2e7b8a-4b5f-4d9c-9"))
+	assert.False(t, isVolumeSerial("2f2e7b8a-4b5f-4d9c-"))
+	assert.False(t, isVolumeSerial("2f2e7b8a_4b5f-4d9c-9"))
+	assert.False(t, isVolumeSerial("QEMU_QEMU_HARDDISK_1"))
+}
+
+func TestVolumeSerials(t *testing.T) {
+	dir := t.TempDir()
+	devices := t.TempDir()
+
+	for link, device := range map[string]string{
+		"scsi-0QEMU_QEMU_HARDDISK_2f2e7b8a-4b5f-4d9c-9":       "sdb",
+		"scsi-0QEMU_QEMU_HARDDISK_2f2e7b8a-4b5f-4d9c-9-part1": "sdb1",
+		"nvme-Linux_6f5c1e4d-8a2b-4c3d-a_1":                   "nvme0n1",
+		"scsi-0QEMU_QEMU_HARDDISK_drive-scsi0":                "sda",
+	} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(devices, device), nil, 0644))
+		assert.NoError(t, os.Symlink(filepath.Join(devices, device), filepath.Join(dir, link)))
+	}
+
+	assert.Equal(t, map[string]string{
+		filepath.Join(devices, "sdb"):     "2f2e7b8a-4b5f-4d9c-9",
+		filepath.Join(devices, "nvme0n1"): "6f5c1e4d-8a2b-4c3d-a",
+	}, VolumeSerials(dir))
+}
@@ -0,0 +1,159 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mounter
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/mount-utils"
+)
+
+const gib = 1 << 30
+
+// Fake is a Mounter for tests, which keeps track of the mounts in memory
+// without touching any device. Every device is reported as formatted, healthy
+// and large enough.
+type Fake struct {
+	mu      sync.Mutex
+	mounted map[string]string // target to source
+}
+
+var _ Mounter = &Fake{}
+
+// NewFake returns a fake mounter without any mounts.
+func NewFake() *Fake {
+	return &Fake{mounted: map[string]string{}}
+}
+
+// Mounts returns the current mounts as a map of the targets to their
+// sources.
+func (f *Fake) Mounts() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mounts := make(map[string]string, len(f.mounted))
+	for target, source := range f.mounted {
+		mounts[target] = source
+	}
+	return mounts
+}
+
+func (f *Fake) VerifyDevice(source, volumeID string, sizeBytes int64) error {
+	return nil
+}
+
+func (f *Fake) Format(_ context.Context, source string, fsType string, luksContext LuksContext, mkfsOptions ...string) error {
+	return nil
+}
+
+func (f *Fake) Discard(_ context.Context, source string) error {
+	return nil
+}
+
+func (f *Fake) Erase(_ context.Context, source, mode string) error {
+	return nil
+}
+
+func (f *Fake) Mount(_ context.Context, source string, target string, fsType string, luksContext LuksContext, options ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.mounted == nil {
+		f.mounted = map[string]string{}
+	}
+	f.mounted[target] = source
+	return nil
+}
+
+func (f *Fake) Unmount(_ context.Context, target string, luksContext LuksContext) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.mounted, target)
+	return nil
+}
+
+func (f *Fake) CloseLuksMapping(_ context.Context, volumeID string) error {
+	return nil
+}
+
+func (f *Fake) GetDeviceName(_ mount.Interface, mountPath string) (string, error) {
+	if mounted, _ := f.IsMounted(mountPath); mounted {
+		return "/mnt/sda1", nil
+	}
+	return "", nil
+}
+
+func (f *Fake) FindAbsoluteDeviceByIDPath(volumeName string) (string, error) {
+	return "/dev/sdb", nil
+}
+
+func (f *Fake) IsFormatted(_ context.Context, source string, luksContext LuksContext) (bool, error) {
+	return true, nil
+}
+
+func (f *Fake) IsMounted(target string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.mounted[target]
+	return ok, nil
+}
+
+func (f *Fake) GetStatistics(_ context.Context, volumePath string) (VolumeStatistics, error) {
+	return VolumeStatistics{
+		AvailableBytes: 3 * gib,
+		TotalBytes:     10 * gib,
+		UsedBytes:      7 * gib,
+
+		AvailableInodes: 3000,
+		TotalInodes:     10000,
+		UsedInodes:      7000,
+	}, nil
+}
+
+func (f *Fake) SetOwnership(target string, uid, gid int, mode os.FileMode) error {
+	return nil
+}
+
+func (f *Fake) SetVolumeMountGroup(_ context.Context, target string, gid int) error {
+	return nil
+}
+
+func (f *Fake) GetVolumeCondition(volumePath, stagingTargetPath string, readOnly bool) (string, error) {
+	return "", nil
+}
+
+func (f *Fake) HasRequiredSize(_ context.Context, log *logrus.Entry, path string, requiredSize int64) (bool, error) {
+	return true, nil
+}
+
+func (f *Fake) ResizeFilesystem(_ context.Context, devicePath, mountPath string) error {
+	return nil
+}
+
+func (f *Fake) FinalizeVolumeAttachmentAndFindPath(_ context.Context, logger *logrus.Entry, target string) (*string, error) {
+	path := "SomePath"
+	return &path, nil
+}
+
+func (f *Fake) IsBlockDevice(volumePath string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,622 @@
+/*
+Copyright 2019 linkyard ag
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mounter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// redacted replaces the luks key when logging luks contexts
+const redacted = "[REDACTED]"
+
+// cryptsetup exits with these codes if no key slot matches the passphrase and
+// if the device is in use, see the return codes in cryptsetup(8)
+const (
+	cryptsetupExitWrongPassphrase = 2
+	cryptsetupExitBusy            = 5
+)
+
+// cryptsetupAttempts and cryptsetupBackoff bound the retries of cryptsetup
+// commands failing as the device is busy, e.g. while udev still processes it
+var (
+	cryptsetupAttempts = 5
+	cryptsetupBackoff  = 500 * time.Millisecond
+)
+
+// luksMappingDir is the directory of the device mapper devices, in which
+// luksOpen looks for mappings which are open already
+var luksMappingDir = "/dev/mapper"
+
+// CryptsetupError is a failed cryptsetup command
+type CryptsetupError struct {
+	Action   string
+	Args     []string
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *CryptsetupError) Error() string {
+	return fmt.Sprintf("cryptsetup %s failed: %v cmd: 'cryptsetup %s' stderr: %q",
+		e.Action, e.Err, strings.Join(e.Args, " "), e.Stderr)
+}
+
+func (e *CryptsetupError) Unwrap() error {
+	return e.Err
+}
+
+// WrongPassphrase returns true if the key does not open the luks volume,
+// which is not resolved by retrying
+func (e *CryptsetupError) WrongPassphrase() bool {
+	return e.ExitCode == cryptsetupExitWrongPassphrase ||
+		strings.Contains(e.Stderr, "No key available with this passphrase")
+}
+
+// Busy returns true if the device is in use, which is usually resolved by
+// retrying
+func (e *CryptsetupError) Busy() bool {
+	stderr := strings.ToLower(e.Stderr)
+	return e.ExitCode == cryptsetupExitBusy ||
+		strings.Contains(stderr, "device or resource busy") ||
+		strings.Contains(stderr, "is in use")
+}
+
+// VolumeLifecycle is the CSI call a luks context is created for
+type VolumeLifecycle string
+
+const (
+	VolumeLifecycleNodeStageVolume     VolumeLifecycle = "NodeStageVolume"
+	VolumeLifecycleNodePublishVolume   VolumeLifecycle = "NodePublishVolume"
+	VolumeLifecycleNodeUnstageVolume   VolumeLifecycle = "NodeUnstageVolume"
+	VolumeLifecycleNodeUnpublishVolume VolumeLifecycle = "NodeUnpublishVolume"
+)
+
+// LuksContext describes the luks encryption of a volume
+type LuksContext struct {
+	EncryptionEnabled bool
+	EncryptionKey     string
+	EncryptionCipher  string
+	EncryptionKeySize string
+	VolumeName        string
+	VolumeLifecycle   VolumeLifecycle
+	// ReadOnly opens the luks mapping read-only
+	ReadOnly bool
+}
+
+// Validate returns an error if the encryption is enabled, but not all of its
+// parameters are set
+func (ctx *LuksContext) Validate() error {
+	if !ctx.EncryptionEnabled {
+		return nil
+	}
+
+	var appendFn = func(x string, xs string) string {
+		if xs != "" {
+			xs += "; "
+		}
+		xs += x
+		return xs
+	}
+
+	errorMsg := ""
+	if ctx.VolumeName == "" {
+		errorMsg = appendFn("no volume name provided", errorMsg)
+	}
+	if ctx.EncryptionKey == "" {
+		errorMsg = appendFn("no encryption key provided", errorMsg)
+	}
+	if ctx.EncryptionCipher == "" {
+		errorMsg = appendFn("no encryption cipher provided", errorMsg)
+	}
+	if ctx.EncryptionKeySize == "" {
+		errorMsg = appendFn("no encryption key size provided", errorMsg)
+	}
+	if errorMsg == "" {
+		return nil
+	}
+	return errors.New(errorMsg)
+}
+
+// Redacted returns a copy of the luks context without the key
+func (ctx LuksContext) Redacted() LuksContext {
+	if ctx.EncryptionKey != "" {
+		ctx.EncryptionKey = redacted
+	}
+	return ctx
+}
+
+// String formats the luks context without the key
+func (ctx LuksContext) String() string {
+	r := ctx.Redacted()
+	return fmt.Sprintf("{EncryptionEnabled:%t EncryptionKey:%s EncryptionCipher:%s EncryptionKeySize:%s VolumeName:%s VolumeLifecycle:%s ReadOnly:%t}",
+		r.EncryptionEnabled, r.EncryptionKey, r.EncryptionCipher, r.EncryptionKeySize, r.VolumeName, r.VolumeLifecycle, r.ReadOnly)
+}
+
+func luksFormat(ctx context.Context, source string, mkfsCmd string, mkfsArgs []string, luksContext LuksContext, log *logrus.Entry) error {
+	filename, err := writeLuksKey(ctx, luksContext.EncryptionKey, log)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		e := os.Remove(filename)
+		if e != nil {
+			log.Errorf("cannot delete temporary file %s: %s", filename, e.Error())
+		}
+	}()
+
+	// a luks header without enabled key slots is left behind if luksFormat
+	// was interrupted
+	if err := wipeIncompleteFormat(source, log); err != nil {
+		return err
+	}
+
+	isLuks, err := isLuks(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	if isLuks {
+		// only the filesystem is missing, luksOpen fails if the header was
+		// created with a different key
+		log.WithField("source", source).Warn("luks header exists already, only formatting the filesystem")
+	} else {
+		// initialize the luks partition
+		err := runCryptsetup(ctx, log, "luksFormat",
+			"-v",
+			"--type=luks1",
+			"--batch-mode",
+			"--cipher", luksContext.EncryptionCipher,
+			"--key-size", luksContext.EncryptionKeySize,
+			"--key-file", filename,
+			"luksFormat", source,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// format the disk with the desired filesystem
+
+	// open the luks partition and set up a mapping
+	opened, err := luksOpen(ctx, source, filename, luksContext, log)
+	if err != nil {
+		return err
+	}
+	if opened {
+		defer func() {
+			// the mapping is closed even if the context is done already
+			e := LuksClose(context.Background(), luksContext.VolumeName, log)
+			if e != nil {
+				log.Errorf("cannot close luks device: %s", e.Error())
+			}
+		}()
+	}
+
+	// mkfs might have been interrupted as well
+	mapping := "/dev/mapper/" + luksContext.VolumeName
+	if err := wipeIncompleteFormat(mapping, log); err != nil {
+		return err
+	}
+	if isLuks {
+		// never format over data in a luks volume which existed already
+		fsType, err := getFilesystemType(mapping)
+		if err != nil {
+			return err
+		}
+		if fsType != "" {
+			return fmt.Errorf("luks volume %s carries %q already, refusing to format it", source, fsType)
+		}
+	}
+
+	// replace the source volume with the mapped one in the arguments to mkfs
+	mkfsNewArgs := make([]string, len(mkfsArgs))
+	for i, elem := range mkfsArgs {
+		if elem != source {
+			mkfsNewArgs[i] = elem
+		} else {
+			mkfsArgs[i] = "/dev/mapper/" + luksContext.VolumeName
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"cmd":  mkfsCmd,
+		"args": mkfsArgs,
+	}).Info("executing format command")
+
+	out, err := exec.CommandContext(ctx, mkfsCmd, mkfsArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("formatting disk failed: %v cmd: '%s %s' output: %q",
+			err, mkfsCmd, strings.Join(mkfsArgs, " "), string(out))
+	}
+
+	return nil
+}
+
+// prepares a luks-encrypted volume for mounting and returns the path of the mapped volume
+func luksPrepareMount(ctx context.Context, source string, luksContext LuksContext, log *logrus.Entry) (string, error) {
+	filename, err := writeLuksKey(ctx, luksContext.EncryptionKey, log)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		e := os.Remove(filename)
+		if e != nil {
+			log.Errorf("cannot delete temporary file %s: %s", filename, e.Error())
+		}
+	}()
+
+	_, err = luksOpen(ctx, source, filename, luksContext, log)
+	if err != nil {
+		return "", err
+	}
+	return "/dev/mapper/" + luksContext.VolumeName, nil
+}
+
+// LuksClose closes the given luks mapping
+func LuksClose(ctx context.Context, volume string, log *logrus.Entry) error {
+	return runCryptsetup(ctx, log, "close", "--batch-mode", "close", volume)
+}
+
+// LuksHeaderBackup writes a backup of the luks header of the given device to
+// the given file, which must not exist yet
+func LuksHeaderBackup(ctx context.Context, device, file string, log *logrus.Entry) error {
+	isLuks, err := isLuks(ctx, device)
+	if err != nil {
+		return err
+	}
+	if !isLuks {
+		return fmt.Errorf("device %s is not a luks volume", device)
+	}
+	return runCryptsetup(ctx, log, "luksHeaderBackup", "--batch-mode", "luksHeaderBackup", device, "--header-backup-file", file)
+}
+
+// runCryptsetup runs cryptsetup with the given arguments and retries it with
+// backoff while the device is busy. It fails with a *CryptsetupError.
+func runCryptsetup(ctx context.Context, log *logrus.Entry, action string, cryptsetupArgs ...string) error {
+	cryptsetupCmd, err := getCryptsetupCmd()
+	if err != nil {
+		return err
+	}
+
+	return retryBusy(ctx, log, func() error {
+		log.WithFields(logrus.Fields{
+			"cmd":  cryptsetupCmd,
+			"args": cryptsetupArgs,
+		}).Infof("executing cryptsetup %s command", action)
+
+		return execCryptsetup(exec.CommandContext(ctx, cryptsetupCmd, cryptsetupArgs...), action, cryptsetupArgs)
+	})
+}
+
+// execCryptsetup runs the given cryptsetup command and returns a
+// *CryptsetupError with its stderr if it fails
+func execCryptsetup(cmd *exec.Cmd, action string, cryptsetupArgs []string) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		cryptsetupErr := &CryptsetupError{
+			Action:   action,
+			Args:     cryptsetupArgs,
+			ExitCode: -1,
+			Stderr:   strings.TrimSpace(stderr.String()),
+			Err:      err,
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			cryptsetupErr.ExitCode = exitErr.ExitCode()
+		}
+		return cryptsetupErr
+	}
+	return nil
+}
+
+// retryBusy calls run until it does not fail with a busy device, at most
+// cryptsetupAttempts times
+func retryBusy(ctx context.Context, log *logrus.Entry, run func() error) error {
+	backoff := cryptsetupBackoff
+	for attempt := 1; ; attempt++ {
+		err := run()
+		var cryptsetupErr *CryptsetupError
+		if err == nil || !errors.As(err, &cryptsetupErr) || !cryptsetupErr.Busy() || attempt >= cryptsetupAttempts {
+			return err
+		}
+
+		log.WithError(err).WithFields(logrus.Fields{
+			"attempt": attempt,
+			"backoff": backoff,
+		}).Warn("device is busy, retrying cryptsetup")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// destroys all keyslots of the luks volume on the given device, which renders
+// the data on it inaccessible
+func luksErase(ctx context.Context, device string, log *logrus.Entry) error {
+	isLuks, err := isLuks(ctx, device)
+	if err != nil {
+		return err
+	}
+	if !isLuks {
+		return fmt.Errorf("device %s is not a luks volume", device)
+	}
+
+	return runCryptsetup(ctx, log, "erase", "--batch-mode", "erase", device)
+}
+
+// checks if the given volume is formatted by checking if it carries a complete
+// luks header. The volume is only reported as unformatted despite its header if
+// the opened luks volume provably carries no signature at all, which is the
+// case if mkfs was interrupted after luksFormat.
+func isLuksVolumeFormatted(ctx context.Context, volume string, luksContext LuksContext, log *logrus.Entry) (bool, error) {
+	isLuks, err := isLuks(ctx, volume)
+	if err != nil {
+		return false, err
+	}
+	if !isLuks {
+		return false, nil
+	}
+
+	incomplete, err := findIncompleteFormat(volume)
+	if err != nil {
+		return false, err
+	}
+	if incomplete != nil {
+		log.WithFields(logrus.Fields{
+			"source": volume,
+			"reason": incomplete.reason,
+		}).Warn("luks volume is only partially formatted")
+		return false, nil
+	}
+
+	filename, err := writeLuksKey(ctx, luksContext.EncryptionKey, log)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		e := os.Remove(filename)
+		if e != nil {
+			log.Errorf("cannot delete temporary file %s: %s", filename, e.Error())
+		}
+	}()
+
+	// a mapping which was open already belongs to the staging mount, which
+	// keeps it busy, so it is left open
+	opened, err := luksOpen(ctx, volume, filename, luksContext, log)
+	if err != nil {
+		return false, err
+	}
+	if opened {
+		defer func() {
+			// the mapping is closed even if the context is done already
+			e := LuksClose(context.Background(), luksContext.VolumeName, log)
+			if e != nil {
+				log.Errorf("cannot close luks device: %s", e.Error())
+			}
+		}()
+	}
+
+	// getFilesystemType falls back to blkid for the signatures it does not
+	// know, so an empty type means that there is no data on the volume
+	mapping := "/dev/mapper/" + luksContext.VolumeName
+	fsType, err := getFilesystemType(mapping)
+	if err != nil {
+		return false, err
+	}
+	if fsType == "" {
+		log.WithField("source", volume).Warn("luks volume carries no filesystem, mkfs was interrupted")
+		return false, nil
+	}
+
+	incomplete, err = findIncompleteFormat(mapping)
+	if err != nil {
+		return false, err
+	}
+	if incomplete != nil {
+		log.WithFields(logrus.Fields{
+			"source": volume,
+			"reason": incomplete.reason,
+		}).Warn("filesystem of luks volume is only partially formatted")
+		return false, nil
+	}
+	return true, nil
+}
+
+// luksOpen opens the luks volume and returns true if it opened the mapping,
+// or false if the mapping was open already, e.g. because the volume is
+// mounted. Only the caller which opened the mapping may close it again.
+func luksOpen(ctx context.Context, volume string, keyFile string, luksContext LuksContext, log *logrus.Entry) (bool, error) {
+	// check if the luks volume is already open
+	if _, err := os.Stat(filepath.Join(luksMappingDir, luksContext.VolumeName)); !os.IsNotExist(err) {
+		log.WithFields(logrus.Fields{
+			"volume": volume,
+		}).Info("luks volume is already open")
+		return false, nil
+	}
+
+	cryptsetupArgs := []string{
+		"--batch-mode",
+		"luksOpen",
+		"--key-file", keyFile,
+	}
+	if luksContext.ReadOnly {
+		cryptsetupArgs = append(cryptsetupArgs, "--readonly")
+	}
+	cryptsetupArgs = append(cryptsetupArgs, volume, luksContext.VolumeName)
+	if err := runCryptsetup(ctx, log, "luksOpen", cryptsetupArgs...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// LuksResize runs cryptsetup resize for a given volume (/dev/mapper/pvc-xyz)
+func LuksResize(ctx context.Context, volume string) error {
+	cryptsetupCmd, err := getCryptsetupCmd()
+	if err != nil {
+		return err
+	}
+	cryptsetupArgs := []string{"--batch-mode", "resize", volume}
+
+	_, err = exec.CommandContext(ctx, cryptsetupCmd, cryptsetupArgs...).CombinedOutput()
+	return err
+}
+
+// runs cryptsetup isLuks for a given volume
+func isLuks(ctx context.Context, volume string) (bool, error) {
+	cryptsetupCmd, err := getCryptsetupCmd()
+	if err != nil {
+		return false, err
+	}
+	cryptsetupArgs := []string{"--batch-mode", "isLuks", volume}
+
+	// cryptsetup isLuks exits with code 0 if the target is a luks volume; otherwise it returns
+	// a non-zero exit code which exec.Command interprets as an error
+	_, err = exec.CommandContext(ctx, cryptsetupCmd, cryptsetupArgs...).CombinedOutput()
+	if err != nil {
+		// the command was killed, which doesn't tell anything about the
+		// volume
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return false, ctxErr
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// IsLuksMapping checks if a given mapping under /dev/mapper is a luks volume
+func IsLuksMapping(ctx context.Context, volume string) (bool, string, error) {
+	if strings.HasPrefix(volume, "/dev/mapper/") {
+		mappingName := volume[len("/dev/mapper/"):]
+		cryptsetupCmd, err := getCryptsetupCmd()
+		if err != nil {
+			return false, mappingName, err
+		}
+		cryptsetupArgs := []string{"status", mappingName}
+
+		out, err := exec.CommandContext(ctx, cryptsetupCmd, cryptsetupArgs...).CombinedOutput()
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return false, mappingName, ctxErr
+			}
+			return false, mappingName, nil
+		}
+		for _, statusLine := range strings.Split(string(out), "\n") {
+			if strings.Contains(statusLine, "type:") {
+				if strings.Contains(strings.ToLower(statusLine), "luks") {
+					return true, mappingName, nil
+				}
+				return false, mappingName, nil
+			}
+		}
+
+	}
+	return false, "", nil
+}
+
+// LuksStatus returns the fields of cryptsetup status for the given luks mapping, e.g.
+// type, cipher, keysize and device
+func LuksStatus(ctx context.Context, mapping string) (map[string]string, error) {
+	cryptsetupCmd, err := getCryptsetupCmd()
+	if err != nil {
+		return nil, err
+	}
+	cryptsetupArgs := []string{"status", mapping}
+
+	out, err := exec.CommandContext(ctx, cryptsetupCmd, cryptsetupArgs...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("cryptsetup status failed: %v cmd: '%s %s' output: %q",
+			err, cryptsetupCmd, strings.Join(cryptsetupArgs, " "), string(out))
+	}
+	return parseLuksStatus(string(out)), nil
+}
+
+func parseLuksStatus(out string) map[string]string {
+	status := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(line, " ") {
+			continue
+		}
+		status[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return status
+}
+
+// FindLuksMappingForDevice finds the name of the luks mapping (e.g. pvc-xyz) that is opened on top of the given
+// device (e.g. /dev/sdb); returns an empty string if the device is not held by a luks mapping
+func FindLuksMappingForDevice(device string) (string, error) {
+	// cryptsetup sets the uuid of luks mappings to CRYPT-LUKS1-... or CRYPT-LUKS2-...
+	return findDeviceMapperHolder(device, "CRYPT-LUKS")
+}
+
+func getCryptsetupCmd() (string, error) {
+	cryptsetupCmd := "cryptsetup"
+	_, err := exec.LookPath(cryptsetupCmd)
+	if err != nil {
+		if err == exec.ErrNotFound {
+			return "", fmt.Errorf("%q executable not found in $PATH", cryptsetupCmd)
+		}
+		return "", err
+	}
+	return cryptsetupCmd, nil
+}
+
+// writes the given luks encryption key to a temporary file and returns the name of the temporary
+// file
+func writeLuksKey(ctx context.Context, key string, log *logrus.Entry) (string, error) {
+	if !checkTmpFs(ctx, "/tmp") {
+		return "", errors.New("temporary directory /tmp is not a tmpfs volume; refusing to write luks key to a volume backed by a disk")
+	}
+	tmpFile, err := ioutil.TempFile("/tmp", "luks-")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmpFile.WriteString(key)
+	if err != nil {
+		log.WithField("tmp_file", tmpFile.Name()).Warnf("Unable to write luks key file: %s", err.Error())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
+
+// makes sure that the given directory is a tmpfs
+func checkTmpFs(ctx context.Context, dir string) bool {
+	out, err := exec.CommandContext(ctx, "sh", "-c", "df -T "+dir+" | tail -n1 | awk '{print $2}'").CombinedOutput()
+	if err != nil {
+		return false
+	}
+	if len(out) == 0 {
+		return false
+	}
+	return strings.TrimSpace(string(out)) == "tmpfs"
+}
@@ -0,0 +1,124 @@
+package mounter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLuksStatus(t *testing.T) {
+	status := parseLuksStatus(`/dev/mapper/pvc-1234 is active and is in use.
+  type:    LUKS1
+  cipher:  aes-xts-plain64
+  keysize: 512 bits
+  key location: dm-crypt
+  device:  /dev/sdb
+  sector size:  512
+  offset:  4096 sectors
+  size:    10481664 sectors
+  mode:    read/write
+`)
+
+	assert.Equal(t, "LUKS1", status["type"])
+	assert.Equal(t, "aes-xts-plain64", status["cipher"])
+	assert.Equal(t, "512 bits", status["keysize"])
+	assert.Equal(t, "/dev/sdb", status["device"])
+	assert.NotContains(t, status, "/dev/mapper/pvc-1234 is active and is in use.")
+}
+
+func TestLuksContextString(t *testing.T) {
+	ctx := LuksContext{EncryptionEnabled: true, EncryptionKey: "hunter2", VolumeName: "pvc-1"}
+	assert.NotContains(t, fmt.Sprint(ctx), "hunter2")
+	assert.NotContains(t, fmt.Sprintf("%v", &ctx), "hunter2")
+	assert.Contains(t, fmt.Sprint(ctx), "pvc-1")
+	assert.Equal(t, "hunter2", ctx.EncryptionKey)
+}
+
+func TestExecCryptsetup(t *testing.T) {
+	args := []string{"--batch-mode", "luksOpen", "/dev/sdb", "pvc-1"}
+	err := execCryptsetup(exec.Command("sh", "-c", "echo 'Command failed.' && echo 'No key available with this passphrase.' >&2 && exit 2"), "luksOpen", args)
+
+	var cryptsetupErr *CryptsetupError
+	assert.True(t, errors.As(err, &cryptsetupErr))
+	assert.Equal(t, 2, cryptsetupErr.ExitCode)
+	assert.Equal(t, "No key available with this passphrase.", cryptsetupErr.Stderr)
+	assert.True(t, cryptsetupErr.WrongPassphrase())
+	assert.False(t, cryptsetupErr.Busy())
+	assert.Contains(t, err.Error(), "No key available with this passphrase.")
+	assert.Contains(t, err.Error(), "cryptsetup --batch-mode luksOpen /dev/sdb pvc-1")
+
+	err = execCryptsetup(exec.Command("sh", "-c", "echo 'Cannot use device /dev/sdb which is in use (already mapped or mounted).' >&2 && exit 5"), "luksFormat", nil)
+	assert.True(t, errors.As(err, &cryptsetupErr))
+	assert.True(t, cryptsetupErr.Busy())
+	assert.False(t, cryptsetupErr.WrongPassphrase())
+
+	assert.NoError(t, execCryptsetup(exec.Command("true"), "close", nil))
+}
+
+func TestRetryBusy(t *testing.T) {
+	defer func(backoff time.Duration) { cryptsetupBackoff = backoff }(cryptsetupBackoff)
+	cryptsetupBackoff = time.Millisecond
+	log := logrus.New().WithField("test_enabled", true)
+
+	run := func(errs ...error) (int, error) {
+		calls := 0
+		err := retryBusy(context.Background(), log, func() error {
+			calls++
+			if calls > len(errs) {
+				return nil
+			}
+			return errs[calls-1]
+		})
+		return calls, err
+	}
+	busy := &CryptsetupError{Action: "luksOpen", ExitCode: cryptsetupExitBusy}
+	wrongPassphrase := &CryptsetupError{Action: "luksOpen", ExitCode: cryptsetupExitWrongPassphrase}
+
+	calls, err := run(busy, busy)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	// a wrong passphrase is not retried
+	calls, err = run(wrongPassphrase)
+	assert.Equal(t, wrongPassphrase, err)
+	assert.Equal(t, 1, calls)
+
+	// the retries are bounded
+	calls, err = run(busy, busy, busy, busy, busy, busy)
+	assert.Equal(t, busy, err)
+	assert.Equal(t, cryptsetupAttempts, calls)
+}
+
+func TestLuksMappingInUseError(t *testing.T) {
+	busy := &CryptsetupError{Action: "close", ExitCode: cryptsetupExitBusy, Stderr: "Device pvc-1 is still in use.", Err: errors.New("exit status 5")}
+
+	err := error(&LuksMappingInUseError{Mapping: "pvc-1", Mounts: []string{"/mnt/leftover"}, Err: busy})
+	assert.Contains(t, err.Error(), "luks mapping pvc-1 is still mounted at /mnt/leftover")
+	var cryptsetupErr *CryptsetupError
+	assert.True(t, errors.As(err, &cryptsetupErr))
+
+	err = &LuksMappingInUseError{Mapping: "pvc-1", Err: busy}
+	assert.Contains(t, err.Error(), "lazily unmounted")
+	assert.Contains(t, err.Error(), "Device pvc-1 is still in use.")
+}
+
+func TestLuksOpenAlreadyOpen(t *testing.T) {
+	defer func(dir string) { luksMappingDir = dir }(luksMappingDir)
+	luksMappingDir = t.TempDir()
+	log := logrus.New().WithField("test_enabled", true)
+	assert.NoError(t, os.WriteFile(filepath.Join(luksMappingDir, "pvc-1"), nil, 0600))
+
+	// the mapping of a staged volume is reported as not opened, so that it
+	// is not closed while it is mounted
+	opened, err := luksOpen(context.Background(), "/dev/sdb", "/tmp/luks-key", LuksContext{VolumeName: "pvc-1"}, log)
+	assert.NoError(t, err)
+	assert.False(t, opened)
+}
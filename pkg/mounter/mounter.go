@@ -0,0 +1,1512 @@
+/*
+Copyright cloudscale.ch
+Copyright 2018 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mounter formats, mounts and encrypts the volumes of the node
+// plugin. New returns the implementation used in production, NewFake one that
+// only keeps track of the mounts in memory. Custom implementations can embed
+// the Mounter returned by New and override single methods, see
+// driver.WithMounter and driver.WithMounterWrapper.
+package mounter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"k8s.io/mount-utils"
+	kexec "k8s.io/utils/exec"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DiskIDPath contains the links to the devices named by their serials
+	DiskIDPath = "/dev/disk/by-id"
+	// SysClassBlockPath contains the block devices in sysfs
+	SysClassBlockPath = "/sys/class/block"
+
+	// EraseModeDiscard discards all blocks of a device
+	EraseModeDiscard = "discard"
+	// EraseModeZero overwrites a device with zeroes
+	EraseModeZero = "zero"
+	// EraseModeCrypto destroys the luks header of an encrypted device
+	EraseModeCrypto = "crypto"
+
+	nvmeClassPath = "/sys/class/nvme"
+	scsiHostPath  = "/sys/class/scsi_host"
+	pciRescanPath = "/sys/bus/pci/rescan"
+
+	procMountInfoPath = "/proc/self/mountinfo"
+)
+
+var (
+	nvmeNamespaceSuffixRe = regexp.MustCompile(`_\d+$`)
+)
+
+const (
+	// formatTimeout bounds formatting and discarding a volume
+	formatTimeout = 30 * time.Minute
+	// eraseTimeout bounds erasing a volume, which writes every block of
+	// it with EraseModeZero
+	eraseTimeout = 12 * time.Hour
+)
+
+// VolumeStatistics are the capacity-related statistics of a volume. The inodes
+// are not set for block volumes.
+type VolumeStatistics struct {
+	AvailableBytes, TotalBytes, UsedBytes    int64
+	AvailableInodes, TotalInodes, UsedInodes int64
+}
+
+// Mounter is responsible for formatting and mounting volumes. The commands
+// run by the methods which take a context are killed once it is done, except
+// for formatting, discarding and erasing, which run to completion or until
+// their own timeout, as an interrupted mkfs or erase leaves the volume behind
+// in an unknown state.
+// TODO(timoreimann): find a more suitable name since the interface encompasses
+// more than just mounting functionality by now.
+type Mounter interface {
+	// Format formats the source with the given filesystem type. The mkfs
+	// options are passed to mkfs in addition to the default ones.
+	Format(ctx context.Context, source, fsType string, luksContext LuksContext, mkfsOptions ...string) error
+
+	// Discard discards all blocks of the given device
+	Discard(ctx context.Context, source string) error
+
+	// Erase destroys the data on the given device with the given erase mode
+	Erase(ctx context.Context, source, mode string) error
+
+	// Mount mounts source to target with the given fstype and options.
+	Mount(ctx context.Context, source, target, fsType string, luksContext LuksContext, options ...string) error
+
+	// Unmount unmounts the given target
+	Unmount(ctx context.Context, target string, luksContext LuksContext) error
+
+	// CloseLuksMapping closes the luks mapping on the device of the given
+	// volume, if there is one. It returns a LuksMappingInUseError as long
+	// as the mapping stays open.
+	CloseLuksMapping(ctx context.Context, volumeID string) error
+
+	// IsFormatted checks whether the source device is formatted or not. It
+	// returns true if the source device is already formatted.
+	IsFormatted(ctx context.Context, source string, luksContext LuksContext) (bool, error)
+
+	// VerifyDevice checks that the source device belongs to the given volume
+	// and has the given size in bytes, which is not checked if zero. It
+	// returns a DeviceMismatchError otherwise.
+	VerifyDevice(source, volumeID string, sizeBytes int64) error
+
+	// IsMounted checks whether the target path is a correct mount (i.e:
+	// propagated). It returns true if it's mounted. An error is returned in
+	// case of system errors or if it's mounted incorrectly.
+	IsMounted(target string) (bool, error)
+
+	// Used to find a path in /dev/disk/by-id with a serial that we have from
+	// the cloudscale API.
+	FinalizeVolumeAttachmentAndFindPath(ctx context.Context, logger *logrus.Entry, VolumeId string) (*string, error)
+
+	// GetStatistics returns capacity-related volume statistics for the given
+	// volume path.
+	GetStatistics(ctx context.Context, volumePath string) (VolumeStatistics, error)
+
+	// IsBlockDevice checks whether the device at the path is a block device
+	IsBlockDevice(volumePath string) (bool, error)
+
+	// SetVolumeMountGroup makes the filesystem mounted at target accessible
+	// for the given group, like kubelet does for the fsGroup of a pod.
+	SetVolumeMountGroup(ctx context.Context, target string, gid int) error
+
+	// SetOwnership changes the owner, group and permissions of the root
+	// directory of the filesystem mounted at target, or of the device node
+	// at target. A uid or gid of -1 and a mode of 0 leave the respective
+	// property unchanged.
+	SetOwnership(target string, uid, gid int, mode os.FileMode) error
+
+	// GetVolumeCondition checks the given volume path for abnormal conditions,
+	// such as a missing device or a filesystem that was remounted read-only.
+	// It returns a message describing the condition or an empty string if the
+	// volume is healthy. The staging target path is optional; a read-only
+	// staging mount is only abnormal if the volume was not staged read-only.
+	GetVolumeCondition(volumePath, stagingTargetPath string, readOnly bool) (string, error)
+
+	GetDeviceName(mounter mount.Interface, mountPath string) (string, error)
+
+	FindAbsoluteDeviceByIDPath(volumeName string) (string, error)
+	HasRequiredSize(ctx context.Context, log *logrus.Entry, path string, requiredSize int64) (bool, error)
+
+	// ResizeFilesystem grows the filesystem on the given device, which is
+	// mounted at mountPath, to the size of the device.
+	ResizeFilesystem(ctx context.Context, devicePath, mountPath string) error
+}
+
+// TODO(arslan): this is Linux only for now. Refactor this into a package with
+// architecture specific code in the future, such as mounter_darwin.go,
+// mounter_linux.go, etc..
+type mounter struct {
+	log      *logrus.Entry
+	kMounter *mount.SafeFormatAndMount
+
+	// deviceWaitTimeout defines how long to wait for the device of an
+	// attached volume to appear
+	deviceWaitTimeout time.Duration
+	// probe rescans the buses for the device of an attached volume
+	probe func(ctx context.Context, logger *logrus.Entry) error
+}
+
+// New returns the mounter used in production, which waits up to the given
+// timeout for the device of an attached volume to appear.
+func New(log *logrus.Entry, deviceWaitTimeout time.Duration) Mounter {
+	kMounter := &mount.SafeFormatAndMount{
+		Interface: mount.New(""),
+		Exec:      kexec.New(),
+	}
+
+	return &mounter{
+		kMounter:          kMounter,
+		log:               log,
+		deviceWaitTimeout: deviceWaitTimeout,
+		probe:             probeAttachedVolume,
+	}
+}
+
+// contextExec runs the commands of the wrapped executor with the context, so
+// that the commands run by the helpers of mount-utils are killed as well once
+// the context is done
+type contextExec struct {
+	kexec.Interface
+	ctx context.Context
+}
+
+func (e contextExec) Command(cmd string, args ...string) kexec.Cmd {
+	return e.Interface.CommandContext(e.ctx, cmd, args...)
+}
+
+// detachedContext keeps the values of the wrapped context, but neither its
+// deadline nor its cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// detach returns a context for a long operation which is not interrupted
+// when the CSI call is canceled, but only after the given timeout. The caller
+// holds the lock of the volume until the operation is done, so that the
+// retries of the call are answered with Aborted in the meantime.
+func detach(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(detachedContext{ctx}, timeout)
+}
+
+// withContext returns the format and mount helper of mount-utils with its
+// commands bound to the context
+func (m *mounter) withContext(ctx context.Context) *mount.SafeFormatAndMount {
+	return &mount.SafeFormatAndMount{
+		Interface: m.kMounter.Interface,
+		Exec:      contextExec{Interface: m.kMounter.Exec, ctx: ctx},
+	}
+}
+
+func (m *mounter) Format(ctx context.Context, source, fsType string, luksContext LuksContext, mkfsOptions ...string) error {
+	mkfsCmd := fmt.Sprintf("mkfs.%s", fsType)
+
+	_, err := m.kMounter.Exec.LookPath(mkfsCmd)
+	if err != nil {
+		return fmt.Errorf("%q executable not found in $PATH: %v", mkfsCmd, err)
+	}
+
+	mkfsArgs := []string{}
+
+	if fsType == "" {
+		return errors.New("fs type is not specified for formatting the volume")
+	}
+
+	if source == "" {
+		return errors.New("source is not specified for formatting the volume")
+	}
+
+	if fsType == "ext4" || fsType == "ext3" {
+		mkfsArgs = []string{
+			"-F",  // Force flag
+			"-m0", // Zero blocks reserved for privileged processes
+		}
+	}
+	mkfsArgs = append(mkfsArgs, mkfsOptions...)
+	mkfsArgs = append(mkfsArgs, source)
+
+	ctx, cancel := detach(ctx, formatTimeout)
+	defer cancel()
+
+	if !luksContext.EncryptionEnabled {
+		if err := wipeIncompleteFormat(source, m.log); err != nil {
+			return err
+		}
+
+		m.log.WithFields(logrus.Fields{
+			"cmd":  mkfsCmd,
+			"args": mkfsArgs,
+		}).Info("executing format command")
+
+		out, err := m.kMounter.Exec.CommandContext(ctx, mkfsCmd, mkfsArgs...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("formatting disk failed: %v cmd: '%s %s' output: %q",
+				err, mkfsCmd, strings.Join(mkfsArgs, " "), string(out))
+		}
+
+		return nil
+	} else {
+		err := luksContext.Validate()
+		if err != nil {
+			return err
+		}
+		err = luksFormat(ctx, source, mkfsCmd, mkfsArgs, luksContext, m.log)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+func (m *mounter) Discard(ctx context.Context, source string) error {
+	if source == "" {
+		return errors.New("source is not specified for discarding the volume")
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"cmd":  "blkdiscard",
+		"args": []string{source},
+	}).Info("executing discard command")
+
+	ctx, cancel := detach(ctx, formatTimeout)
+	defer cancel()
+	return blkdiscard(ctx, source)
+}
+
+func (m *mounter) Erase(ctx context.Context, source, mode string) error {
+	if source == "" {
+		return errors.New("source is not specified for erasing the volume")
+	}
+
+	ctx, cancel := detach(ctx, eraseTimeout)
+	defer cancel()
+
+	switch mode {
+	case EraseModeDiscard:
+		m.log.WithFields(logrus.Fields{
+			"cmd":  "blkdiscard",
+			"args": []string{source},
+		}).Info("executing erase command")
+		return blkdiscard(ctx, source)
+	case EraseModeZero:
+		m.log.WithFields(logrus.Fields{
+			"cmd":  "blkdiscard",
+			"args": []string{"--zeroout", source},
+		}).Info("executing erase command")
+		out, err := exec.CommandContext(ctx, "blkdiscard", "--zeroout", source).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("zeroing device failed: %v cmd: 'blkdiscard --zeroout %s' output: %q", err, source, string(out))
+		}
+		return nil
+	case EraseModeCrypto:
+		return luksErase(ctx, source, m.log)
+	default:
+		return fmt.Errorf("unsupported erase mode %q", mode)
+	}
+}
+
+func (m *mounter) Mount(ctx context.Context, source, target, fsType string, luksContext LuksContext, options ...string) error {
+	if source == "" {
+		return errors.New("source is not specified for mounting the volume")
+	}
+
+	if target == "" {
+		return errors.New("target is not specified for mounting the volume")
+	}
+
+	// This is a raw block device mount. Create the mount point as a file
+	// since bind mount device node requires it to be a file
+	if fsType == "" {
+		// create directory for target, os.Mkdirall is noop if directory exists
+		err := os.MkdirAll(filepath.Dir(target), 0750)
+		if err != nil {
+			return fmt.Errorf("failed to create target directory for raw block bind mount: %v", err)
+		}
+
+		file, err := os.OpenFile(target, os.O_CREATE, 0660)
+		if err != nil {
+			return fmt.Errorf("failed to create target file for raw block bind mount: %v", err)
+		}
+		file.Close()
+	} else {
+		// create target, os.Mkdirall is noop if directory exists
+		err := os.MkdirAll(target, 0750)
+		if err != nil {
+			return err
+		}
+	}
+
+	if luksContext.EncryptionEnabled && luksContext.VolumeLifecycle == VolumeLifecycleNodeStageVolume {
+		luksSource, err := luksPrepareMount(ctx, source, luksContext, m.log)
+		if err != nil {
+			m.log.WithFields(logrus.Fields{
+				"error":  err.Error(),
+				"volume": luksContext.VolumeName,
+			}).Error("failed to prepare luks volume for mounting")
+			return err
+		}
+		source = luksSource
+	}
+
+	// propagation flags cannot be passed as mount options, they are
+	// applied after mounting instead
+	options, propagation := splitPropagationOptions(options)
+
+	bindMount := false
+	for _, option := range options {
+		if option == "bind" {
+			bindMount = true
+		}
+	}
+
+	if bindMount {
+		notMnt, err := m.kMounter.IsLikelyNotMountPoint(target)
+		switch {
+		case err != nil && mount.IsCorruptedMnt(err):
+			// e.g. the source device is gone
+			m.log.WithError(err).WithField("target", target).Warn("target is a corrupted mount, publishing it again")
+			if err := m.kMounter.Unmount(target); err != nil {
+				return err
+			}
+		case err == nil && !notMnt:
+			if isBindMountOf(source, target) {
+				// the target has already been published, e.g. by a previous
+				// call; just make sure that the flags are applied
+				if err := remountBind(ctx, target, options, m.log); err != nil {
+					return err
+				}
+				if err := setMountPropagation(ctx, target, propagation, m.log); err != nil {
+					return err
+				}
+				if fsType == "" {
+					return syncBlockDeviceReadOnly(ctx, source, m.log)
+				}
+				return nil
+			}
+
+			// e.g. the staging path was mounted again after the target had
+			// been published, which leaves the target with the old mount
+			m.log.WithFields(logrus.Fields{
+				"source": source,
+				"target": target,
+			}).Warn("target is not mounted from the source, publishing it again")
+			if err := m.kMounter.Unmount(target); err != nil {
+				return err
+			}
+		}
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"options": options,
+	}).Info("executing mount command")
+
+	// mounting itself can't be canceled, don't start if the context is done
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if bindMount || fsType == "" {
+		if err := m.kMounter.Mount(source, target, fsType, options); err != nil {
+			return err
+		}
+		if err := setMountPropagation(ctx, target, propagation, m.log); err != nil {
+			return err
+		}
+		if bindMount && fsType == "" {
+			return syncBlockDeviceReadOnly(ctx, source, m.log)
+		}
+		return nil
+	}
+
+	if err := checkFilesystemType(source, fsType); err != nil {
+		if luksContext.EncryptionEnabled && luksContext.VolumeLifecycle == VolumeLifecycleNodeStageVolume {
+			// the mapping is closed even if the context is done already
+			if closeErr := LuksClose(context.Background(), luksContext.VolumeName, m.log); closeErr != nil {
+				m.log.WithError(closeErr).Warn("failed to close luks volume after filesystem check")
+			}
+		}
+		return err
+	}
+
+	if fsType == "xfs" {
+		duplicate, err := m.hasDuplicateXFSUUID(source)
+		if err != nil {
+			m.log.WithError(err).Warn("could not check for duplicate xfs uuid")
+		} else if duplicate {
+			// xfs refuses to mount a filesystem with the UUID of an already
+			// mounted one, which is the case for clones of a volume
+			m.log.WithField("source", source).Info("xfs filesystem with the same uuid is already mounted, mounting with nouuid")
+			options = append(options, "nouuid")
+		}
+	}
+
+	// propagation flags are only applied to the bind mounts of published
+	// volumes, the staging mount has to stay shared
+	if propagation != "" {
+		m.log.WithField("propagation", propagation).Info("ignoring propagation flag for the staging mount")
+	}
+
+	// the device is formatted before mounting already; FormatAndMount
+	// additionally checks and repairs the filesystem before mounting it and
+	// refuses to mount a filesystem of another type than the requested one
+	return m.withContext(ctx).FormatAndMount(source, target, fsType, options)
+}
+
+// isBindMountOf returns true if the target is a bind mount of the source, in
+// which case both refer to the same file. This holds for the root of a
+// staging mount as well as for device nodes.
+func isBindMountOf(source, target string) bool {
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return false
+	}
+	targetInfo, err := os.Stat(target)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(sourceInfo, targetInfo)
+}
+
+// remountBind applies the given options to an existing bind mount; the mount
+// is switched back to read-write if the options do not contain "ro"
+func remountBind(ctx context.Context, target string, options []string, log *logrus.Entry) error {
+	mode := "rw"
+	flags := []string{}
+	for _, option := range options {
+		switch option {
+		case "bind", "rw":
+		case "ro":
+			mode = "ro"
+		default:
+			flags = append(flags, option)
+		}
+	}
+	mountOptions := append([]string{"remount", "bind", mode}, flags...)
+	mountArgs := []string{"-o", strings.Join(mountOptions, ","), target}
+
+	log.WithFields(logrus.Fields{
+		"cmd":  "mount",
+		"args": mountArgs,
+	}).Info("target is already mounted, executing remount command")
+
+	out, err := exec.CommandContext(ctx, "mount", mountArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("remounting failed: %v cmd: 'mount %s' output: %q",
+			err, strings.Join(mountArgs, " "), string(out))
+	}
+	return nil
+}
+
+// propagationOptions are the mount propagation flags accepted as mount options
+var propagationOptions = map[string]bool{
+	"shared":   true,
+	"rshared":  true,
+	"slave":    true,
+	"rslave":   true,
+	"private":  true,
+	"rprivate": true,
+}
+
+// IsPropagationOption returns true for the mount propagation flags, e.g.
+// rslave, which Mount accepts as mount options
+func IsPropagationOption(option string) bool {
+	return propagationOptions[option]
+}
+
+// splitPropagationOptions separates the propagation flag from the other mount
+// options; if multiple are given, the last one wins
+func splitPropagationOptions(options []string) ([]string, string) {
+	var rest []string
+	propagation := ""
+	for _, option := range options {
+		if propagationOptions[option] {
+			propagation = option
+			continue
+		}
+		rest = append(rest, option)
+	}
+	return rest, propagation
+}
+
+// setMountPropagation changes the propagation type of the given mount
+func setMountPropagation(ctx context.Context, target, propagation string, log *logrus.Entry) error {
+	if propagation == "" {
+		return nil
+	}
+
+	mountArgs := []string{"--make-" + propagation, target}
+	log.WithFields(logrus.Fields{
+		"cmd":  "mount",
+		"args": mountArgs,
+	}).Info("executing mount propagation command")
+
+	out, err := exec.CommandContext(ctx, "mount", mountArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("changing mount propagation failed: %v cmd: 'mount %s' output: %q",
+			err, strings.Join(mountArgs, " "), string(out))
+	}
+	return nil
+}
+
+// syncBlockDeviceReadOnly sets the read-only flag of the given block device
+// if it is only bind mounted read-only, and clears it otherwise. A read-only
+// bind mount does not prevent writes to a device node, but the flag applies
+// to every target the device is published to, so it is only set as long as
+// no target is read-write, whose writes would fail with EROFS otherwise. The
+// flag is cleared once the device is not published anymore.
+func syncBlockDeviceReadOnly(ctx context.Context, device string, log *logrus.Entry) error {
+	mounts, err := deviceBindMounts(device, procMountInfoPath)
+	if err != nil {
+		return err
+	}
+	readOnly := len(mounts) > 0
+	for _, mountReadOnly := range mounts {
+		readOnly = readOnly && mountReadOnly
+	}
+	return setBlockDeviceReadOnly(ctx, device, readOnly, log)
+}
+
+// deviceBindMounts returns the bind mounts of the given device node and
+// whether they are read-only. Like mount.SearchMountPoints, the bind mounts
+// are found by the device and root of the mount.
+func deviceBindMounts(device, mountInfoPath string) (map[string]bool, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, err
+	}
+	mountInfos, err := mount.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// later mounts might overlap earlier ones
+	var devMount *mount.MountInfo
+	for i := len(mountInfos) - 1; i >= 0; i-- {
+		if mount.PathWithinBase(resolved, mountInfos[i].MountPoint) {
+			devMount = &mountInfos[i]
+			break
+		}
+	}
+	if devMount == nil {
+		return nil, fmt.Errorf("failed to find the mount of device %s", resolved)
+	}
+	root := filepath.Join(devMount.Root, strings.TrimPrefix(resolved, devMount.MountPoint))
+
+	mounts := map[string]bool{}
+	for _, info := range mountInfos {
+		if info.ID == devMount.ID || info.Root != root || info.Major != devMount.Major || info.Minor != devMount.Minor {
+			continue
+		}
+		mounts[info.MountPoint] = false
+		for _, option := range info.MountOptions {
+			if option == "ro" {
+				mounts[info.MountPoint] = true
+			}
+		}
+	}
+	return mounts, nil
+}
+
+// blockDeviceOf returns the block device node the given device node refers
+// to, e.g. the bind mount of a published raw block volume, or an empty
+// string if it is none
+func blockDeviceOf(path string) string {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil || stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return ""
+	}
+	link, err := os.Readlink(fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev))))
+	if err != nil {
+		return ""
+	}
+	return "/dev/" + filepath.Base(link)
+}
+
+// setBlockDeviceReadOnly sets or clears the read-only flag of the given block device
+func setBlockDeviceReadOnly(ctx context.Context, device string, readOnly bool, log *logrus.Entry) error {
+	flag := "--setrw"
+	if readOnly {
+		flag = "--setro"
+	}
+
+	log.WithFields(logrus.Fields{
+		"cmd":  "blockdev",
+		"args": []string{flag, device},
+	}).Info("executing blockdev command")
+
+	out, err := exec.CommandContext(ctx, "blockdev", flag, device).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("setting read-only flag of device failed: %v cmd: 'blockdev %s %s' output: %q",
+			err, flag, device, string(out))
+	}
+	return nil
+}
+
+func (m *mounter) Unmount(ctx context.Context, target string, luksContext LuksContext) error {
+	if target == "" {
+		return errors.New("target is not specified for unmounting the volume")
+	}
+
+	// if this is the unmount call after the mount-bind has been removed,
+	// a luks volume needs to be closed after unmounting; get the source
+	// of the mount to check if that is a luks volume
+	mountSources, err := m.getMountSources(target)
+	// the read-only flag of a published raw block device is updated for
+	// the remaining targets
+	device := blockDeviceOf(target)
+
+	err = mount.CleanupMountPoint(target, m.kMounter, true)
+	if err != nil {
+		return err
+	}
+
+	if device != "" {
+		if err := syncBlockDeviceReadOnly(ctx, device, m.log); err != nil {
+			return err
+		}
+	}
+
+	// if this is the unstaging process, check if the source is a luks volume and close it
+	if luksContext.VolumeLifecycle == VolumeLifecycleNodeUnstageVolume {
+		for _, source := range mountSources {
+			IsLuksMapping, mappingName, err := IsLuksMapping(ctx, source)
+			if err != nil {
+				return err
+			}
+			if IsLuksMapping {
+				err := LuksClose(ctx, mappingName, m.log)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// LuksMappingInUseError is returned if the luks mapping of a volume cannot be
+// closed as it is still in use
+type LuksMappingInUseError struct {
+	Mapping string
+	// Mounts are the mount points of the mapping; without any, the
+	// filesystem was likely unmounted lazily and is still in use
+	Mounts []string
+	Err    error
+}
+
+func (e *LuksMappingInUseError) Error() string {
+	if len(e.Mounts) > 0 {
+		return fmt.Sprintf("luks mapping %s is still mounted at %s: %v", e.Mapping, strings.Join(e.Mounts, ", "), e.Err)
+	}
+	return fmt.Sprintf("luks mapping %s is still in use although it is not mounted, e.g. by a lazily unmounted filesystem: %v", e.Mapping, e.Err)
+}
+
+func (e *LuksMappingInUseError) Unwrap() error {
+	return e.Err
+}
+
+// CloseLuksMapping closes the luks mapping of a volume, which is usually
+// closed by Unmount already. It is left open if closing it failed, e.g. as
+// the device was busy, after the staging target path had been unmounted.
+// Detaching the volume with its mapping still open makes it fail to open on
+// the next node, so an error is returned as long as the mapping is open.
+func (m *mounter) CloseLuksMapping(ctx context.Context, volumeID string) error {
+	device, err := m.FindAbsoluteDeviceByIDPath(volumeID)
+	if err != nil {
+		// without the device, there is no mapping on it either
+		return nil
+	}
+	name, err := FindLuksMappingForDevice(device)
+	if err != nil || name == "" {
+		return err
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"volume_id":    volumeID,
+		"luks_mapping": name,
+	}).Info("closing luks mapping of the volume")
+	// busy devices are retried by LuksClose
+	closeErr := LuksClose(ctx, name, m.log)
+	var cryptsetupErr *CryptsetupError
+	if closeErr != nil && !(errors.As(closeErr, &cryptsetupErr) && cryptsetupErr.Busy()) {
+		return closeErr
+	}
+
+	open, err := FindLuksMappingForDevice(device)
+	if err != nil || open == "" {
+		return err
+	}
+	if closeErr == nil {
+		closeErr = errors.New("the mapping is still open after closing it")
+	}
+	mounts, err := m.mountsOfDevice("/dev/mapper/" + name)
+	if err != nil {
+		m.log.WithError(err).Warn("couldn't list the mounts of the luks mapping")
+	}
+	return &LuksMappingInUseError{Mapping: name, Mounts: mounts, Err: closeErr}
+}
+
+// mountsOfDevice returns the mount points of the given device
+func (m *mounter) mountsOfDevice(device string) ([]string, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, err
+	}
+	mountPoints, err := m.kMounter.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing mounts failed: %v", err)
+	}
+
+	var mounts []string
+	for _, mp := range mountPoints {
+		if mounted, err := filepath.EvalSymlinks(mp.Device); err == nil && mounted == resolved {
+			mounts = append(mounts, mp.Path)
+		}
+	}
+	return mounts, nil
+}
+
+// hasDuplicateXFSUUID checks whether an xfs filesystem with the same UUID as
+// the one on the given device is mounted already
+func (m *mounter) hasDuplicateXFSUUID(source string) (bool, error) {
+	uuid, err := xfsUUID(source)
+	if err != nil || uuid == nil {
+		return false, err
+	}
+
+	resolvedSource, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return false, err
+	}
+
+	mountPoints, err := m.kMounter.List()
+	if err != nil {
+		return false, err
+	}
+
+	for _, mp := range mountPoints {
+		if mp.Type != "xfs" {
+			continue
+		}
+		device, err := filepath.EvalSymlinks(mp.Device)
+		if err != nil || device == resolvedSource {
+			continue
+		}
+		mountedUUID, err := xfsUUID(device)
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(uuid, mountedUUID) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// gets the mount sources of a mountpoint
+func (m *mounter) getMountSources(target string) ([]string, error) {
+	mountPoints, err := m.kMounter.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing mounts failed: %v", err)
+	}
+
+	var sources []string
+	for _, mp := range mountPoints {
+		if mp.Path == target {
+			sources = append(sources, mp.Device)
+		}
+	}
+	return sources, nil
+}
+
+func (m *mounter) IsFormatted(ctx context.Context, source string, luksContext LuksContext) (bool, error) {
+	if !luksContext.EncryptionEnabled {
+		return isVolumeFormatted(source, m.log)
+	}
+
+	formatted, err := isLuksVolumeFormatted(ctx, source, luksContext, m.log)
+	if err != nil {
+		return false, err
+	}
+	return formatted, nil
+}
+
+func isVolumeFormatted(source string, log *logrus.Entry) (bool, error) {
+	if source == "" {
+		return false, errors.New("source is not specified")
+	}
+
+	log.WithFields(logrus.Fields{
+		"source": source,
+	}).Info("checking if source is formatted")
+
+	fsType, err := getFilesystemType(source)
+	if err != nil {
+		return false, err
+	}
+	if fsType == "" {
+		return false, nil
+	}
+
+	incomplete, err := findIncompleteFormat(source)
+	if err != nil {
+		return false, err
+	}
+	if incomplete != nil {
+		log.WithFields(logrus.Fields{
+			"source": source,
+			"reason": incomplete.reason,
+		}).Warn("source is only partially formatted")
+		return false, nil
+	}
+	return true, nil
+}
+
+func (m *mounter) VerifyDevice(source, volumeID string, sizeBytes int64) error {
+	m.log.WithFields(logrus.Fields{
+		"source":     source,
+		"volume_id":  volumeID,
+		"size_bytes": sizeBytes,
+	}).Info("verifying the device before formatting")
+	return verifyDevice(SysClassBlockPath, DiskIDPath, source, volumeID, sizeBytes)
+}
+
+func (m *mounter) ResizeFilesystem(ctx context.Context, devicePath, mountPath string) error {
+	m.log.WithFields(logrus.Fields{
+		"device_path": devicePath,
+		"mount_path":  mountPath,
+	}).Info("resizing filesystem")
+
+	// ext filesystems are resized through the device, xfs and btrfs can only
+	// be grown while mounted and are addressed by their mount point
+	if _, err := mount.NewResizeFs(m.withContext(ctx).Exec).Resize(devicePath, mountPath); err != nil {
+		return fmt.Errorf("resizing filesystem on device %s failed: %v", devicePath, err)
+	}
+	return nil
+}
+
+func (m *mounter) IsMounted(target string) (bool, error) {
+	if target == "" {
+		return false, errors.New("target is not specified for checking the mount")
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"target": target,
+	}).Info("checking if target is mounted")
+
+	mountInfos, err := mount.ParseMountInfo(procMountInfoPath)
+	if err != nil {
+		return false, fmt.Errorf("checking mounted failed: %v", err)
+	}
+
+	targetFound := false
+	for _, info := range mountInfos {
+		if info.MountPoint != target {
+			continue
+		}
+		targetFound = true
+
+		// check if the mount is propagated correctly. It should be set to shared.
+		if !isSharedMount(info) {
+			return true, fmt.Errorf("mount propagation for target %q is not enabled", target)
+		}
+	}
+
+	return targetFound, nil
+}
+
+// isSharedMount returns true if the mount is part of a shared peer group
+func isSharedMount(info mount.MountInfo) bool {
+	for _, field := range info.OptionalFields {
+		if strings.HasPrefix(field, "shared:") {
+			return true
+		}
+	}
+	return false
+}
+
+// Copyright note for the functions below. Originally taken from
+// https://github.com/kubernetes/cloud-provider-openstack/blob/v1.16.0/pkg/volume/cinder/cinder_util.go
+// Sleightly modified.
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func guessDiskIDPathByVolumeID(volumeID string) *string {
+	if path := guessDiskIDPathByVolumeIDInDir(DiskIDPath, volumeID); path != nil {
+		return path
+	}
+	return findNVMeDeviceByVolumeID(nvmeClassPath, volumeID)
+}
+
+func guessDiskIDPathByVolumeIDInDir(dir, volumeID string) *string {
+	// Get the first part of the UUID.
+	// The linux kernel limits volume serials to 20 bytes:
+	// include/uapi/linux/virtio_blk.h:#define VIRTIO_BLK_ID_BYTES 20 /* ID string length */
+	if len(volumeID) < 20 {
+		return nil
+	}
+	linuxSerial := volumeID[:20]
+
+	globExpr := dir + "/*" + linuxSerial + "*"
+	matches, _ := filepath.Glob(globExpr)
+	for _, match := range matches {
+		// the name has to end with the (possibly truncated) volume ID; this
+		// skips partitions of the disk as well as other disks whose serial
+		// just contains the volume serial
+		name := filepath.Base(match)
+		if strings.HasPrefix(name, "nvme-") {
+			// newer versions of udev append the namespace ID to the name
+			name = nvmeNamespaceSuffixRe.ReplaceAllString(name, "")
+		}
+		serial := name[strings.Index(name, linuxSerial):]
+		if !strings.HasPrefix(volumeID, serial) {
+			continue
+		}
+		return &match
+	}
+	return nil
+}
+
+// findNVMeDeviceByVolumeID looks up the NVMe controller whose serial matches the
+// given volume ID in sysfs and returns the path of its first namespace. This
+// covers systems where udev does not create /dev/disk/by-id links for NVMe
+// devices.
+func findNVMeDeviceByVolumeID(classPath, volumeID string) *string {
+	if len(volumeID) < 20 {
+		return nil
+	}
+
+	controllers, err := ioutil.ReadDir(classPath)
+	if err != nil {
+		return nil
+	}
+
+	for _, controller := range controllers {
+		serial, err := ioutil.ReadFile(filepath.Join(classPath, controller.Name(), "serial"))
+		if err != nil {
+			continue
+		}
+		trimmed := strings.TrimSpace(string(serial))
+		if len(trimmed) < 20 || !strings.HasPrefix(volumeID, trimmed) {
+			continue
+		}
+
+		// namespaces are listed as nvme<controller>n<namespace> (or as
+		// nvme<subsystem>c<controller>n<namespace> with native multipathing)
+		namespaces, err := filepath.Glob(filepath.Join(classPath, controller.Name(), "nvme*n*"))
+		if err != nil || len(namespaces) == 0 {
+			continue
+		}
+		sort.Strings(namespaces)
+		device := "/dev/" + filepath.Base(namespaces[0])
+		return &device
+	}
+	return nil
+}
+
+// findDeviceMapperHolder finds the name of the device mapper device (e.g.
+// mpatha) that holds the given device (e.g. /dev/sdb) and whose uuid starts
+// with the given prefix, by looking at the holders of the device in sysfs.
+// An empty string is returned if there is no such holder.
+func findDeviceMapperHolder(device, uuidPrefix string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", err
+	}
+
+	holdersDir := filepath.Join("/sys/class/block", filepath.Base(resolved), "holders")
+	holders, err := ioutil.ReadDir(holdersDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	for _, holder := range holders {
+		dmDir := filepath.Join("/sys/class/block", holder.Name(), "dm")
+		uuid, err := ioutil.ReadFile(filepath.Join(dmDir, "uuid"))
+		if err != nil {
+			continue
+		}
+		if !strings.HasPrefix(string(uuid), uuidPrefix) {
+			continue
+		}
+		name, err := ioutil.ReadFile(filepath.Join(dmDir, "name"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(name)), nil
+	}
+	return "", nil
+}
+
+// resolveMultipathDevice returns the multipath device if the given device is
+// one of its paths, so that the volume is not accessed through a single path
+// only. Otherwise the device is returned unchanged.
+func resolveMultipathDevice(device string) (string, error) {
+	// multipathd sets the uuid of multipath devices to mpath-<wwid>
+	name, err := findDeviceMapperHolder(device, "mpath-")
+	if err != nil {
+		return "", fmt.Errorf("could not check if %s is part of a multipath device: %v", device, err)
+	}
+	if name == "" {
+		return device, nil
+	}
+	return "/dev/mapper/" + name, nil
+}
+
+// FilesystemMismatchError is returned if a device is to be mounted with another
+// filesystem type than the one it is formatted with.
+type FilesystemMismatchError struct {
+	Device    string
+	Existing  string
+	Requested string
+}
+
+func (e *FilesystemMismatchError) Error() string {
+	return fmt.Sprintf("device %s is formatted as %q, but %q was requested; refusing to mount or reformat it",
+		e.Device, e.Existing, e.Requested)
+}
+
+// checkFilesystemType makes sure that the filesystem on the device matches
+// the requested type. Unformatted devices are accepted, as they are
+// formatted before mounting.
+func checkFilesystemType(source, fsType string) error {
+	existing, err := getFilesystemType(source)
+	if err != nil {
+		return err
+	}
+
+	if existing == "" || existing == fsType {
+		return nil
+	}
+
+	// the ext4 driver mounts ext2 and ext3 filesystems as well
+	if fsType == "ext4" && (existing == "ext2" || existing == "ext3") {
+		return nil
+	}
+
+	return &FilesystemMismatchError{Device: source, Existing: existing, Requested: fsType}
+}
+
+// DeviceNotFoundError is returned if the device of an attached volume did not
+// appear in time.
+type DeviceNotFoundError struct {
+	VolumeID string
+	Timeout  time.Duration
+}
+
+func (e *DeviceNotFoundError) Error() string {
+	return fmt.Sprintf("device of volume %s did not appear within %s", e.VolumeID, e.Timeout)
+}
+
+func (m *mounter) FinalizeVolumeAttachmentAndFindPath(ctx context.Context, logger *logrus.Entry, volumeID string) (*string, error) {
+	deadline := time.Now().Add(m.deviceWaitTimeout)
+	backoff := 100 * time.Millisecond
+	var nextProbe time.Time
+	probeBackoff := time.Second
+
+	for {
+		DiskIDPath := guessDiskIDPathByVolumeID(volumeID)
+		if DiskIDPath != nil {
+			return m.resolveMultipath(logger, *DiskIDPath)
+		}
+
+		// the kernel might have missed the hotplug event, so rescan the
+		// buses at least once before giving up; rescanning all buses is
+		// expensive, so it is repeated with backoff
+		if !time.Now().Before(nextProbe) {
+			m.probe(ctx, logger)
+			nextProbe = time.Now().Add(probeBackoff)
+			probeBackoff *= 2
+
+			// the device might have appeared while probing
+			if DiskIDPath := guessDiskIDPathByVolumeID(volumeID); DiskIDPath != nil {
+				return m.resolveMultipath(logger, *DiskIDPath)
+			}
+		}
+
+		if time.Now().After(deadline) {
+			break
+		}
+
+		logger.WithField("backoff", backoff).Debug("device not found yet, waiting")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff < 2*time.Second {
+			backoff *= 2
+		}
+	}
+	return nil, &DeviceNotFoundError{VolumeID: volumeID, Timeout: m.deviceWaitTimeout}
+}
+
+func (m *mounter) resolveMultipath(logger *logrus.Entry, device string) (*string, error) {
+	resolved, err := resolveMultipathDevice(device)
+	if err != nil {
+		return nil, err
+	}
+	if resolved != device {
+		logger.WithFields(logrus.Fields{
+			"device":           device,
+			"multipath_device": resolved,
+		}).Info("using multipath device")
+	}
+	return &resolved, nil
+}
+
+func probeAttachedVolume(ctx context.Context, logger *logrus.Entry) error {
+	// rescan the buses the volume might be attached to, in case the kernel
+	// missed the hotplug event
+	if err := scsiHostRescan(scsiHostPath); err != nil {
+		logger.WithError(err).Warn("scsi host rescan failed")
+	}
+	if err := pciBusRescan(pciRescanPath); err != nil {
+		logger.WithError(err).Warn("pci bus rescan failed")
+	}
+
+	// udevadm trigger replays the device events, in case one was missed
+	args := []string{"trigger", "--subsystem-match=block"}
+	cmd := exec.CommandContext(ctx, "udevadm", args...)
+	_, err := cmd.CombinedOutput()
+	if err != nil {
+		logger.Errorf("error running udevadm trigger %v\n", err)
+		return err
+	}
+
+	// udevadm settle waits for udevd to process the device creation
+	// events for all hardware devices, thus ensuring that any device
+	// nodes have been created successfully before proceeding.
+	argsSettle := []string{"settle"}
+	cmdSettle := exec.CommandContext(ctx, "udevadm", argsSettle...)
+	_, errSettle := cmdSettle.CombinedOutput()
+	if errSettle != nil {
+		logger.Errorf("error running udevadm settle %v\n", errSettle)
+		return errSettle
+	}
+
+	logger.Debugf("Successfully probed all attachments")
+	return nil
+}
+
+// scsiHostRescan makes all scsi hosts (e.g. virtio-scsi) scan for new devices
+func scsiHostRescan(scsiPath string) error {
+	dirs, err := ioutil.ReadDir(scsiPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var errs []string
+	for _, f := range dirs {
+		name := filepath.Join(scsiPath, f.Name(), "scan")
+		if err := ioutil.WriteFile(name, []byte("- - -"), 0666); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// pciBusRescan makes the kernel rescan the pci bus, which picks up virtio-blk
+// devices whose hotplug event was missed
+func pciBusRescan(rescanPath string) error {
+	if _, err := os.Stat(rescanPath); os.IsNotExist(err) {
+		return nil
+	}
+	return ioutil.WriteFile(rescanPath, []byte("1"), 0200)
+}
+
+func (m *mounter) GetDeviceName(mounter mount.Interface, mountPath string) (string, error) {
+	devicePath, _, err := mount.GetDeviceNameFromMount(mounter, mountPath)
+	return devicePath, err
+}
+
+// FindAbsoluteDeviceByIDPath follows the /dev/disk/by-id symlink to find the absolute path of a device
+func (m *mounter) FindAbsoluteDeviceByIDPath(volumeName string) (string, error) {
+	path := guessDiskIDPathByVolumeID(volumeName)
+	if path == nil {
+		return "", fmt.Errorf("could not find device-path for volume: %s", volumeName)
+	}
+
+	// EvalSymlinks returns relative link if the file is not a symlink
+	// so we do not have to check if it is symlink prior to evaluation
+	resolved, err := filepath.EvalSymlinks(*path)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve symlink %q: %v", *path, err)
+	}
+
+	if !strings.HasPrefix(resolved, "/dev") {
+		return "", fmt.Errorf("resolved symlink %q for %q was unexpected", resolved, *path)
+	}
+
+	multipathDevice, err := resolveMultipathDevice(resolved)
+	if err != nil {
+		return "", err
+	}
+	if multipathDevice != resolved {
+		return filepath.EvalSymlinks(multipathDevice)
+	}
+
+	return resolved, nil
+}
+
+func (m *mounter) HasRequiredSize(ctx context.Context, log *logrus.Entry, path string, requiredSize int64) (bool, error) {
+	log.Infof("Checking device size: %s", path)
+	output, err := exec.CommandContext(ctx, "blockdev", "--getsize64", path).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("error when getting size of block volume at path %s: output: %s, err: %v", path, string(output), err)
+	}
+	strOut := strings.TrimSpace(string(output))
+	gotSizeBytes, err := strconv.ParseInt(strOut, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	log.Infof("actual=%v, requiredSize=%v", gotSizeBytes, requiredSize)
+	return gotSizeBytes == requiredSize, nil
+}
+
+func (m *mounter) GetStatistics(ctx context.Context, volumePath string) (VolumeStatistics, error) {
+	isBlock, err := m.IsBlockDevice(volumePath)
+	if err != nil {
+		return VolumeStatistics{}, fmt.Errorf("failed to determine if volume %s is block device: %v", volumePath, err)
+	}
+
+	if isBlock {
+		// See http://man7.org/linux/man-pages/man8/blockdev.8.html for details
+		output, err := exec.CommandContext(ctx, "blockdev", "getsize64", volumePath).CombinedOutput()
+		if err != nil {
+			return VolumeStatistics{}, fmt.Errorf("error when getting size of block volume at path %s: output: %s, err: %v", volumePath, string(output), err)
+		}
+		strOut := strings.TrimSpace(string(output))
+		gotSizeBytes, err := strconv.ParseInt(strOut, 10, 64)
+		if err != nil {
+			return VolumeStatistics{}, fmt.Errorf("failed to parse size %s into int", strOut)
+		}
+
+		return VolumeStatistics{
+			TotalBytes: gotSizeBytes,
+		}, nil
+	}
+
+	var statfs unix.Statfs_t
+	// See http://man7.org/linux/man-pages/man2/statfs.2.html for details.
+	err = unix.Statfs(volumePath, &statfs)
+	if err != nil {
+		return VolumeStatistics{}, err
+	}
+
+	volStats := VolumeStatistics{
+		AvailableBytes: int64(statfs.Bavail) * int64(statfs.Bsize),
+		TotalBytes:     int64(statfs.Blocks) * int64(statfs.Bsize),
+		UsedBytes:      (int64(statfs.Blocks) - int64(statfs.Bfree)) * int64(statfs.Bsize),
+
+		AvailableInodes: int64(statfs.Ffree),
+		TotalInodes:     int64(statfs.Files),
+		UsedInodes:      int64(statfs.Files) - int64(statfs.Ffree),
+	}
+
+	return volStats, nil
+}
+
+func (m *mounter) IsBlockDevice(devicePath string) (bool, error) {
+	var stat unix.Stat_t
+	err := unix.Stat(devicePath, &stat)
+	if err != nil {
+		return false, err
+	}
+
+	return (stat.Mode & unix.S_IFMT) == unix.S_IFBLK, nil
+}
+
+func (m *mounter) GetVolumeCondition(volumePath, stagingTargetPath string, readOnly bool) (string, error) {
+	isBlock, err := m.IsBlockDevice(volumePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine if volume %s is block device: %v", volumePath, err)
+	}
+
+	if isBlock {
+		// the device node is bind mounted to the volume path and thus still
+		// exists if the device is gone, but it can't be opened anymore
+		f, err := os.OpenFile(volumePath, os.O_RDONLY, 0)
+		if err != nil {
+			return fmt.Sprintf("block device at %s is not accessible: %v", volumePath, err), nil
+		}
+		f.Close()
+		return "", nil
+	}
+
+	device, _, err := mount.GetDeviceNameFromMount(m.kMounter, volumePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get device of volume path %s: %v", volumePath, err)
+	}
+	if strings.HasPrefix(device, "/dev/") {
+		if _, err := os.Stat(device); os.IsNotExist(err) {
+			return fmt.Sprintf("device %s of volume path %s is missing", device, volumePath), nil
+		}
+	}
+
+	if stagingTargetPath != "" {
+		var statfs unix.Statfs_t
+		if err := unix.Statfs(stagingTargetPath, &statfs); err != nil {
+			return fmt.Sprintf("staging target path %s is not accessible: %v", stagingTargetPath, err), nil
+		}
+		return readOnlyCondition(stagingTargetPath, int64(statfs.Flags), readOnly), nil
+	}
+
+	return "", nil
+}
+
+// readOnlyCondition returns the condition of the staging mount with the given
+// statfs flags. A staging mount which is read-only although the volume was
+// staged read-write was remounted read-only by the kernel due to errors.
+func readOnlyCondition(stagingTargetPath string, flags int64, readOnly bool) string {
+	if readOnly || flags&unix.ST_RDONLY == 0 {
+		return ""
+	}
+	return fmt.Sprintf("filesystem at %s is read-only", stagingTargetPath)
+}
+
+func (m *mounter) SetOwnership(target string, uid, gid int, mode os.FileMode) error {
+	m.log.WithFields(logrus.Fields{
+		"target": target,
+		"uid":    uid,
+		"gid":    gid,
+		"mode":   mode,
+	}).Info("setting ownership of the volume")
+
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(target, uid, gid); err != nil {
+			return fmt.Errorf("failed to change owner of %s: %v", target, err)
+		}
+	}
+
+	if mode != 0 {
+		if err := os.Chmod(target, mode); err != nil {
+			return fmt.Errorf("failed to change permissions of %s: %v", target, err)
+		}
+	}
+	return nil
+}
+
+func (m *mounter) SetVolumeMountGroup(ctx context.Context, target string, gid int) error {
+	var stat unix.Stat_t
+	if err := unix.Stat(target, &stat); err != nil {
+		return err
+	}
+
+	// if the root of the volume already belongs to the group and has the
+	// setgid bit set, the ownership has been applied before; skipping the
+	// walk saves a lot of time on volumes with many files
+	if int(stat.Gid) == gid && stat.Mode&unix.S_ISGID != 0 {
+		m.log.WithFields(logrus.Fields{
+			"target": target,
+			"gid":    gid,
+		}).Info("volume mount group is already applied")
+		return nil
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"target": target,
+		"gid":    gid,
+	}).Info("applying volume mount group")
+
+	// this mirrors the ownership handling of kubelet for fsGroup; the root
+	// is changed last, as it marks the ownership as applied
+	var root os.FileInfo
+	err := filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// the walk takes long on large volumes, stop once the call is
+		// canceled; it starts over with the next call
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if path == target {
+			root = info
+			return nil
+		}
+		return applyVolumeMountGroup(path, info, gid)
+	})
+	if err != nil {
+		return err
+	}
+	return applyVolumeMountGroup(target, root, gid)
+}
+
+// applyVolumeMountGroup changes the group of the file to the given one and
+// makes it accessible for the group
+func applyVolumeMountGroup(path string, info os.FileInfo, gid int) error {
+	if err := os.Lchown(path, -1, gid); err != nil {
+		return fmt.Errorf("failed to change group of %s: %v", path, err)
+	}
+
+	// chmod on a symlink would change the permissions of its target
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	mode := info.Mode() | 0660
+	if info.IsDir() {
+		mode |= os.ModeSetgid | 0110
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("failed to change mode of %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package mounter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"k8s.io/mount-utils"
+	kexec "k8s.io/utils/exec"
+)
+
+func TestGuessDiskIDPathByVolumeID(t *testing.T) {
+	volumeID := "2f2e7b8a-4b5f-4d9c-9a8e-1c2d3e4f5a6b"
+	dir := t.TempDir()
+	for _, name := range []string{
+		"scsi-0QEMU_QEMU_HARDDISK_2f2e7b8a-4b5f-4d9c-9",
+		"scsi-0QEMU_QEMU_HARDDISK_2f2e7b8a-4b5f-4d9c-9-part1",
+	} {
+		f, err := os.Create(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		f.Close()
+	}
+
+	path := guessDiskIDPathByVolumeIDInDir(dir, volumeID)
+	if assert.NotNil(t, path) {
+		assert.Equal(t, filepath.Join(dir, "scsi-0QEMU_QEMU_HARDDISK_2f2e7b8a-4b5f-4d9c-9"), *path)
+	}
+
+	// a disk exposing the full serial of another volume must not match
+	otherDir := t.TempDir()
+	f, err := os.Create(filepath.Join(otherDir, "scsi-0QEMU_QEMU_HARDDISK_2f2e7b8a-4b5f-4d9c-9fff-000000000000"))
+	assert.NoError(t, err)
+	f.Close()
+	assert.Nil(t, guessDiskIDPathByVolumeIDInDir(otherDir, volumeID))
+}
+
+func TestGuessDiskIDPathByVolumeIDNVMe(t *testing.T) {
+	volumeID := "2f2e7b8a-4b5f-4d9c-9a8e-1c2d3e4f5a6b"
+	dir := t.TempDir()
+	name := "nvme-QEMU_NVMe_Ctrl_2f2e7b8a-4b5f-4d9c-9_1"
+	f, err := os.Create(filepath.Join(dir, name))
+	assert.NoError(t, err)
+	f.Close()
+
+	path := guessDiskIDPathByVolumeIDInDir(dir, volumeID)
+	if assert.NotNil(t, path) {
+		assert.Equal(t, filepath.Join(dir, name), *path)
+	}
+}
+
+func TestFindNVMeDeviceByVolumeID(t *testing.T) {
+	volumeID := "2f2e7b8a-4b5f-4d9c-9a8e-1c2d3e4f5a6b"
+	classPath := t.TempDir()
+	for controller, serial := range map[string]string{
+		"nvme0": "00000000-0000-0000-0\n",
+		"nvme1": "2f2e7b8a-4b5f-4d9c-9\n",
+	} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(classPath, controller, controller+"n1"), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(classPath, controller, "serial"), []byte(serial), 0644))
+	}
+
+	path := findNVMeDeviceByVolumeID(classPath, volumeID)
+	if assert.NotNil(t, path) {
+		assert.Equal(t, "/dev/nvme1n1", *path)
+	}
+
+	assert.Nil(t, findNVMeDeviceByVolumeID(classPath, "11111111-4b5f-4d9c-9a8e-1c2d3e4f5a6b"))
+}
+
+func TestScsiHostRescan(t *testing.T) {
+	scsiPath := t.TempDir()
+	for _, host := range []string{"host0", "host1"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(scsiPath, host), 0755))
+	}
+
+	assert.NoError(t, scsiHostRescan(scsiPath))
+	for _, host := range []string{"host0", "host1"} {
+		data, err := os.ReadFile(filepath.Join(scsiPath, host, "scan"))
+		assert.NoError(t, err)
+		assert.Equal(t, "- - -", string(data))
+	}
+
+	// hosts without scsi support just have nothing to rescan
+	assert.NoError(t, scsiHostRescan(filepath.Join(scsiPath, "missing")))
+	assert.NoError(t, pciBusRescan(filepath.Join(scsiPath, "missing")))
+}
+
+func TestIsBindMountOf(t *testing.T) {
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "staging")
+	other := filepath.Join(dir, "other")
+	assert.NoError(t, os.Mkdir(staging, 0755))
+	assert.NoError(t, os.Mkdir(other, 0755))
+
+	assert.True(t, isBindMountOf(staging, staging))
+	assert.False(t, isBindMountOf(staging, other))
+	assert.False(t, isBindMountOf(staging, filepath.Join(dir, "missing")))
+}
+
+func TestSplitPropagationOptions(t *testing.T) {
+	options, propagation := splitPropagationOptions([]string{"bind", "rshared", "noexec", "rslave"})
+	assert.Equal(t, []string{"bind", "noexec"}, options)
+	assert.Equal(t, "rslave", propagation)
+
+	options, propagation = splitPropagationOptions([]string{"bind"})
+	assert.Equal(t, []string{"bind"}, options)
+	assert.Equal(t, "", propagation)
+}
+
+func TestSetVolumeMountGroupCanceled(t *testing.T) {
+	target := t.TempDir()
+	file := filepath.Join(target, "data")
+	assert.NoError(t, os.WriteFile(file, nil, 0600))
+	m := &mounter{log: logrus.New().WithField("test_enabled", true)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, m.SetVolumeMountGroup(ctx, target, os.Getgid()))
+
+	// the root is only marked once the walk completed
+	info, err := os.Stat(target)
+	assert.NoError(t, err)
+	assert.Zero(t, info.Mode()&os.ModeSetgid)
+
+	assert.NoError(t, m.SetVolumeMountGroup(context.Background(), target, os.Getgid()))
+	info, err = os.Stat(target)
+	assert.NoError(t, err)
+	assert.NotZero(t, info.Mode()&os.ModeSetgid)
+	info, err = os.Stat(file)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+}
+
+func TestDetach(t *testing.T) {
+	type key struct{}
+	parent, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "request"))
+	ctx, cancelDetached := detach(parent, time.Hour)
+	defer cancelDetached()
+
+	// mkfs is not killed once the CSI call is canceled
+	cancel()
+	assert.NoError(t, ctx.Err())
+	assert.Equal(t, "request", ctx.Value(key{}))
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), deadline, time.Minute)
+
+	// but once its own timeout expired
+	ctx, cancelDetached = detach(parent, time.Millisecond)
+	defer cancelDetached()
+	<-ctx.Done()
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+}
+
+func TestReadOnlyCondition(t *testing.T) {
+	path := "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount"
+
+	assert.Empty(t, readOnlyCondition(path, 0, false))
+	assert.Equal(t, "filesystem at "+path+" is read-only", readOnlyCondition(path, unix.ST_RDONLY, false))
+
+	// volumes staged read-only are mounted read-only on purpose
+	assert.Empty(t, readOnlyCondition(path, unix.ST_RDONLY, true))
+}
+
+func TestDeviceBindMounts(t *testing.T) {
+	dev, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dev, "sdb"), nil, 0600))
+
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	assert.NoError(t, os.WriteFile(mountInfo, []byte(`22 1 0:5 / `+dev+` rw,nosuid shared:2 - devtmpfs udev rw,mode=755
+100 30 0:5 /sdb /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-1/pod-1 rw,relatime shared:50 - devtmpfs udev rw,mode=755
+101 30 0:5 /sdb /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-1/pod-2 ro,relatime shared:50 - devtmpfs udev rw,mode=755
+102 30 0:5 /sdc /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-2/pod-1 ro,relatime shared:51 - devtmpfs udev rw,mode=755
+103 30 8:16 / /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-3/globalmount rw,relatime shared:52 - ext4 /dev/sdb rw
+`), 0600))
+
+	mounts, err := deviceBindMounts(filepath.Join(dev, "sdb"), mountInfo)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-1/pod-1": false,
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-1/pod-2": true,
+	}, mounts)
+}
+
+// fakeExec records the commands run and answers blkid with the given
+// filesystem type
+type fakeExec struct {
+	kexec.Interface
+	fsType   string
+	commands [][]string
+}
+
+func (e *fakeExec) Command(cmd string, args ...string) kexec.Cmd {
+	return e.CommandContext(context.Background(), cmd, args...)
+}
+
+func (e *fakeExec) CommandContext(ctx context.Context, cmd string, args ...string) kexec.Cmd {
+	e.commands = append(e.commands, append([]string{cmd}, args...))
+	out := ""
+	if cmd == "blkid" {
+		out = "DEVNAME=/dev/sdb\nTYPE=" + e.fsType + "\n"
+	}
+	return &fakeCmd{out: out}
+}
+
+type fakeCmd struct {
+	kexec.Cmd
+	out string
+}
+
+func (c *fakeCmd) CombinedOutput() ([]byte, error) {
+	return []byte(c.out), nil
+}
+
+func TestResizeFilesystem(t *testing.T) {
+	for _, tc := range []struct {
+		fsType string
+		resize []string
+	}{
+		// ext filesystems are resized through the device
+		{fsType: "ext4", resize: []string{"resize2fs", "/dev/sdb"}},
+		// xfs and btrfs through their mount point
+		{fsType: "xfs", resize: []string{"xfs_growfs", "-d", "/mnt/staging"}},
+		{fsType: "btrfs", resize: []string{"btrfs", "filesystem", "resize", "max", "/mnt/staging"}},
+	} {
+		t.Run(tc.fsType, func(t *testing.T) {
+			exec := &fakeExec{fsType: tc.fsType}
+			m := &mounter{
+				log:      logrus.New().WithField("test_enabled", true),
+				kMounter: &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil), Exec: exec},
+			}
+
+			assert.NoError(t, m.ResizeFilesystem(context.Background(), "/dev/sdb", "/mnt/staging"))
+			if assert.Len(t, exec.commands, 2) {
+				assert.Equal(t, "blkid", exec.commands[0][0])
+				assert.Equal(t, tc.resize, exec.commands[1])
+			}
+		})
+	}
+
+	// unsupported filesystems are not resized
+	exec := &fakeExec{fsType: "vfat"}
+	m := &mounter{
+		log:      logrus.New().WithField("test_enabled", true),
+		kMounter: &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil), Exec: exec},
+	}
+	assert.Error(t, m.ResizeFilesystem(context.Background(), "/dev/sdb", "/mnt/staging"))
+	assert.Len(t, exec.commands, 1)
+}
+
+func TestFinalizeVolumeAttachmentProbesWithBackoff(t *testing.T) {
+	probes := 0
+	m := &mounter{
+		log:               logrus.New().WithField("test_enabled", true),
+		deviceWaitTimeout: 1500 * time.Millisecond,
+		probe: func(ctx context.Context, logger *logrus.Entry) error {
+			probes++
+			return nil
+		},
+	}
+
+	_, err := m.FinalizeVolumeAttachmentAndFindPath(context.Background(), m.log, "2f2e7b8a-4b5f-4d9c-9a1b-0123456789ab")
+	var notFound *DeviceNotFoundError
+	assert.ErrorAs(t, err, &notFound)
+	// right away and once the first backoff of a second expired, not for
+	// every check of the device
+	assert.Equal(t, 2, probes)
+}
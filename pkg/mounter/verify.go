@@ -0,0 +1,76 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mounter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// DeviceMismatchError is returned if the device found for a volume does not
+// belong to it. Such a device must never be formatted.
+type DeviceMismatchError struct {
+	Device   string
+	VolumeID string
+	Reason   string
+}
+
+func (e *DeviceMismatchError) Error() string {
+	return fmt.Sprintf("device %s does not belong to volume %s: %s; refusing to format it",
+		e.Device, e.VolumeID, e.Reason)
+}
+
+// verifyDevice checks that the serials of the given device (or of all paths
+// of a multipath device) match the volume ID and that the device has the
+// expected size. The size is not checked if it is zero.
+func verifyDevice(sysBlockPath, byIDPath, device, volumeID string, sizeBytes int64) error {
+	if len(volumeID) < 20 {
+		return &DeviceMismatchError{Device: device, VolumeID: volumeID, Reason: "the volume ID is too short"}
+	}
+	expected := volumeID[:20]
+
+	serials := VolumeSerials(byIDPath)
+	for _, backing := range BackingDevices(sysBlockPath, device) {
+		serial, ok := serials[backing]
+		if !ok {
+			// udev might not have created links for NVMe devices
+			out, err := ioutil.ReadFile(filepath.Join(sysBlockPath, filepath.Base(backing), "device", "serial"))
+			if err != nil {
+				return &DeviceMismatchError{Device: device, VolumeID: volumeID, Reason: fmt.Sprintf("the serial of %s is unknown", backing)}
+			}
+			serial = strings.TrimSpace(string(out))
+		}
+
+		if !strings.HasPrefix(serial, expected) {
+			return &DeviceMismatchError{Device: device, VolumeID: volumeID, Reason: fmt.Sprintf("%s has the serial %q", backing, serial)}
+		}
+	}
+
+	if sizeBytes == 0 {
+		return nil
+	}
+	size, err := DeviceSize(device)
+	if err != nil {
+		return fmt.Errorf("checking the size of %s failed: %v", device, err)
+	}
+	if size != sizeBytes {
+		return &DeviceMismatchError{Device: device, VolumeID: volumeID, Reason: fmt.Sprintf("its size is %d bytes instead of %d bytes", size, sizeBytes)}
+	}
+	return nil
+}
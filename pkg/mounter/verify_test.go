@@ -0,0 +1,52 @@
+package mounter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyDevice(t *testing.T) {
+	sysBlock := t.TempDir()
+	byID := t.TempDir()
+	devices := t.TempDir()
+
+	volumeID := "2f2e7b8a-4b5f-4d9c-9a1b-0123456789ab"
+
+	sdb := filepath.Join(devices, "sdb")
+	assert.NoError(t, ioutil.WriteFile(sdb, make([]byte, 4096), 0644))
+	assert.NoError(t, os.Symlink(sdb, filepath.Join(byID, "scsi-0QEMU_QEMU_HARDDISK_2f2e7b8a-4b5f-4d9c-9")))
+
+	sdc := filepath.Join(devices, "sdc")
+	assert.NoError(t, ioutil.WriteFile(sdc, make([]byte, 4096), 0644))
+	assert.NoError(t, os.Symlink(sdc, filepath.Join(byID, "scsi-0QEMU_QEMU_HARDDISK_6f5c1e4d-8a2b-4c3d-a")))
+
+	nvme := filepath.Join(devices, "nvme0n1")
+	assert.NoError(t, ioutil.WriteFile(nvme, make([]byte, 4096), 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysBlock, "nvme0n1", "device"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(sysBlock, "nvme0n1", "device", "serial"), []byte("2f2e7b8a-4b5f-4d9c-9   \n"), 0644))
+
+	unknown := filepath.Join(devices, "sdd")
+	assert.NoError(t, ioutil.WriteFile(unknown, make([]byte, 4096), 0644))
+
+	assert.NoError(t, verifyDevice(sysBlock, byID, sdb, volumeID, 4096))
+	assert.NoError(t, verifyDevice(sysBlock, byID, sdb, volumeID, 0), "the size is optional")
+	assert.NoError(t, verifyDevice(sysBlock, byID, nvme, volumeID, 4096))
+
+	for name, tc := range map[string]struct {
+		device string
+		size   int64
+	}{
+		"other volume":   {device: sdc, size: 4096},
+		"unknown serial": {device: unknown, size: 4096},
+		"wrong size":     {device: sdb, size: 8192},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := verifyDevice(sysBlock, byID, tc.device, volumeID, tc.size)
+			assert.IsType(t, &DeviceMismatchError{}, err)
+		})
+	}
+}
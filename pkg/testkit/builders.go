@@ -0,0 +1,269 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testkit
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pauseImage is used instead of a sleeping busybox, as the pause container
+// properly terminates when the container runtime signals TERM; a sleeping
+// busybox will not and it will take a while before the container is killed
+const pauseImage = "gcr.io/google-containers/pause-amd64:3.1"
+
+// Pod returns a pod which mounts the filesystem volumes of the descriptor at
+// /data-<index> and the block volumes at /dev/xvd-<index>.
+func Pod(desc PodDescriptor, namespace string) *v1.Pod {
+	volumeMounts := make([]v1.VolumeMount, 0)
+	volumeDevices := make([]v1.VolumeDevice, 0)
+
+	for i, volume := range desc.Volumes {
+		volumeName := fmt.Sprintf("volume-%v", i)
+		if !volume.Block {
+			volumeMounts = append(volumeMounts, v1.VolumeMount{
+				MountPath: fmt.Sprintf("/data-%v", i),
+				Name:      volumeName,
+			})
+		} else {
+			volumeDevices = append(volumeDevices, v1.VolumeDevice{
+				DevicePath: fmt.Sprintf("/dev/xvd-%v", i),
+				Name:       volumeName,
+			})
+		}
+	}
+
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      desc.Name,
+			Namespace: namespace,
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{
+					Name:          "pause",
+					Image:         pauseImage,
+					VolumeMounts:  volumeMounts,
+					VolumeDevices: volumeDevices,
+				},
+			},
+			Volumes: podVolumes(desc),
+		},
+	}
+}
+
+// Deployment returns a deployment with a single replica, which mounts the
+// volumes of the descriptor at /data-<index>.
+func Deployment(desc PodDescriptor) *appsv1.Deployment {
+	replicas := int32(1)
+	volumeMounts := make([]v1.VolumeMount, 0)
+	for i := range desc.Volumes {
+		volumeMounts = append(volumeMounts, v1.VolumeMount{
+			MountPath: fmt.Sprintf("/data-%v", i),
+			Name:      fmt.Sprintf("volume-%v", i),
+		})
+	}
+
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: desc.Name,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": desc.Name,
+				},
+			},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						"app": desc.Name,
+					},
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{
+							Name:         "pause",
+							Image:        pauseImage,
+							VolumeMounts: volumeMounts,
+						},
+					},
+					Volumes: podVolumes(desc),
+				},
+			},
+		},
+	}
+}
+
+func podVolumes(desc PodDescriptor) []v1.Volume {
+	volumes := make([]v1.Volume, 0)
+	for i, volume := range desc.Volumes {
+		volumes = append(volumes, v1.Volume{
+			Name: fmt.Sprintf("volume-%v", i),
+			VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+					ClaimName: volume.ClaimName,
+				},
+			},
+		})
+	}
+	return volumes
+}
+
+// PersistentVolumeClaims returns the claims of the volumes of the descriptor.
+func PersistentVolumeClaims(desc PodDescriptor) []*v1.PersistentVolumeClaim {
+	pvcs := make([]*v1.PersistentVolumeClaim, 0)
+
+	for _, volume := range desc.Volumes {
+		volMode := v1.PersistentVolumeFilesystem
+		if volume.Block {
+			volMode = v1.PersistentVolumeBlock
+		}
+		storageClass := volume.StorageClass
+
+		pvcs = append(pvcs, &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: volume.ClaimName,
+			},
+			Spec: v1.PersistentVolumeClaimSpec{
+				VolumeMode: &volMode,
+				AccessModes: []v1.PersistentVolumeAccessMode{
+					v1.ReadWriteOnce,
+				},
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{
+						v1.ResourceStorage: resource.MustParse(fmt.Sprintf("%vGi", volume.SizeGB)),
+					},
+				},
+				StorageClassName: &storageClass,
+				DataSource:       DataSource(volume),
+			},
+		})
+	}
+
+	return pvcs
+}
+
+// DataSource returns the data source of the claim of a volume, if it is
+// restored from a snapshot or cloned.
+func DataSource(volume Volume) *v1.TypedLocalObjectReference {
+	switch {
+	case volume.FromSnapshot != "":
+		apiGroup := "snapshot.storage.k8s.io"
+		return &v1.TypedLocalObjectReference{
+			APIGroup: &apiGroup,
+			Kind:     "VolumeSnapshot",
+			Name:     volume.FromSnapshot,
+		}
+	case volume.CloneOf != "":
+		return &v1.TypedLocalObjectReference{
+			Kind: "PersistentVolumeClaim",
+			Name: volume.CloneOf,
+		}
+	}
+	return nil
+}
+
+// LuksSecrets returns the secrets with the luks keys of the volumes of the
+// descriptor.
+func LuksSecrets(desc PodDescriptor, namespace string) []*v1.Secret {
+	secrets := make([]*v1.Secret, 0)
+	for _, volume := range desc.Volumes {
+		if volume.LuksKey == "" {
+			continue
+		}
+		secrets = append(secrets, &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%v-luks-key", volume.ClaimName),
+				Namespace: namespace,
+			},
+			Type: v1.SecretTypeOpaque,
+			StringData: map[string]string{
+				"luksKey": volume.LuksKey,
+			},
+		})
+	}
+	return secrets
+}
+
+// CreatePod creates the luks secrets of the volumes and the pod of the
+// descriptor. The claims are created by CreatePersistentVolumeClaims.
+func (k *Kit) CreatePod(ctx context.Context, desc PodDescriptor) (*v1.Pod, error) {
+	if err := k.createLuksSecrets(ctx, desc); err != nil {
+		return nil, err
+	}
+	return k.Client.CoreV1().Pods(k.Namespace).Create(ctx, Pod(desc, k.Namespace), metav1.CreateOptions{})
+}
+
+// CreateDeployment creates the luks secrets of the volumes and the deployment
+// of the descriptor.
+func (k *Kit) CreateDeployment(ctx context.Context, desc PodDescriptor) (*appsv1.Deployment, error) {
+	if err := k.createLuksSecrets(ctx, desc); err != nil {
+		return nil, err
+	}
+	return k.Client.AppsV1().Deployments(k.Namespace).Create(ctx, Deployment(desc), metav1.CreateOptions{})
+}
+
+func (k *Kit) createLuksSecrets(ctx context.Context, desc PodDescriptor) error {
+	for _, secret := range LuksSecrets(desc, k.Namespace) {
+		_, err := k.Client.CoreV1().Secrets(k.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("creating luks secret %v: %w", secret.Name, err)
+		}
+	}
+	return nil
+}
+
+// CreatePersistentVolumeClaims creates the claims of the volumes of the
+// descriptor.
+func (k *Kit) CreatePersistentVolumeClaims(ctx context.Context, desc PodDescriptor) ([]*v1.PersistentVolumeClaim, error) {
+	pvcs := PersistentVolumeClaims(desc)
+	for _, pvc := range pvcs {
+		_, err := k.Client.CoreV1().PersistentVolumeClaims(k.Namespace).Create(ctx, pvc, metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("creating pvc %v: %w", pvc.Name, err)
+		}
+	}
+	return pvcs, nil
+}
+
+// Delete deletes the pod or the deployment and the claims of the descriptor.
+// It does not wait for the resources to be deleted.
+func (k *Kit) Delete(ctx context.Context, desc PodDescriptor) error {
+	var err error
+	if desc.Kind == "Deployment" {
+		err = k.Client.AppsV1().Deployments(k.Namespace).Delete(ctx, desc.Name, metav1.DeleteOptions{})
+	} else {
+		err = k.Client.CoreV1().Pods(k.Namespace).Delete(ctx, desc.Name, metav1.DeleteOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	for _, volume := range desc.Volumes {
+		err := k.Client.CoreV1().PersistentVolumeClaims(k.Namespace).Delete(ctx, volume.ClaimName, metav1.DeleteOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testkit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Metric is a sample of the Prometheus text format.
+type Metric struct {
+	Name string
+	// Labels is the label set including the braces, e.g.
+	// {persistentvolumeclaim="data",namespace="default"}
+	Labels string
+	Value  float64
+}
+
+// ParseMetrics parses the samples of the Prometheus text format; comments
+// and timestamps are ignored.
+func ParseMetrics(r io.Reader) ([]Metric, error) {
+	metrics := make([]Metric, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var metric Metric
+		rest := line
+		if start := strings.Index(line, "{"); start >= 0 {
+			end := strings.LastIndex(line, "}")
+			if end < start {
+				return nil, fmt.Errorf("invalid metric %q", line)
+			}
+			metric.Name = line[:start]
+			metric.Labels = line[start : end+1]
+			rest = line[end+1:]
+		} else {
+			fields := strings.Fields(line)
+			metric.Name = fields[0]
+			rest = strings.TrimPrefix(line, fields[0])
+		}
+
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("metric %q has no value", line)
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("metric %q: %w", line, err)
+		}
+		metric.Value = value
+		metrics = append(metrics, metric)
+	}
+	return metrics, scanner.Err()
+}
+
+// FindMetric returns the first sample with the name whose labels contain the
+// given substring.
+func FindMetric(metrics []Metric, name, labelSubstring string) (Metric, bool) {
+	for _, metric := range metrics {
+		if metric.Name == name && strings.Contains(metric.Labels, labelSubstring) {
+			return metric, true
+		}
+	}
+	return Metric{}, false
+}
+
+// Sum returns the sum of the samples with the name whose labels contain all
+// of the given substrings, e.g. the number of calls of a CSI method across
+// all status codes with the name csi_plugin_operations_seconds_count.
+func Sum(metrics []Metric, name string, labelSubstrings ...string) float64 {
+	sum := 0.0
+	for _, metric := range metrics {
+		if metric.Name != name {
+			continue
+		}
+		matches := true
+		for _, substring := range labelSubstrings {
+			if !strings.Contains(metric.Labels, substring) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			sum += metric.Value
+		}
+	}
+	return sum
+}
+
+// ControllerMetrics scrapes the metrics endpoint of the controller. With
+// multiple replicas, the metrics of all replicas are returned.
+func (k *Kit) ControllerMetrics(ctx context.Context) ([]Metric, error) {
+	pods, err := k.Client.CoreV1().Pods(k.driverNamespace()).List(ctx, metav1.ListOptions{
+		LabelSelector: controllerSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(pods.Items) == 0 {
+		return nil, fmt.Errorf("unable to find csi-cloudscale-controller pods in namespace %v", k.driverNamespace())
+	}
+
+	var all []Metric
+	for _, pod := range pods.Items {
+		raw, err := k.Client.CoreV1().Pods(pod.Namespace).
+			ProxyGet("http", pod.Name, k.metricsPort(), "/metrics", nil).
+			DoRaw(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("scraping the metrics of %v: %w", pod.Name, err)
+		}
+		metrics, err := ParseMetrics(strings.NewReader(string(raw)))
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, metrics...)
+	}
+	return all, nil
+}
+
+// NodeMetrics scrapes the metrics of kubelet on the node, which include the
+// volume stats reported by the node plugin.
+func (k *Kit) NodeMetrics(ctx context.Context, nodeName string) ([]Metric, error) {
+	raw, err := k.Client.CoreV1().RESTClient().Get().
+		AbsPath("/api/v1/nodes", nodeName, "proxy/metrics").
+		DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMetrics(strings.NewReader(string(raw)))
+}
@@ -0,0 +1,122 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// NodePluginPod returns the node plugin pod of the node.
+func (k *Kit) NodePluginPod(ctx context.Context, nodeName string) (*v1.Pod, error) {
+	pods, err := k.Client.CoreV1().Pods(k.driverNamespace()).List(ctx, metav1.ListOptions{
+		LabelSelector: nodePluginSelector,
+		FieldSelector: "spec.nodeName=" + nodeName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		if pods.Items[i].DeletionTimestamp == nil {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unable to find csi-cloudscale-node pod on node %v", nodeName)
+}
+
+// NodeDiskInfo returns the disks of the volumes on the node, as reported by
+// the debug endpoint of the node plugin.
+func (k *Kit) NodeDiskInfo(ctx context.Context, nodeName string) ([]driver.DiskInfo, error) {
+	pod, err := k.NodePluginPod(ctx, nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := k.Client.CoreV1().Pods(pod.Namespace).
+		ProxyGet("http", pod.Name, k.debugPort(), "/diskinfo", nil).
+		DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	diskInfo := make([]driver.DiskInfo, 0)
+	err = json.Unmarshal(output, &diskInfo)
+	return diskInfo, err
+}
+
+// VolumeDiskInfo returns the disk of the persistent volume on the node of the
+// pod.
+func (k *Kit) VolumeDiskInfo(ctx context.Context, pod *v1.Pod, pvName string) (driver.DiskInfo, error) {
+	pod, err := k.Client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if err != nil {
+		return driver.DiskInfo{}, err
+	}
+	diskInfo, err := k.NodeDiskInfo(ctx, pod.Spec.NodeName)
+	if err != nil {
+		return driver.DiskInfo{}, err
+	}
+	for _, disk := range diskInfo {
+		if disk.PVCName == pvName {
+			return disk, nil
+		}
+	}
+	return driver.DiskInfo{}, fmt.Errorf("cannot find volume with name %v on node %v", pvName, pod.Spec.NodeName)
+}
+
+// Exec runs the command in a container of a pod and returns its stdout.
+func (k *Kit) Exec(ctx context.Context, namespace, podName, container string, command ...string) (string, error) {
+	var (
+		execOut bytes.Buffer
+		execErr bytes.Buffer
+	)
+
+	req := k.Client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(podName).
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(k.Config, "POST", req.URL())
+	if err != nil {
+		return "", fmt.Errorf("failed to init executor: %w", err)
+	}
+
+	err = exec.Stream(remotecommand.StreamOptions{
+		Stdout: &execOut,
+		Stderr: &execErr,
+	})
+	if err != nil {
+		return execOut.String(), fmt.Errorf("could not execute %q: %v: %v", strings.Join(command, " "), err, execErr.String())
+	}
+
+	return execOut.String(), nil
+}
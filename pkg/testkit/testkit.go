@@ -0,0 +1,117 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package testkit contains the helpers of the csi-cloudscale integration
+// tests for acceptance tests against a cluster running the driver: builders
+// for pods, deployments and claims, waiters, and access to the disk info and
+// the metrics of the nodes.
+package testkit
+
+import (
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// DefaultDriverNamespace is the namespace the Helm chart deploys the
+	// controller and the node plugin to
+	DefaultDriverNamespace = "kube-system"
+
+	// DefaultDebugPort is the port of the debug endpoint of the node plugin,
+	// which has to be enabled with --debug-addr=:9810 for the disk info
+	DefaultDebugPort = "9810"
+
+	// DefaultMetricsPort is the port of the metrics endpoint of the
+	// controller, which has to be enabled with --metrics-addr=:9809
+	DefaultMetricsPort = "9809"
+
+	// nodePluginSelector selects the node plugin pods of the Helm chart
+	nodePluginSelector = "app=csi-cloudscale-node, role=csi-cloudscale"
+
+	// controllerSelector selects the controller pods of the Helm chart
+	controllerSelector = "app=csi-cloudscale-controller, role=csi-cloudscale"
+)
+
+// Volume describes a volume of a pod and its claim.
+type Volume struct {
+	ClaimName    string
+	SizeGB       int
+	StorageClass string
+	// LuksKey is stored in the secret <ClaimName>-luks-key, which the luks
+	// storage classes of the Helm chart reference
+	LuksKey string
+	Block   bool
+	// FromSnapshot restores the volume from the VolumeSnapshot with this name
+	FromSnapshot string
+	// CloneOf clones the volume from the claim with this name
+	CloneOf string
+}
+
+// PodDescriptor describes a pod or a deployment (Kind "Deployment") with
+// volumes.
+type PodDescriptor struct {
+	Kind    string
+	Name    string
+	Volumes []Volume
+}
+
+// Kit runs the helpers against a namespace of a cluster.
+type Kit struct {
+	Client kubernetes.Interface
+	Config *rest.Config
+	// Namespace the pods, deployments and claims are created in
+	Namespace string
+	// DriverNamespace defaults to DefaultDriverNamespace
+	DriverNamespace string
+	// DebugPort defaults to DefaultDebugPort
+	DebugPort string
+	// MetricsPort defaults to DefaultMetricsPort
+	MetricsPort string
+}
+
+// New returns a Kit for the given cluster and namespace.
+func New(config *rest.Config, namespace string) (*Kit, error) {
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Kit{
+		Client:    client,
+		Config:    config,
+		Namespace: namespace,
+	}, nil
+}
+
+func (k *Kit) driverNamespace() string {
+	if k.DriverNamespace != "" {
+		return k.DriverNamespace
+	}
+	return DefaultDriverNamespace
+}
+
+func (k *Kit) debugPort() string {
+	if k.DebugPort != "" {
+		return k.DebugPort
+	}
+	return DefaultDebugPort
+}
+
+func (k *Kit) metricsPort() string {
+	if k.MetricsPort != "" {
+		return k.MetricsPort
+	}
+	return DefaultMetricsPort
+}
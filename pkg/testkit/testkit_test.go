@@ -0,0 +1,109 @@
+package testkit
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestPod(t *testing.T) {
+	pod := Pod(PodDescriptor{
+		Name: "app",
+		Volumes: []Volume{
+			{ClaimName: "data"},
+			{ClaimName: "raw", Block: true},
+		},
+	}, "test")
+
+	assert.Equal(t, "test", pod.Namespace)
+	container := pod.Spec.Containers[0]
+	assert.Equal(t, []v1.VolumeMount{{Name: "volume-0", MountPath: "/data-0"}}, container.VolumeMounts)
+	assert.Equal(t, []v1.VolumeDevice{{Name: "volume-1", DevicePath: "/dev/xvd-1"}}, container.VolumeDevices)
+	assert.Equal(t, "raw", pod.Spec.Volumes[1].PersistentVolumeClaim.ClaimName)
+}
+
+func TestPersistentVolumeClaims(t *testing.T) {
+	pvcs := PersistentVolumeClaims(PodDescriptor{
+		Volumes: []Volume{
+			{ClaimName: "data", SizeGB: 5, StorageClass: "ssd"},
+			{ClaimName: "raw", SizeGB: 1, StorageClass: "ssd", Block: true, CloneOf: "data"},
+			{ClaimName: "restored", SizeGB: 5, StorageClass: "ssd", FromSnapshot: "snap"},
+		},
+	})
+
+	assert.Equal(t, 3, len(pvcs))
+	assert.Equal(t, "5Gi", pvcs[0].Spec.Resources.Requests.Storage().String())
+	assert.Equal(t, v1.PersistentVolumeFilesystem, *pvcs[0].Spec.VolumeMode)
+	assert.Equal(t, "ssd", *pvcs[0].Spec.StorageClassName)
+	assert.Nil(t, pvcs[0].Spec.DataSource)
+
+	assert.Equal(t, v1.PersistentVolumeBlock, *pvcs[1].Spec.VolumeMode)
+	assert.Equal(t, &v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "data"}, pvcs[1].Spec.DataSource)
+
+	assert.Equal(t, "VolumeSnapshot", pvcs[2].Spec.DataSource.Kind)
+	assert.Equal(t, "snapshot.storage.k8s.io", *pvcs[2].Spec.DataSource.APIGroup)
+	assert.Equal(t, "snap", pvcs[2].Spec.DataSource.Name)
+}
+
+func TestLuksSecrets(t *testing.T) {
+	secrets := LuksSecrets(PodDescriptor{
+		Volumes: []Volume{
+			{ClaimName: "plain"},
+			{ClaimName: "encrypted", LuksKey: "secret"},
+		},
+	}, "test")
+
+	if assert.Equal(t, 1, len(secrets)) {
+		assert.Equal(t, "encrypted-luks-key", secrets[0].Name)
+		assert.Equal(t, "test", secrets[0].Namespace)
+		assert.Equal(t, map[string]string{"luksKey": "secret"}, secrets[0].StringData)
+	}
+}
+
+func TestParseMetrics(t *testing.T) {
+	metrics, err := ParseMetrics(strings.NewReader(`# HELP kubelet_volume_stats_capacity_bytes Capacity in bytes of the volume
+# TYPE kubelet_volume_stats_capacity_bytes gauge
+kubelet_volume_stats_capacity_bytes{namespace="test",persistentvolumeclaim="data"} 1.0434699264e+09
+kubelet_volume_stats_inodes{namespace="test",persistentvolumeclaim="data label"} 65536 1700000000000
+
+process_open_fds 12
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(metrics))
+
+	metric, ok := FindMetric(metrics, "kubelet_volume_stats_capacity_bytes", `persistentvolumeclaim="data"`)
+	assert.True(t, ok)
+	assert.Equal(t, 1.0434699264e+09, metric.Value)
+
+	metric, ok = FindMetric(metrics, "kubelet_volume_stats_inodes", "data label")
+	assert.True(t, ok)
+	assert.Equal(t, float64(65536), metric.Value)
+
+	metric, ok = FindMetric(metrics, "process_open_fds", "")
+	assert.True(t, ok)
+	assert.Equal(t, "", metric.Labels)
+	assert.Equal(t, float64(12), metric.Value)
+
+	_, ok = FindMetric(metrics, "kubelet_volume_stats_capacity_bytes", "other")
+	assert.False(t, ok)
+
+	_, err = ParseMetrics(strings.NewReader("broken{a=\"b\"} nan-ish\n"))
+	assert.Error(t, err)
+}
+
+func TestSum(t *testing.T) {
+	metrics := []Metric{
+		{Name: "ops_count", Labels: `{code="OK",method="CreateVolume"}`, Value: 3},
+		{Name: "ops_count", Labels: `{code="Internal",method="CreateVolume"}`, Value: 1},
+		{Name: "ops_count", Labels: `{code="OK",method="DeleteVolume"}`, Value: 2},
+		{Name: "ops_sum", Labels: `{code="OK",method="CreateVolume"}`, Value: 7.5},
+	}
+
+	assert.Equal(t, 6.0, Sum(metrics, "ops_count"))
+	assert.Equal(t, 4.0, Sum(metrics, "ops_count", `method="CreateVolume"`))
+	assert.Equal(t, 3.0, Sum(metrics, "ops_count", `method="CreateVolume"`, `code="OK"`))
+	assert.Equal(t, 0.0, Sum(metrics, "ops_count", `method="ListVolumes"`))
+	assert.Equal(t, 7.5, Sum(metrics, "ops_sum"))
+}
@@ -0,0 +1,95 @@
+/*
+Copyright cloudscale.ch
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testkit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// pollInterval is the interval of the waiters
+const pollInterval = 2 * time.Second
+
+// WaitForPodRunning waits until the pod runs. It fails early if the pod
+// terminated.
+func (k *Kit) WaitForPodRunning(ctx context.Context, name string, timeout time.Duration) (*v1.Pod, error) {
+	var pod *v1.Pod
+	err := wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		var err error
+		pod, err = k.Client.CoreV1().Pods(k.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		switch pod.Status.Phase {
+		case v1.PodFailed, v1.PodSucceeded:
+			return false, fmt.Errorf("pod %v terminated with phase %v", name, pod.Status.Phase)
+		case v1.PodRunning:
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("waiting for pod %v to run: %w", name, err)
+	}
+	return pod, nil
+}
+
+// WaitForClaimBound waits until the claim is bound.
+func (k *Kit) WaitForClaimBound(ctx context.Context, name string, timeout time.Duration) (*v1.PersistentVolumeClaim, error) {
+	var pvc *v1.PersistentVolumeClaim
+	err := wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		var err error
+		pvc, err = k.Client.CoreV1().PersistentVolumeClaims(k.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return pvc.Status.Phase == v1.ClaimBound, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("waiting for pvc %v to be bound: %w", name, err)
+	}
+	return pvc, nil
+}
+
+// WaitForVolumeAttached waits until the persistent volume is attached to a
+// node and returns the name of the node.
+func (k *Kit) WaitForVolumeAttached(ctx context.Context, pvName string, timeout time.Duration) (string, error) {
+	var nodeName string
+	err := wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		attachments, err := k.Client.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, attachment := range attachments.Items {
+			source := attachment.Spec.Source.PersistentVolumeName
+			if source != nil && *source == pvName && attachment.Status.Attached {
+				nodeName = attachment.Spec.NodeName
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("waiting for volume %v to be attached: %w", pvName, err)
+	}
+	return nodeName, nil
+}
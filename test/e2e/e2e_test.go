@@ -0,0 +1,78 @@
+//go:build e2e
+// +build e2e
+
+// Package e2e runs the external storage tests of Kubernetes against the
+// driver installed in the cluster of $KUBECONFIG. The e2e.test binary of the
+// Kubernetes release is taken from $E2E_TEST_BINARY, `make test-e2e`
+// downloads it.
+package e2e
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadSkipList returns the regular expressions of the skipped tests in the
+// given file, ignoring empty lines and comments
+func loadSkipList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var skip []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		skip = append(skip, line)
+	}
+	return skip, scanner.Err()
+}
+
+func TestExternalStorage(t *testing.T) {
+	binary := os.Getenv("E2E_TEST_BINARY")
+	if binary == "" {
+		t.Fatal("E2E_TEST_BINARY must be set to the e2e.test binary of Kubernetes")
+	}
+	kubeconfig := os.Getenv("KUBECONFIG")
+	if kubeconfig == "" {
+		t.Fatal("KUBECONFIG must be set to the cluster the driver is installed in")
+	}
+
+	testdriver, err := filepath.Abs("testdriver.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	skip, err := loadSkipList("skip.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{
+		"-ginkgo.focus=External.Storage.*csi.cloudscale.ch",
+		"-ginkgo.skip=" + strings.Join(skip, "|"),
+		"-storage.testdriver=" + testdriver,
+		"-kubeconfig=" + kubeconfig,
+	}
+	if reportDir := os.Getenv("E2E_REPORT_DIR"); reportDir != "" {
+		args = append(args, "-report-dir="+reportDir)
+	}
+	if focus := os.Getenv("E2E_FOCUS"); focus != "" {
+		args[0] = "-ginkgo.focus=External.Storage.*csi.cloudscale.ch.*" + focus
+	}
+
+	cmd := exec.Command(binary, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("external storage tests failed: %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"text/tabwriter"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// benchmarkTimeout bounds the time until all pods of the benchmark run and
+// until all of their volumes are detached again
+const benchmarkTimeout = 15 * time.Minute
+
+// TestBenchmark_Attach_Detach creates CSI_TEST_BENCHMARK pods with a volume
+// each at the same time, deletes them again once all of them run and prints
+// the distribution of the time until the pods run and until their volumes are
+// detached. The storage class is cloudscale-volume-ssd unless
+// CSI_TEST_BENCHMARK_STORAGE_CLASS is set.
+//
+// The times are sampled once per second.
+func TestBenchmark_Attach_Detach(t *testing.T) {
+	count, err := strconv.Atoi(os.Getenv("CSI_TEST_BENCHMARK"))
+	if err != nil || count < 1 {
+		t.Skip("set CSI_TEST_BENCHMARK to the number of pods to run the attach/detach benchmark")
+	}
+	storageClass := os.Getenv("CSI_TEST_BENCHMARK_STORAGE_CLASS")
+	if storageClass == "" {
+		storageClass = "cloudscale-volume-ssd"
+	}
+
+	run := pseudoUuid()[:8]
+	descriptors := make([]TestPodDescriptor, count)
+	for i := range descriptors {
+		descriptors[i] = TestPodDescriptor{
+			Kind: "Pod",
+			Name: fmt.Sprintf("csi-benchmark-%v-%d", run, i),
+			Volumes: []TestPodVolume{
+				{
+					ClaimName:    fmt.Sprintf("csi-benchmark-%v-%d", run, i),
+					SizeGB:       1,
+					StorageClass: storageClass,
+				},
+			},
+		}
+	}
+	defer deleteBenchmarkPods(t, descriptors)
+
+	t.Logf("Creating %d pods with storage class %v", count, storageClass)
+	created := make([]time.Time, count)
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	for i, descriptor := range descriptors {
+		wg.Add(1)
+		go func(i int, descriptor TestPodDescriptor) {
+			defer wg.Done()
+			created[i] = time.Now()
+			errs <- createBenchmarkPod(descriptor, run, storageClass)
+		}(i, descriptor)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	toRunning := make([]time.Duration, count)
+	err = wait.PollImmediate(time.Second, benchmarkTimeout, func() (bool, error) {
+		pods, err := client.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{
+			LabelSelector: "csi-benchmark=" + run,
+		})
+		if err != nil {
+			return false, err
+		}
+		now := time.Now()
+		for _, pod := range pods.Items {
+			i := benchmarkIndex(descriptors, pod.Name)
+			if i >= 0 && toRunning[i] == 0 && pod.Status.Phase == v1.PodRunning {
+				toRunning[i] = now.Sub(created[i])
+			}
+		}
+		return countDone(toRunning) == count, nil
+	})
+	if err != nil {
+		t.Fatalf("only %d of %d pods are running after %v: %v", countDone(toRunning), count, benchmarkTimeout, err)
+	}
+
+	volumes := make([]string, count)
+	for i, descriptor := range descriptors {
+		volumes[i] = getPVC(t, client, descriptor.Volumes[0].ClaimName).Spec.VolumeName
+	}
+
+	t.Logf("Deleting %d pods", count)
+	deleted := time.Now()
+	for _, descriptor := range descriptors {
+		err := client.CoreV1().Pods(namespace).Delete(context.Background(), descriptor.Name, metav1.DeleteOptions{})
+		assert.NoError(t, err)
+	}
+
+	toDetached := make([]time.Duration, count)
+	err = wait.PollImmediate(time.Second, benchmarkTimeout, func() (bool, error) {
+		attachments, err := client.StorageV1().VolumeAttachments().List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		attached := map[string]bool{}
+		for _, attachment := range attachments.Items {
+			if attachment.Spec.Source.PersistentVolumeName != nil {
+				attached[*attachment.Spec.Source.PersistentVolumeName] = true
+			}
+		}
+		now := time.Now()
+		for i, volume := range volumes {
+			if toDetached[i] == 0 && !attached[volume] {
+				toDetached[i] = now.Sub(deleted)
+			}
+		}
+		return countDone(toDetached) == count, nil
+	})
+	if err != nil {
+		t.Errorf("only %d of %d volumes are detached after %v: %v", countDone(toDetached), count, benchmarkTimeout, err)
+	}
+
+	fmt.Printf("\nattach/detach benchmark: %d pods, storage class %v\n\n", count, storageClass)
+	printBenchmarkReport(os.Stdout, map[string][]time.Duration{
+		"time to running":  toRunning,
+		"time to detached": toDetached,
+	})
+}
+
+// createBenchmarkPod creates the claim and the pod of the descriptor without
+// failing the test, so that it can be called from multiple goroutines
+func createBenchmarkPod(descriptor TestPodDescriptor, run string, storageClass string) error {
+	volume := descriptor.Volumes[0]
+	volumeMode := v1.PersistentVolumeFilesystem
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: volume.ClaimName},
+		Spec: v1.PersistentVolumeClaimSpec{
+			VolumeMode:  &volumeMode,
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: resource.MustParse(fmt.Sprintf("%vGi", volume.SizeGB)),
+				},
+			},
+			StorageClassName: strPtr(storageClass),
+		},
+	}
+	_, err := client.CoreV1().PersistentVolumeClaims(namespace).Create(context.Background(), pvc, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("creating pvc %v: %v", pvc.Name, err)
+	}
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   descriptor.Name,
+			Labels: map[string]string{"csi-benchmark": run},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{
+					Name:  "pause",
+					Image: "gcr.io/google-containers/pause-amd64:3.1",
+					VolumeMounts: []v1.VolumeMount{
+						{MountPath: "/data", Name: "volume"},
+					},
+				},
+			},
+			Volumes: []v1.Volume{
+				{
+					Name: "volume",
+					VolumeSource: v1.VolumeSource{
+						PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+							ClaimName: volume.ClaimName,
+						},
+					},
+				},
+			},
+		},
+	}
+	_, err = client.CoreV1().Pods(namespace).Create(context.Background(), pod, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("creating pod %v: %v", pod.Name, err)
+	}
+	return nil
+}
+
+// deleteBenchmarkPods deletes the pods and claims of the benchmark which
+// still exist
+func deleteBenchmarkPods(t *testing.T, descriptors []TestPodDescriptor) {
+	for _, descriptor := range descriptors {
+		err := client.CoreV1().Pods(namespace).Delete(context.Background(), descriptor.Name, metav1.DeleteOptions{})
+		if err != nil && !kubeerrors.IsNotFound(err) {
+			t.Errorf("deleting pod %v failed: %v", descriptor.Name, err)
+		}
+		err = client.CoreV1().PersistentVolumeClaims(namespace).Delete(context.Background(), descriptor.Volumes[0].ClaimName, metav1.DeleteOptions{})
+		if err != nil && !kubeerrors.IsNotFound(err) {
+			t.Errorf("deleting pvc %v failed: %v", descriptor.Volumes[0].ClaimName, err)
+		}
+	}
+}
+
+func benchmarkIndex(descriptors []TestPodDescriptor, name string) int {
+	for i, descriptor := range descriptors {
+		if descriptor.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// countDone returns the number of measurements which were taken
+func countDone(durations []time.Duration) int {
+	done := 0
+	for _, d := range durations {
+		if d != 0 {
+			done++
+		}
+	}
+	return done
+}
+
+// printBenchmarkReport prints the distribution of each measurement; missing
+// measurements are counted as failed
+func printBenchmarkReport(w io.Writer, measurements map[string][]time.Duration) {
+	names := make([]string, 0, len(measurements))
+	for name := range measurements {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MEASUREMENT\tN\tFAILED\tMIN\tP50\tP90\tP99\tMAX\tMEAN")
+	for _, name := range names {
+		var durations []time.Duration
+		for _, d := range measurements[name] {
+			if d != 0 {
+				durations = append(durations, d)
+			}
+		}
+		failed := len(measurements[name]) - len(durations)
+		if len(durations) == 0 {
+			fmt.Fprintf(tw, "%v\t0\t%d\t-\t-\t-\t-\t-\t-\n", name, failed)
+			continue
+		}
+
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		var sum time.Duration
+		for _, d := range durations {
+			sum += d
+		}
+		percentile := func(p int) time.Duration {
+			return durations[(len(durations)-1)*p/100]
+		}
+		fmt.Fprintf(tw, "%v\t%d\t%d\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			name, len(durations), failed,
+			durations[0].Round(time.Second),
+			percentile(50).Round(time.Second),
+			percentile(90).Round(time.Second),
+			percentile(99).Round(time.Second),
+			durations[len(durations)-1].Round(time.Second),
+			(sum / time.Duration(len(durations))).Round(time.Second))
+	}
+	tw.Flush()
+}
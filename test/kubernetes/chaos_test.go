@@ -0,0 +1,215 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// TestNodePlugin_Killed_During_Stage deletes the node plugin of the node a
+// pod is scheduled to as soon as its volume is attached, while the volume is
+// being formatted and staged, and checks that the pod runs with its volume
+// once the node plugin is back and that no luks mapping outlives the volume
+func TestNodePlugin_Killed_During_Stage(t *testing.T) {
+	for _, luks := range []bool{false, true} {
+		luks := luks
+		t.Run(fmt.Sprintf("luks=%v", luks), func(t *testing.T) {
+			volume, podDescriptor := chaosPod(t, luks)
+
+			pod := makeKubernetesPod(t, podDescriptor)
+			pvcs := makeKubernetesPVCs(t, podDescriptor)
+			assert.Equal(t, 1, len(pvcs))
+
+			pvc, err := kit.WaitForClaimBound(context.Background(), volume.ClaimName, 5*time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pvName := pvc.Spec.VolumeName
+			nodeName, err := kit.WaitForVolumeAttached(context.Background(), pvName, 5*time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if getPod(t, client, pod.Name).Status.Phase == v1.PodRunning {
+				t.Log("the pod is already running, the node plugin is killed after staging")
+			}
+			killNodePlugin(t, nodeName)
+
+			waitForPod(t, client, pod.Name)
+			disk, err := getVolumeInfo(t, pod, pvName)
+			assert.NoError(t, err)
+			assert.Equal(t, "ext4", disk.Filesystem)
+			if luks {
+				assert.Equal(t, "LUKS1", disk.Luks)
+			}
+			assertNoOrphanedLuksMappings(t, nodeName)
+
+			cleanup(t, podDescriptor)
+			waitCloudscaleVolumeDeleted(t, pvName)
+			assertNoOrphanedLuksMappings(t, nodeName)
+		})
+	}
+}
+
+// TestNodePlugin_Killed_During_Expand deletes the node plugin as soon as the
+// controller expanded a volume, while the node expands the luks mapping and
+// the filesystem, and checks that the expansion completes once the node
+// plugin is back
+func TestNodePlugin_Killed_During_Expand(t *testing.T) {
+	for _, luks := range []bool{false, true} {
+		luks := luks
+		t.Run(fmt.Sprintf("luks=%v", luks), func(t *testing.T) {
+			volume, podDescriptor := chaosPod(t, luks)
+
+			pod := makeKubernetesPod(t, podDescriptor)
+			pvcs := makeKubernetesPVCs(t, podDescriptor)
+			assert.Equal(t, 1, len(pvcs))
+
+			waitForPod(t, client, pod.Name)
+			pvc := getPVC(t, client, volume.ClaimName)
+			pv, err := client.CoreV1().PersistentVolumes().Get(context.Background(), pvc.Spec.VolumeName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodeName, err := getNodeName(namespace, pod.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			newSizeGB := volume.SizeGB + 2
+			pvc.Spec.Resources.Requests = v1.ResourceList{
+				v1.ResourceStorage: resource.MustParse(fmt.Sprintf("%vGi", newSizeGB)),
+			}
+			updatedPVC, err := client.CoreV1().PersistentVolumeClaims(namespace).Update(context.Background(), pvc, metav1.UpdateOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the node expansion starts as soon as the controller is done
+			_, err = waitForVolumeCapacityChange(client, pv.Name, pv.Spec.Capacity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			killNodePlugin(t, nodeName)
+
+			_, err = waitForVolumeClaimCapacityChange(client, pvc.Name, updatedPVC.Status.Capacity)
+			assert.NoError(t, err)
+
+			expectedFilesystemSize := newSizeGB * driver.GB
+			if luks {
+				expectedFilesystemSize -= luksOverhead
+			}
+			waitFilesystemResized(t, pod, pv.Name, expectedFilesystemSize)
+			assertNoOrphanedLuksMappings(t, nodeName)
+
+			cleanup(t, podDescriptor)
+			waitCloudscaleVolumeDeleted(t, pv.Name)
+			assertNoOrphanedLuksMappings(t, nodeName)
+		})
+	}
+}
+
+// chaosPod returns the descriptor of a pod with an ext4 volume, which is
+// encrypted if luks is set
+func chaosPod(t *testing.T, luks bool) (TestPodVolume, TestPodDescriptor) {
+	sc := TestStorageClass{VolumeType: "ssd", FsType: "ext4"}
+	volume := TestPodVolume{
+		ClaimName: "csi-pod-chaos-pvc",
+		SizeGB:    5,
+	}
+	if luks {
+		sc.LuksCipher = "aes-xts-plain64"
+		sc.LuksKeySize = "512"
+		volume.LuksKey = "secret"
+	}
+	volume.StorageClass = makeStorageClass(t, sc)
+
+	return volume, TestPodDescriptor{
+		Kind:    "Pod",
+		Name:    pseudoUuid(),
+		Volumes: []TestPodVolume{volume},
+	}
+}
+
+// killNodePlugin deletes the node plugin pod of the node without a grace
+// period and waits until its replacement is ready
+func killNodePlugin(t *testing.T, nodeName string) {
+	pod, err := kit.NodePluginPod(context.Background(), nodeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Killing node plugin %v on node %v", pod.Name, nodeName)
+	gracePeriod := int64(0)
+	err = client.CoreV1().Pods(pod.Namespace).Delete(context.Background(), pod.Name, metav1.DeleteOptions{
+		GracePeriodSeconds: &gracePeriod,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForNodePluginReady(t, nodeName, pod.UID)
+}
+
+// waitForNodePluginReady waits until a node plugin pod other than the given
+// one is ready on the node
+func waitForNodePluginReady(t *testing.T, nodeName string, killed types.UID) {
+	err := wait.PollImmediate(2*time.Second, 5*time.Minute, func() (bool, error) {
+		pod, err := kit.NodePluginPod(context.Background(), nodeName)
+		if err != nil || pod.UID == killed {
+			return false, nil
+		}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatalf("waiting for the node plugin on node %v to be ready: %v", nodeName, err)
+	}
+}
+
+// assertNoOrphanedLuksMappings checks that each luks mapping of a volume on
+// the node belongs to a persistent volume which still exists
+func assertNoOrphanedLuksMappings(t *testing.T, nodeName string) {
+	pod, err := kit.NodePluginPod(context.Background(), nodeName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	out, err := kit.Exec(context.Background(), pod.Namespace, pod.Name, "csi-cloudscale-plugin", "ls", "/dev/mapper")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pvs, err := client.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	existing := map[string]bool{}
+	for _, pv := range pvs.Items {
+		existing[pv.Name] = true
+	}
+
+	for _, mapping := range strings.Fields(out) {
+		if strings.HasPrefix(mapping, "pvc-") && !existing[mapping] {
+			t.Errorf("luks mapping %v on node %v has no persistent volume", mapping, nodeName)
+		}
+	}
+}
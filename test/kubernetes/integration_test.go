@@ -3,23 +3,19 @@
 package integration
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"crypto/rand"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/cloudscale-ch/cloudscale-go-sdk"
 	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/testkit"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/oauth2"
 	"k8s.io/client-go/rest"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
-	"strings"
 	"testing"
 	"time"
 
@@ -34,7 +30,6 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/tools/remotecommand"
 )
 
 const (
@@ -45,38 +40,21 @@ const (
 	luksOverhead = 2 * driver.MB
 )
 
-type TestPodVolume struct {
-	ClaimName    string
-	SizeGB       int
-	StorageClass string
-	LuksKey      string
-	Block        bool
-}
+type TestPodVolume = testkit.Volume
 
-type TestPodDescriptor struct {
-	Kind    string
-	Name    string
-	Volumes []TestPodVolume
-}
+type TestPodDescriptor = testkit.PodDescriptor
 
-type DiskInfo struct {
-	PVCName        string `json:"pvcName"`
-	PVCVolumeMode  string `json:"pvcVolumeMode"`
-	DeviceName     string `json:"deviceName"`
-	DeviceSize     int    `json:"deviceSize"`
-	Filesystem     string `json:"filesystem"`
-	FilesystemUUID string `json:"filesystemUUID"`
-	FilesystemSize int    `json:"filesystemSize"`
-	DeviceSource   string `json:"deviceSource"`
-	Luks           string `json:"luks,omitempty"`
-	Cipher         string `json:"cipher,omitempty"`
-	Keysize        int    `json:"keysize,omitempty"`
-}
+type DiskInfo = driver.DiskInfo
+
+// the node plugin has to be deployed with --debug-addr=:9810 for the tests to
+// query the disk info of the nodes
+const debugPort = "9810"
 
 var (
 	client           kubernetes.Interface
 	config           *rest.Config
 	cloudscaleClient *cloudscale.Client
+	kit              *testkit.Kit
 )
 
 func TestMain(m *testing.M) {
@@ -95,6 +73,8 @@ func TestMain(m *testing.M) {
 	os.Exit(exitStatus)
 }
 
+// TestNode_Zone_Annotation expects the zone labels of the node labeler
+// (controller.nodeLabeler in the Helm chart) or of kubelet
 func TestNode_Zone_Annotation(t *testing.T) {
 	labelSelector := "node-role.kubernetes.io/worker=true"
 	nodes, err := client.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{
@@ -679,13 +659,10 @@ func TestVolumeStats(t *testing.T) {
 	// wait for the pod to be running and verify that the p is bound
 	waitForPod(t, client, pod.Name)
 
-	// construct the metric url
 	nodeName := getPod(t, client, podName).Spec.NodeName
-	uri := fmt.Sprintf("%s/api/v1/nodes/%s/proxy/metrics", config.Host, nodeName)
-	t.Logf("Using the following metrics url: %v", uri)
 
 	// wait until the metrics for the volume are available
-	metrics, err := waitForMetric(t, uri, "kubelet_volume_stats_capacity_bytes", pvcName)
+	metrics, err := waitForMetric(t, nodeName, "kubelet_volume_stats_capacity_bytes", pvcName)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -721,19 +698,11 @@ func setup() error {
 	if err != nil {
 		return err
 	}
-
-	// create test namespace
-	_, err = client.CoreV1().Namespaces().Create(
-		context.Background(),
-		&v1.Namespace{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: namespace,
-			}},
-		metav1.CreateOptions{},
-	)
-
-	if err != nil {
-		return err
+	kit = &testkit.Kit{
+		Client:    client,
+		Config:    config,
+		Namespace: namespace,
+		DebugPort: debugPort,
 	}
 
 	// create cloudscale client with the secret deployed into the kube-system namespace
@@ -749,10 +718,35 @@ func setup() error {
 
 	cloudscaleClient = cloudscale.NewClient(oauthClient)
 
+	// remove what previous, aborted test runs left behind
+	if err := cleanLeakedResources(); err != nil {
+		return err
+	}
+
+	// create test namespace
+	_, err = client.CoreV1().Namespaces().Create(
+		context.Background(),
+		&v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   namespace,
+				Labels: map[string]string{testRunTag: testRunID},
+			}},
+		metav1.CreateOptions{},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("tagging the volumes of this test run with %v=%v", testRunTag, testRunID)
+	go tagTestVolumes(stopTagging)
+
 	return nil
 }
 
 func teardown() error {
+	close(stopTagging)
+
 	// delete all test resources
 	err := client.CoreV1().Namespaces().Delete(context.Background(), namespace, metav1.DeleteOptions{})
 	if err != nil && !(kubeerrors.IsNotFound(err) || kubeerrors.IsAlreadyExists(err)) {
@@ -769,94 +763,14 @@ func strPtr(s string) *string {
 // deletes resources (pods, deployment, pvcs) for the given TestPodDescriptor from kubernetes
 // NOTE: does not wait for the resources to be deleted
 func cleanup(t *testing.T, pod TestPodDescriptor) {
-	if pod.Kind == "Deployment" {
-		err := client.AppsV1().Deployments(namespace).Delete(context.Background(), pod.Name, metav1.DeleteOptions{})
-		assert.NoError(t, err)
-	} else {
-		err := client.CoreV1().Pods(namespace).Delete(context.Background(), pod.Name, metav1.DeleteOptions{})
-		assert.NoError(t, err)
-	}
-	for _, volume := range pod.Volumes {
-		err := client.CoreV1().PersistentVolumeClaims(namespace).Delete(context.Background(), volume.ClaimName, metav1.DeleteOptions{})
-		assert.NoError(t, err)
-	}
+	err := kit.Delete(context.Background(), pod)
+	assert.NoError(t, err)
 }
 
 // creates a kubernetes pod from the given TestPodDescriptor
 func makeKubernetesPod(t *testing.T, pod TestPodDescriptor) *v1.Pod {
-
-	volumeMounts := make([]v1.VolumeMount, 0)
-	volumeDevices := make([]v1.VolumeDevice, 0)
-	volumes := make([]v1.Volume, 0)
-	luksSecrets := make([]v1.Secret, 0)
-
-	for i, volume := range pod.Volumes {
-		volumeName := fmt.Sprintf("volume-%v", i)
-		if !volume.Block {
-			volumeMounts = append(volumeMounts, v1.VolumeMount{
-				MountPath: fmt.Sprintf("/data-%v", i),
-				Name:      volumeName,
-			})
-		} else {
-			volumeDevices = append(volumeDevices, v1.VolumeDevice{
-				DevicePath: fmt.Sprintf("/dev/xvd-%v", i),
-				Name:       volumeName,
-			})
-		}
-		volumes = append(volumes, v1.Volume{
-			Name: volumeName,
-			VolumeSource: v1.VolumeSource{
-				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
-					ClaimName: volume.ClaimName,
-				},
-			},
-		})
-		if volume.LuksKey != "" {
-			luksSecrets = append(luksSecrets, v1.Secret{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      fmt.Sprintf("%v-luks-key", volume.ClaimName),
-					Namespace: namespace,
-				},
-				Type: v1.SecretTypeOpaque,
-				StringData: map[string]string{
-					"luksKey": volume.LuksKey,
-				},
-			})
-		}
-	}
-
-	for _, secret := range luksSecrets {
-		t.Logf("Creating luks-secret %v", secret.Name)
-		_, err := client.CoreV1().Secrets(namespace).Create(context.Background(), &secret, metav1.CreateOptions{})
-		if err != nil {
-			t.Fatal(err)
-		}
-	}
-
-	kubernetesPod := &v1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      pod.Name,
-			Namespace: namespace,
-		},
-		Spec: v1.PodSpec{
-			// use google's pause container instead of a sleeping busybox
-			// reasoning: the pause container properly terminates when the container runtime
-			// signals TERM; a sleeping busybox will not and it will take a while before the
-			// container is killed, unless we were to explicitly handle the TERM signal
-			Containers: []v1.Container{
-				{
-					Name:          "pause",
-					Image:         "gcr.io/google-containers/pause-amd64:3.1",
-					VolumeMounts:  volumeMounts,
-					VolumeDevices: volumeDevices,
-				},
-			},
-			Volumes: volumes,
-		},
-	}
-
 	t.Log("Creating pod")
-	_, err := client.CoreV1().Pods(namespace).Create(context.Background(), kubernetesPod, metav1.CreateOptions{})
+	kubernetesPod, err := kit.CreatePod(context.Background(), pod)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -866,65 +780,8 @@ func makeKubernetesPod(t *testing.T, pod TestPodDescriptor) *v1.Pod {
 
 // creates a kubernetes deployment from the given TestPodDescriptor
 func makeKubernetesDeployment(t *testing.T, pod TestPodDescriptor) *appsv1.Deployment {
-	replicaCount := new(int32)
-	*replicaCount = 1
-
-	volumeMounts := make([]v1.VolumeMount, 0)
-	volumes := make([]v1.Volume, 0)
-
-	for i, volume := range pod.Volumes {
-		volumeName := fmt.Sprintf("volume-%v", i)
-		volumeMounts = append(volumeMounts, v1.VolumeMount{
-			MountPath: fmt.Sprintf("/data-%v", i),
-			Name:      volumeName,
-		})
-		volumes = append(volumes, v1.Volume{
-			Name: volumeName,
-			VolumeSource: v1.VolumeSource{
-				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
-					ClaimName: volume.ClaimName,
-				},
-			},
-		})
-	}
-
-	deployment := &appsv1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: pod.Name,
-		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: replicaCount,
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"app": pod.Name,
-				},
-			},
-			Template: v1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": pod.Name,
-					},
-				},
-				Spec: v1.PodSpec{
-					// use google's pause container instead of a sleeping busybox
-					// reasoning: the pause container properly terminates when the container runtime
-					// signals TERM; a sleeping busybox will not and it will take a while before the
-					// container is killed, unless we were to explicitly handle the TERM signal
-					Containers: []v1.Container{
-						{
-							Name:         "pause",
-							Image:        "gcr.io/google-containers/pause-amd64:3.1",
-							VolumeMounts: volumeMounts,
-						},
-					},
-					Volumes: volumes,
-				},
-			},
-		},
-	}
-
 	t.Logf("Creating deployment %v", pod.Name)
-	_, err := client.AppsV1().Deployments(namespace).Create(context.Background(), deployment, metav1.CreateOptions{})
+	deployment, err := kit.CreateDeployment(context.Background(), pod)
 	assert.NoError(t, err)
 
 	return deployment
@@ -932,39 +789,10 @@ func makeKubernetesDeployment(t *testing.T, pod TestPodDescriptor) *appsv1.Deplo
 
 // creates kubernetes pvcs from the given TestPodDescriptor
 func makeKubernetesPVCs(t *testing.T, pod TestPodDescriptor) []*v1.PersistentVolumeClaim {
-	pvcs := make([]*v1.PersistentVolumeClaim, 0)
-
-	for _, volume := range pod.Volumes {
-		volMode := v1.PersistentVolumeFilesystem
-		if volume.Block {
-			volMode = v1.PersistentVolumeBlock
-		}
-
-		pvcs = append(pvcs, &v1.PersistentVolumeClaim{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: volume.ClaimName,
-			},
-			Spec: v1.PersistentVolumeClaimSpec{
-				VolumeMode: &volMode,
-				AccessModes: []v1.PersistentVolumeAccessMode{
-					v1.ReadWriteOnce,
-				},
-				Resources: v1.ResourceRequirements{
-					Requests: v1.ResourceList{
-						v1.ResourceStorage: resource.MustParse(fmt.Sprintf("%vGi", volume.SizeGB)),
-					},
-				},
-				StorageClassName: strPtr(volume.StorageClass),
-			},
-		})
-	}
-
 	t.Log("Creating pvc")
-	for _, pvc := range pvcs {
-		_, err := client.CoreV1().PersistentVolumeClaims(namespace).Create(context.Background(), pvc, metav1.CreateOptions{})
-		if err != nil {
-			t.Fatal(err)
-		}
+	pvcs, err := kit.CreatePersistentVolumeClaims(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err)
 	}
 
 	return pvcs
@@ -988,44 +816,9 @@ func pseudoUuid() (uuid string) {
 
 // waitForPod waits for the given pod name to be running
 func waitForPod(t *testing.T, client kubernetes.Interface, name string) {
-	var err error
-	stopCh := make(chan struct{})
-
 	t.Logf("Waiting for pod %q to be running ...\n", name)
 
-	go func() {
-		select {
-		case <-time.After(time.Minute * 5):
-			err = errors.New("timing out waiting for pod state")
-			close(stopCh)
-		case <-stopCh:
-		}
-	}()
-
-	watchlist := cache.NewListWatchFromClient(client.CoreV1().RESTClient(),
-		"pods", namespace, fields.Everything())
-	_, controller := cache.NewInformer(watchlist, &v1.Pod{}, time.Second*1,
-		cache.ResourceEventHandlerFuncs{
-			UpdateFunc: func(o, n interface{}) {
-				pod := n.(*v1.Pod)
-				if name != pod.Name {
-					return
-				}
-
-				if pod.Status.Phase == v1.PodFailed || pod.Status.Phase == v1.PodSucceeded {
-					err = errors.New("pod status is Failed or in Succeeded status (terminated)")
-					close(stopCh)
-					return
-				}
-
-				if pod.Status.Phase == v1.PodRunning {
-					close(stopCh)
-					return
-				}
-			},
-		})
-
-	controller.Run(stopCh)
+	_, err := kit.WaitForPodRunning(context.Background(), name, 5*time.Minute)
 	assert.NoError(t, err)
 }
 
@@ -1112,34 +905,25 @@ func waitForVolumeClaimCapacityChange(client kubernetes.Interface, name string,
 	return pvc, err
 }
 
-// waitForMetric waits for the the given metric to be present at the location specified by uri
-func waitForMetric(t *testing.T, uri string, metricName string, pvcName string) (metrics *MetricsSet, err error) {
+// waitForMetric waits for the the given metric to be present in the kubelet metrics of the node
+func waitForMetric(t *testing.T, nodeName string, metricName string, pvcName string) ([]testkit.Metric, error) {
 	start := time.Now()
 
 	for {
-		result := client.CoreV1().RESTClient().
-			Get().
-			RequestURI(uri).
-			Do(context.Background())
-
-		if err := result.Error(); err != nil {
+		metrics, err := kit.NodeMetrics(context.Background(), nodeName)
+		if err != nil {
 			return nil, err
 		}
 
-		metrics := generateMetricsObject(result)
-		_, err := metrics.findByLabel(metricName, pvcName)
+		if _, ok := testkit.FindMetric(metrics, metricName, pvcName); ok {
+			return metrics, nil
+		}
 
-		if err != nil {
-			if time.Now().UnixNano()-start.UnixNano() > (5 * time.Minute).Nanoseconds() {
-				err = errors.New(fmt.Sprintf("timeout exceeded while waiting for metric %v for pvc %v", metricName, pvcName))
-				return nil, err
-			} else {
-				t.Logf("Waiting for metric, currently: %v", err)
-				time.Sleep(15 * time.Second)
-			}
-		} else {
-			return &metrics, nil
+		if time.Now().UnixNano()-start.UnixNano() > (5 * time.Minute).Nanoseconds() {
+			return nil, fmt.Errorf("timeout exceeded while waiting for metric %v for pvc %v", metricName, pvcName)
 		}
+		t.Logf("Waiting for metric %v of pvc %v", metricName, pvcName)
+		time.Sleep(15 * time.Second)
 	}
 }
 
@@ -1269,185 +1053,18 @@ func getNodeName(podNamespace string, podName string) (string, error) {
 
 // returns the diskinfo for the volume with the given name mounted into the given pod
 func getVolumeInfo(t *testing.T, pod *v1.Pod, volumeName string) (DiskInfo, error) {
-	node, err := getNodeName(pod.Namespace, pod.Name)
-	if err != nil {
-		return DiskInfo{}, err
-	}
-	diskInfo, err := getVolumeInfoFromNode(t, node)
-	if err != nil {
-		return DiskInfo{}, err
+	disk, err := kit.VolumeDiskInfo(context.Background(), pod, volumeName)
+	if err == nil {
+		t.Logf("disk info of volume %v: %+v", volumeName, disk)
 	}
-	for _, disk := range diskInfo {
-		if disk.PVCName == volumeName {
-			return disk, nil
-		}
-	}
-	return DiskInfo{}, fmt.Errorf("cannot find volume with name %v on node %v", volumeName, node)
+	return disk, err
 }
 
-// inspects the node and returns information about the disks from the node's perspective
-func getVolumeInfoFromNode(t *testing.T, nodeName string) ([]DiskInfo, error) {
-	diskInfo := make([]DiskInfo, 0)
-
-	pods, err := client.CoreV1().Pods("kube-system").List(context.Background(), metav1.ListOptions{
-		LabelSelector: "app=csi-cloudscale-node, role=csi-cloudscale",
-	})
-	if err != nil {
-		t.Errorf("unable to list pods in namespace kube-system: %v", err)
-		return diskInfo, err
-	}
-	var csiPluginPod *v1.Pod
-	for _, pod := range pods.Items {
-		tmpPod := pod
-		if tmpPod.Spec.NodeName == nodeName {
-			csiPluginPod = &tmpPod
-			break
-		}
-	}
-	if csiPluginPod == nil {
-		t.Errorf("unable to find csi-cloudscale-node pod on node %v", nodeName)
-		return diskInfo, errors.New("unable to find csi-cloudscale-node pod on node " + nodeName)
-	}
-
-	output, err := ExecCommand(csiPluginPod.Namespace, csiPluginPod.Name, "/bin/csi-diskinfo.sh")
-	log.Print("output:")
-	log.Print(output)
-	if err != nil {
-		return diskInfo, err
-	}
-	err = json.Unmarshal([]byte(output), &diskInfo)
-	return diskInfo, err
-}
-
-// taken from https://github.com/zalando-incubator/postgres-operator/blob/master/pkg/cluster/exec.go
-// and adapted to work for this scenario
-// ExecCommand executes arbitrary command inside the pod
-func ExecCommand(podNamespace string, podName string, command ...string) (string, error) {
-	log.Printf("executing command %q", strings.Join(command, " "))
-
-	var (
-		execOut bytes.Buffer
-		execErr bytes.Buffer
-	)
-
-	pod, err := client.CoreV1().Pods(podNamespace).Get(context.Background(), podName, metav1.GetOptions{})
-	if err != nil {
-		return "", fmt.Errorf("could not get pod info: %v", err)
-	}
-
-	// iterate through all containers looking for the one running the csi plugin
-	targetContainer := -1
-	for i, cr := range pod.Spec.Containers {
-		if cr.Name == "csi-cloudscale-plugin" {
-			targetContainer = i
-			break
-		}
-	}
-
-	if targetContainer < 0 {
-		return "", fmt.Errorf("could not find %s container to exec to", "csi-cloudscale-plugin")
-	}
-
-	req := client.CoreV1().RESTClient().Post().
-		Resource("pods").
-		Name(podName).
-		Namespace(podNamespace).
-		SubResource("exec").
-		Param("container", pod.Spec.Containers[targetContainer].Name).
-		Param("command", strings.Join(command, " ")).
-		Param("stdin", "false").
-		Param("stdout", "true").
-		Param("stderr", "true").
-		Param("tty", "false")
-
-	exec, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
-	if err != nil {
-		return "", fmt.Errorf("failed to init executor: %v", err)
-	}
-
-	err = exec.Stream(remotecommand.StreamOptions{
-		Stdout: &execOut,
-		Stderr: &execErr,
-		Tty:    false,
-	})
-
-	if err != nil {
-		return "", fmt.Errorf("could not execute: %v", err)
-	}
-
-	if execErr.Len() > 0 {
-		return "", fmt.Errorf("stderr: %v", execErr.String())
-	}
-
-	return execOut.String(), nil
-}
-
-// Metrics Handling
-
-type MetricsSet struct {
-	entries []MetricEntry
-}
-
-type MetricEntry struct {
-	metricName string
-	labels     string
-	value      string
-}
-
-func assertMetric(t *testing.T, metrics *MetricsSet, name string, substring string, expected float64, delta float64) {
-	metric, err := metrics.findByLabel(name, substring)
-	if err != nil {
+func assertMetric(t *testing.T, metrics []testkit.Metric, name string, substring string, expected float64, delta float64) {
+	metric, ok := testkit.FindMetric(metrics, name, substring)
+	if !ok {
 		t.Errorf("Metric not found %v", name)
+		return
 	}
-	float, err := strconv.ParseFloat(metric.value, 64)
-	if err != nil {
-		t.Error(err)
-	}
-	assert.InDelta(t, expected, float, delta)
-}
-
-func (km *MetricsSet) filterByName(name string) (ret []MetricEntry) {
-	for _, s := range km.entries {
-		if s.metricName == name {
-			ret = append(ret, s)
-		}
-	}
-	return
-}
-
-func (km *MetricsSet) findByLabel(name string, dictSubstring string) (*MetricEntry, error) {
-	for _, s := range km.filterByName(name) {
-		if strings.Contains(s.labels, dictSubstring) {
-			return &s, nil
-		}
-	}
-	return nil, errors.New(fmt.Sprintf("Could not find metric with name %v and label containg %v", name, dictSubstring))
-}
-
-func generateMetricsObject(result rest.Result) MetricsSet {
-	entries := make([]MetricEntry, 1000)
-	rawBody, _ := result.Raw()
-	scanner := bufio.NewScanner(strings.NewReader(string(rawBody)))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "#") {
-			continue
-		}
-		metric := generateMetricEntry(line)
-		entries = append(entries, metric)
-	}
-
-	return MetricsSet{entries}
-}
-
-func generateMetricEntry(line string) MetricEntry {
-	split := strings.Split(line, " ")
-	if strings.Contains(split[0], "{") {
-		start := strings.Index(split[0], "{")
-		end := strings.Index(split[0], "}")
-		metricLabels := split[0][start : end+1]
-		name := split[0][:start]
-		return MetricEntry{name, metricLabels, split[1]}
-	}
-	return MetricEntry{split[0], "", split[1]}
+	assert.InDelta(t, expected, metric.Value, delta)
 }
@@ -0,0 +1,142 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// luksKeyRotationTimeout bounds the time from the update of the luks secret
+// until the volume only opens with the new key
+const luksKeyRotationTimeout = 5 * time.Minute
+
+// TestLuksKey_Rotation updates the luks key of a claim and checks that the
+// volume opens with the new key and not with the old one, before and after
+// its pod was rescheduled to another node. The driver does not rotate luks
+// keys yet, so the test only runs if CSI_TEST_LUKS_KEY_ROTATION is set.
+func TestLuksKey_Rotation(t *testing.T) {
+	if os.Getenv("CSI_TEST_LUKS_KEY_ROTATION") == "" {
+		t.Skip("set CSI_TEST_LUKS_KEY_ROTATION to run the luks key rotation test")
+	}
+
+	nodeServers := getNodeServers(t)
+	if len(nodeServers) < 2 {
+		t.Skipf("at least two nodes with the driver are needed, found %d", len(nodeServers))
+	}
+
+	oldKey, newKey := "secret", "rotated-secret"
+	podDescriptor := TestPodDescriptor{
+		Kind: "Deployment",
+		Name: pseudoUuid(),
+		Volumes: []TestPodVolume{
+			{
+				ClaimName:    "csi-luks-rotation-pvc",
+				SizeGB:       1,
+				StorageClass: "cloudscale-volume-ssd-luks",
+				LuksKey:      oldKey,
+			},
+		},
+	}
+	makeKubernetesDeployment(t, podDescriptor)
+	pvcs := makeKubernetesPVCs(t, podDescriptor)
+	defer cleanup(t, podDescriptor)
+
+	pod := waitForDeploymentPod(t, podDescriptor.Name, "", time.Now().Add(5*time.Minute))
+	if pod == nil {
+		t.FailNow()
+	}
+	pvName := getPVC(t, client, pvcs[0].Name).Spec.VolumeName
+	assertLuksKey(t, pod, pvName, oldKey, "")
+
+	updateLuksKey(t, podDescriptor.Volumes[0].ClaimName, newKey)
+	waitForLuksKey(t, pod, pvName, newKey)
+	assertLuksKey(t, pod, pvName, newKey, oldKey)
+
+	// the volume must be staged with the new key on another node
+	oldNode := pod.Spec.NodeName
+	cordonNode(t, oldNode, true)
+	defer cordonNode(t, oldNode, false)
+	t.Logf("Deleting pod %v to move it away from node %v", pod.Name, oldNode)
+	err := client.CoreV1().Pods(namespace).Delete(context.Background(), pod.Name, metav1.DeleteOptions{})
+	assert.NoError(t, err)
+
+	pod = waitForDeploymentPod(t, podDescriptor.Name, oldNode, time.Now().Add(10*time.Minute))
+	if pod == nil {
+		t.FailNow()
+	}
+	assertLuksKey(t, pod, pvName, newKey, oldKey)
+}
+
+// updateLuksKey replaces the luks key in the secret of the claim
+func updateLuksKey(t *testing.T, claimName string, key string) {
+	name := fmt.Sprintf("%v-luks-key", claimName)
+	secret, err := client.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Updating the luks key in secret %v", name)
+	secret.Data = nil
+	secret.StringData = map[string]string{"luksKey": key}
+	_, err = client.CoreV1().Secrets(namespace).Update(context.Background(), secret, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// luksKeyOpens tests the key against the luks header of the device of the
+// volume on the node of the pod
+func luksKeyOpens(t *testing.T, pod *v1.Pod, pvName string, key string) (bool, error) {
+	disk, err := getVolumeInfo(t, pod, pvName)
+	if err != nil {
+		return false, err
+	}
+	if disk.Luks == "" {
+		return false, fmt.Errorf("volume %v is not luks encrypted", pvName)
+	}
+
+	nodePlugin, err := kit.NodePluginPod(context.Background(), pod.Spec.NodeName)
+	if err != nil {
+		return false, err
+	}
+	_, err = kit.Exec(context.Background(), nodePlugin.Namespace, nodePlugin.Name, "csi-cloudscale-plugin",
+		"sh", "-c", `printf %s "$0" | cryptsetup open --test-passphrase --key-file=- "$1"`, key, disk.DeviceSource)
+	return err == nil, nil
+}
+
+// assertLuksKey checks that the volume opens with the valid key and, unless
+// it is empty, not with the invalid key
+func assertLuksKey(t *testing.T, pod *v1.Pod, pvName string, valid string, invalid string) {
+	pod = getPod(t, client, pod.Name)
+	assert.Equal(t, v1.PodRunning, pod.Status.Phase)
+
+	opens, err := luksKeyOpens(t, pod, pvName, valid)
+	assert.NoError(t, err)
+	assert.True(t, opens, "volume %v does not open with the current key", pvName)
+
+	if invalid != "" {
+		opens, err = luksKeyOpens(t, pod, pvName, invalid)
+		assert.NoError(t, err)
+		assert.False(t, opens, "volume %v still opens with the old key", pvName)
+	}
+}
+
+// waitForLuksKey waits until the volume opens with the key
+func waitForLuksKey(t *testing.T, pod *v1.Pod, pvName string, key string) {
+	err := wait.PollImmediate(5*time.Second, luksKeyRotationTimeout, func() (bool, error) {
+		return luksKeyOpens(t, pod, pvName, key)
+	})
+	if err != nil {
+		t.Fatalf("waiting for volume %v to open with the new key: %v", pvName, err)
+	}
+}
@@ -0,0 +1,92 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cloudscale-ch/csi-cloudscale/pkg/testkit"
+	"github.com/stretchr/testify/assert"
+)
+
+// the controller has to be deployed with --metrics-addr=:9809 for the tests
+// to scrape its metrics
+const (
+	operationsCount = "csi_plugin_operations_seconds_count"
+	operationsSum   = "csi_plugin_operations_seconds_sum"
+	inFlight        = "csi_plugin_inflight_operations"
+	latencyCount    = "csi_plugin_provisioning_latency_seconds_count"
+	apiRequestCount = "cloudscale_api_request_duration_seconds_count"
+)
+
+// TestController_Metrics provisions, attaches, detaches and deletes a volume
+// and checks that the operation and API metrics of the controller account
+// for it
+func TestController_Metrics(t *testing.T) {
+	before := getControllerMetrics(t)
+
+	podDescriptor := TestPodDescriptor{
+		Kind: "Pod",
+		Name: pseudoUuid(),
+		Volumes: []TestPodVolume{
+			{
+				ClaimName:    "csi-pod-metrics-pvc",
+				SizeGB:       1,
+				StorageClass: "cloudscale-volume-ssd",
+			},
+		},
+	}
+	pod := makeKubernetesPod(t, podDescriptor)
+	pvcs := makeKubernetesPVCs(t, podDescriptor)
+	waitForPod(t, client, pod.Name)
+	pvName := getPVC(t, client, pvcs[0].Name).Spec.VolumeName
+
+	cleanup(t, podDescriptor)
+	waitCloudscaleVolumeDeleted(t, pvName)
+
+	after := getControllerMetrics(t)
+
+	for _, method := range []string{
+		"CreateVolume",
+		"ControllerPublishVolume",
+		"ControllerUnpublishVolume",
+		"DeleteVolume",
+	} {
+		labels := []string{
+			fmt.Sprintf(`method_name="/csi.v1.Controller/%v"`, method),
+			`grpc_status_code="OK"`,
+		}
+		assertMetricIncreased(t, before, after, operationsCount, labels...)
+		assertMetricIncreased(t, before, after, operationsSum, labels...)
+		assert.Equal(t, 0.0, testkit.Sum(after, inFlight, labels[0]), "%v still in flight", method)
+	}
+
+	for _, method := range []string{"CreateVolume", "ControllerPublishVolume"} {
+		for _, part := range []string{"total", "cloudscale_api"} {
+			assertMetricIncreased(t, before, after, latencyCount,
+				fmt.Sprintf(`method_name="/csi.v1.Controller/%v"`, method),
+				fmt.Sprintf(`part="%v"`, part))
+		}
+	}
+
+	assertMetricIncreased(t, before, after, apiRequestCount, `method="POST"`, `resource="volumes"`)
+	assertMetricIncreased(t, before, after, apiRequestCount, `method="DELETE"`, `resource="volumes"`)
+}
+
+func getControllerMetrics(t *testing.T) []testkit.Metric {
+	metrics, err := kit.ControllerMetrics(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metrics
+}
+
+// assertMetricIncreased checks that the sum of the matching samples increased
+func assertMetricIncreased(t *testing.T, before, after []testkit.Metric, name string, labelSubstrings ...string) {
+	old := testkit.Sum(before, name, labelSubstrings...)
+	current := testkit.Sum(after, name, labelSubstrings...)
+	assert.Greater(t, current, old, "%v%v did not increase", name, labelSubstrings)
+}
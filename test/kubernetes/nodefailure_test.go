@@ -0,0 +1,151 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// nodeFailureTimeout bounds the time from the node failure until the pod
+// runs with its volume on another node. Without fencing, Kubernetes force
+// detaches volumes of unreachable nodes after six minutes.
+const nodeFailureTimeout = 10 * time.Minute
+
+// TestDeployment_Node_Failure fails the node of a pod with a volume and
+// checks that the volume is detached from it and attached to the node of the
+// replacement pod. As it disrupts a node, it only runs if
+// CSI_TEST_NODE_FAILURE is set:
+//
+//   - taint: cordons the node and taints it with csi.cloudscale.ch/fenced,
+//     which evicts the pod and, with --node-fencing, detaches the volumes
+//   - delete: cordons and deletes the node object, which kubelet registers
+//     again
+func TestDeployment_Node_Failure(t *testing.T) {
+	mode := os.Getenv("CSI_TEST_NODE_FAILURE")
+	switch mode {
+	case "":
+		t.Skip("set CSI_TEST_NODE_FAILURE to taint or delete to run the node failure test")
+	case "taint", "delete":
+	default:
+		t.Fatalf("unknown CSI_TEST_NODE_FAILURE %q, must be taint or delete", mode)
+	}
+
+	nodeServers := getNodeServers(t)
+	if len(nodeServers) < 2 {
+		t.Skipf("at least two nodes with the driver are needed, found %d", len(nodeServers))
+	}
+
+	podDescriptor := TestPodDescriptor{
+		Kind: "Deployment",
+		Name: pseudoUuid(),
+		Volumes: []TestPodVolume{
+			{
+				ClaimName:    "csi-node-failure-pvc",
+				SizeGB:       5,
+				StorageClass: "cloudscale-volume-ssd",
+			},
+		},
+	}
+	makeKubernetesDeployment(t, podDescriptor)
+	pvcs := makeKubernetesPVCs(t, podDescriptor)
+
+	pod := waitForDeploymentPod(t, podDescriptor.Name, "", time.Now().Add(5*time.Minute))
+	if pod == nil {
+		t.FailNow()
+	}
+	pvc := getPVC(t, client, pvcs[0].Name)
+	assertVolumeFollowsPod(t, nodeServers, pod.Name, pvc.Spec.VolumeName)
+
+	failedNode := pod.Spec.NodeName
+	cordonNode(t, failedNode, true)
+	start := time.Now()
+	switch mode {
+	case "taint":
+		taintNode(t, failedNode, true)
+		defer taintNode(t, failedNode, false)
+		defer cordonNode(t, failedNode, false)
+	case "delete":
+		t.Logf("Deleting node %v", failedNode)
+		err := client.CoreV1().Nodes().Delete(context.Background(), failedNode, metav1.DeleteOptions{})
+		assert.NoError(t, err)
+		defer waitForNodeRegistered(t, failedNode)
+	}
+
+	moved := waitForDeploymentPod(t, podDescriptor.Name, failedNode, start.Add(nodeFailureTimeout))
+	if moved == nil {
+		t.Fatalf("the pod didn't run on another node within %v", nodeFailureTimeout)
+	}
+	t.Logf("Pod %v runs on node %v %v after the failure of node %v", moved.Name, moved.Spec.NodeName, time.Since(start), failedNode)
+	assertVolumeFollowsPod(t, nodeServers, moved.Name, pvc.Spec.VolumeName)
+
+	cleanup(t, podDescriptor)
+	waitCloudscaleVolumeDeleted(t, pvc.Spec.VolumeName)
+}
+
+// waitForDeploymentPod waits until a pod of the deployment runs on a node
+// other than the excluded one, and returns nil at the deadline
+func waitForDeploymentPod(t *testing.T, name, excludedNode string, deadline time.Time) *v1.Pod {
+	selector, err := appSelector(name)
+	assert.NoError(t, err)
+
+	var running *v1.Pod
+	err = wait.PollImmediate(5*time.Second, time.Until(deadline), func() (bool, error) {
+		pods, err := client.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return false, err
+		}
+		for i, pod := range pods.Items {
+			if pod.DeletionTimestamp == nil && pod.Status.Phase == v1.PodRunning && pod.Spec.NodeName != excludedNode {
+				running = &pods.Items[i]
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	assert.NoError(t, err, "waiting for a pod of deployment %v", name)
+	return running
+}
+
+func taintNode(t *testing.T, name string, taint bool) {
+	t.Logf("Setting taint %v of node %v to %v", driver.FenceTaint, name, taint)
+	node, err := client.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	taints := []v1.Taint{}
+	for _, existing := range node.Spec.Taints {
+		if existing.Key != driver.FenceTaint {
+			taints = append(taints, existing)
+		}
+	}
+	if taint {
+		taints = append(taints, v1.Taint{Key: driver.FenceTaint, Value: "true", Effect: v1.TaintEffectNoExecute})
+	}
+	node.Spec.Taints = taints
+	_, err = client.CoreV1().Nodes().Update(context.Background(), node, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+}
+
+// waitForNodeRegistered waits until kubelet registered the deleted node again
+func waitForNodeRegistered(t *testing.T, name string) {
+	err := wait.PollImmediate(5*time.Second, 5*time.Minute, func() (bool, error) {
+		_, err := client.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+		if kubeerrors.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	assert.NoError(t, err, "waiting for node %v to be registered again", name)
+}
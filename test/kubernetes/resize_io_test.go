@@ -0,0 +1,266 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ioWriterScript writes checksummed chunks of random data to /data/io until
+// /data/stop exists. The chunks are rewritten in a ring so that the volume
+// does not fill up. A failed write terminates the container with an error,
+// which fails the pod, as it is not restarted.
+const ioWriterScript = `
+set -u
+mkdir -p /data/io
+cd /data/io
+i=0
+while [ ! -e /data/stop ]; do
+  f=chunk-$((i % 32))
+  if ! dd if=/dev/urandom of=$f.tmp bs=1M count=8 conv=fsync 2>/dev/null; then
+    echo "write of $f failed"
+    exit 1
+  fi
+  mv $f.tmp $f || exit 1
+  md5sum $f > $f.md5 || exit 1
+  sync
+  i=$((i + 1))
+done
+echo "wrote $i chunks"
+touch /data/stopped
+sleep 3600
+`
+
+// TestPersistentVolume_Resize_Under_IO expands volumes while a pod keeps
+// writing to them and verifies that no write failed and that the data is
+// intact after the expansion
+func TestPersistentVolume_Resize_Under_IO(t *testing.T) {
+	storageClasses := []TestStorageClass{
+		{VolumeType: "ssd", FsType: "ext4"},
+		{VolumeType: "ssd", FsType: "xfs"},
+		{VolumeType: "ssd", FsType: "ext4", LuksCipher: "aes-xts-plain64", LuksKeySize: "512"},
+		{VolumeType: "ssd", FsType: "xfs", LuksCipher: "aes-xts-plain64", LuksKeySize: "512"},
+	}
+
+	for _, sc := range storageClasses {
+		sc := sc
+		t.Run(fmt.Sprintf("%v luks=%v", sc.FsType, sc.LuksCipher != ""), func(t *testing.T) {
+			testResizeUnderIO(t, sc, 5, 8)
+		})
+	}
+}
+
+func testResizeUnderIO(t *testing.T, sc TestStorageClass, initialSizeGB int, newSizeGB int) {
+	volume := TestPodVolume{
+		ClaimName:    "csi-pod-resize-io-pvc",
+		SizeGB:       initialSizeGB,
+		StorageClass: makeStorageClass(t, sc),
+	}
+	if sc.LuksCipher != "" {
+		volume.LuksKey = "secret"
+	}
+	podDescriptor := TestPodDescriptor{
+		Kind:    "Pod",
+		Name:    pseudoUuid(),
+		Volumes: []TestPodVolume{volume},
+	}
+
+	pod := makeIOWriterPod(t, podDescriptor)
+	pvcs := makeKubernetesPVCs(t, podDescriptor)
+	assert.Equal(t, 1, len(pvcs))
+
+	waitForPod(t, client, pod.Name)
+	pvc := getPVC(t, client, pvcs[0].Name)
+	assert.Equal(t, v1.ClaimBound, pvc.Status.Phase)
+
+	initialFilesystemSize, err := podFilesystemSize(pod.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// give the writer some time to get going before the volume is expanded
+	waitForChunks(t, pod.Name, 4)
+
+	pv, err := client.CoreV1().PersistentVolumes().Get(context.Background(), pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newSize := resource.MustParse(fmt.Sprintf("%vGi", newSizeGB))
+	t.Logf("Expanding pvc %v to %v while the pod is writing", pvc.Name, newSize.String())
+	pvc.Spec.Resources.Requests = v1.ResourceList{
+		v1.ResourceStorage: newSize,
+	}
+	updatedPVC, err := client.CoreV1().PersistentVolumeClaims(namespace).Update(context.Background(), pvc, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resizedPV, err := waitForVolumeCapacityChange(client, pv.Name, pv.Spec.Capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, newSize, resizedPV.Spec.Capacity[v1.ResourceStorage])
+
+	// the claim capacity is only updated once the node expanded the filesystem
+	resizedPVC, err := waitForVolumeClaimCapacityChange(client, pvc.Name, updatedPVC.Status.Capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, newSize, resizedPVC.Status.Capacity[v1.ResourceStorage])
+
+	filesystemSize, err := podFilesystemSize(pod.Name)
+	assert.NoError(t, err)
+	assert.Greater(t, filesystemSize, initialFilesystemSize, "the filesystem seen by the pod was not expanded")
+
+	// keep writing to the expanded volume for a bit, then stop the writer
+	time.Sleep(15 * time.Second)
+	stopIOWriter(t, pod.Name)
+
+	out, err := kit.Exec(context.Background(), namespace, pod.Name, "io", "sh", "-c", "cd /data/io && cat *.md5 | md5sum -c -")
+	assert.NoError(t, err, "data integrity check failed: %v", out)
+
+	pod = getPod(t, client, pod.Name)
+	if assert.Equal(t, 1, len(pod.Status.ContainerStatuses)) {
+		assert.Equal(t, int32(0), pod.Status.ContainerStatuses[0].RestartCount)
+	}
+	assert.Equal(t, v1.PodRunning, pod.Status.Phase)
+
+	cleanup(t, podDescriptor)
+	waitCloudscaleVolumeDeleted(t, pvc.Spec.VolumeName)
+}
+
+// makeIOWriterPod creates a pod which runs the ioWriterScript against the
+// first volume of the descriptor, which is mounted at /data
+func makeIOWriterPod(t *testing.T, pod TestPodDescriptor) *v1.Pod {
+	volume := pod.Volumes[0]
+	if volume.LuksKey != "" {
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%v-luks-key", volume.ClaimName),
+				Namespace: namespace,
+			},
+			Type: v1.SecretTypeOpaque,
+			StringData: map[string]string{
+				"luksKey": volume.LuksKey,
+			},
+		}
+		t.Logf("Creating luks-secret %v", secret.Name)
+		_, err := client.CoreV1().Secrets(namespace).Create(context.Background(), secret, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kubernetesPod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: namespace,
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy: v1.RestartPolicyNever,
+			Containers: []v1.Container{
+				{
+					Name:    "io",
+					Image:   "busybox",
+					Command: []string{"sh", "-c", ioWriterScript},
+					VolumeMounts: []v1.VolumeMount{
+						{
+							MountPath: "/data",
+							Name:      "volume-0",
+						},
+					},
+				},
+			},
+			Volumes: []v1.Volume{
+				{
+					Name: "volume-0",
+					VolumeSource: v1.VolumeSource{
+						PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+							ClaimName: volume.ClaimName,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	t.Log("Creating io writer pod")
+	_, err := client.CoreV1().Pods(namespace).Create(context.Background(), kubernetesPod, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return kubernetesPod
+}
+
+// waitForChunks waits until the writer completed the given number of chunks
+func waitForChunks(t *testing.T, podName string, count int) {
+	start := time.Now()
+
+	for {
+		out, err := kit.Exec(context.Background(), namespace, podName, "io", "sh", "-c", "ls /data/io | grep -c '\\.md5$'")
+		if err == nil {
+			if n, err := strconv.Atoi(strings.TrimSpace(out)); err == nil && n >= count {
+				return
+			}
+		}
+
+		if time.Since(start) > 2*time.Minute {
+			t.Fatalf("timeout exceeded while waiting for pod %v to write %v chunks", podName, count)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// stopIOWriter signals the writer to stop and waits until it did
+func stopIOWriter(t *testing.T, podName string) {
+	_, err := kit.Exec(context.Background(), namespace, podName, "io", "touch", "/data/stop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for {
+		if _, err := kit.Exec(context.Background(), namespace, podName, "io", "test", "-e", "/data/stopped"); err == nil {
+			return
+		}
+
+		pod := getPod(t, client, podName)
+		if pod.Status.Phase == v1.PodFailed {
+			t.Fatalf("io writer of pod %v failed", podName)
+		}
+
+		if time.Since(start) > 2*time.Minute {
+			t.Fatalf("timeout exceeded while waiting for the io writer of pod %v to stop", podName)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// podFilesystemSize returns the size in KiB of the filesystem mounted at /data
+// as seen from within the pod
+func podFilesystemSize(podName string) (int, error) {
+	out, err := kit.Exec(context.Background(), namespace, podName, "io", "df", "-Pk", "/data")
+	if err != nil {
+		return 0, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected df output: %q", out)
+	}
+	return strconv.Atoi(fields[1])
+}
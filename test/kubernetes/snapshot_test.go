@@ -0,0 +1,232 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// the snapshot client is not vendored, VolumeSnapshots are managed through the
+// REST client of the core API instead
+const volumeSnapshotsPath = "/apis/snapshot.storage.k8s.io/v1/namespaces/" + namespace + "/volumesnapshots"
+
+// TestVolumeSnapshot describes a VolumeSnapshot of a claim in the test
+// namespace
+type TestVolumeSnapshot struct {
+	Name      string
+	ClaimName string
+	// SnapshotClass is the VolumeSnapshotClass; the cluster default if empty
+	SnapshotClass string
+}
+
+// volumeSnapshot holds the fields of a snapshot.storage.k8s.io/v1
+// VolumeSnapshot which are used by the tests
+type volumeSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              struct {
+		Source struct {
+			PersistentVolumeClaimName *string `json:"persistentVolumeClaimName,omitempty"`
+		} `json:"source"`
+		VolumeSnapshotClassName *string `json:"volumeSnapshotClassName,omitempty"`
+	} `json:"spec"`
+	Status *struct {
+		ReadyToUse *bool `json:"readyToUse,omitempty"`
+		Error      *struct {
+			Message *string `json:"message,omitempty"`
+		} `json:"error,omitempty"`
+	} `json:"status,omitempty"`
+}
+
+// snapshotsEnabled skips the test unless CSI_TEST_SNAPSHOTS is set, as the
+// controller does not support snapshots and clones yet
+func snapshotsEnabled(t *testing.T) {
+	if os.Getenv("CSI_TEST_SNAPSHOTS") == "" {
+		t.Skip("set CSI_TEST_SNAPSHOTS to run the snapshot and clone tests")
+	}
+}
+
+// TestVolumeSnapshot_Restore restores a snapshot of a volume into a new
+// claim and checks that the restored volume has the filesystem of the original
+func TestVolumeSnapshot_Restore(t *testing.T) {
+	snapshotsEnabled(t)
+
+	original := TestPodDescriptor{
+		Kind: "Pod",
+		Name: pseudoUuid(),
+		Volumes: []TestPodVolume{
+			{
+				ClaimName:    "csi-pod-snapshot-source-pvc",
+				SizeGB:       5,
+				StorageClass: "cloudscale-volume-ssd",
+			},
+		},
+	}
+	restored := TestPodDescriptor{
+		Kind: "Pod",
+		Name: pseudoUuid(),
+		Volumes: []TestPodVolume{
+			{
+				ClaimName:    "csi-pod-snapshot-restored-pvc",
+				SizeGB:       5,
+				StorageClass: "cloudscale-volume-ssd",
+				FromSnapshot: "csi-test-snapshot",
+			},
+		},
+	}
+	testRestoredVolume(t, original, restored, func() {
+		makeVolumeSnapshot(t, TestVolumeSnapshot{
+			Name:      "csi-test-snapshot",
+			ClaimName: original.Volumes[0].ClaimName,
+		})
+		waitForVolumeSnapshotReady(t, "csi-test-snapshot")
+	})
+}
+
+// TestPersistentVolume_Clone clones a claim and checks that the clone has the
+// filesystem of the original
+func TestPersistentVolume_Clone(t *testing.T) {
+	snapshotsEnabled(t)
+
+	original := TestPodDescriptor{
+		Kind: "Pod",
+		Name: pseudoUuid(),
+		Volumes: []TestPodVolume{
+			{
+				ClaimName:    "csi-pod-clone-source-pvc",
+				SizeGB:       5,
+				StorageClass: "cloudscale-volume-ssd",
+			},
+		},
+	}
+	clone := TestPodDescriptor{
+		Kind: "Pod",
+		Name: pseudoUuid(),
+		Volumes: []TestPodVolume{
+			{
+				ClaimName:    "csi-pod-clone-pvc",
+				SizeGB:       5,
+				StorageClass: "cloudscale-volume-ssd",
+				CloneOf:      "csi-pod-clone-source-pvc",
+			},
+		},
+	}
+	testRestoredVolume(t, original, clone, func() {})
+}
+
+// testRestoredVolume runs the original pod, calls prepare and then runs the
+// restored pod, whose volume must have the filesystem of the original volume
+func testRestoredVolume(t *testing.T, original, restored TestPodDescriptor, prepare func()) {
+	originalPod := makeKubernetesPod(t, original)
+	makeKubernetesPVCs(t, original)
+	waitForPod(t, client, originalPod.Name)
+	originalPVC := getPVC(t, client, original.Volumes[0].ClaimName)
+	originalDisk, err := getVolumeInfo(t, originalPod, originalPVC.Spec.VolumeName)
+	assert.NoError(t, err)
+
+	prepare()
+
+	restoredPod := makeKubernetesPod(t, restored)
+	makeKubernetesPVCs(t, restored)
+	waitForPod(t, client, restoredPod.Name)
+	restoredPVC := getPVC(t, client, restored.Volumes[0].ClaimName)
+	assert.NotEqual(t, originalPVC.Spec.VolumeName, restoredPVC.Spec.VolumeName)
+
+	restoredDisk, err := getVolumeInfo(t, restoredPod, restoredPVC.Spec.VolumeName)
+	assert.NoError(t, err)
+	assert.Equal(t, originalDisk.Filesystem, restoredDisk.Filesystem)
+	assert.Equal(t, originalDisk.FilesystemUUID, restoredDisk.FilesystemUUID)
+
+	cleanup(t, restored)
+	waitCloudscaleVolumeDeleted(t, restoredPVC.Spec.VolumeName)
+	cleanup(t, original)
+	waitCloudscaleVolumeDeleted(t, originalPVC.Spec.VolumeName)
+}
+
+// makeVolumeSnapshot creates the snapshot and deletes it at the end of the
+// test
+func makeVolumeSnapshot(t *testing.T, snapshot TestVolumeSnapshot) {
+	vs := volumeSnapshot{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "snapshot.storage.k8s.io/v1",
+			Kind:       "VolumeSnapshot",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: snapshot.Name},
+	}
+	vs.Spec.Source.PersistentVolumeClaimName = strPtr(snapshot.ClaimName)
+	if snapshot.SnapshotClass != "" {
+		vs.Spec.VolumeSnapshotClassName = strPtr(snapshot.SnapshotClass)
+	}
+	body, err := json.Marshal(vs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Creating volume snapshot %v of pvc %v", snapshot.Name, snapshot.ClaimName)
+	err = client.CoreV1().RESTClient().Post().
+		AbsPath(volumeSnapshotsPath).
+		Body(body).
+		Do(context.Background()).
+		Error()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		deleteVolumeSnapshot(t, snapshot.Name)
+	})
+}
+
+func getVolumeSnapshot(name string) (*volumeSnapshot, error) {
+	raw, err := client.CoreV1().RESTClient().Get().
+		AbsPath(volumeSnapshotsPath, name).
+		DoRaw(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	var vs volumeSnapshot
+	if err := json.Unmarshal(raw, &vs); err != nil {
+		return nil, err
+	}
+	return &vs, nil
+}
+
+// waitForVolumeSnapshotReady waits until the snapshot can be restored
+func waitForVolumeSnapshotReady(t *testing.T, name string) {
+	err := wait.PollImmediate(2*time.Second, 5*time.Minute, func() (bool, error) {
+		vs, err := getVolumeSnapshot(name)
+		if err != nil {
+			return false, err
+		}
+		if vs.Status == nil {
+			return false, nil
+		}
+		if vs.Status.Error != nil && vs.Status.Error.Message != nil {
+			return false, fmt.Errorf("snapshot failed: %v", *vs.Status.Error.Message)
+		}
+		return vs.Status.ReadyToUse != nil && *vs.Status.ReadyToUse, nil
+	})
+	if err != nil {
+		t.Fatalf("waiting for volume snapshot %v to be ready: %v", name, err)
+	}
+}
+
+func deleteVolumeSnapshot(t *testing.T, name string) {
+	err := client.CoreV1().RESTClient().Delete().
+		AbsPath(volumeSnapshotsPath, name).
+		Do(context.Background()).
+		Error()
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		t.Errorf("deleting volume snapshot %v failed: %v", name, err)
+	}
+}
@@ -0,0 +1,296 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// TestStatefulSet_Scale scales a StatefulSet with a volume claim template up
+// across the nodes and down again. It checks that the volumes are attached to
+// the servers of the nodes of their pods, also after a pod moved to another
+// node, that the attach limits are respected, and that the volumes are
+// deleted or retained according to the reclaim policy.
+func TestStatefulSet_Scale(t *testing.T) {
+	for _, reclaimPolicy := range []v1.PersistentVolumeReclaimPolicy{
+		v1.PersistentVolumeReclaimDelete,
+		v1.PersistentVolumeReclaimRetain,
+	} {
+		reclaimPolicy := reclaimPolicy
+		t.Run(string(reclaimPolicy), func(t *testing.T) {
+			testStatefulSetScale(t, reclaimPolicy)
+		})
+	}
+}
+
+func testStatefulSetScale(t *testing.T, reclaimPolicy v1.PersistentVolumeReclaimPolicy) {
+	ctx := context.Background()
+	nodeServers := getNodeServers(t)
+	if len(nodeServers) < 2 {
+		t.Skipf("at least two nodes with the driver are needed, found %d", len(nodeServers))
+	}
+
+	storageClass := makeStorageClass(t, TestStorageClass{
+		VolumeType:    "ssd",
+		ReclaimPolicy: reclaimPolicy,
+	})
+	name := "sts-" + pseudoUuid()[:8]
+	makeStatefulSet(t, name, storageClass)
+	defer func() {
+		err := client.AppsV1().StatefulSets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		assert.NoError(t, err)
+	}()
+
+	// one more pod than there are nodes, so that at least one node gets
+	// two volumes
+	replicas := len(nodeServers) + 1
+	scaleStatefulSet(t, name, replicas)
+	for i := 0; i < replicas; i++ {
+		waitForPod(t, client, fmt.Sprintf("%s-%d", name, i))
+	}
+
+	pvNames := make([]string, replicas)
+	for i := 0; i < replicas; i++ {
+		pvc := getPVC(t, client, fmt.Sprintf("data-%s-%d", name, i))
+		assert.Equal(t, v1.ClaimBound, pvc.Status.Phase)
+		pvNames[i] = pvc.Spec.VolumeName
+		assertVolumeFollowsPod(t, nodeServers, fmt.Sprintf("%s-%d", name, i), pvNames[i])
+	}
+	assertAttachLimits(t, nodeServers)
+
+	// move the first pod to another node by cordoning its node
+	first := getPod(t, client, name+"-0")
+	cordonNode(t, first.Spec.NodeName, true)
+	defer cordonNode(t, first.Spec.NodeName, false)
+	err := client.CoreV1().Pods(namespace).Delete(ctx, first.Name, metav1.DeleteOptions{})
+	assert.NoError(t, err)
+	waitForPodRecreated(t, first)
+	waitForPod(t, client, first.Name)
+	moved := getPod(t, client, first.Name)
+	assert.NotEqual(t, first.Spec.NodeName, moved.Spec.NodeName)
+	assertVolumeFollowsPod(t, nodeServers, moved.Name, pvNames[0])
+	cordonNode(t, first.Spec.NodeName, false)
+
+	// scaling down detaches the volumes of the removed pods, the claims are
+	// kept by the StatefulSet
+	scaleStatefulSet(t, name, 1)
+	for i := 1; i < replicas; i++ {
+		waitForPodDeleted(t, fmt.Sprintf("%s-%d", name, i))
+		waitCloudscaleVolumeDetached(t, pvNames[i])
+	}
+	assertVolumeFollowsPod(t, nodeServers, name+"-0", pvNames[0])
+
+	scaleStatefulSet(t, name, 0)
+	waitForPodDeleted(t, name+"-0")
+	for i := 0; i < replicas; i++ {
+		err := client.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, fmt.Sprintf("data-%s-%d", name, i), metav1.DeleteOptions{})
+		assert.NoError(t, err)
+	}
+
+	for _, pvName := range pvNames {
+		if reclaimPolicy == v1.PersistentVolumeReclaimDelete {
+			waitCloudscaleVolumeDeleted(t, pvName)
+			continue
+		}
+
+		// retained volumes stay in the account after the claim is gone
+		waitForPVPhase(t, pvName, v1.VolumeReleased)
+		volume := getCloudscaleVolume(t, pvName)
+		err := client.CoreV1().PersistentVolumes().Delete(ctx, pvName, metav1.DeleteOptions{})
+		assert.NoError(t, err)
+		waitCloudscaleVolumeDetached(t, pvName)
+		err = cloudscaleClient.Volumes.Delete(ctx, volume.UUID)
+		assert.NoError(t, err)
+	}
+}
+
+// makeStatefulSet creates a StatefulSet without replicas, whose pods prefer
+// to run on different nodes and get a 1GB volume of the storage class
+func makeStatefulSet(t *testing.T, name, storageClass string) {
+	replicas := int32(0)
+	labels := map[string]string{"app": name}
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:            &replicas,
+			ServiceName:         name,
+			PodManagementPolicy: appsv1.ParallelPodManagement,
+			Selector:            &metav1.LabelSelector{MatchLabels: labels},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: v1.PodSpec{
+					Affinity: &v1.Affinity{
+						PodAntiAffinity: &v1.PodAntiAffinity{
+							PreferredDuringSchedulingIgnoredDuringExecution: []v1.WeightedPodAffinityTerm{{
+								Weight: 100,
+								PodAffinityTerm: v1.PodAffinityTerm{
+									LabelSelector: &metav1.LabelSelector{MatchLabels: labels},
+									TopologyKey:   "kubernetes.io/hostname",
+								},
+							}},
+						},
+					},
+					Containers: []v1.Container{{
+						Name:         "pause",
+						Image:        "gcr.io/google-containers/pause-amd64:3.1",
+						VolumeMounts: []v1.VolumeMount{{Name: "data", MountPath: "/data"}},
+					}},
+				},
+			},
+			VolumeClaimTemplates: []v1.PersistentVolumeClaim{{
+				ObjectMeta: metav1.ObjectMeta{Name: "data"},
+				Spec: v1.PersistentVolumeClaimSpec{
+					AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+					Resources: v1.ResourceRequirements{
+						Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+					},
+					StorageClassName: strPtr(storageClass),
+				},
+			}},
+		},
+	}
+
+	t.Logf("Creating statefulset %v", name)
+	_, err := client.AppsV1().StatefulSets(namespace).Create(context.Background(), statefulSet, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func scaleStatefulSet(t *testing.T, name string, replicas int) {
+	t.Logf("Scaling statefulset %v to %d", name, replicas)
+	patch := fmt.Sprintf(`{"spec":{"replicas":%d}}`, replicas)
+	_, err := client.AppsV1().StatefulSets(namespace).Patch(context.Background(), name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func cordonNode(t *testing.T, name string, unschedulable bool) {
+	t.Logf("Setting unschedulable of node %v to %v", name, unschedulable)
+	patch := fmt.Sprintf(`{"spec":{"unschedulable":%v}}`, unschedulable)
+	_, err := client.CoreV1().Nodes().Patch(context.Background(), name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	assert.NoError(t, err)
+}
+
+// getNodeServers returns the server UUIDs of the nodes with the driver by
+// node name, as registered in the CSINode objects
+func getNodeServers(t *testing.T) map[string]string {
+	csiNodes, err := client.StorageV1().CSINodes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := map[string]string{}
+	for _, csiNode := range csiNodes.Items {
+		for _, d := range csiNode.Spec.Drivers {
+			if d.Name == driver.DriverName {
+				servers[csiNode.Name] = d.NodeID
+			}
+		}
+	}
+	return servers
+}
+
+// assertVolumeFollowsPod checks that the volume is attached to the server of
+// the node of the pod, and only to it
+func assertVolumeFollowsPod(t *testing.T, nodeServers map[string]string, podName, pvName string) {
+	pod := getPod(t, client, podName)
+	volume := getCloudscaleVolume(t, pvName)
+	if assert.NotNil(t, volume.ServerUUIDs) {
+		assert.Equal(t, []string{nodeServers[pod.Spec.NodeName]}, *volume.ServerUUIDs,
+			"volume %v of pod %v on node %v", pvName, podName, pod.Spec.NodeName)
+	}
+}
+
+// assertAttachLimits checks that no server has more volumes of the driver
+// attached than its node allows
+func assertAttachLimits(t *testing.T, nodeServers map[string]string) {
+	ctx := context.Background()
+	volumes, err := cloudscaleClient.Volumes.List(ctx)
+	assert.NoError(t, err)
+	attached := map[string]int{}
+	for _, volume := range volumes {
+		if !driver.IsManagedVolume(volume) || volume.ServerUUIDs == nil {
+			continue
+		}
+		for _, server := range *volume.ServerUUIDs {
+			attached[server]++
+		}
+	}
+
+	for node, server := range nodeServers {
+		csiNode, err := client.StorageV1().CSINodes().Get(ctx, node, metav1.GetOptions{})
+		assert.NoError(t, err)
+		for _, d := range csiNode.Spec.Drivers {
+			if d.Name == driver.DriverName && d.Allocatable != nil && d.Allocatable.Count != nil {
+				assert.LessOrEqual(t, attached[server], int(*d.Allocatable.Count), "volumes attached to node %v", node)
+			}
+		}
+	}
+}
+
+// waitForPodRecreated waits until the pod was replaced by a new one with the
+// same name, as done by the StatefulSet controller
+func waitForPodRecreated(t *testing.T, old *v1.Pod) {
+	err := wait.PollImmediate(2*time.Second, 5*time.Minute, func() (bool, error) {
+		pod, err := client.CoreV1().Pods(namespace).Get(context.Background(), old.Name, metav1.GetOptions{})
+		if kubeerrors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return pod.UID != old.UID, nil
+	})
+	assert.NoError(t, err, "waiting for pod %v to be recreated", old.Name)
+}
+
+func waitForPodDeleted(t *testing.T, name string) {
+	err := wait.PollImmediate(2*time.Second, 5*time.Minute, func() (bool, error) {
+		_, err := client.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if kubeerrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	assert.NoError(t, err, "waiting for pod %v to be deleted", name)
+}
+
+func waitForPVPhase(t *testing.T, name string, phase v1.PersistentVolumePhase) {
+	err := wait.PollImmediate(2*time.Second, 5*time.Minute, func() (bool, error) {
+		pv, err := client.CoreV1().PersistentVolumes().Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return pv.Status.Phase == phase, nil
+	})
+	assert.NoError(t, err, "waiting for persistent volume %v to be %v", name, phase)
+}
+
+// waitCloudscaleVolumeDetached waits until the volume with the given name is
+// not attached to any server
+func waitCloudscaleVolumeDetached(t *testing.T, volumeName string) {
+	err := wait.PollImmediate(5*time.Second, 5*time.Minute, func() (bool, error) {
+		volumes, err := cloudscaleClient.Volumes.List(context.Background(), cloudscale.WithNameFilter(volumeName))
+		if err != nil {
+			return false, err
+		}
+		return len(volumes) == 1 && (volumes[0].ServerUUIDs == nil || len(*volumes[0].ServerUUIDs) == 0), nil
+	})
+	assert.NoError(t, err, "waiting for volume %v to be detached", volumeName)
+}
@@ -0,0 +1,163 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestStorageClass describes a storage class created by a test, so that new
+// driver parameters can be tested without changing the storage classes of
+// the cluster
+type TestStorageClass struct {
+	// VolumeType is ssd or bulk
+	VolumeType string
+	// FsType is the filesystem of the volumes; the driver default if empty
+	FsType string
+	// LuksCipher enables luks with the given cipher and LuksKeySize
+	LuksCipher   string
+	LuksKeySize  string
+	MountOptions []string
+	// ReclaimPolicy defaults to Delete
+	ReclaimPolicy v1.PersistentVolumeReclaimPolicy
+}
+
+// makeStorageClass creates the storage class and deletes it at the end of the
+// test. It returns the name of the storage class.
+func makeStorageClass(t *testing.T, sc TestStorageClass) string {
+	name := "csi-test-" + pseudoUuid()
+	parameters := map[string]string{
+		driver.StorageTypeAttribute: sc.VolumeType,
+	}
+	if sc.FsType != "" {
+		parameters["csi.storage.k8s.io/fstype"] = sc.FsType
+	}
+	if sc.LuksCipher != "" {
+		parameters[driver.LuksEncryptedAttribute] = "true"
+		parameters[driver.LuksCipherAttribute] = sc.LuksCipher
+		parameters[driver.LuksKeySizeAttribute] = sc.LuksKeySize
+		// the luks key is created by makeKubernetesPod
+		parameters["csi.storage.k8s.io/node-stage-secret-namespace"] = "${pvc.namespace}"
+		parameters["csi.storage.k8s.io/node-stage-secret-name"] = "${pvc.name}-luks-key"
+	}
+
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	if sc.ReclaimPolicy != "" {
+		reclaimPolicy = sc.ReclaimPolicy
+	}
+	bindingMode := storagev1.VolumeBindingImmediate
+	allowExpansion := true
+	storageClass := &storagev1.StorageClass{
+		ObjectMeta:           metav1.ObjectMeta{Name: name},
+		Provisioner:          driver.DriverName,
+		Parameters:           parameters,
+		ReclaimPolicy:        &reclaimPolicy,
+		VolumeBindingMode:    &bindingMode,
+		AllowVolumeExpansion: &allowExpansion,
+		MountOptions:         sc.MountOptions,
+	}
+
+	t.Logf("Creating storage class %v", name)
+	_, err := client.StorageV1().StorageClasses().Create(context.Background(), storageClass, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		deleteStorageClass(t, name)
+	})
+	return name
+}
+
+func deleteStorageClass(t *testing.T, name string) {
+	err := client.StorageV1().StorageClasses().Delete(context.Background(), name, metav1.DeleteOptions{})
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		t.Errorf("deleting storage class %v failed: %v", name, err)
+	}
+}
+
+// TestPod_StorageClass_Matrix runs a pod with a volume of every storage class
+// and checks the filesystem, luks and mount options of the volume
+func TestPod_StorageClass_Matrix(t *testing.T) {
+	var storageClasses []TestStorageClass
+	for _, fsType := range []string{"ext4", "xfs"} {
+		for _, luks := range []struct{ cipher, keySize string }{
+			{},
+			{"aes-xts-plain64", "512"},
+			{"aes-xts-plain64", "256"},
+		} {
+			storageClasses = append(storageClasses, TestStorageClass{
+				VolumeType:  "ssd",
+				FsType:      fsType,
+				LuksCipher:  luks.cipher,
+				LuksKeySize: luks.keySize,
+			})
+		}
+	}
+	storageClasses = append(storageClasses, TestStorageClass{
+		VolumeType:   "ssd",
+		FsType:       "ext4",
+		MountOptions: []string{"noatime", "nodiratime"},
+	})
+
+	for _, sc := range storageClasses {
+		sc := sc
+		name := fmt.Sprintf("%v %v luks=%v/%v mount=%v", sc.VolumeType, sc.FsType, sc.LuksCipher, sc.LuksKeySize, strings.Join(sc.MountOptions, ","))
+		t.Run(name, func(t *testing.T) {
+			volume := TestPodVolume{
+				ClaimName:    "csi-pod-matrix-pvc",
+				SizeGB:       5,
+				StorageClass: makeStorageClass(t, sc),
+			}
+			if sc.LuksCipher != "" {
+				volume.LuksKey = "secret"
+			}
+			podDescriptor := TestPodDescriptor{
+				Kind:    "Pod",
+				Name:    pseudoUuid(),
+				Volumes: []TestPodVolume{volume},
+			}
+
+			pod := makeKubernetesPod(t, podDescriptor)
+			pvcs := makeKubernetesPVCs(t, podDescriptor)
+			assert.Equal(t, 1, len(pvcs))
+
+			waitForPod(t, client, pod.Name)
+			pvc := getPVC(t, client, pvcs[0].Name)
+			assert.Equal(t, v1.ClaimBound, pvc.Status.Phase)
+
+			cloudscaleVolume := getCloudscaleVolume(t, pvc.Spec.VolumeName)
+			assert.Equal(t, sc.VolumeType, cloudscaleVolume.Type)
+
+			disk, err := getVolumeInfo(t, pod, pvc.Spec.VolumeName)
+			assert.NoError(t, err)
+			assert.Equal(t, sc.FsType, disk.Filesystem)
+			if sc.LuksCipher != "" {
+				assert.Equal(t, "LUKS1", disk.Luks)
+				assert.Equal(t, sc.LuksCipher, disk.Cipher)
+				assert.Equal(t, sc.LuksKeySize, fmt.Sprint(disk.Keysize))
+			} else {
+				assert.Equal(t, "", disk.Luks)
+			}
+
+			if len(sc.MountOptions) > 0 {
+				pv, err := client.CoreV1().PersistentVolumes().Get(context.Background(), pvc.Spec.VolumeName, metav1.GetOptions{})
+				assert.NoError(t, err)
+				assert.Equal(t, sc.MountOptions, pv.Spec.MountOptions)
+			}
+
+			cleanup(t, podDescriptor)
+			waitCloudscaleVolumeDeleted(t, pvc.Spec.VolumeName)
+		})
+	}
+}
@@ -0,0 +1,146 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk"
+	"github.com/cloudscale-ch/csi-cloudscale/driver"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// testRunTag is set on the cloudscale.ch volumes of the test namespace
+	// (and as label on the namespace) to the ID of the test run
+	testRunTag = "csi-cloudscale-test-run"
+
+	// leakedVolumeAge is the age after which a detached volume of another
+	// test run is considered leaked; younger volumes might belong to a run
+	// against another cluster in the same account
+	leakedVolumeAge = 2 * time.Hour
+)
+
+var (
+	// testRunID identifies the volumes of this test run
+	testRunID = time.Now().UTC().Format("20060102T150405") + "-" + pseudoUuid()[:8]
+
+	// stopTagging stops tagTestVolumes at teardown
+	stopTagging = make(chan struct{})
+)
+
+// cleanLeakedResources deletes the test namespace and the volumes of previous
+// test runs which were aborted before their teardown
+func cleanLeakedResources() error {
+	ctx := context.Background()
+
+	_, err := client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err == nil {
+		log.Printf("deleting namespace %v of a previous test run", namespace)
+		err = client.CoreV1().Namespaces().Delete(ctx, namespace, metav1.DeleteOptions{})
+		if err != nil && !kubeerrors.IsNotFound(err) {
+			return err
+		}
+		err = wait.PollImmediate(5*time.Second, 10*time.Minute, func() (bool, error) {
+			_, err := client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+			if kubeerrors.IsNotFound(err) {
+				return true, nil
+			}
+			return false, err
+		})
+		if err != nil {
+			return fmt.Errorf("waiting for namespace %v to be deleted: %v", namespace, err)
+		}
+	} else if !kubeerrors.IsNotFound(err) {
+		return err
+	}
+
+	volumes, err := cloudscaleClient.Volumes.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, volume := range volumes {
+		if !isLeakedVolume(volume, time.Now()) {
+			continue
+		}
+		log.Printf("deleting volume %v (%v) leaked by test run %v", volume.Name, volume.UUID, volume.Tags[testRunTag])
+		err := cloudscaleClient.Volumes.Delete(ctx, volume.UUID)
+		if err != nil {
+			return fmt.Errorf("deleting leaked volume %v: %v", volume.UUID, err)
+		}
+	}
+
+	return nil
+}
+
+// isLeakedVolume returns true for detached volumes of other test runs which
+// are older than leakedVolumeAge
+func isLeakedVolume(volume cloudscale.Volume, now time.Time) bool {
+	run := volume.Tags[testRunTag]
+	if run == "" || run == testRunID {
+		return false
+	}
+	if volume.ServerUUIDs != nil && len(*volume.ServerUUIDs) > 0 {
+		return false
+	}
+	return now.Sub(volume.CreatedAt) > leakedVolumeAge
+}
+
+// tagTestVolumes tags the cloudscale.ch volumes of the persistent volumes
+// bound to claims in the test namespace with the test run ID until stopCh is
+// closed. The volumes are created by the driver, so the harness tags them once
+// they show up in the cluster.
+func tagTestVolumes(stopCh <-chan struct{}) {
+	tagged := map[string]bool{}
+	wait.Until(func() {
+		pvs, err := client.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			log.Printf("listing persistent volumes failed: %v", err)
+			return
+		}
+		for _, pv := range pvs.Items {
+			if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driver.DriverName {
+				continue
+			}
+			if pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Namespace != namespace {
+				continue
+			}
+			volumeID := pv.Spec.CSI.VolumeHandle
+			if tagged[volumeID] {
+				continue
+			}
+			if err := tagVolume(volumeID); err != nil {
+				log.Printf("tagging volume %v failed: %v", volumeID, err)
+				continue
+			}
+			tagged[volumeID] = true
+		}
+	}, 5*time.Second, stopCh)
+}
+
+// tagVolume adds the test run tag to the tags of a volume
+func tagVolume(volumeID string) error {
+	volume, err := cloudscaleClient.Volumes.Get(context.Background(), volumeID)
+	if err != nil {
+		return err
+	}
+	if volume.Tags[testRunTag] == testRunID {
+		return nil
+	}
+
+	tags := cloudscale.TagMap{testRunTag: testRunID}
+	for key, value := range volume.Tags {
+		if key != testRunTag {
+			tags[key] = value
+		}
+	}
+	req := &cloudscale.VolumeRequest{}
+	req.Tags = tags
+	return cloudscaleClient.Volumes.Update(context.Background(), volumeID, req)
+}